@@ -17,9 +17,33 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// ManagedClusterFinalizer allows the control plane to tell the assigned worker
+// to delete the cluster before the managed cluster is removed.
+const ManagedClusterFinalizer = "managedcluster.infrastructure.cluster.x-k8s.io"
+
+// Annotations set by a worker on the managed clusters it hosts, so the command
+// that last put a cluster is replied to once the cluster is running.
+const (
+	// ManagedClusterCommandAnnotation is the id of the command that last put the cluster
+	ManagedClusterCommandAnnotation = "managedcluster.infrastructure.cluster.x-k8s.io/command-id"
+
+	// ManagedClusterReplyToAnnotation is the destination of the command's replies
+	ManagedClusterReplyToAnnotation = "managedcluster.infrastructure.cluster.x-k8s.io/reply-to"
+
+	// ManagedClusterSourceNamespaceAnnotation is the namespace of the managed
+	// cluster on the control plane, when the worker hosts it in another one
+	ManagedClusterSourceNamespaceAnnotation = "managedcluster.infrastructure.cluster.x-k8s.io/source-namespace"
+)
+
+// ManagedClusterHostedByLabel is the name of the worker that created the
+// managed cluster from a command. Workers only provision and change the
+// managed clusters they created, and the control plane ignores them.
+const ManagedClusterHostedByLabel = "managedcluster.infrastructure.cluster.x-k8s.io/hosted-by"
+
 type ManagedClusterPhase string
 
 const (
@@ -35,11 +59,12 @@ const (
 
 // ManagedClusterSpec defines the desired state of ManagedCluster
 type ManagedClusterSpec struct {
-	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
-
-	// Foo is an example field of ManagedCluster. Edit ManagedCluster_types.go to remove/update
-	Foo string `json:"foo,omitempty"`
+	// Version is the version of Kubernetes running on this managed cluster.
+	Version string `json:"version"`
+	// Location is the Azure region for this cluster.
+	Location string `json:"location"`
+	// Replicas is the number of worker machines in this managed cluster.
+	Replicas int32 `json:"replicas"`
 }
 
 // ManagedClusterStatus defines the observed state of ManagedCluster
@@ -49,6 +74,146 @@ type ManagedClusterStatus struct {
 
 	// AssignedWorker is the unique identifier of the worker to which the cluster has been assigned
 	AssignedWorker *string `json:"assignedWorker,omitempty"`
+
+	// PublishedGeneration is the generation of the spec last staged for the assigned worker
+	PublishedGeneration int64 `json:"publishedGeneration,omitempty"`
+
+	// LastCommandID is the id of the last command staged for the assigned worker
+	LastCommandID string `json:"lastCommandId,omitempty"`
+
+	// LastCommandTime is when the last command was staged
+	LastCommandTime *metav1.Time `json:"lastCommandTime,omitempty"`
+
+	// LastCommandOutcome is the outcome of the last command: Accepted,
+	// Rejected or Completed as replied by the assigned worker, Unacknowledged
+	// when it didn't reply in time, or Undeliverable when the staged command
+	// couldn't be decoded for publishing. Empty while a reply is awaited.
+	LastCommandOutcome CommandOutcome `json:"lastCommandOutcome,omitempty"`
+
+	// CompletedCommandID is the id of the last command a worker replied
+	// Completed to. It is only set on the worker.
+	CompletedCommandID string `json:"completedCommandId,omitempty"`
+
+	// Outbox holds the commands waiting to be published to the assigned
+	// worker. They are staged in the same update as the state change that
+	// caused them and removed once the bus has accepted them.
+	Outbox []OutboxEntry `json:"outbox,omitempty"`
+
+	// ControlPlaneEndpoint is the host:port of the managed cluster's api server
+	ControlPlaneEndpoint string `json:"controlPlaneEndpoint,omitempty"`
+
+	// Errors are the errors encountered provisioning the managed cluster
+	Errors []string `json:"errors,omitempty"`
+
+	// Conditions are the latest observations of the managed cluster's state
+	Conditions []ManagedClusterCondition `json:"conditions,omitempty"`
+
+	// Sequence orders the status reports of the managed cluster. The worker
+	// increments it whenever the status changes and the control plane ignores
+	// reports older than the last one it applied.
+	Sequence int64 `json:"sequence,omitempty"`
+
+	// ReportedSequence is the sequence last reported by the worker to the control plane
+	ReportedSequence int64 `json:"reportedSequence,omitempty"`
+}
+
+// OutboxEntry is a message waiting to be published to the bus
+type OutboxEntry struct {
+	// ID is the id of the message, which is kept when the message is published
+	ID string `json:"id"`
+
+	// Type is the registered type of the message
+	Type string `json:"type"`
+
+	// SchemaVersion is the schema version of the message type
+	SchemaVersion string `json:"schemaVersion"`
+
+	// Payload is the JSON encoded message
+	Payload string `json:"payload"`
+
+	// CreatedTime is when the message was staged
+	CreatedTime metav1.Time `json:"createdTime,omitempty"`
+}
+
+// CommandOutcome is what became of a command sent to a worker
+type CommandOutcome string
+
+const (
+	// CommandAccepted means the worker applied the command and is carrying it out
+	CommandAccepted CommandOutcome = "Accepted"
+
+	// CommandRejected means the worker didn't apply the command
+	CommandRejected CommandOutcome = "Rejected"
+
+	// CommandCompleted means the worker carried the command out: the cluster it
+	// put is running or the cluster it deleted is gone
+	CommandCompleted CommandOutcome = "Completed"
+
+	// CommandUnacknowledged means the worker didn't reply to the command in time
+	CommandUnacknowledged CommandOutcome = "Unacknowledged"
+
+	// CommandUndeliverable means the staged command couldn't be decoded, so it
+	// was dropped from the outbox without being published
+	CommandUndeliverable CommandOutcome = "Undeliverable"
+)
+
+type ManagedClusterConditionType string
+
+const (
+	// ManagedClusterInfrastructureReady means the azure infrastructure of the managed cluster is provisioned
+	ManagedClusterInfrastructureReady ManagedClusterConditionType = "InfrastructureReady"
+
+	// ManagedClusterControlPlaneInitialized means the managed cluster's control plane is reachable
+	ManagedClusterControlPlaneInitialized ManagedClusterConditionType = "ControlPlaneInitialized"
+
+	// ManagedClusterCommandAcknowledged means the assigned worker replied to the last command
+	// staged for it. It is False when the command was rejected, couldn't be published or no
+	// reply arrived in time.
+	ManagedClusterCommandAcknowledged ManagedClusterConditionType = "CommandAcknowledged"
+)
+
+// ManagedClusterCondition is an observation of a managed cluster's state
+type ManagedClusterCondition struct {
+	// Type is the type of the condition
+	Type ManagedClusterConditionType `json:"type"`
+
+	// Status is the status of the condition, one of True, False or Unknown
+	Status corev1.ConditionStatus `json:"status"`
+
+	// LastTransitionTime is the last time the condition changed status
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+
+	// Reason is a brief CamelCase reason for the condition's status
+	Reason string `json:"reason,omitempty"`
+
+	// Message is a human readable description of the condition's status
+	Message string `json:"message,omitempty"`
+}
+
+// GetCondition returns the condition of the given type, or nil if it isn't set
+func (in *ManagedClusterStatus) GetCondition(t ManagedClusterConditionType) *ManagedClusterCondition {
+	for i := range in.Conditions {
+		if in.Conditions[i].Type == t {
+			return &in.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition adds or updates the condition of the given type. The
+// transition time only changes when the status does.
+func (in *ManagedClusterStatus) SetCondition(t ManagedClusterConditionType, status corev1.ConditionStatus, reason, message string) {
+	c := in.GetCondition(t)
+	if c == nil {
+		in.Conditions = append(in.Conditions, ManagedClusterCondition{Type: t})
+		c = &in.Conditions[len(in.Conditions)-1]
+	}
+	if c.Status != status {
+		c.LastTransitionTime = metav1.Now()
+	}
+	c.Status = status
+	c.Reason = reason
+	c.Message = message
 }
 
 // +kubebuilder:object:root=true
@@ -63,6 +228,24 @@ type ManagedCluster struct {
 	Status ManagedClusterStatus `json:"status,omitempty"`
 }
 
+// SourceNamespace returns the namespace of the managed cluster on the control plane
+func (in *ManagedCluster) SourceNamespace() string {
+	if ns := in.Annotations[ManagedClusterSourceNamespaceAnnotation]; ns != "" {
+		return ns
+	}
+	return in.Namespace
+}
+
+// GetOutbox returns the messages waiting to be published
+func (in *ManagedCluster) GetOutbox() []OutboxEntry {
+	return in.Status.Outbox
+}
+
+// SetOutbox sets the messages waiting to be published
+func (in *ManagedCluster) SetOutbox(outbox []OutboxEntry) {
+	in.Status.Outbox = outbox
+}
+
 // +kubebuilder:object:root=true
 
 // ManagedClusterList contains a list of ManagedCluster
@@ -0,0 +1,127 @@
+/*
+Copyright 2020 Juan-Lee Pang.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// MessageTopicLabel is the label holding the topic of a message
+	MessageTopicLabel = "bus.carp.cluster.x-k8s.io/topic"
+
+	// MessageDestinationLabel is the label holding the destination of a message
+	MessageDestinationLabel = "bus.carp.cluster.x-k8s.io/destination"
+
+	// MessageTypeLabel is the label holding the type of a message
+	MessageTypeLabel = "bus.carp.cluster.x-k8s.io/type"
+)
+
+type MessagePhase string
+
+const (
+	// MessagePending means the message is waiting to be delivered or redelivered
+	MessagePending MessagePhase = "Pending"
+
+	// MessageCompleted means the message has been handled by its destination
+	MessageCompleted MessagePhase = "Completed"
+
+	// MessageDeadLettered means the message could not be handled and won't be redelivered
+	MessageDeadLettered MessagePhase = "DeadLettered"
+)
+
+// MessageSpec defines the desired state of Message
+type MessageSpec struct {
+	// Topic is the topic the message was published to.
+	Topic string `json:"topic"`
+	// DestinationId is the id of the subscriber the message is addressed to.
+	DestinationId string `json:"destinationId"`
+	// Type is the registered type of the message.
+	Type string `json:"type"`
+	// SchemaVersion is the schema version of the message type.
+	SchemaVersion string `json:"schemaVersion"`
+	// CorrelationId is the id of the message that caused this one, if any.
+	// +optional
+	CorrelationId string `json:"correlationId,omitempty"`
+	// SessionId is the session the message is delivered in order within.
+	// +optional
+	SessionId string `json:"sessionId,omitempty"`
+	// Timestamp is when the message was published, which orders the messages of a session.
+	// +optional
+	Timestamp metav1.MicroTime `json:"timestamp,omitempty"`
+	// Data is the message envelope.
+	Data string `json:"data"`
+	// ExpirationTime is when the message is deleted, whether or not it was delivered.
+	ExpirationTime metav1.Time `json:"expirationTime"`
+	// BroadcastName is the name of the broadcast message this message is a
+	// subscriber's copy of, if it is one.
+	// +optional
+	BroadcastName string `json:"broadcastName,omitempty"`
+}
+
+// MessageStatus defines the observed state of Message
+type MessageStatus struct {
+	// Phase is the delivery state of the message
+	Phase MessagePhase `json:"phase,omitempty"`
+
+	// DeliveryCount is the number of times the message has been delivered
+	DeliveryCount int32 `json:"deliveryCount,omitempty"`
+
+	// LockedUntil is when the subscriber currently handling the message loses its lock
+	LockedUntil *metav1.Time `json:"lockedUntil,omitempty"`
+
+	// CompletionTime is when the message was completed or dead-lettered
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// DeadLetterReason is why the message was dead-lettered, if it was
+	// +optional
+	DeadLetterReason string `json:"deadLetterReason,omitempty"`
+
+	// Error is the last error handling the message, or the description of why
+	// it was dead-lettered
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Destination",type="string",JSONPath=".spec.destinationId"
+// +kubebuilder:printcolumn:name="Type",type="string",JSONPath=".spec.type"
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
+// +kubebuilder:printcolumn:name="Deliveries",type="integer",JSONPath=".status.deliveryCount"
+
+// Message is a bus message stored in the control plane cluster
+type Message struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MessageSpec   `json:"spec,omitempty"`
+	Status MessageStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// MessageList contains a list of Message
+type MessageList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Message `json:"items"`
+}
+
+func init() { // nolint: gochecknoinits
+	SchemeBuilder.Register(&Message{}, &MessageList{})
+}
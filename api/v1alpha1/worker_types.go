@@ -17,9 +17,14 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// WorkerRegionLabel is the label broadcasts select the workers of a region by.
+// It is set from the worker's location.
+const WorkerRegionLabel = "topology.kubernetes.io/region"
+
 type WorkerPhase string
 
 const (
@@ -45,6 +50,118 @@ type WorkerSpec struct {
 	Capacity int32 `json:"capacity"`
 	//	Replicas is the number of worker machines in this worker cluster.
 	Replicas int32 `json:"replicas"`
+	// ControlPlaneReplicas is the number of control plane machines in this worker cluster.
+	// It must be odd to preserve etcd quorum. Defaults to 1.
+	// +kubebuilder:validation:Enum=1;3;5
+	// +optional
+	ControlPlaneReplicas *int32 `json:"controlPlaneReplicas,omitempty"`
+	// Network is the network configuration of this worker cluster.
+	// +optional
+	Network WorkerNetwork `json:"network,omitempty"`
+	// CNI is the CNI plugin installed on this worker cluster.
+	// +optional
+	CNI WorkerCNI `json:"cni,omitempty"`
+	// Providers are the versions of the cluster api components installed on this worker cluster.
+	// +optional
+	Providers WorkerProviders `json:"providers,omitempty"`
+}
+
+// WorkerProviders defines the versions of the cluster api components installed on a worker cluster.
+// Versions default to the ones embedded in carp.
+type WorkerProviders struct {
+	// CertManager is the version of cert-manager.
+	// +optional
+	CertManager string `json:"certManager,omitempty"`
+	// ClusterAPI is the version of the core, kubeadm bootstrap and kubeadm control plane providers.
+	// +optional
+	ClusterAPI string `json:"clusterAPI,omitempty"`
+	// Azure is the version of the azure infrastructure provider.
+	// +optional
+	Azure string `json:"azure,omitempty"`
+}
+
+// CNIName is the name of a CNI plugin
+// +kubebuilder:validation:Enum=calico;cilium;none
+type CNIName string
+
+const (
+	// CNICalico installs calico
+	CNICalico CNIName = "calico"
+
+	// CNICilium installs cilium. No cilium manifest is embedded, so it must be
+	// provided by an addon ConfigMap of the version set in the worker's CNI.
+	CNICilium CNIName = "cilium"
+
+	// CNINone installs no CNI plugin
+	CNINone CNIName = "none"
+)
+
+// WorkerCNI defines the CNI plugin of a worker cluster
+type WorkerCNI struct {
+	// Name is the CNI plugin to install. Defaults to calico.
+	// +optional
+	Name CNIName `json:"name,omitempty"`
+	// Version is the version of the CNI manifest to install. Defaults to the
+	// version embedded in carp, if there is one for the plugin.
+	// +optional
+	Version string `json:"version,omitempty"`
+}
+
+// WorkerNetwork defines the network configuration of a worker cluster
+type WorkerNetwork struct {
+	// PodCIDRBlocks are the CIDR blocks pod IPs are allocated from. Defaults to 192.168.0.0/16.
+	// +optional
+	PodCIDRBlocks []string `json:"podCIDRBlocks,omitempty"`
+	// ServiceCIDRBlocks are the CIDR blocks service IPs are allocated from.
+	// +optional
+	ServiceCIDRBlocks []string `json:"serviceCIDRBlocks,omitempty"`
+	// Vnet is the Azure virtual network the worker cluster is deployed into.
+	// +optional
+	Vnet WorkerVnet `json:"vnet,omitempty"`
+	// Subnets are the control plane and node subnets of the worker cluster.
+	// +optional
+	Subnets []WorkerSubnet `json:"subnets,omitempty"`
+}
+
+// WorkerVnet defines the Azure virtual network of a worker cluster
+type WorkerVnet struct {
+	// Name is the name of the virtual network. Defaults to <worker>-vnet.
+	// +optional
+	Name string `json:"name,omitempty"`
+	// ResourceGroup is the resource group of the virtual network. Defaults to the worker's resource group.
+	// +optional
+	ResourceGroup string `json:"resourceGroup,omitempty"`
+	// CIDRBlock is the address space of the virtual network when it is created by carp.
+	// +optional
+	CIDRBlock string `json:"cidrBlock,omitempty"`
+	// Existing means the virtual network is pre-existing, e.g. peered to a hub network,
+	// and must not be created by carp. Name and ResourceGroup are required when set.
+	// +optional
+	Existing bool `json:"existing,omitempty"`
+}
+
+// WorkerSubnetRole is the role of a subnet in a worker cluster
+// +kubebuilder:validation:Enum=control-plane;node
+type WorkerSubnetRole string
+
+const (
+	// WorkerSubnetControlPlane is the subnet of the control plane machines
+	WorkerSubnetControlPlane WorkerSubnetRole = "control-plane"
+
+	// WorkerSubnetNode is the subnet of the worker machines
+	WorkerSubnetNode WorkerSubnetRole = "node"
+)
+
+// WorkerSubnet defines a subnet of a worker cluster
+type WorkerSubnet struct {
+	// Role is the role of the subnet.
+	Role WorkerSubnetRole `json:"role"`
+	// Name is the name of the subnet. Defaults to <worker>-controlplane-subnet or <worker>-node-subnet.
+	// +optional
+	Name string `json:"name,omitempty"`
+	// CIDRBlock is the address space of the subnet.
+	// +optional
+	CIDRBlock string `json:"cidrBlock,omitempty"`
 }
 
 // WorkerStatus defines the observed state of Worker
@@ -57,6 +174,98 @@ type WorkerStatus struct {
 
 	// LastScheduledTime is the last time that a managed control plane was scheduled to this cluster
 	LastScheduledTime metav1.Time `json:"lastScheduledTime,omitempty"`
+
+	// ControlPlaneReadyReplicas is the number of ready control plane machines in this worker cluster
+	ControlPlaneReadyReplicas int32 `json:"controlPlaneReadyReplicas,omitempty"`
+
+	// CNI is the name and version of the CNI manifest applied to the worker cluster
+	CNI string `json:"cni,omitempty"`
+
+	// Providers are the names and versions of the cluster api components applied to the worker cluster
+	Providers []string `json:"providers,omitempty"`
+
+	// AgentVersion is the version of the carp agent running on the worker cluster
+	AgentVersion string `json:"agentVersion,omitempty"`
+
+	// Conditions are the observations of the worker cluster's state
+	Conditions []WorkerCondition `json:"conditions,omitempty"`
+}
+
+type WorkerConditionType string
+
+const (
+	// WorkerProvidersReady means cert-manager and the cluster api providers are running on the worker cluster
+	WorkerProvidersReady WorkerConditionType = "ProvidersReady"
+
+	// WorkerAgentReady means the carp agent is running on the worker cluster
+	WorkerAgentReady WorkerConditionType = "AgentReady"
+
+	// WorkerClustersInSync means the last digest of the worker listed exactly the
+	// managed clusters assigned to it, at the generations last published to it
+	WorkerClustersInSync WorkerConditionType = "ClustersInSync"
+)
+
+// WorkerCondition is an observation of a worker cluster's state
+type WorkerCondition struct {
+	// Type is the type of the condition
+	Type WorkerConditionType `json:"type"`
+
+	// Status is the status of the condition, one of True, False or Unknown
+	Status corev1.ConditionStatus `json:"status"`
+
+	// LastTransitionTime is the last time the condition changed status
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+
+	// Reason is a brief CamelCase reason for the condition's status
+	Reason string `json:"reason,omitempty"`
+
+	// Message is a human readable description of the condition's status
+	Message string `json:"message,omitempty"`
+}
+
+// GetCondition returns the condition of the given type, or nil if it isn't set
+func (in *WorkerStatus) GetCondition(t WorkerConditionType) *WorkerCondition {
+	for i := range in.Conditions {
+		if in.Conditions[i].Type == t {
+			return &in.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// IsConditionTrue returns whether the condition of the given type is set and True
+func (in *WorkerStatus) IsConditionTrue(t WorkerConditionType) bool {
+	c := in.GetCondition(t)
+	return c != nil && c.Status == corev1.ConditionTrue
+}
+
+// SetCondition adds or updates the condition of the given type. The
+// transition time only changes when the status does.
+func (in *WorkerStatus) SetCondition(t WorkerConditionType, status corev1.ConditionStatus, reason, message string) {
+	c := in.GetCondition(t)
+	if c == nil {
+		in.Conditions = append(in.Conditions, WorkerCondition{Type: t})
+		c = &in.Conditions[len(in.Conditions)-1]
+	}
+	if c.Status != status {
+		c.LastTransitionTime = metav1.Now()
+	}
+	c.Status = status
+	c.Reason = reason
+	c.Message = message
+}
+
+// RecipientLabels returns the labels broadcasts are matched against: the
+// worker's labels and its region.
+func (in *Worker) RecipientLabels() map[string]string {
+	labels := make(map[string]string, len(in.Labels)+1)
+	for k, v := range in.Labels {
+		labels[k] = v
+	}
+	if in.Spec.Location != "" {
+		labels[WorkerRegionLabel] = in.Spec.Location
+	}
+	return labels
 }
 
 // +kubebuilder:object:root=true
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 Juan-Lee Pang.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WorkerAddonMode is how a worker addon is kept up to date on the selected workers
+type WorkerAddonMode string
+
+const (
+	// WorkerAddonApplyOnce applies the addon to each worker once and never updates it afterwards
+	WorkerAddonApplyOnce WorkerAddonMode = "ApplyOnce"
+
+	// WorkerAddonReconcile reapplies the addon whenever its manifests change or drift
+	WorkerAddonReconcile WorkerAddonMode = "Reconcile"
+)
+
+// WorkerAddonSpec defines the desired state of WorkerAddon
+type WorkerAddonSpec struct {
+	// WorkerSelector selects the workers in this namespace the addon is applied to.
+	WorkerSelector metav1.LabelSelector `json:"workerSelector"`
+	// Mode is how the addon is kept up to date on selected workers. Defaults to Reconcile.
+	// +kubebuilder:validation:Enum=ApplyOnce;Reconcile
+	// +optional
+	Mode WorkerAddonMode `json:"mode,omitempty"`
+	// Manifests are the sources of the addon's manifests, applied in order.
+	// +kubebuilder:validation:MinItems=1
+	Manifests []WorkerAddonManifest `json:"manifests"`
+}
+
+// WorkerAddonManifest is a source of manifests. Exactly one field must be set.
+type WorkerAddonManifest struct {
+	// Inline is a manifest embedded in the WorkerAddon.
+	// +optional
+	Inline string `json:"inline,omitempty"`
+	// ConfigMapRef references a manifest stored in a ConfigMap in this namespace.
+	// +optional
+	ConfigMapRef *WorkerAddonManifestRef `json:"configMapRef,omitempty"`
+	// SecretRef references a manifest stored in a Secret in this namespace.
+	// +optional
+	SecretRef *WorkerAddonManifestRef `json:"secretRef,omitempty"`
+}
+
+// WorkerAddonManifestRef references a key of a ConfigMap or Secret
+type WorkerAddonManifestRef struct {
+	// Name is the name of the ConfigMap or Secret.
+	Name string `json:"name"`
+	// Key is the data key holding the manifest. Defaults to manifest.yaml.
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// WorkerAddonStatus defines the observed state of WorkerAddon
+type WorkerAddonStatus struct {
+	// Workers is the status of the addon on each selected worker
+	Workers []WorkerAddonWorkerStatus `json:"workers,omitempty"`
+}
+
+// WorkerAddonWorkerStatus is the status of an addon on a single worker
+type WorkerAddonWorkerStatus struct {
+	// Name is the name of the worker
+	Name string `json:"name"`
+
+	// Revision is the hash of the manifests last applied to the worker
+	Revision string `json:"revision,omitempty"`
+
+	// LastAppliedTime is the last time the manifests were applied to the worker
+	LastAppliedTime metav1.Time `json:"lastAppliedTime,omitempty"`
+
+	// Healthy is true when every workload in the applied manifests is ready
+	Healthy bool `json:"healthy"`
+
+	// Error is the last error applying the addon to the worker, if any
+	Error string `json:"error,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+
+// WorkerAddon is the Schema for the workeraddons API
+type WorkerAddon struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   WorkerAddonSpec   `json:"spec,omitempty"`
+	Status WorkerAddonStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// WorkerAddonList contains a list of WorkerAddon
+type WorkerAddonList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []WorkerAddon `json:"items"`
+}
+
+func init() { // nolint: gochecknoinits
+	SchemeBuilder.Register(&WorkerAddon{}, &WorkerAddonList{})
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2020 Juan-Lee Pang.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WorkerCommandType is the operational command broadcast to workers
+// +kubebuilder:validation:Enum=ReportInventory;RotateCredentials
+type WorkerCommandType string
+
+const (
+	// WorkerCommandReportInventory asks workers to report the managed clusters they host
+	WorkerCommandReportInventory WorkerCommandType = "ReportInventory"
+
+	// WorkerCommandRotateCredentials asks workers to restart the components
+	// using the azure credentials, so rotated credentials are picked up
+	WorkerCommandRotateCredentials WorkerCommandType = "RotateCredentials"
+)
+
+type WorkerCommandPhase string
+
+const (
+	// WorkerCommandPending means some selected workers haven't acknowledged the command
+	WorkerCommandPending WorkerCommandPhase = "Pending"
+
+	// WorkerCommandSucceeded means every selected worker handled the command
+	WorkerCommandSucceeded WorkerCommandPhase = "Succeeded"
+
+	// WorkerCommandFailed means every selected worker acknowledged the command
+	// and at least one failed to handle it
+	WorkerCommandFailed WorkerCommandPhase = "Failed"
+)
+
+// WorkerCommandSpec defines the desired state of WorkerCommand
+type WorkerCommandSpec struct {
+	// Type is the command broadcast to the workers.
+	Type WorkerCommandType `json:"type"`
+	// Selector selects the workers receiving the command by their labels. The
+	// region of a worker is the topology.kubernetes.io/region label. An empty
+	// selector selects every worker.
+	// +optional
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+// WorkerCommandStatus defines the observed state of WorkerCommand
+type WorkerCommandStatus struct {
+	// Phase is the progress of the command
+	Phase WorkerCommandPhase `json:"phase,omitempty"`
+
+	// CommandID is the id of the broadcast command, which acknowledgements refer to
+	CommandID string `json:"commandID,omitempty"`
+
+	// Recipients are the names of the workers selected when the command was broadcast
+	Recipients []string `json:"recipients,omitempty"`
+
+	// Acknowledgements are the acknowledgements received from the recipients
+	Acknowledgements []WorkerCommandAcknowledgement `json:"acknowledgements,omitempty"`
+
+	// Outbox holds the broadcast command until the bus has accepted it
+	Outbox []OutboxEntry `json:"outbox,omitempty"`
+}
+
+// WorkerCommandAcknowledgement is a worker's acknowledgement of a command
+type WorkerCommandAcknowledgement struct {
+	// Worker is the name of the acknowledging worker
+	Worker string `json:"worker"`
+
+	// Time is when the acknowledgement was received
+	Time metav1.Time `json:"time"`
+
+	// Error is why the worker failed to handle the command, if it did
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
+// GetAcknowledgement returns the acknowledgement of the given worker, or nil if it hasn't acknowledged the command
+func (in *WorkerCommandStatus) GetAcknowledgement(worker string) *WorkerCommandAcknowledgement {
+	for i := range in.Acknowledgements {
+		if in.Acknowledgements[i].Worker == worker {
+			return &in.Acknowledgements[i]
+		}
+	}
+	return nil
+}
+
+// Acknowledge records the acknowledgement of a recipient and updates the
+// phase. Repeated acknowledgements replace the earlier one.
+func (in *WorkerCommandStatus) Acknowledge(worker, errMessage string) {
+	ack := in.GetAcknowledgement(worker)
+	if ack == nil {
+		in.Acknowledgements = append(in.Acknowledgements, WorkerCommandAcknowledgement{Worker: worker})
+		ack = &in.Acknowledgements[len(in.Acknowledgements)-1]
+	}
+	ack.Time = metav1.Now()
+	ack.Error = errMessage
+	in.UpdatePhase()
+}
+
+// UpdatePhase sets the phase from the acknowledgements of the recipients.
+func (in *WorkerCommandStatus) UpdatePhase() {
+	in.Phase = WorkerCommandSucceeded
+	for _, worker := range in.Recipients {
+		ack := in.GetAcknowledgement(worker)
+		switch {
+		case ack == nil:
+			in.Phase = WorkerCommandPending
+			return
+		case ack.Error != "":
+			in.Phase = WorkerCommandFailed
+		}
+	}
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Type",type="string",JSONPath=".spec.type"
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// WorkerCommand is an operational command broadcast to the workers matching a selector
+type WorkerCommand struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   WorkerCommandSpec   `json:"spec,omitempty"`
+	Status WorkerCommandStatus `json:"status,omitempty"`
+}
+
+// GetOutbox returns the messages waiting to be published
+func (in *WorkerCommand) GetOutbox() []OutboxEntry {
+	return in.Status.Outbox
+}
+
+// SetOutbox sets the messages waiting to be published
+func (in *WorkerCommand) SetOutbox(outbox []OutboxEntry) {
+	in.Status.Outbox = outbox
+}
+
+// +kubebuilder:object:root=true
+
+// WorkerCommandList contains a list of WorkerCommand
+type WorkerCommandList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []WorkerCommand `json:"items"`
+}
+
+func init() { // nolint: gochecknoinits
+	SchemeBuilder.Register(&WorkerCommand{}, &WorkerCommandList{})
+}
@@ -51,6 +51,22 @@ func (in *ManagedCluster) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ManagedClusterCondition) DeepCopyInto(out *ManagedClusterCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ManagedClusterCondition.
+func (in *ManagedClusterCondition) DeepCopy() *ManagedClusterCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(ManagedClusterCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ManagedClusterList) DeepCopyInto(out *ManagedClusterList) {
 	*out = *in
@@ -106,6 +122,29 @@ func (in *ManagedClusterStatus) DeepCopyInto(out *ManagedClusterStatus) {
 		*out = new(string)
 		**out = **in
 	}
+	if in.LastCommandTime != nil {
+		in, out := &in.LastCommandTime, &out.LastCommandTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Outbox != nil {
+		in, out := &in.Outbox, &out.Outbox
+		*out = make([]OutboxEntry, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Errors != nil {
+		in, out := &in.Errors, &out.Errors
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]ManagedClusterCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ManagedClusterStatus.
@@ -118,12 +157,127 @@ func (in *ManagedClusterStatus) DeepCopy() *ManagedClusterStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Message) DeepCopyInto(out *Message) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Message.
+func (in *Message) DeepCopy() *Message {
+	if in == nil {
+		return nil
+	}
+	out := new(Message)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *Message) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MessageList) DeepCopyInto(out *MessageList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]Message, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MessageList.
+func (in *MessageList) DeepCopy() *MessageList {
+	if in == nil {
+		return nil
+	}
+	out := new(MessageList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *MessageList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MessageSpec) DeepCopyInto(out *MessageSpec) {
+	*out = *in
+	in.Timestamp.DeepCopyInto(&out.Timestamp)
+	in.ExpirationTime.DeepCopyInto(&out.ExpirationTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MessageSpec.
+func (in *MessageSpec) DeepCopy() *MessageSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(MessageSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MessageStatus) DeepCopyInto(out *MessageStatus) {
+	*out = *in
+	if in.LockedUntil != nil {
+		in, out := &in.LockedUntil, &out.LockedUntil
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MessageStatus.
+func (in *MessageStatus) DeepCopy() *MessageStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(MessageStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OutboxEntry) DeepCopyInto(out *OutboxEntry) {
+	*out = *in
+	in.CreatedTime.DeepCopyInto(&out.CreatedTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OutboxEntry.
+func (in *OutboxEntry) DeepCopy() *OutboxEntry {
+	if in == nil {
+		return nil
+	}
+	out := new(OutboxEntry)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Worker) DeepCopyInto(out *Worker) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
+	in.Spec.DeepCopyInto(&out.Spec)
 	in.Status.DeepCopyInto(&out.Status)
 }
 
@@ -145,6 +299,328 @@ func (in *Worker) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerAddon) DeepCopyInto(out *WorkerAddon) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerAddon.
+func (in *WorkerAddon) DeepCopy() *WorkerAddon {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerAddon)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *WorkerAddon) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerAddonList) DeepCopyInto(out *WorkerAddonList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]WorkerAddon, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerAddonList.
+func (in *WorkerAddonList) DeepCopy() *WorkerAddonList {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerAddonList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *WorkerAddonList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerAddonManifest) DeepCopyInto(out *WorkerAddonManifest) {
+	*out = *in
+	if in.ConfigMapRef != nil {
+		in, out := &in.ConfigMapRef, &out.ConfigMapRef
+		*out = new(WorkerAddonManifestRef)
+		**out = **in
+	}
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(WorkerAddonManifestRef)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerAddonManifest.
+func (in *WorkerAddonManifest) DeepCopy() *WorkerAddonManifest {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerAddonManifest)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerAddonManifestRef) DeepCopyInto(out *WorkerAddonManifestRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerAddonManifestRef.
+func (in *WorkerAddonManifestRef) DeepCopy() *WorkerAddonManifestRef {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerAddonManifestRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerAddonSpec) DeepCopyInto(out *WorkerAddonSpec) {
+	*out = *in
+	in.WorkerSelector.DeepCopyInto(&out.WorkerSelector)
+	if in.Manifests != nil {
+		in, out := &in.Manifests, &out.Manifests
+		*out = make([]WorkerAddonManifest, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerAddonSpec.
+func (in *WorkerAddonSpec) DeepCopy() *WorkerAddonSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerAddonSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerAddonStatus) DeepCopyInto(out *WorkerAddonStatus) {
+	*out = *in
+	if in.Workers != nil {
+		in, out := &in.Workers, &out.Workers
+		*out = make([]WorkerAddonWorkerStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerAddonStatus.
+func (in *WorkerAddonStatus) DeepCopy() *WorkerAddonStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerAddonStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerAddonWorkerStatus) DeepCopyInto(out *WorkerAddonWorkerStatus) {
+	*out = *in
+	in.LastAppliedTime.DeepCopyInto(&out.LastAppliedTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerAddonWorkerStatus.
+func (in *WorkerAddonWorkerStatus) DeepCopy() *WorkerAddonWorkerStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerAddonWorkerStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerCNI) DeepCopyInto(out *WorkerCNI) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerCNI.
+func (in *WorkerCNI) DeepCopy() *WorkerCNI {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerCNI)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerCommand) DeepCopyInto(out *WorkerCommand) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerCommand.
+func (in *WorkerCommand) DeepCopy() *WorkerCommand {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerCommand)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *WorkerCommand) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerCommandAcknowledgement) DeepCopyInto(out *WorkerCommandAcknowledgement) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerCommandAcknowledgement.
+func (in *WorkerCommandAcknowledgement) DeepCopy() *WorkerCommandAcknowledgement {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerCommandAcknowledgement)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerCommandList) DeepCopyInto(out *WorkerCommandList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]WorkerCommand, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerCommandList.
+func (in *WorkerCommandList) DeepCopy() *WorkerCommandList {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerCommandList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *WorkerCommandList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerCommandSpec) DeepCopyInto(out *WorkerCommandSpec) {
+	*out = *in
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerCommandSpec.
+func (in *WorkerCommandSpec) DeepCopy() *WorkerCommandSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerCommandSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerCommandStatus) DeepCopyInto(out *WorkerCommandStatus) {
+	*out = *in
+	if in.Recipients != nil {
+		in, out := &in.Recipients, &out.Recipients
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Acknowledgements != nil {
+		in, out := &in.Acknowledgements, &out.Acknowledgements
+		*out = make([]WorkerCommandAcknowledgement, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Outbox != nil {
+		in, out := &in.Outbox, &out.Outbox
+		*out = make([]OutboxEntry, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerCommandStatus.
+func (in *WorkerCommandStatus) DeepCopy() *WorkerCommandStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerCommandStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerCondition) DeepCopyInto(out *WorkerCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerCondition.
+func (in *WorkerCondition) DeepCopy() *WorkerCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *WorkerList) DeepCopyInto(out *WorkerList) {
 	*out = *in
@@ -177,9 +653,63 @@ func (in *WorkerList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerNetwork) DeepCopyInto(out *WorkerNetwork) {
+	*out = *in
+	if in.PodCIDRBlocks != nil {
+		in, out := &in.PodCIDRBlocks, &out.PodCIDRBlocks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ServiceCIDRBlocks != nil {
+		in, out := &in.ServiceCIDRBlocks, &out.ServiceCIDRBlocks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	out.Vnet = in.Vnet
+	if in.Subnets != nil {
+		in, out := &in.Subnets, &out.Subnets
+		*out = make([]WorkerSubnet, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerNetwork.
+func (in *WorkerNetwork) DeepCopy() *WorkerNetwork {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerNetwork)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerProviders) DeepCopyInto(out *WorkerProviders) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerProviders.
+func (in *WorkerProviders) DeepCopy() *WorkerProviders {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerProviders)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *WorkerSpec) DeepCopyInto(out *WorkerSpec) {
 	*out = *in
+	if in.ControlPlaneReplicas != nil {
+		in, out := &in.ControlPlaneReplicas, &out.ControlPlaneReplicas
+		*out = new(int32)
+		**out = **in
+	}
+	in.Network.DeepCopyInto(&out.Network)
+	out.CNI = in.CNI
+	out.Providers = in.Providers
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerSpec.
@@ -201,6 +731,18 @@ func (in *WorkerStatus) DeepCopyInto(out *WorkerStatus) {
 		**out = **in
 	}
 	in.LastScheduledTime.DeepCopyInto(&out.LastScheduledTime)
+	if in.Providers != nil {
+		in, out := &in.Providers, &out.Providers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]WorkerCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerStatus.
@@ -212,3 +754,33 @@ func (in *WorkerStatus) DeepCopy() *WorkerStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerSubnet) DeepCopyInto(out *WorkerSubnet) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerSubnet.
+func (in *WorkerSubnet) DeepCopy() *WorkerSubnet {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerSubnet)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkerVnet) DeepCopyInto(out *WorkerVnet) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkerVnet.
+func (in *WorkerVnet) DeepCopy() *WorkerVnet {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkerVnet)
+	in.DeepCopyInto(out)
+	return out
+}
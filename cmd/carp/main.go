@@ -0,0 +1,178 @@
+// carp is the command line tool for operating a carp deployment.
+//
+//	carp bus dlq list --subscription=<underlay>
+//	carp bus dlq inspect --subscription=<underlay> <message-id>
+//	carp bus dlq resubmit --subscription=<underlay> <message-id>
+//	carp bus dlq purge --subscription=<underlay> (<message-id> | --all)
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	"github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus"
+)
+
+const usage = `usage: carp bus dlq <command> [flags] [message-id]
+
+Commands:
+  list      list the dead-lettered messages of a subscription
+  inspect   show a dead-lettered message and its envelope
+  resubmit  publish a dead-lettered message again
+  purge     remove a dead-lettered message, or all of them with --all
+
+Flags:
+`
+
+func main() {
+	if len(os.Args) < 4 || os.Args[1] != "bus" || os.Args[2] != "dlq" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := dlq(os.Args[3], os.Args[4:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func dlq(command string, args []string) error {
+	flags := pflag.NewFlagSet("dlq", pflag.ContinueOnError)
+	transport := flags.String("bus", bus.TransportServiceBus, "The bus transport, one of servicebus or kubernetes.")
+	region := flags.String("bus-region", "eastus", "The region of the bus topic.")
+	environment := flags.String("bus-environment", "prod", "The environment of the bus topic (intv2, staging, prod).")
+	subscription := flags.String("subscription", "", "The subscription to manage, a worker name or controlplane.")
+	kubeconfig := flags.String("bus-kubeconfig", "", "The kubeconfig of the cluster storing the messages of the kubernetes bus.")
+	namespace := flags.String("bus-namespace", "carp-system", "The namespace storing the messages of the kubernetes bus.")
+	all := flags.Bool("all", false, "Purge every dead-lettered message of the subscription.")
+	timeout := flags.Duration("timeout", time.Minute, "How long to wait for the bus.")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *subscription == "" {
+		return errors.New("--subscription is required")
+	}
+
+	cfg := bus.Config{
+		Transport:                  *transport,
+		Region:                     *region,
+		Environment:                *environment,
+		ServiceBusConnectionString: os.Getenv("SERVICE_BUS_CONNECTION_STRING"),
+		KubernetesNamespace:        *namespace,
+	}
+	if *transport == bus.TransportKubernetes {
+		c, err := newClient(*kubeconfig)
+		if err != nil {
+			return err
+		}
+		cfg.KubernetesClient = c
+	}
+	factory, err := bus.NewFactory(cfg)
+	if err != nil {
+		return err
+	}
+	q, err := factory.NewDeadLetterQueue(*subscription)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	messageID := flags.Arg(0)
+	switch command {
+	case "list":
+		return list(ctx, q)
+	case "inspect":
+		if messageID == "" {
+			return errors.New("inspect needs a message id")
+		}
+		return inspect(ctx, q, messageID)
+	case "resubmit":
+		if messageID == "" {
+			return errors.New("resubmit needs a message id")
+		}
+		return q.Resubmit(ctx, messageID)
+	case "purge":
+		if messageID == "" && !*all {
+			return errors.New("purge needs a message id or --all")
+		}
+		return q.Purge(ctx, messageID)
+	}
+	flags.Usage()
+	return fmt.Errorf("unknown command %q", command)
+}
+
+func newClient(kubeconfig string) (client.Client, error) {
+	restConfig, err := config.GetConfig()
+	if kubeconfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	return client.New(restConfig, client.Options{Scheme: scheme})
+}
+
+func list(ctx context.Context, q bus.DeadLetterQueue) error {
+	deadLetters, err := q.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tREASON\tDELIVERIES\tENQUEUED")
+	for _, m := range deadLetters {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", m.MessageID, m.Type, m.Reason, m.DeliveryCount, m.EnqueuedTime.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func inspect(ctx context.Context, q bus.DeadLetterQueue, messageID string) error {
+	deadLetters, err := q.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range deadLetters {
+		if m.MessageID != messageID {
+			continue
+		}
+		fmt.Printf("ID:          %s\n", m.MessageID)
+		fmt.Printf("Type:        %s\n", m.Type)
+		fmt.Printf("Reason:      %s\n", m.Reason)
+		fmt.Printf("Description: %s\n", m.Description)
+		fmt.Printf("Deliveries:  %d\n", m.DeliveryCount)
+		fmt.Printf("Enqueued:    %s\n", m.EnqueuedTime.Format(time.RFC3339))
+
+		var data bytes.Buffer
+		if err := json.Indent(&data, m.Data, "", "  "); err != nil {
+			data.Reset()
+			data.Write(m.Data)
+		}
+		fmt.Printf("Data:\n%s\n", data.String())
+		return nil
+	}
+	return fmt.Errorf("%w: %s", bus.ErrDeadLetterNotFound, messageID)
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/apex/log"
 	"github.com/spf13/pflag"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/juan-lee/carp/internal/bus"
 	"github.com/juan-lee/carp/internal/messages"
@@ -23,6 +24,9 @@ var (
 	serviceBusNamespace = pflag.String("service-bus-namespace", "aksglobalgitopssb", "gitops sb namespace")
 	deploymentNamespace = pflag.String("deployment-namespace", "gitops-dp", "namespace that these gitops deployment live in")
 
+	maxConcurrentHandlers = pflag.Int("max-concurrent-handlers", 1, "number of messages handled at once")
+	prefetchCount         = pflag.Uint32("prefetch", 0, "number of messages fetched ahead of the handlers")
+
 	// temporarily pass in SAS token until we use /etc/kubernetes/azure.json
 	serviceBusConnectionString = pflag.String("service-bus-connection-string", "", "connection string for SB")
 )
@@ -36,13 +40,18 @@ func main() {
 		UnderlayID:                 *underlayName,
 		ServiceBusNamespace:        *serviceBusNamespace,
 		ServiceBusConnectionString: *serviceBusConnectionString,
+		MaxConcurrentHandlers:      *maxConcurrentHandlers,
+		PrefetchCount:              *prefetchCount,
 	}
 
-	handler := func(ctx context.Context, message string) error {
-		log.Info(message)
+	handler := bus.NewDispatcher()
+	handler.Fallback(func(ctx context.Context, md bus.Metadata, data []byte) error {
+		log.WithField("type", md.Type).WithField("deliveryCount", md.DeliveryCount).Info(string(data))
 		return nil
-	}
-	rec := bus.NewListener(sbListenerCfg)
+	})
+	// the listener is restarted when its connection fails rather than exiting
+	supervisor := &bus.Supervisor{Log: zap.New(zap.UseDevMode(true))}
+	rec := supervisor.Supervise(*underlayName, bus.NewListener(sbListenerCfg))
 
 	ctx, cancel := context.WithCancel(context.Background())
 
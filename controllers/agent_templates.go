@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	carpv1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+	carpbus "github.com/juan-lee/carp/internal/bus"
+)
+
+const (
+	agentName      = "carp-agent"
+	agentNamespace = "carp-system"
+
+	// agentBusSecretName is the secret holding the bus credentials on the worker cluster
+	agentBusSecretName = "carp-bus-credentials"
+
+	// BusConnectionStringKey is the key of the bus connection string in the bus credentials secret
+	BusConnectionStringKey = "connection-string"
+
+	// BusKubeconfigKey is the key of the control plane kubeconfig used by the
+	// kubernetes bus in the bus credentials secret
+	BusKubeconfigKey = "kubeconfig"
+
+	// agentBusKeysSecretName is the secret holding the keys the agent signs and verifies messages with
+	agentBusKeysSecretName = "carp-bus-keys"
+
+	// agentHealthPort is the port of the agent's health and readiness probes
+	agentHealthPort = 9440
+
+	// agentBusCredentialsPath is where the bus credentials secret is mounted in the agent
+	agentBusCredentialsPath = "/etc/carp/bus"
+)
+
+// agentBus is the bus configuration passed to the agent
+type agentBus struct {
+	transport   string
+	region      string
+	environment string
+	natsURL     string
+	// provisioning is the service bus provisioning mode
+	provisioning string
+	// keys is set when the agent is given bus keys
+	keys bool
+}
+
+var agentLabels = map[string]string{
+	"app.kubernetes.io/name":      agentName,
+	"app.kubernetes.io/component": "agent",
+}
+
+func getAgentNamespace() *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: agentNamespace,
+		},
+	}
+}
+
+func getAgentServiceAccount() *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      agentName,
+			Namespace: agentNamespace,
+			Labels:    agentLabels,
+		},
+	}
+}
+
+func getAgentClusterRole() *rbacv1.ClusterRole {
+	return &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   agentName,
+			Labels: agentLabels,
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups: []string{
+					"cluster.x-k8s.io",
+					"infrastructure.cluster.x-k8s.io",
+					"bootstrap.cluster.x-k8s.io",
+					"controlplane.cluster.x-k8s.io",
+				},
+				Resources: []string{"*"},
+				Verbs:     []string{"*"},
+			},
+			{
+				// cluster namespaces, kubeconfigs, credentials, the dedupe
+				// store and leader election; the agent never deletes them
+				APIGroups: []string{""},
+				Resources: []string{"secrets", "configmaps", "namespaces"},
+				Verbs:     []string{"get", "list", "watch", "create", "update"},
+			},
+			{
+				APIGroups: []string{""},
+				Resources: []string{"events"},
+				Verbs:     []string{"create", "patch"},
+			},
+			{
+				// restarting capz when credentials are rotated
+				APIGroups: []string{"apps"},
+				Resources: []string{"deployments"},
+				Verbs:     []string{"get", "list", "watch", "patch"},
+			},
+			{
+				APIGroups: []string{"coordination.k8s.io"},
+				Resources: []string{"leases"},
+				Verbs:     []string{"*"},
+			},
+		},
+	}
+}
+
+func getAgentClusterRoleBinding() *rbacv1.ClusterRoleBinding {
+	return &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   agentName,
+			Labels: agentLabels,
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "ClusterRole",
+			Name:     agentName,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      agentName,
+				Namespace: agentNamespace,
+			},
+		},
+	}
+}
+
+func getAgentDeployment(worker *carpv1alpha1.Worker, image string, bus agentBus) *appsv1.Deployment {
+	args := []string{
+		"--enable-leader-election",
+		"--mode=worker",
+		"--worker-name=" + worker.Name,
+		"--bus=" + bus.transport,
+		"--bus-region=" + bus.region,
+		"--bus-environment=" + bus.environment,
+	}
+	if labels := labels.Set(worker.RecipientLabels()).String(); labels != "" {
+		args = append(args, "--worker-labels="+labels)
+	}
+	if bus.transport == carpbus.TransportKubernetes {
+		args = append(args, "--bus-kubeconfig="+agentBusCredentialsPath+"/"+BusKubeconfigKey)
+	}
+	if bus.transport == carpbus.TransportNATS {
+		args = append(args, "--bus-nats-url="+bus.natsURL)
+	}
+	if bus.transport == carpbus.TransportServiceBus && bus.provisioning != "" {
+		args = append(args, "--bus-provisioning="+bus.provisioning)
+	}
+	if bus.keys {
+		args = append(args, "--bus-keys="+agentNamespace+"/"+agentBusKeysSecretName)
+	}
+
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      agentName,
+			Namespace: agentNamespace,
+			Labels:    agentLabels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: to.Int32Ptr(1),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: agentLabels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: agentLabels,
+				},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: agentName,
+					Containers: []corev1.Container{
+						{
+							Name:    "manager",
+							Image:   image,
+							Command: []string{"/manager"},
+							Args:    args,
+							Env: []corev1.EnvVar{
+								{
+									Name: "SERVICE_BUS_CONNECTION_STRING",
+									ValueFrom: &corev1.EnvVarSource{
+										SecretKeyRef: &corev1.SecretKeySelector{
+											LocalObjectReference: corev1.LocalObjectReference{Name: agentBusSecretName},
+											Key:                  BusConnectionStringKey,
+											Optional:             to.BoolPtr(true),
+										},
+									},
+								},
+							},
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "healthz",
+									ContainerPort: agentHealthPort,
+									Protocol:      corev1.ProtocolTCP,
+								},
+							},
+							LivenessProbe: &corev1.Probe{
+								Handler: corev1.Handler{
+									HTTPGet: &corev1.HTTPGetAction{Path: "/healthz", Port: intstr.FromString("healthz")},
+								},
+							},
+							// the agent is ready while its bus listeners are receiving
+							ReadinessProbe: &corev1.Probe{
+								Handler: corev1.Handler{
+									HTTPGet: &corev1.HTTPGetAction{Path: "/readyz", Port: intstr.FromString("healthz")},
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "bus-credentials",
+									MountPath: agentBusCredentialsPath,
+									ReadOnly:  true,
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "bus-credentials",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName: agentBusSecretName,
+									Optional:   to.BoolPtr(true),
+								},
+							},
+						},
+					},
+					// long enough for the bus listeners to drain
+					TerminationGracePeriodSeconds: to.Int64Ptr(45),
+				},
+			},
+		},
+	}
+}
+
+// getImageTag returns the tag of an image reference, or latest if it has none
+func getImageTag(image string) string {
+	i := strings.LastIndex(image, ":")
+	if i == -1 || strings.Contains(image[i:], "/") {
+		return "latest"
+	}
+	return image[i+1:]
+}
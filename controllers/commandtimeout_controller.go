@@ -0,0 +1,89 @@
+/*
+Copyright 2020 Juan-Lee Pang.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License. You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied. See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+)
+
+// CommandTimeoutTracker marks the last command of a managed cluster as
+// unacknowledged when the assigned worker hasn't replied to it within the
+// timeout. A reply arriving later still records its outcome.
+type CommandTimeoutTracker struct {
+	client.Client
+	Log     logr.Logger
+	Timeout time.Duration
+}
+
+func (r *CommandTimeoutTracker) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("commandtimeout").
+		For(&infrastructurev1alpha1.ManagedCluster{}).
+		WithEventFilter(predicate.Funcs{
+			CreateFunc:  func(e event.CreateEvent) bool { return awaitingReply(e.Object) },
+			UpdateFunc:  func(e event.UpdateEvent) bool { return awaitingReply(e.ObjectNew) },
+			DeleteFunc:  func(e event.DeleteEvent) bool { return false },
+			GenericFunc: func(e event.GenericEvent) bool { return awaitingReply(e.Object) },
+		}).
+		Complete(r)
+}
+
+// awaitingReply reports whether the last command of a managed cluster hasn't
+// been replied to or timed out yet.
+func awaitingReply(o runtime.Object) bool {
+	mc, ok := o.(*infrastructurev1alpha1.ManagedCluster)
+	return ok && mc.Status.LastCommandID != "" && mc.Status.LastCommandTime != nil && mc.Status.LastCommandOutcome == ""
+}
+
+func (r *CommandTimeoutTracker) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("managedcluster", req.NamespacedName)
+
+	var mc infrastructurev1alpha1.ManagedCluster
+	if err := r.Get(ctx, req.NamespacedName, &mc); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !awaitingReply(&mc) {
+		return ctrl.Result{}, nil
+	}
+
+	if wait := time.Until(mc.Status.LastCommandTime.Add(r.Timeout)); wait > 0 {
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+
+	mc.Status.LastCommandOutcome = infrastructurev1alpha1.CommandUnacknowledged
+	mc.Status.SetCondition(infrastructurev1alpha1.ManagedClusterCommandAcknowledged, corev1.ConditionFalse,
+		string(infrastructurev1alpha1.CommandUnacknowledged),
+		fmt.Sprintf("no reply to command %s within %s", mc.Status.LastCommandID, r.Timeout))
+	if err := r.Status().Update(ctx, &mc); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to mark command unacknowledged: %w", err)
+	}
+
+	log.Info("command unacknowledged", "command", mc.Status.LastCommandID)
+	return ctrl.Result{}, nil
+}
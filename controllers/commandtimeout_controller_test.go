@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+)
+
+func TestCommandTimeoutTrackerMarksUnacknowledgedCommands(t *testing.T) {
+	staged := metav1.NewTime(time.Now().Add(-time.Minute))
+	mc := &infrastructurev1alpha1.ManagedCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "one"},
+		Status: infrastructurev1alpha1.ManagedClusterStatus{
+			LastCommandID:   "command-1",
+			LastCommandTime: &staged,
+		},
+	}
+	r := &CommandTimeoutTracker{
+		Client:  newFakeClient(t, mc),
+		Log:     zap.New(zap.UseDevMode(true)),
+		Timeout: 5 * time.Minute,
+	}
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "one"}}
+
+	// the reply is still awaited
+	result, err := r.Reconcile(req)
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if result.RequeueAfter <= 3*time.Minute || result.RequeueAfter > 4*time.Minute {
+		t.Fatalf("expected a requeue when the timeout expires, got %v", result.RequeueAfter)
+	}
+
+	r.Timeout = 30 * time.Second
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	var got infrastructurev1alpha1.ManagedCluster
+	if err := r.Get(context.Background(), req.NamespacedName, &got); err != nil {
+		t.Fatalf("failed to get managed cluster: %v", err)
+	}
+	if got.Status.LastCommandOutcome != infrastructurev1alpha1.CommandUnacknowledged {
+		t.Fatalf("expected the command to be unacknowledged, got %q", got.Status.LastCommandOutcome)
+	}
+	cond := got.Status.GetCondition(infrastructurev1alpha1.ManagedClusterCommandAcknowledged)
+	if cond == nil || cond.Status != corev1.ConditionFalse || cond.Reason != "Unacknowledged" {
+		t.Fatalf("expected the CommandAcknowledged condition to be false, got %+v", cond)
+	}
+}
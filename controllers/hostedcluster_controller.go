@@ -0,0 +1,296 @@
+/*
+Copyright 2020 Juan-Lee Pang.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License. You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied. See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	capiv1alpha3 "sigs.k8s.io/cluster-api/api/v1alpha3"
+	kcpv1alpha3 "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1alpha3"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/azure"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+// HostedClusterReconciler provisions the capz clusters of the managed
+// clusters the worker it runs on created from commands
+type HostedClusterReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// CredentialsSecret is the capz credentials secret copied to the worker by the control plane
+	CredentialsSecret types.NamespacedName
+	// WorkerName is the name of the worker the reconciler runs on
+	WorkerName string
+	// Publisher reports status changes and completed commands to the control
+	// plane. Neither is reported when it is nil.
+	Publisher bus.Publisher
+}
+
+type hostedObject interface {
+	metav1.Object
+	runtime.Object
+}
+
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=managedclusters,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=managedclusters/status,verbs=get;update;patch
+
+func (r *HostedClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("hostedcluster").
+		For(&infrastructurev1alpha1.ManagedCluster{}).
+		Owns(&capiv1alpha3.Cluster{}).
+		Owns(&kcpv1alpha3.KubeadmControlPlane{}).
+		Complete(r)
+}
+
+func (r *HostedClusterReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, reterr error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("hostedcluster", req.NamespacedName)
+
+	var mc infrastructurev1alpha1.ManagedCluster
+	if err := r.Get(ctx, req.NamespacedName, &mc); err != nil {
+		log.Error(err, "unable to fetch managed cluster")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// managed clusters the worker didn't create from commands belong to the
+	// control plane, e.g. when both run in the same cluster
+	if mc.Labels[infrastructurev1alpha1.ManagedClusterHostedByLabel] != r.WorkerName {
+		return ctrl.Result{}, nil
+	}
+
+	// the capz objects are owned by the managed cluster and garbage collected with it
+	if !mc.ObjectMeta.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	previous := mc.Status.DeepCopy()
+	mc.Status.Errors = nil
+
+	defer func() {
+		if reterr != nil {
+			mc.Status.Errors = append(mc.Status.Errors, reterr.Error())
+		}
+		if err := r.reportStatus(ctx, &mc, previous); err != nil {
+			log.Error(err, "failed to report managed cluster status")
+			if reterr == nil {
+				reterr = err
+			}
+		}
+		if err := r.replyCompleted(ctx, &mc); err != nil {
+			log.Error(err, "failed to reply to command")
+			if reterr == nil {
+				reterr = err
+			}
+		}
+		if err := r.Status().Update(ctx, &mc); err != nil && reterr == nil {
+			log.Error(err, "failed to update managed cluster status")
+			reterr = err
+		}
+	}()
+
+	if err := r.reconcileHostedCluster(ctx, &mc); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+func (r *HostedClusterReconciler) reconcileHostedCluster(ctx context.Context, mc *infrastructurev1alpha1.ManagedCluster) error {
+	credentials := &corev1.Secret{}
+	if err := r.Get(ctx, r.CredentialsSecret, credentials); err != nil {
+		return fmt.Errorf("failed to get azure credentials: %w", err)
+	}
+	settings, err := azure.GetSettingsFromSecret(credentials)
+	if err != nil {
+		return err
+	}
+
+	objects, err := getHostedClusterObjects(mc, settings)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objects {
+		obj.SetNamespace(mc.Namespace)
+		if err := controllerutil.SetControllerReference(mc, obj, r.Scheme); err != nil {
+			return err
+		}
+		// like the worker controller, the capz objects are only created, never updated
+		if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, obj, func() error {
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to create hosted cluster object %s: %w", obj.GetName(), err)
+		}
+	}
+
+	cluster := &capiv1alpha3.Cluster{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: mc.Namespace, Name: mc.Name}, cluster); err != nil {
+		return fmt.Errorf("failed to get hosted cluster: %w", err)
+	}
+
+	mc.Status.SetCondition(infrastructurev1alpha1.ManagedClusterInfrastructureReady,
+		conditionStatus(cluster.Status.InfrastructureReady), "", "")
+	mc.Status.SetCondition(infrastructurev1alpha1.ManagedClusterControlPlaneInitialized,
+		conditionStatus(cluster.Status.ControlPlaneInitialized), "", "")
+	if !cluster.Spec.ControlPlaneEndpoint.IsZero() {
+		mc.Status.ControlPlaneEndpoint = cluster.Spec.ControlPlaneEndpoint.String()
+	}
+	if cluster.Status.FailureMessage != nil {
+		mc.Status.Errors = append(mc.Status.Errors, *cluster.Status.FailureMessage)
+	}
+
+	mc.Status.Phase = infrastructurev1alpha1.ManagedClusterPending
+	if cluster.Status.ControlPlaneInitialized && cluster.Status.InfrastructureReady {
+		mc.Status.Phase = infrastructurev1alpha1.ManagedClusterRunning
+	}
+
+	return nil
+}
+
+// reportStatus publishes the status to the control plane when it has changed
+// since the previous reconcile. The sequence is bumped on every change and a
+// report that fails to publish is retried until it succeeds.
+func (r *HostedClusterReconciler) reportStatus(
+	ctx context.Context,
+	mc *infrastructurev1alpha1.ManagedCluster,
+	previous *infrastructurev1alpha1.ManagedClusterStatus) error {
+	if mc.Status.Phase != previous.Phase ||
+		mc.Status.ControlPlaneEndpoint != previous.ControlPlaneEndpoint ||
+		!equality.Semantic.DeepEqual(mc.Status.Errors, previous.Errors) ||
+		!equality.Semantic.DeepEqual(mc.Status.Conditions, previous.Conditions) {
+		mc.Status.Sequence++
+	}
+
+	if r.Publisher == nil || mc.Status.ReportedSequence == mc.Status.Sequence {
+		return nil
+	}
+
+	event := workers.ClusterStatusChanged{
+		Event: messages.Event{
+			Id:       uuid.New(),
+			SourceId: r.WorkerName,
+			Sequence: mc.Status.Sequence,
+		},
+		Name:      mc.Name,
+		Namespace: mc.SourceNamespace(),
+		Status:    mc.Status,
+	}
+	if err := r.Publisher.Publish(ctx, event); err != nil {
+		return fmt.Errorf("failed to publish cluster status changed: %w", err)
+	}
+
+	mc.Status.ReportedSequence = mc.Status.Sequence
+	return nil
+}
+
+// replyCompleted replies Completed to the command that last put the cluster
+// once the cluster is running. A reply that fails to publish is retried until
+// it succeeds.
+func (r *HostedClusterReconciler) replyCompleted(ctx context.Context, mc *infrastructurev1alpha1.ManagedCluster) error {
+	commandID := mc.Annotations[infrastructurev1alpha1.ManagedClusterCommandAnnotation]
+	replyTo := mc.Annotations[infrastructurev1alpha1.ManagedClusterReplyToAnnotation]
+	if r.Publisher == nil || commandID == "" || replyTo == "" ||
+		mc.Status.Phase != infrastructurev1alpha1.ManagedClusterRunning ||
+		mc.Status.CompletedCommandID == commandID {
+		return nil
+	}
+
+	reply := workers.CommandReply{
+		Event: messages.Event{
+			Id:            uuid.New(),
+			SourceId:      r.WorkerName,
+			CorrelationId: commandID,
+		},
+		DestinationId: replyTo,
+		CommandId:     commandID,
+		Name:          mc.Name,
+		Namespace:     mc.SourceNamespace(),
+		Outcome:       infrastructurev1alpha1.CommandCompleted,
+	}
+	if err := r.Publisher.Publish(ctx, reply); err != nil {
+		return fmt.Errorf("failed to reply completed to command %s: %w", commandID, err)
+	}
+
+	mc.Status.CompletedCommandID = commandID
+	return nil
+}
+
+func conditionStatus(b bool) corev1.ConditionStatus {
+	if b {
+		return corev1.ConditionTrue
+	}
+	return corev1.ConditionFalse
+}
+
+// getHostedClusterObjects returns the capz objects of a managed cluster. A
+// hosted cluster has the same shape as a worker cluster, so it reuses the
+// worker templates.
+func getHostedClusterObjects(mc *infrastructurev1alpha1.ManagedCluster, settings map[string]string) ([]hostedObject, error) {
+	worker := &infrastructurev1alpha1.Worker{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      mc.Name,
+			Namespace: mc.Namespace,
+		},
+		Spec: infrastructurev1alpha1.WorkerSpec{
+			Version:  mc.Spec.Version,
+			Location: mc.Spec.Location,
+			Replicas: mc.Spec.Replicas,
+		},
+	}
+
+	network, err := getWorkerNetwork(worker)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := getControlPlaneReplicas(worker)
+	if err != nil {
+		return nil, err
+	}
+
+	controlPlane, err := getKubeadmControlPlane(mc.Name, mc.Spec.Location, replicas, network, settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kubeadm control plane: %w", err)
+	}
+	configTemplate, err := getKubeadmConfigTemplate(mc.Name, mc.Spec.Location, network, settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kubeadm config template: %w", err)
+	}
+
+	return []hostedObject{
+		getCluster(mc.Name, network),
+		getAzureCluster(mc.Name, mc.Spec.Location, network, settings),
+		controlPlane,
+		getMachineTemplate(mc.Name, mc.Spec.Location),
+		configTemplate,
+		getMachineDeployment(worker),
+	}, nil
+}
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus/bustest"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+func TestHostedClusterRepliesCompletedOnceRunning(t *testing.T) {
+	p := &bustest.RecordingPublisher{}
+	r := &HostedClusterReconciler{WorkerName: "worker-a", Publisher: p}
+	mc := &infrastructurev1alpha1.ManagedCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "one",
+			Annotations: map[string]string{
+				infrastructurev1alpha1.ManagedClusterCommandAnnotation: "command-1",
+				infrastructurev1alpha1.ManagedClusterReplyToAnnotation: messages.ControlPlaneRepliesId,
+			},
+		},
+		Status: infrastructurev1alpha1.ManagedClusterStatus{Phase: infrastructurev1alpha1.ManagedClusterPending},
+	}
+
+	ctx := context.Background()
+	if err := r.replyCompleted(ctx, mc); err != nil || len(p.Published) != 0 {
+		t.Fatalf("expected no reply while pending, got %v %v", err, p.Published)
+	}
+	mc.Status.Phase = infrastructurev1alpha1.ManagedClusterRunning
+	for i := 0; i < 2; i++ {
+		if err := r.replyCompleted(ctx, mc); err != nil {
+			t.Fatalf("reply failed: %v", err)
+		}
+	}
+	if len(p.Published) != 1 {
+		t.Fatalf("expected a single reply, got %v", p.Published)
+	}
+	reply := p.Published[0].(workers.CommandReply)
+	if reply.CommandId != "command-1" || reply.Outcome != infrastructurev1alpha1.CommandCompleted ||
+		reply.Destination() != messages.ControlPlaneRepliesId {
+		t.Fatalf("expected command-1 to be replied completed, got %+v", reply)
+	}
+}
+
+func TestHostedClusterIgnoresClustersItDoesNotHost(t *testing.T) {
+	clusters := []runtime.Object{
+		&infrastructurev1alpha1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "control-plane"}},
+		&infrastructurev1alpha1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "other-worker",
+			Labels:    map[string]string{infrastructurev1alpha1.ManagedClusterHostedByLabel: "worker-b"},
+		}},
+	}
+	r := &HostedClusterReconciler{
+		Client:     newFakeClient(t, clusters...),
+		Log:        zap.New(zap.UseDevMode(true)),
+		WorkerName: "worker-a",
+	}
+
+	for _, name := range []string{"control-plane", "other-worker"} {
+		key := client.ObjectKey{Namespace: "default", Name: name}
+		// reconciling a hosted cluster fails here, since there are no capz credentials
+		if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+			t.Fatalf("expected %s to be ignored, got %v", name, err)
+		}
+		var mc infrastructurev1alpha1.ManagedCluster
+		if err := r.Get(context.Background(), key, &mc); err != nil {
+			t.Fatalf("failed to get managed cluster: %v", err)
+		}
+		if mc.Status.Phase != "" {
+			t.Errorf("expected %s to be left alone, got phase %s", name, mc.Status.Phase)
+		}
+	}
+}
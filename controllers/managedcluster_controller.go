@@ -21,15 +21,22 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
 )
 
 var mux sync.Mutex
@@ -39,12 +46,44 @@ type ManagedClusterReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+
+	// Publisher sends cluster commands to the assigned worker. Commands are
+	// staged in the managed cluster's outbox and published by an OutboxRelay.
+	// Commands are not staged when it is nil.
+	Publisher bus.Publisher
+
+	// ReplyTimeout is how long the reply to a command is awaited before the
+	// command is marked unacknowledged. Commands never time out when it is zero.
+	ReplyTimeout time.Duration
 }
 
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=managedclusters,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=managedclusters/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=messages,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=messages/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch
 
 func (r *ManagedClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Publisher != nil {
+		if err := (&OutboxRelay{
+			Client:    r.Client,
+			Log:       r.Log.WithName("outbox"),
+			Publisher: r.Publisher,
+			For:       &infrastructurev1alpha1.ManagedCluster{},
+		}).SetupWithManager(mgr); err != nil {
+			return fmt.Errorf("failed to set up outbox relay: %w", err)
+		}
+	}
+	if r.Publisher != nil && r.ReplyTimeout > 0 {
+		if err := (&CommandTimeoutTracker{
+			Client:  r.Client,
+			Log:     r.Log.WithName("commandtimeout"),
+			Timeout: r.ReplyTimeout,
+		}).SetupWithManager(mgr); err != nil {
+			return fmt.Errorf("failed to set up command timeout tracker: %w", err)
+		}
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&infrastructurev1alpha1.ManagedCluster{}).
 		Complete(r)
@@ -60,16 +99,27 @@ func (r *ManagedClusterReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, r
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	// managed clusters hosted by a worker running in the same cluster are
+	// provisioned by that worker
+	if _, ok := mc.Labels[infrastructurev1alpha1.ManagedClusterHostedByLabel]; ok {
+		return ctrl.Result{}, nil
+	}
+
 	if !mc.ObjectMeta.DeletionTimestamp.IsZero() {
-		// get worker and increase available capacity
-		if err := r.unassignWorker(ctx, &mc); err != nil {
-			return ctrl.Result{}, err
-		}
+		return r.reconcileDelete(ctx, &mc)
+	}
 
-		return ctrl.Result{}, nil
+	if !containsString(mc.Finalizers, infrastructurev1alpha1.ManagedClusterFinalizer) {
+		controllerutil.AddFinalizer(&mc, infrastructurev1alpha1.ManagedClusterFinalizer)
+		if err := r.Update(ctx, &mc); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to add finalizer: %w", err)
+		}
 	}
 
-	mc.Status.Phase = infrastructurev1alpha1.ManagedClusterPending
+	// once assigned, the phase is reported by the worker
+	if mc.Status.Phase == "" {
+		mc.Status.Phase = infrastructurev1alpha1.ManagedClusterPending
+	}
 
 	defer func() {
 		if err := r.Status().Update(ctx, &mc); err != nil && reterr == nil {
@@ -83,11 +133,120 @@ func (r *ManagedClusterReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, r
 		return ctrl.Result{}, err
 	}
 
-	mc.Status.Phase = infrastructurev1alpha1.ManagedClusterRunning
+	if err := r.stageCluster(&mc); err != nil {
+		log.Error(err, "failed to stage cluster")
+		return ctrl.Result{}, err
+	}
 
 	return ctrl.Result{}, nil
 }
 
+func (r *ManagedClusterReconciler) reconcileDelete(ctx context.Context, mc *infrastructurev1alpha1.ManagedCluster) (ctrl.Result, error) {
+	if !containsString(mc.Finalizers, infrastructurev1alpha1.ManagedClusterFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	// the delete is staged in the same status update that unassigns the
+	// worker, so it is staged exactly once. The worker's capacity is only
+	// released once that update is saved.
+	if worker := mc.Status.AssignedWorker; worker != nil {
+		if err := r.stageDelete(mc); err != nil {
+			return ctrl.Result{}, err
+		}
+		mc.Status.AssignedWorker = nil
+		if err := r.Status().Update(ctx, mc); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to stage delete: %w", err)
+		}
+
+		if err := r.releaseCapacity(ctx, *worker); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// keep the managed cluster until the relay has published its outbox, it
+	// is reconciled again when the relay updates the status
+	if len(mc.Status.Outbox) > 0 {
+		return ctrl.Result{}, nil
+	}
+
+	controllerutil.RemoveFinalizer(mc, infrastructurev1alpha1.ManagedClusterFinalizer)
+	if err := r.Update(ctx, mc); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to remove finalizer: %w", err)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// stageCluster stages the spec for the assigned worker whenever the spec has
+// changed since it was last staged. The command and the published generation
+// are saved together with the rest of the status.
+func (r *ManagedClusterReconciler) stageCluster(mc *infrastructurev1alpha1.ManagedCluster) error {
+	if r.Publisher == nil || mc.Status.AssignedWorker == nil {
+		return nil
+	}
+	if mc.Status.PublishedGeneration == mc.Generation {
+		return nil
+	}
+
+	command := workers.PutCluster{
+		Command: messages.Command{
+			Id:            uuid.New(),
+			DestinationId: *mc.Status.AssignedWorker,
+			Generation:    mc.Generation,
+			ReplyTo:       messages.ControlPlaneRepliesId,
+		},
+		Name:       mc.Name,
+		Namespace:  mc.Namespace,
+		ClusterUID: string(mc.UID),
+		Spec:       mc.Spec,
+	}
+	if err := stageMessage(mc, command); err != nil {
+		return fmt.Errorf("failed to stage put cluster for worker %s: %w", command.DestinationId, err)
+	}
+
+	mc.Status.PublishedGeneration = mc.Generation
+	awaitReply(mc, command.Id.String())
+	return nil
+}
+
+// stageDelete stages a command telling the assigned worker to delete the
+// cluster. The command is a generation past any PutCluster of the cluster, so
+// the worker rejects puts that arrive after it.
+func (r *ManagedClusterReconciler) stageDelete(mc *infrastructurev1alpha1.ManagedCluster) error {
+	if r.Publisher == nil || mc.Status.AssignedWorker == nil {
+		return nil
+	}
+
+	command := workers.DeleteCluster{
+		Command: messages.Command{
+			Id:            uuid.New(),
+			DestinationId: *mc.Status.AssignedWorker,
+			Generation:    mc.Generation + 1,
+			ReplyTo:       messages.ControlPlaneRepliesId,
+		},
+		Name:       mc.Name,
+		Namespace:  mc.Namespace,
+		ClusterUID: string(mc.UID),
+	}
+	if err := stageMessage(mc, command); err != nil {
+		return fmt.Errorf("failed to stage delete cluster for worker %s: %w", command.DestinationId, err)
+	}
+
+	awaitReply(mc, command.Id.String())
+	return nil
+}
+
+// awaitReply records the command as the last one staged, whose reply is
+// awaited until the CommandTimeoutTracker gives up on it.
+func awaitReply(mc *infrastructurev1alpha1.ManagedCluster, commandID string) {
+	now := metav1.Now()
+	mc.Status.LastCommandID = commandID
+	mc.Status.LastCommandTime = &now
+	mc.Status.LastCommandOutcome = ""
+	mc.Status.SetCondition(infrastructurev1alpha1.ManagedClusterCommandAcknowledged, corev1.ConditionUnknown,
+		"AwaitingReply", fmt.Sprintf("waiting for the reply to command %s", commandID))
+}
+
 func (r *ManagedClusterReconciler) assignWorker(ctx context.Context, mc *infrastructurev1alpha1.ManagedCluster) error {
 	mux.Lock()
 	defer mux.Unlock()
@@ -112,8 +271,13 @@ func (r *ManagedClusterReconciler) assignWorker(ctx context.Context, mc *infrast
 			return fmt.Errorf("0 workers found with available capacity")
 		}
 
+		// the cluster isn't saved as assigned yet, so it is counted on top
+		assigned, err := r.assignedClusters(ctx, selectedWorker.Name, mc)
+		if err != nil {
+			return err
+		}
 		mc.Status.AssignedWorker = &selectedWorker.Name
-		*selectedWorker.Status.AvailableCapacity--
+		setAvailableCapacity(selectedWorker, assigned+1)
 		selectedWorker.Status.LastScheduledTime = metav1.Now()
 		if err := r.Status().Update(ctx, selectedWorker); err != nil {
 			return fmt.Errorf("unable to update selected worker status: %+v", err)
@@ -123,25 +287,57 @@ func (r *ManagedClusterReconciler) assignWorker(ctx context.Context, mc *infrast
 	return nil
 }
 
-func (r *ManagedClusterReconciler) unassignWorker(ctx context.Context, mc *infrastructurev1alpha1.ManagedCluster) error {
+// releaseCapacity recomputes the available capacity of a worker from the
+// managed clusters assigned to it, so releasing a cluster's capacity more than
+// once doesn't inflate it.
+func (r *ManagedClusterReconciler) releaseCapacity(ctx context.Context, name string) error {
 	mux.Lock()
 	defer mux.Unlock()
 
-	if mc.Status.AssignedWorker != nil {
-		var worker infrastructurev1alpha1.Worker
-		// assuming default namespace just for the moment
-		if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: *mc.Status.AssignedWorker}, &worker); err != nil {
-			return err
-		}
+	var worker infrastructurev1alpha1.Worker
+	// assuming default namespace just for the moment
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: name}, &worker); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	assigned, err := r.assignedClusters(ctx, name, nil)
+	if err != nil {
+		return err
+	}
+	setAvailableCapacity(&worker, assigned)
+	if err := r.Status().Update(ctx, &worker); err != nil {
+		return fmt.Errorf("unable to update worker %s status: %+v", name, err)
+	}
+	return nil
+}
 
-		mc.Status.AssignedWorker = nil
-		*worker.Status.AvailableCapacity++
-		if err := r.Status().Update(ctx, &worker); err != nil {
-			return fmt.Errorf("unable to update selected worker status: %+v", err)
+// assignedClusters counts the managed clusters assigned to the worker, other
+// than except.
+func (r *ManagedClusterReconciler) assignedClusters(ctx context.Context, worker string, except *infrastructurev1alpha1.ManagedCluster) (int32, error) {
+	var clusters infrastructurev1alpha1.ManagedClusterList
+	if err := r.List(ctx, &clusters); err != nil {
+		return 0, fmt.Errorf("unable to list managed clusters: %w", err)
+	}
+	var assigned int32
+	for i := range clusters.Items {
+		mc := &clusters.Items[i]
+		if except != nil && mc.Namespace == except.Namespace && mc.Name == except.Name {
+			continue
+		}
+		if mc.Status.AssignedWorker != nil && *mc.Status.AssignedWorker == worker {
+			assigned++
 		}
 	}
+	return assigned, nil
+}
 
-	return nil
+// setAvailableCapacity sets the available capacity of a worker with the
+// given number of assigned clusters.
+func setAvailableCapacity(worker *infrastructurev1alpha1.Worker, assigned int32) {
+	available := worker.Spec.Capacity - assigned
+	if available < 0 {
+		available = 0
+	}
+	worker.Status.AvailableCapacity = &available
 }
 
 func validWorker(worker *infrastructurev1alpha1.Worker, minLastScheduledTime *metav1.Time) bool {
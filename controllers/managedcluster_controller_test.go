@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus/bustest"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+// conflictingClient fails the first status updates of managed clusters.
+type conflictingClient struct {
+	client.Client
+	failures int
+}
+
+func (c *conflictingClient) Status() client.StatusWriter {
+	return &conflictingStatusWriter{StatusWriter: c.Client.Status(), client: c}
+}
+
+type conflictingStatusWriter struct {
+	client.StatusWriter
+	client *conflictingClient
+}
+
+func (w *conflictingStatusWriter) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	if _, ok := obj.(*infrastructurev1alpha1.ManagedCluster); ok && w.client.failures > 0 {
+		w.client.failures--
+		return errors.New("conflict")
+	}
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+func TestReconcileDeleteReleasesCapacityOnce(t *testing.T) {
+	now := metav1.Now()
+	deleting := &infrastructurev1alpha1.ManagedCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         "default",
+			Name:              "one",
+			Finalizers:        []string{infrastructurev1alpha1.ManagedClusterFinalizer},
+			DeletionTimestamp: &now,
+		},
+		Status: infrastructurev1alpha1.ManagedClusterStatus{AssignedWorker: to.StringPtr("worker-a")},
+	}
+	remaining := &infrastructurev1alpha1.ManagedCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "two"},
+		Status:     infrastructurev1alpha1.ManagedClusterStatus{AssignedWorker: to.StringPtr("worker-a")},
+	}
+	worker := runningWorker("worker-a", "eastus", nil)
+	worker.Spec.Capacity = 3
+	worker.Status.AvailableCapacity = to.Int32Ptr(1)
+
+	c := &conflictingClient{Client: newFakeClient(t, deleting, remaining, worker), failures: 1}
+	r := &ManagedClusterReconciler{
+		Client:    c,
+		Log:       zap.New(zap.UseDevMode(true)),
+		Publisher: &bustest.RecordingPublisher{},
+	}
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "one"}}
+
+	// the failed update neither stages the delete nor releases capacity
+	if _, err := r.Reconcile(req); err == nil {
+		t.Fatalf("expected the reconcile to fail")
+	}
+	var got infrastructurev1alpha1.Worker
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "worker-a"}, &got); err != nil {
+		t.Fatalf("failed to get worker: %v", err)
+	}
+	if *got.Status.AvailableCapacity != 1 {
+		t.Errorf("expected capacity to be kept until the delete is staged, got %d", *got.Status.AvailableCapacity)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("reconcile failed: %v", err)
+		}
+	}
+	var mc infrastructurev1alpha1.ManagedCluster
+	if err := r.Get(context.Background(), req.NamespacedName, &mc); err != nil {
+		t.Fatalf("failed to get managed cluster: %v", err)
+	}
+	if mc.Status.AssignedWorker != nil || len(mc.Status.Outbox) != 1 || mc.Status.Outbox[0].Type != workers.DeleteClusterType {
+		t.Fatalf("expected a single staged delete and no assigned worker, got %+v", mc.Status)
+	}
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "worker-a"}, &got); err != nil {
+		t.Fatalf("failed to get worker: %v", err)
+	}
+	if *got.Status.AvailableCapacity != 2 {
+		t.Errorf("expected one cluster to remain assigned, got available capacity %d", *got.Status.AvailableCapacity)
+	}
+}
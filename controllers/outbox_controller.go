@@ -0,0 +1,173 @@
+/*
+Copyright 2020 Juan-Lee Pang.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License. You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied. See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/messages"
+)
+
+// OutboxRelay publishes the messages staged in the outbox of objects of one
+// kind and removes them once the bus has accepted them. A relay that stops
+// between publishing and removing a message publishes it again with the same
+// id, so the duplicate is dropped by the destination.
+type OutboxRelay struct {
+	client.Client
+	Log       logr.Logger
+	Publisher bus.Publisher
+	// For is the kind of object relayed. Defaults to ManagedCluster.
+	For outboxObject
+}
+
+// outboxObject is an object whose status has an outbox.
+type outboxObject interface {
+	runtime.Object
+	GetOutbox() []infrastructurev1alpha1.OutboxEntry
+	SetOutbox([]infrastructurev1alpha1.OutboxEntry)
+}
+
+func (r *OutboxRelay) SetupWithManager(mgr ctrl.Manager) error {
+	gvk, err := apiutil.GVKForObject(r.kind(), mgr.GetScheme())
+	if err != nil {
+		return fmt.Errorf("failed to get kind of relayed objects: %w", err)
+	}
+	pending := func(o runtime.Object) bool {
+		obj, ok := o.(outboxObject)
+		return ok && len(obj.GetOutbox()) > 0
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("outboxrelay-" + strings.ToLower(gvk.Kind)).
+		For(r.kind()).
+		WithEventFilter(predicate.Funcs{
+			CreateFunc:  func(e event.CreateEvent) bool { return pending(e.Object) },
+			UpdateFunc:  func(e event.UpdateEvent) bool { return pending(e.ObjectNew) },
+			DeleteFunc:  func(e event.DeleteEvent) bool { return false },
+			GenericFunc: func(e event.GenericEvent) bool { return pending(e.Object) },
+		}).
+		Complete(r)
+}
+
+func (r *OutboxRelay) kind() outboxObject {
+	if r.For == nil {
+		return &infrastructurev1alpha1.ManagedCluster{}
+	}
+	return r.For
+}
+
+func (r *OutboxRelay) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("object", req.NamespacedName)
+
+	obj := r.kind().DeepCopyObject().(outboxObject)
+	if err := r.Get(ctx, req.NamespacedName, obj); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	outbox := obj.GetOutbox()
+	if len(outbox) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	// entries are published in order and the outbox is saved even when one
+	// fails, so the entries already sent aren't sent again
+	var relayErr error
+	sent := 0
+	for _, entry := range outbox {
+		message, err := decodeOutboxEntry(entry)
+		if err != nil {
+			log.Error(err, "dropping outbox entry that can't be decoded", "id", entry.ID, "type", entry.Type)
+			markUndeliverable(obj, entry, err)
+			sent++
+			continue
+		}
+		if err := r.Publisher.Publish(ctx, message); err != nil {
+			relayErr = fmt.Errorf("failed to publish %s %s: %w", entry.Type, entry.ID, err)
+			break
+		}
+		log.V(1).Info("published outbox entry", "id", entry.ID, "type", entry.Type)
+		sent++
+	}
+
+	if sent > 0 {
+		obj.SetOutbox(outbox[sent:])
+		if err := r.Status().Update(ctx, obj); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to remove published entries from outbox: %w", err)
+		}
+	}
+	return ctrl.Result{}, relayErr
+}
+
+// stageMessage adds a message to the outbox of an object. The message is
+// published by the OutboxRelay once the status has been saved.
+func stageMessage(obj outboxObject, message messages.Message) error {
+	envelope, err := messages.NewEnvelope(message)
+	if err != nil {
+		return fmt.Errorf("failed to stage message: %w", err)
+	}
+	obj.SetOutbox(append(obj.GetOutbox(), infrastructurev1alpha1.OutboxEntry{
+		ID:            envelope.Id.String(),
+		Type:          envelope.Type,
+		SchemaVersion: envelope.SchemaVersion,
+		Payload:       string(envelope.Payload),
+		CreatedTime:   metav1.Now(),
+	}))
+	return nil
+}
+
+// markUndeliverable records on the object that an outbox entry was dropped
+// because it couldn't be decoded, so the message isn't silently lost. A
+// managed cluster marks its last command undeliverable, and a worker command
+// fails as no worker will acknowledge it.
+func markUndeliverable(obj outboxObject, entry infrastructurev1alpha1.OutboxEntry, err error) {
+	switch o := obj.(type) {
+	case *infrastructurev1alpha1.ManagedCluster:
+		if o.Status.LastCommandID != entry.ID {
+			return
+		}
+		o.Status.LastCommandOutcome = infrastructurev1alpha1.CommandUndeliverable
+		o.Status.SetCondition(infrastructurev1alpha1.ManagedClusterCommandAcknowledged, corev1.ConditionFalse,
+			string(infrastructurev1alpha1.CommandUndeliverable),
+			fmt.Sprintf("command %s can't be decoded for publishing: %v", entry.ID, err))
+	case *infrastructurev1alpha1.WorkerCommand:
+		if o.Status.CommandID == entry.ID {
+			o.Status.Phase = infrastructurev1alpha1.WorkerCommandFailed
+		}
+	}
+}
+
+func decodeOutboxEntry(entry infrastructurev1alpha1.OutboxEntry) (messages.Message, error) {
+	envelope := messages.Envelope{
+		Type:          entry.Type,
+		SchemaVersion: entry.SchemaVersion,
+		Payload:       json.RawMessage(entry.Payload),
+	}
+	return envelope.Decode()
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus/bustest"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+func newOutboxRelay(t *testing.T, objs ...runtime.Object) (*OutboxRelay, *bustest.RecordingPublisher) {
+	t.Helper()
+	p := &bustest.RecordingPublisher{}
+	return &OutboxRelay{
+		Client:    newFakeClient(t, objs...),
+		Log:       zap.New(zap.UseDevMode(true)),
+		Publisher: p,
+	}, p
+}
+
+func TestOutboxRelayPublishesStagedCommands(t *testing.T) {
+	mc := &infrastructurev1alpha1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "one"}}
+	put := workers.PutCluster{
+		Command:   messages.Command{Id: uuid.New(), DestinationId: "worker-a", Generation: 1},
+		Name:      "one",
+		Namespace: "default",
+	}
+	del := workers.DeleteCluster{
+		Command:   messages.Command{Id: uuid.New(), DestinationId: "worker-a", Generation: 2},
+		Name:      "one",
+		Namespace: "default",
+	}
+	for _, m := range []messages.Message{put, del} {
+		if err := stageMessage(mc, m); err != nil {
+			t.Fatalf("failed to stage: %v", err)
+		}
+	}
+	r, p := newOutboxRelay(t, mc)
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "one"}}
+
+	// nothing is removed from the outbox while the bus is down
+	p.Fail = true
+	if _, err := r.Reconcile(req); err == nil {
+		t.Fatalf("expected the relay to fail")
+	}
+	var got infrastructurev1alpha1.ManagedCluster
+	if err := r.Get(context.Background(), req.NamespacedName, &got); err != nil {
+		t.Fatalf("failed to get managed cluster: %v", err)
+	}
+	if len(got.Status.Outbox) != 2 {
+		t.Fatalf("expected 2 staged commands, got %d", len(got.Status.Outbox))
+	}
+
+	p.Fail = false
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("relay failed: %v", err)
+	}
+	var drained infrastructurev1alpha1.ManagedCluster
+	if err := r.Get(context.Background(), req.NamespacedName, &drained); err != nil {
+		t.Fatalf("failed to get managed cluster: %v", err)
+	}
+	if len(drained.Status.Outbox) != 0 {
+		t.Fatalf("expected the outbox to be drained, got %v", drained.Status.Outbox)
+	}
+	if len(p.Published) != 2 {
+		t.Fatalf("expected 2 published commands, got %d", len(p.Published))
+	}
+	if p.Published[0].MessageID() != put.Id || p.Published[1].MessageID() != del.Id {
+		t.Fatalf("expected the staged ids in order, got %s and %s", p.Published[0].MessageID(), p.Published[1].MessageID())
+	}
+	if _, ok := p.Published[1].(*workers.DeleteCluster); !ok {
+		t.Fatalf("expected a delete cluster, got %T", p.Published[1])
+	}
+}
+
+func TestOutboxRelayMarksUndecodableCommandsUndeliverable(t *testing.T) {
+	mc := &infrastructurev1alpha1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "one"}}
+	put := workers.PutCluster{
+		Command:   messages.Command{Id: uuid.New(), DestinationId: "worker-a", Generation: 1},
+		Name:      "one",
+		Namespace: "default",
+	}
+	if err := stageMessage(mc, put); err != nil {
+		t.Fatalf("failed to stage: %v", err)
+	}
+	awaitReply(mc, put.Id.String())
+	mc.Status.Outbox[0].SchemaVersion = "v0"
+	r, p := newOutboxRelay(t, mc)
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "one"}}
+
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("relay failed: %v", err)
+	}
+	var got infrastructurev1alpha1.ManagedCluster
+	if err := r.Get(context.Background(), req.NamespacedName, &got); err != nil {
+		t.Fatalf("failed to get managed cluster: %v", err)
+	}
+	if len(got.Status.Outbox) != 0 || len(p.Published) != 0 {
+		t.Fatalf("expected the entry to be dropped unpublished, got outbox %v and published %v", got.Status.Outbox, p.Published)
+	}
+	if got.Status.LastCommandOutcome != infrastructurev1alpha1.CommandUndeliverable {
+		t.Errorf("expected the command to be undeliverable, got %q", got.Status.LastCommandOutcome)
+	}
+	c := got.Status.GetCondition(infrastructurev1alpha1.ManagedClusterCommandAcknowledged)
+	if c == nil || c.Status != corev1.ConditionFalse || c.Reason != string(infrastructurev1alpha1.CommandUndeliverable) {
+		t.Errorf("expected the command acknowledged condition to be False and Undeliverable, got %+v", c)
+	}
+}
@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/cluster-api/util/secret"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/remote"
+)
+
+// getRemoteClient returns a client for the worker cluster using the
+// kubeconfig secret CAPI generates for it.
+func getRemoteClient(ctx context.Context, c client.Client, worker *infrastructurev1alpha1.Worker) (*remote.Client, error) {
+	// Fetch remote kubeconfig
+	kubeconfigSecret := &corev1.Secret{}
+	kubeconfigKey := types.NamespacedName{
+		Name:      fmt.Sprintf("%s-kubeconfig", worker.Name),
+		Namespace: worker.Namespace,
+	}
+
+	if err := c.Get(ctx, kubeconfigKey, kubeconfigSecret); err != nil {
+		return nil, fmt.Errorf("failed to get remote kubeconfig to apply to cluster: %w", err)
+	}
+
+	data, ok := kubeconfigSecret.Data[secret.KubeconfigDataName]
+	if !ok {
+		return nil, fmt.Errorf("missing key %q in secret data", secret.KubeconfigDataName)
+	}
+
+	// Construct a kubeclient with it
+	remoteClient, err := remote.NewClient(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create REST configuration for worker %s/%s : %w", worker.Namespace, worker.Name, err)
+	}
+	return remoteClient, nil
+}
@@ -110,6 +110,13 @@ var _ = BeforeSuite(func(done Done) {
 		Log:           ctrl.Log.WithName("controllers").WithName("Worker"),
 		Scheme:        mgr.GetScheme(),
 		AzureSettings: settings,
+		AgentImage:    "juanlee/carp-controller:latest",
+	}).SetupWithManager(mgr)).NotTo(HaveOccurred())
+
+	Expect((&WorkerAddonReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("WorkerAddon"),
+		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr)).NotTo(HaveOccurred())
 
 	close(done)
@@ -3,6 +3,7 @@ package controllers
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/Azure/go-autorest/autorest/azure/auth"
@@ -73,17 +74,116 @@ func getMachineTemplate(cluster, location string) *capzv1alpha3.AzureMachineTemp
 	}
 }
 
-func getCluster(cluster, location string, settings map[string]string) *capiv1alpha3.Cluster {
+// getWorkerNetwork returns the worker's network configuration with defaults
+// applied. Both the AzureCluster and azure.json are derived from it so they
+// always agree on vnet, subnet and resource group names.
+func getWorkerNetwork(worker *carpv1alpha1.Worker) (*carpv1alpha1.WorkerNetwork, error) {
+	network := worker.Spec.Network.DeepCopy()
+
+	if len(network.PodCIDRBlocks) == 0 {
+		network.PodCIDRBlocks = []string{"192.168.0.0/16"}
+	}
+
+	if network.Vnet.Existing && (network.Vnet.Name == "" || network.Vnet.ResourceGroup == "") {
+		return nil, fmt.Errorf("existing vnet requires both a name and a resource group")
+	}
+	if network.Vnet.Existing && network.Vnet.ResourceGroup == worker.Name {
+		// the worker's own resource group is deleted along with the worker
+		return nil, fmt.Errorf("existing vnet must not be in the worker's resource group %s", worker.Name)
+	}
+	if network.Vnet.Name == "" {
+		network.Vnet.Name = fmt.Sprintf("%s-vnet", worker.Name)
+	}
+	if network.Vnet.ResourceGroup == "" {
+		network.Vnet.ResourceGroup = worker.Name
+	}
+
+	if err := validateWorkerSubnets(network); err != nil {
+		return nil, err
+	}
+
+	defaultSubnetNames := map[carpv1alpha1.WorkerSubnetRole]string{
+		carpv1alpha1.WorkerSubnetControlPlane: fmt.Sprintf("%s-controlplane-subnet", worker.Name),
+		carpv1alpha1.WorkerSubnetNode:         fmt.Sprintf("%s-node-subnet", worker.Name),
+	}
+	for _, role := range []carpv1alpha1.WorkerSubnetRole{carpv1alpha1.WorkerSubnetControlPlane, carpv1alpha1.WorkerSubnetNode} {
+		subnet := getWorkerSubnet(network, role)
+		if subnet == nil {
+			network.Subnets = append(network.Subnets, carpv1alpha1.WorkerSubnet{Role: role})
+			subnet = &network.Subnets[len(network.Subnets)-1]
+		}
+		if subnet.Name == "" {
+			subnet.Name = defaultSubnetNames[role]
+		}
+	}
+
+	return network, nil
+}
+
+// validateWorkerSubnets rejects duplicate subnet roles and subnets outside the vnet's address space.
+func validateWorkerSubnets(network *carpv1alpha1.WorkerNetwork) error {
+	var vnet *net.IPNet
+	if network.Vnet.CIDRBlock != "" {
+		_, cidr, err := net.ParseCIDR(network.Vnet.CIDRBlock)
+		if err != nil {
+			return fmt.Errorf("invalid vnet cidr block %s: %w", network.Vnet.CIDRBlock, err)
+		}
+		vnet = cidr
+	}
+
+	roles := map[carpv1alpha1.WorkerSubnetRole]bool{}
+	for _, subnet := range network.Subnets {
+		if roles[subnet.Role] {
+			return fmt.Errorf("duplicate %s subnet", subnet.Role)
+		}
+		roles[subnet.Role] = true
+
+		if subnet.CIDRBlock == "" {
+			continue
+		}
+		ip, cidr, err := net.ParseCIDR(subnet.CIDRBlock)
+		if err != nil {
+			return fmt.Errorf("invalid %s subnet cidr block %s: %w", subnet.Role, subnet.CIDRBlock, err)
+		}
+		if vnet == nil {
+			continue
+		}
+		vnetOnes, _ := vnet.Mask.Size()
+		subnetOnes, _ := cidr.Mask.Size()
+		if !vnet.Contains(ip) || subnetOnes < vnetOnes {
+			return fmt.Errorf("%s subnet %s is outside vnet %s", subnet.Role, subnet.CIDRBlock, network.Vnet.CIDRBlock)
+		}
+	}
+	return nil
+}
+
+func getWorkerSubnet(network *carpv1alpha1.WorkerNetwork, role carpv1alpha1.WorkerSubnetRole) *carpv1alpha1.WorkerSubnet {
+	for i := range network.Subnets {
+		if network.Subnets[i].Role == role {
+			return &network.Subnets[i]
+		}
+	}
+	return nil
+}
+
+func getCluster(cluster string, network *carpv1alpha1.WorkerNetwork) *capiv1alpha3.Cluster {
+	clusterNetwork := &capiv1alpha3.ClusterNetwork{
+		Pods: &capiv1alpha3.NetworkRanges{
+			CIDRBlocks: network.PodCIDRBlocks,
+		},
+	}
+	if len(network.ServiceCIDRBlocks) > 0 {
+		clusterNetwork.Services = &capiv1alpha3.NetworkRanges{
+			CIDRBlocks: network.ServiceCIDRBlocks,
+		}
+	}
+
 	return &capiv1alpha3.Cluster{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: cluster,
 		},
 		Spec: capiv1alpha3.ClusterSpec{
-			ClusterNetwork: &capiv1alpha3.ClusterNetwork{
-				Pods: &capiv1alpha3.NetworkRanges{
-					CIDRBlocks: []string{"192.168.0.0/16"},
-				},
-			},
+			ClusterNetwork: clusterNetwork,
 			ControlPlaneRef: &corev1.ObjectReference{
 				APIVersion: "controlplane.cluster.x-k8s.io/v1alpha3",
 				Kind:       "KubeadmControlPlane",
@@ -98,7 +198,39 @@ func getCluster(cluster, location string, settings map[string]string) *capiv1alp
 	}
 }
 
-func getAzureCluster(cluster, location string) *capzv1alpha3.AzureCluster {
+func getAzureCluster(cluster, location string, network *carpv1alpha1.WorkerNetwork,
+	settings map[string]string) *capzv1alpha3.AzureCluster {
+	subnetRoles := map[carpv1alpha1.WorkerSubnetRole]capzv1alpha3.SubnetRole{
+		carpv1alpha1.WorkerSubnetControlPlane: capzv1alpha3.SubnetControlPlane,
+		carpv1alpha1.WorkerSubnetNode:         capzv1alpha3.SubnetNode,
+	}
+	securityGroups := map[carpv1alpha1.WorkerSubnetRole]string{
+		carpv1alpha1.WorkerSubnetControlPlane: controlPlaneSecurityGroupName(cluster),
+		carpv1alpha1.WorkerSubnetNode:         nodeSecurityGroupName(cluster),
+	}
+	subnets := capzv1alpha3.Subnets{}
+	for _, subnet := range network.Subnets {
+		subnets = append(subnets, &capzv1alpha3.SubnetSpec{
+			Role:      subnetRoles[subnet.Role],
+			Name:      subnet.Name,
+			CidrBlock: subnet.CIDRBlock,
+			SecurityGroup: capzv1alpha3.SecurityGroup{
+				Name: securityGroups[subnet.Role],
+			},
+		})
+	}
+
+	// The Azure provider only creates and deletes vnets without an id, so an
+	// existing vnet is referenced by id to leave it unmanaged.
+	vnet := capzv1alpha3.VnetSpec{
+		Name:          network.Vnet.Name,
+		ResourceGroup: network.Vnet.ResourceGroup,
+		CidrBlock:     network.Vnet.CIDRBlock,
+	}
+	if network.Vnet.Existing {
+		vnet.ID = vnetID(settings[auth.SubscriptionID], network.Vnet.ResourceGroup, network.Vnet.Name)
+	}
+
 	return &capzv1alpha3.AzureCluster{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: cluster,
@@ -106,21 +238,53 @@ func getAzureCluster(cluster, location string) *capzv1alpha3.AzureCluster {
 		Spec: capzv1alpha3.AzureClusterSpec{
 			Location: location,
 			NetworkSpec: capzv1alpha3.NetworkSpec{
-				Vnet: capzv1alpha3.VnetSpec{
-					Name: fmt.Sprintf("%s-vnet", cluster),
-				},
+				Vnet:    vnet,
+				Subnets: subnets,
 			},
 			ResourceGroup: cluster,
 		},
 	}
 }
 
-func getKubeadmControlPlane(cluster, location string, settings map[string]string) (*kcpv1alpha3.KubeadmControlPlane, error) {
-	data, err := getCloudProviderConfig(cluster, location, settings)
+// The security group and route table names match the ones the Azure provider
+// generates, and are shared by the AzureCluster and azure.json.
+func controlPlaneSecurityGroupName(cluster string) string {
+	return fmt.Sprintf("%s-controlplane-nsg", cluster)
+}
+
+func nodeSecurityGroupName(cluster string) string {
+	return fmt.Sprintf("%s-node-nsg", cluster)
+}
+
+func nodeRouteTableName(cluster string) string {
+	return fmt.Sprintf("%s-node-routetable", cluster)
+}
+
+func vnetID(subscriptionID, resourceGroup, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/virtualNetworks/%s",
+		subscriptionID, resourceGroup, name)
+}
+
+func getControlPlaneReplicas(worker *carpv1alpha1.Worker) (int32, error) {
+	if worker.Spec.ControlPlaneReplicas == nil {
+		return 1, nil
+	}
+	replicas := *worker.Spec.ControlPlaneReplicas
+	if replicas < 1 || replicas%2 == 0 {
+		return 0, fmt.Errorf("control plane replicas must be a positive odd number, got %d", replicas)
+	}
+	return replicas, nil
+}
+
+func getKubeadmControlPlane(
+	cluster, location string,
+	replicas int32,
+	network *carpv1alpha1.WorkerNetwork,
+	settings map[string]string) (*kcpv1alpha3.KubeadmControlPlane, error) {
+	data, err := getCloudProviderConfig(cluster, location, network, settings)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate cloud provider config")
 	}
-	replicas := int32(1)
 	controlplane := &kcpv1alpha3.KubeadmControlPlane{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: cluster,
@@ -203,8 +367,11 @@ func getKubeadmControlPlane(cluster, location string, settings map[string]string
 	return controlplane, nil
 }
 
-func getKubeadmConfigTemplate(cluster, location string, settings map[string]string) (*capbkv1alpha3.KubeadmConfigTemplate, error) {
-	data, err := getCloudProviderConfig(cluster, location, settings)
+func getKubeadmConfigTemplate(
+	cluster, location string,
+	network *carpv1alpha1.WorkerNetwork,
+	settings map[string]string) (*capbkv1alpha3.KubeadmConfigTemplate, error) {
+	data, err := getCloudProviderConfig(cluster, location, network, settings)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate cloud provider config")
 	}
@@ -260,7 +427,12 @@ type CloudProviderConfig struct {
 	UseInstanceMetadata          bool   `json:"useInstanceMetadata"`
 }
 
-func getCloudProviderConfig(cluster, location string, settings map[string]string) (string, error) {
+func getCloudProviderConfig(cluster, location string, network *carpv1alpha1.WorkerNetwork, settings map[string]string) (string, error) {
+	nodeSubnet := getWorkerSubnet(network, carpv1alpha1.WorkerSubnetNode)
+	if nodeSubnet == nil {
+		return "", fmt.Errorf("missing node subnet")
+	}
+
 	config := &CloudProviderConfig{
 		Cloud:                        settings[auth.EnvironmentName],
 		TenantID:                     settings[auth.TenantID],
@@ -268,13 +440,13 @@ func getCloudProviderConfig(cluster, location string, settings map[string]string
 		AadClientID:                  settings[auth.ClientID],
 		AadClientSecret:              settings[auth.ClientSecret],
 		ResourceGroup:                cluster,
-		SecurityGroupName:            fmt.Sprintf("%s-node-nsg", cluster),
+		SecurityGroupName:            nodeSecurityGroupName(cluster),
 		Location:                     location,
 		VMType:                       "standard",
-		VnetName:                     fmt.Sprintf("%s-vnet", cluster),
-		VnetResourceGroup:            cluster,
-		SubnetName:                   fmt.Sprintf("%s-node-subnet", cluster),
-		RouteTableName:               fmt.Sprintf("%s-node-routetable", cluster),
+		VnetName:                     network.Vnet.Name,
+		VnetResourceGroup:            network.Vnet.ResourceGroup,
+		SubnetName:                   nodeSubnet.Name,
+		RouteTableName:               nodeRouteTableName(cluster),
 		LoadBalancerSku:              "standard",
 		MaximumLoadBalancerRuleCount: 250,
 		UseManagedIdentityExtension:  false,
@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/Azure/go-autorest/autorest/to"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	capzv1alpha3 "sigs.k8s.io/cluster-api-provider-azure/api/v1alpha3"
+	azure "sigs.k8s.io/cluster-api-provider-azure/cloud"
+
+	carpv1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+)
+
+func TestGetControlPlaneReplicas(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas *int32
+		want     int32
+		wantErr  bool
+	}{
+		{name: "default", replicas: nil, want: 1},
+		{name: "one", replicas: to.Int32Ptr(1), want: 1},
+		{name: "three", replicas: to.Int32Ptr(3), want: 3},
+		{name: "five", replicas: to.Int32Ptr(5), want: 5},
+		{name: "zero", replicas: to.Int32Ptr(0), wantErr: true},
+		{name: "even", replicas: to.Int32Ptr(2), wantErr: true},
+		{name: "negative", replicas: to.Int32Ptr(-1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			worker := &carpv1alpha1.Worker{
+				ObjectMeta: metav1.ObjectMeta{Name: "worker-a"},
+				Spec:       carpv1alpha1.WorkerSpec{ControlPlaneReplicas: tt.replicas},
+			}
+			got, err := getControlPlaneReplicas(worker)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %d replicas, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGetWorkerNetworkRejectsInvalidNetworks(t *testing.T) {
+	tests := map[string]carpv1alpha1.WorkerNetwork{
+		"existing vnet without resource group": {
+			Vnet: carpv1alpha1.WorkerVnet{Name: "hub", Existing: true},
+		},
+		"existing vnet in the worker's resource group": {
+			Vnet: carpv1alpha1.WorkerVnet{Name: "hub", ResourceGroup: "worker-a", Existing: true},
+		},
+		"duplicate subnet role": {
+			Subnets: []carpv1alpha1.WorkerSubnet{
+				{Role: carpv1alpha1.WorkerSubnetNode, Name: "one"},
+				{Role: carpv1alpha1.WorkerSubnetNode, Name: "two"},
+			},
+		},
+		"subnet outside vnet": {
+			Vnet: carpv1alpha1.WorkerVnet{CIDRBlock: "10.0.0.0/16"},
+			Subnets: []carpv1alpha1.WorkerSubnet{
+				{Role: carpv1alpha1.WorkerSubnetNode, CIDRBlock: "10.1.0.0/24"},
+			},
+		},
+		"subnet larger than vnet": {
+			Vnet: carpv1alpha1.WorkerVnet{CIDRBlock: "10.0.0.0/16"},
+			Subnets: []carpv1alpha1.WorkerSubnet{
+				{Role: carpv1alpha1.WorkerSubnetNode, CIDRBlock: "10.0.0.0/8"},
+			},
+		},
+		"invalid subnet cidr": {
+			Subnets: []carpv1alpha1.WorkerSubnet{
+				{Role: carpv1alpha1.WorkerSubnetNode, CIDRBlock: "10.0.0.0"},
+			},
+		},
+	}
+	for name, network := range tests {
+		t.Run(name, func(t *testing.T) {
+			worker := &carpv1alpha1.Worker{
+				ObjectMeta: metav1.ObjectMeta{Name: "worker-a"},
+				Spec:       carpv1alpha1.WorkerSpec{Network: network},
+			}
+			if _, err := getWorkerNetwork(worker); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func subnetByRole(subnets capzv1alpha3.Subnets, role capzv1alpha3.SubnetRole) *capzv1alpha3.SubnetSpec {
+	for _, subnet := range subnets {
+		if subnet.Role == role {
+			return subnet
+		}
+	}
+	return nil
+}
+
+func TestAzureClusterAndCloudProviderConfigAgree(t *testing.T) {
+	tests := []struct {
+		name               string
+		network            carpv1alpha1.WorkerNetwork
+		vnet, vnetGroup    string
+		vnetID             string
+		nodeSubnet         string
+		controlPlaneSubnet string
+	}{
+		{
+			name:               "defaults",
+			vnet:               "worker-a-vnet",
+			vnetGroup:          "worker-a",
+			nodeSubnet:         "worker-a-node-subnet",
+			controlPlaneSubnet: "worker-a-controlplane-subnet",
+		},
+		{
+			name: "custom",
+			network: carpv1alpha1.WorkerNetwork{
+				Vnet: carpv1alpha1.WorkerVnet{Name: "custom-vnet", CIDRBlock: "10.0.0.0/16"},
+				Subnets: []carpv1alpha1.WorkerSubnet{
+					{Role: carpv1alpha1.WorkerSubnetNode, Name: "nodes", CIDRBlock: "10.0.1.0/24"},
+					{Role: carpv1alpha1.WorkerSubnetControlPlane, Name: "masters", CIDRBlock: "10.0.0.0/24"},
+				},
+			},
+			vnet:               "custom-vnet",
+			vnetGroup:          "worker-a",
+			nodeSubnet:         "nodes",
+			controlPlaneSubnet: "masters",
+		},
+		{
+			name: "existing",
+			network: carpv1alpha1.WorkerNetwork{
+				Vnet: carpv1alpha1.WorkerVnet{Name: "hub", ResourceGroup: "networking", Existing: true},
+			},
+			vnet:               "hub",
+			vnetGroup:          "networking",
+			vnetID:             "/subscriptions/sub/resourceGroups/networking/providers/Microsoft.Network/virtualNetworks/hub",
+			nodeSubnet:         "worker-a-node-subnet",
+			controlPlaneSubnet: "worker-a-controlplane-subnet",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			worker := &carpv1alpha1.Worker{
+				ObjectMeta: metav1.ObjectMeta{Name: "worker-a"},
+				Spec:       carpv1alpha1.WorkerSpec{Location: "eastus", Network: tt.network},
+			}
+			network, err := getWorkerNetwork(worker)
+			if err != nil {
+				t.Fatalf("failed to get network: %v", err)
+			}
+			settings := map[string]string{auth.SubscriptionID: "sub"}
+			cluster := getAzureCluster(worker.Name, worker.Spec.Location, network, settings)
+			data, err := getCloudProviderConfig(worker.Name, worker.Spec.Location, network, settings)
+			if err != nil {
+				t.Fatalf("failed to get cloud provider config: %v", err)
+			}
+			var config CloudProviderConfig
+			if err := json.Unmarshal([]byte(data), &config); err != nil {
+				t.Fatalf("failed to parse cloud provider config: %v", err)
+			}
+
+			vnet := cluster.Spec.NetworkSpec.Vnet
+			if vnet.Name != tt.vnet || config.VnetName != tt.vnet {
+				t.Errorf("expected vnet %s, got %s in the cluster and %s in azure.json", tt.vnet, vnet.Name, config.VnetName)
+			}
+			if vnet.ResourceGroup != tt.vnetGroup || config.VnetResourceGroup != tt.vnetGroup {
+				t.Errorf("expected vnet resource group %s, got %s in the cluster and %s in azure.json",
+					tt.vnetGroup, vnet.ResourceGroup, config.VnetResourceGroup)
+			}
+			if vnet.ID != tt.vnetID || vnet.IsManaged(cluster.Name) != (tt.vnetID == "") {
+				t.Errorf("expected vnet id %q, got %q", tt.vnetID, vnet.ID)
+			}
+			if config.ResourceGroup != cluster.Spec.ResourceGroup {
+				t.Errorf("expected resource group %s in azure.json, got %s", cluster.Spec.ResourceGroup, config.ResourceGroup)
+			}
+
+			node := subnetByRole(cluster.Spec.NetworkSpec.Subnets, capzv1alpha3.SubnetNode)
+			if node == nil || node.Name != tt.nodeSubnet || config.SubnetName != tt.nodeSubnet {
+				t.Fatalf("expected node subnet %s, got %+v in the cluster and %s in azure.json", tt.nodeSubnet, node, config.SubnetName)
+			}
+			if node.SecurityGroup.Name != config.SecurityGroupName ||
+				config.SecurityGroupName != azure.GenerateNodeSecurityGroupName(cluster.Name) {
+				t.Errorf("expected node security group %s, got %s in the cluster and %s in azure.json",
+					azure.GenerateNodeSecurityGroupName(cluster.Name), node.SecurityGroup.Name, config.SecurityGroupName)
+			}
+			if config.RouteTableName != azure.GenerateNodeRouteTableName(cluster.Name) {
+				t.Errorf("expected route table %s in azure.json, got %s",
+					azure.GenerateNodeRouteTableName(cluster.Name), config.RouteTableName)
+			}
+
+			controlPlane := subnetByRole(cluster.Spec.NetworkSpec.Subnets, capzv1alpha3.SubnetControlPlane)
+			if controlPlane == nil || controlPlane.Name != tt.controlPlaneSubnet ||
+				controlPlane.SecurityGroup.Name != azure.GenerateControlPlaneSecurityGroupName(cluster.Name) {
+				t.Errorf("expected control plane subnet %s, got %+v", tt.controlPlaneSubnet, controlPlane)
+			}
+		})
+	}
+}
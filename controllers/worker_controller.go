@@ -19,6 +19,7 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
@@ -29,21 +30,39 @@ import (
 	capiv1alpha3 "sigs.k8s.io/cluster-api/api/v1alpha3"
 	capbkv1alpha3 "sigs.k8s.io/cluster-api/bootstrap/kubeadm/api/v1alpha3"
 	kcpv1alpha3 "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1alpha3"
-	"sigs.k8s.io/cluster-api/util/secret"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/addons"
 	"github.com/juan-lee/carp/internal/remote"
 )
 
+// workerNotReadyRequeue is how often a worker is rechecked while waiting for its providers
+const workerNotReadyRequeue = 30 * time.Second
+
 // WorkerReconciler reconciles a Worker object
 type WorkerReconciler struct {
 	client.Client
 	Log           logr.Logger
 	Scheme        *runtime.Scheme
 	AzureSettings map[string]string
+	// AgentImage is the carp image deployed to worker clusters as the agent
+	AgentImage string
+	// BusSecret is the secret holding the bus credentials given to agents, if any
+	BusSecret types.NamespacedName
+	// BusTransport is the bus transport agents use
+	BusTransport string
+	// BusRegion and BusEnvironment select the bus topic agents subscribe to
+	BusRegion      string
+	BusEnvironment string
+	// BusNATSURL is the NATS server agents connect to with the nats transport
+	BusNATSURL string
+	// BusProvisioning is how agents provision their service bus subscription
+	BusProvisioning string
+	// BusKeysSecret is the secret holding the bus keys given to agents, if any
+	BusKeysSecret types.NamespacedName
 }
 
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=workers,verbs=get;list;watch;create;update;patch;delete
@@ -55,6 +74,7 @@ type WorkerReconciler struct {
 // +kubebuilder:rbac:groups=bootstrap.cluster.x-k8s.io,resources=kubeadmconfigs;kubeadmconfigs/status,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machinedeployments;machinedeployments/status,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;patch
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
 
 func (r *WorkerReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
@@ -111,13 +131,29 @@ func (r *WorkerReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, reterr er
 
 	// need to handle update to capacity
 
+	// workers can't host control planes until capi, capz and the agent are running on them
+	if !worker.Status.IsConditionTrue(infrastructurev1alpha1.WorkerProvidersReady) ||
+		!worker.Status.IsConditionTrue(infrastructurev1alpha1.WorkerAgentReady) {
+		return ctrl.Result{RequeueAfter: workerNotReadyRequeue}, nil
+	}
+
 	worker.Status.Phase = infrastructurev1alpha1.WorkerRunning
 
 	return ctrl.Result{}, nil
 }
 
 func (r *WorkerReconciler) reconcileKubeadmControlPlane(ctx context.Context, worker *infrastructurev1alpha1.Worker) error {
-	template, err := getKubeadmControlPlane(worker.Name, worker.Spec.Location, r.AzureSettings)
+	replicas, err := getControlPlaneReplicas(worker)
+	if err != nil {
+		return err
+	}
+
+	network, err := getWorkerNetwork(worker)
+	if err != nil {
+		return err
+	}
+
+	template, err := getKubeadmControlPlane(worker.Name, worker.Spec.Location, replicas, network, r.AzureSettings)
 	if err != nil {
 		return fmt.Errorf("failed to get azure settings: %w", err)
 	}
@@ -130,7 +166,10 @@ func (r *WorkerReconciler) reconcileKubeadmControlPlane(ctx context.Context, wor
 	want := template.DeepCopy()
 
 	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, template, func() error {
-		template = want
+		// KCP only allows a subset of its spec to change after creation, so
+		// replicas are the only field carried over to an existing object.
+		// This is what scales the control plane up or down.
+		template.Spec.Replicas = want.Spec.Replicas
 		return nil
 	})
 
@@ -138,11 +177,18 @@ func (r *WorkerReconciler) reconcileKubeadmControlPlane(ctx context.Context, wor
 		return fmt.Errorf("failed to create/update kubeadm control plane: %w", err)
 	}
 
+	worker.Status.ControlPlaneReadyReplicas = template.Status.ReadyReplicas
+
 	return nil
 }
 
 func (r *WorkerReconciler) reconcileKubeadmConfigTemplate(ctx context.Context, worker *infrastructurev1alpha1.Worker) error {
-	template, err := getKubeadmConfigTemplate(worker.Name, worker.Spec.Location, r.AzureSettings)
+	network, err := getWorkerNetwork(worker)
+	if err != nil {
+		return err
+	}
+
+	template, err := getKubeadmConfigTemplate(worker.Name, worker.Spec.Location, network, r.AzureSettings)
 	if err != nil {
 		return fmt.Errorf("failed to get azure settings: %w", err)
 	}
@@ -209,7 +255,12 @@ func (r *WorkerReconciler) reconcileMachineDeployment(ctx context.Context, worke
 }
 
 func (r *WorkerReconciler) reconcileCluster(ctx context.Context, worker *infrastructurev1alpha1.Worker) error {
-	template := getCluster(worker.Name, worker.Spec.Location, r.AzureSettings)
+	network, err := getWorkerNetwork(worker)
+	if err != nil {
+		return err
+	}
+
+	template := getCluster(worker.Name, network)
 	template.Namespace = worker.Namespace
 
 	// TODO(ace): Verify -- I believe this is necessary because CreateOrUpdate does a get
@@ -217,7 +268,7 @@ func (r *WorkerReconciler) reconcileCluster(ctx context.Context, worker *infrast
 	// into the closure context.
 	want := template.DeepCopy()
 
-	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, template, func() error {
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, template, func() error {
 		template = want
 		return nil
 	})
@@ -230,7 +281,12 @@ func (r *WorkerReconciler) reconcileCluster(ctx context.Context, worker *infrast
 }
 
 func (r *WorkerReconciler) reconcileAzureCluster(ctx context.Context, worker *infrastructurev1alpha1.Worker) error {
-	template := getAzureCluster(worker.Name, worker.Spec.Location)
+	network, err := getWorkerNetwork(worker)
+	if err != nil {
+		return err
+	}
+
+	template := getAzureCluster(worker.Name, worker.Spec.Location, network, r.AzureSettings)
 	template.Namespace = worker.Namespace
 
 	// TODO(ace): Verify -- I believe this is necessary because CreateOrUpdate does a get
@@ -238,11 +294,17 @@ func (r *WorkerReconciler) reconcileAzureCluster(ctx context.Context, worker *in
 	// into the closure context.
 	want := template.DeepCopy()
 
-	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, template, func() error {
-		if err := controllerutil.SetControllerReference(worker, want, r.Scheme); err != nil {
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, template, func() error {
+		if err := controllerutil.SetControllerReference(worker, template, r.Scheme); err != nil {
 			return err
 		}
-		template = want
+		// The Azure provider fills in the rest of the vnet once it has found
+		// or created it, so only the fields carp decides are carried over.
+		template.Spec.NetworkSpec.Vnet.Name = want.Spec.NetworkSpec.Vnet.Name
+		template.Spec.NetworkSpec.Vnet.ResourceGroup = want.Spec.NetworkSpec.Vnet.ResourceGroup
+		if want.Spec.NetworkSpec.Vnet.ID != "" {
+			template.Spec.NetworkSpec.Vnet.ID = want.Spec.NetworkSpec.Vnet.ID
+		}
 		return nil
 	})
 
@@ -266,26 +328,9 @@ func (r *WorkerReconciler) reconcileExternal(ctx context.Context, worker *infras
 		return fmt.Errorf("failed to get azure manager secret to apply to cluster: %w", err)
 	}
 
-	// Fetch remove kubeconfig
-	kubeconfigSecret := &corev1.Secret{}
-	kubeconfigKey := types.NamespacedName{
-		Name:      fmt.Sprintf("%s-kubeconfig", worker.Name),
-		Namespace: worker.Namespace,
-	}
-
-	if err := r.Get(ctx, kubeconfigKey, kubeconfigSecret); err != nil {
-		return fmt.Errorf("failed to get remote kubeconfig to apply to cluster: %w", err)
-	}
-
-	data, ok := kubeconfigSecret.Data[secret.KubeconfigDataName]
-	if !ok {
-		return fmt.Errorf("missing key %q in secret data", secret.KubeconfigDataName)
-	}
-
-	// Construct a kubeclient with it
-	remoteClient, err := remote.NewClient(data)
+	remoteClient, err := getRemoteClient(ctx, r.Client, worker)
 	if err != nil {
-		return fmt.Errorf("failed to create REST configuration for worker %s/%s : %w", worker.Namespace, worker.Name, err)
+		return err
 	}
 
 	// Ensure existence of remote namespace
@@ -318,11 +363,226 @@ func (r *WorkerReconciler) reconcileExternal(ctx context.Context, worker *infras
 		return fmt.Errorf("failed to create remote azure manager secret")
 	}
 
-	_, _, err = remoteClient.Apply("https://raw.githubusercontent.com/juan-lee/cluster-api-provider-azure/hackathon/templates/addons/calico.yaml")
+	if err := r.reconcileCNI(ctx, worker, remoteClient); err != nil {
+		return err
+	}
+
+	if err := r.reconcileProviders(ctx, worker, remoteClient); err != nil {
+		return err
+	}
+
+	return r.reconcileAgent(ctx, worker, remoteClient)
+}
+
+func (r *WorkerReconciler) reconcileCNI(ctx context.Context, worker *infrastructurev1alpha1.Worker, remoteClient *remote.Client) error {
+	name := worker.Spec.CNI.Name
+	if name == "" {
+		name = infrastructurev1alpha1.CNICalico
+	}
+	if name == infrastructurev1alpha1.CNINone {
+		worker.Status.CNI = ""
+		return nil
+	}
+
+	network, err := getWorkerNetwork(worker)
+	if err != nil {
+		return err
+	}
+
+	addon, err := addons.Get(ctx, r.Client, worker.Namespace, string(name), worker.Spec.CNI.Version)
+	if err != nil {
+		return fmt.Errorf("failed to get %s manifest: %w", name, err)
+	}
+
+	manifest := addon.Render(map[string]string{
+		"POD_CIDR": network.PodCIDRBlocks[0],
+	})
+	if _, _, err := remoteClient.ApplyManifest(manifest); err != nil {
+		return fmt.Errorf("failed to apply %s config: %w", name, err)
+	}
+
+	worker.Status.CNI = fmt.Sprintf("%s/%s", addon.Name, addon.Version)
+
+	return nil
+}
+
+// reconcileProviders installs cert-manager, capi and capz onto the worker
+// cluster in order, waiting for each one's deployments to be ready before
+// moving on to the next since later providers depend on cert-manager's
+// webhooks.
+func (r *WorkerReconciler) reconcileProviders(ctx context.Context, worker *infrastructurev1alpha1.Worker, remoteClient *remote.Client) error {
+	providers := []struct {
+		name    string
+		version string
+	}{
+		{"cert-manager", worker.Spec.Providers.CertManager},
+		{"cluster-api", worker.Spec.Providers.ClusterAPI},
+		{"cluster-api-provider-azure", worker.Spec.Providers.Azure},
+	}
+
+	installed := make([]string, 0, len(providers))
+	for _, provider := range providers {
+		addon, err := addons.Get(ctx, r.Client, worker.Namespace, provider.name, provider.version)
+		if err != nil {
+			return fmt.Errorf("failed to get %s manifest: %w", provider.name, err)
+		}
+		manifest := []byte(addon.Manifest)
+		version := fmt.Sprintf("%s/%s", addon.Name, addon.Version)
+
+		// applying the providers is expensive, so skip it when this version
+		// was already applied and is still running. Anything else, such as a
+		// deployment deleted from the worker cluster, is re-applied.
+		ready := false
+		if containsString(worker.Status.Providers, version) {
+			if ready, err = remoteClient.Ready(ctx, manifest); err != nil {
+				return fmt.Errorf("failed to check %s readiness: %w", version, err)
+			}
+		}
+		if !ready {
+			if _, _, err := remoteClient.ApplyManifest(manifest); err != nil {
+				return fmt.Errorf("failed to apply %s: %w", version, err)
+			}
+			if ready, err = remoteClient.Ready(ctx, manifest); err != nil {
+				return fmt.Errorf("failed to check %s readiness: %w", version, err)
+			}
+		}
+		installed = append(installed, version)
+		worker.Status.Providers = installed
+
+		if !ready {
+			worker.Status.SetCondition(infrastructurev1alpha1.WorkerProvidersReady, corev1.ConditionFalse,
+				"WaitingForProvider", fmt.Sprintf("waiting for %s to become ready", version))
+			return nil
+		}
+	}
+
+	worker.Status.SetCondition(infrastructurev1alpha1.WorkerProvidersReady, corev1.ConditionTrue, "ProvidersRunning", "")
+
+	return nil
+}
 
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileAgent installs or upgrades the carp agent on the worker cluster,
+// along with the CRDs, RBAC and bus credentials it needs.
+func (r *WorkerReconciler) reconcileAgent(ctx context.Context, worker *infrastructurev1alpha1.Worker, remoteClient *remote.Client) error {
+	crds, err := addons.Get(ctx, r.Client, worker.Namespace, "carp-crds", "v1alpha1")
 	if err != nil {
-		return fmt.Errorf("failed to apply calico config: %w", err)
+		return fmt.Errorf("failed to get carp crds: %w", err)
+	}
+	if _, _, err := remoteClient.ApplyManifest([]byte(crds.Manifest)); err != nil {
+		return fmt.Errorf("failed to apply carp crds: %w", err)
+	}
+
+	namespace := getAgentNamespace()
+	if _, err := controllerutil.CreateOrUpdate(ctx, remoteClient, namespace, func() error {
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to create remote agent namespace: %w", err)
+	}
+
+	serviceAccount := getAgentServiceAccount()
+	if _, err := controllerutil.CreateOrUpdate(ctx, remoteClient, serviceAccount, func() error {
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to create remote agent service account: %w", err)
 	}
 
+	role := getAgentClusterRole()
+	wantRole := role.DeepCopy()
+	if _, err := controllerutil.CreateOrUpdate(ctx, remoteClient, role, func() error {
+		role.Rules = wantRole.Rules
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to create/update remote agent cluster role: %w", err)
+	}
+
+	binding := getAgentClusterRoleBinding()
+	wantBinding := binding.DeepCopy()
+	if _, err := controllerutil.CreateOrUpdate(ctx, remoteClient, binding, func() error {
+		binding.Subjects = wantBinding.Subjects
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to create/update remote agent cluster role binding: %w", err)
+	}
+
+	if r.BusSecret.Name != "" {
+		busSecret := &corev1.Secret{}
+		if err := r.Get(ctx, r.BusSecret, busSecret); err != nil {
+			return fmt.Errorf("failed to get bus credentials to apply to cluster: %w", err)
+		}
+
+		// Create fresh copy to avoid copying stuff like UID, resourceVersion
+		remoteSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      agentBusSecretName,
+				Namespace: agentNamespace,
+			},
+		}
+		if _, err := controllerutil.CreateOrUpdate(ctx, remoteClient, remoteSecret, func() error {
+			remoteSecret.Data = busSecret.Data
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to create/update remote bus credentials: %w", err)
+		}
+	}
+
+	if r.BusKeysSecret.Name != "" {
+		keys := &corev1.Secret{}
+		if err := r.Get(ctx, r.BusKeysSecret, keys); err != nil {
+			return fmt.Errorf("failed to get bus keys to apply to cluster: %w", err)
+		}
+
+		remoteKeys := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      agentBusKeysSecretName,
+				Namespace: agentNamespace,
+			},
+		}
+		if _, err := controllerutil.CreateOrUpdate(ctx, remoteClient, remoteKeys, func() error {
+			remoteKeys.Data = keys.Data
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to create/update remote bus keys: %w", err)
+		}
+	}
+
+	deployment := getAgentDeployment(worker, r.AgentImage, agentBus{
+		transport:    r.BusTransport,
+		region:       r.BusRegion,
+		environment:  r.BusEnvironment,
+		natsURL:      r.BusNATSURL,
+		provisioning: r.BusProvisioning,
+		keys:         r.BusKeysSecret.Name != "",
+	})
+	want := deployment.DeepCopy()
+	if _, err := controllerutil.CreateOrUpdate(ctx, remoteClient, deployment, func() error {
+		deployment.Spec.Replicas = want.Spec.Replicas
+		deployment.Spec.Template = want.Spec.Template
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to create/update remote agent deployment: %w", err)
+	}
+
+	// the status is only trustworthy once the deployment controller has seen the latest spec
+	rolledOut := deployment.Status.ObservedGeneration >= deployment.Generation &&
+		deployment.Status.UpdatedReplicas == *want.Spec.Replicas &&
+		deployment.Status.AvailableReplicas == *want.Spec.Replicas
+	if !rolledOut {
+		worker.Status.SetCondition(infrastructurev1alpha1.WorkerAgentReady, corev1.ConditionFalse,
+			"WaitingForAgent", fmt.Sprintf("waiting for agent %s to roll out", r.AgentImage))
+		return nil
+	}
+
+	worker.Status.AgentVersion = getImageTag(r.AgentImage)
+	worker.Status.SetCondition(infrastructurev1alpha1.WorkerAgentReady, corev1.ConditionTrue, "AgentRunning", "")
+
 	return nil
 }
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kcpv1alpha3 "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1alpha3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+)
+
+func TestReconcileKubeadmControlPlaneScalesExistingControlPlane(t *testing.T) {
+	existing := &kcpv1alpha3.KubeadmControlPlane{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "worker-a"},
+		Spec: kcpv1alpha3.KubeadmControlPlaneSpec{
+			Replicas: to.Int32Ptr(1),
+			Version:  "v1.17.4",
+		},
+	}
+	r := &WorkerReconciler{
+		Client: newFakeClient(t, existing),
+		Log:    zap.New(zap.UseDevMode(true)),
+	}
+	worker := &infrastructurev1alpha1.Worker{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "worker-a"},
+		Spec: infrastructurev1alpha1.WorkerSpec{
+			Location:             "eastus",
+			ControlPlaneReplicas: to.Int32Ptr(3),
+		},
+	}
+
+	ctx := context.Background()
+	if err := r.reconcileKubeadmControlPlane(ctx, worker); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	var got kcpv1alpha3.KubeadmControlPlane
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "worker-a"}, &got); err != nil {
+		t.Fatalf("failed to get control plane: %v", err)
+	}
+	if got.Spec.Replicas == nil || *got.Spec.Replicas != 3 {
+		t.Errorf("expected the control plane to be scaled to 3 replicas, got %v", got.Spec.Replicas)
+	}
+}
+
+func TestAgentClusterRoleCannotDeleteCoreResources(t *testing.T) {
+	for _, rule := range getAgentClusterRole().Rules {
+		core := false
+		for _, group := range rule.APIGroups {
+			core = core || group == ""
+		}
+		if !core {
+			continue
+		}
+		for _, verb := range rule.Verbs {
+			if verb == "*" || verb == "delete" || verb == "deletecollection" {
+				t.Errorf("expected the agent not to %s core %v", verb, rule.Resources)
+			}
+		}
+	}
+}
@@ -0,0 +1,288 @@
+/*
+Copyright 2020 Juan-Lee Pang.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License. You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied. See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/addons"
+)
+
+// workerAddonResyncPeriod is how often addons in Reconcile mode are reapplied to correct drift
+const workerAddonResyncPeriod = 5 * time.Minute
+
+// WorkerAddonReconciler reconciles a WorkerAddon object
+type WorkerAddonReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// remoteClient returns the client of a worker's cluster, defaulting to
+	// one built from the worker's kubeconfig secret
+	remoteClient func(ctx context.Context, worker *infrastructurev1alpha1.Worker) (addonApplier, error)
+}
+
+// addonApplier applies manifests to a worker's cluster and checks their health.
+type addonApplier interface {
+	ApplyManifest(manifest []byte) (stdout *bytes.Buffer, stderr *bytes.Buffer, err error)
+	Ready(ctx context.Context, manifest []byte) (bool, error)
+}
+
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=workeraddons,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=workeraddons/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=core,resources=configmaps;secrets,verbs=get;list;watch
+
+func (r *WorkerAddonReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&infrastructurev1alpha1.WorkerAddon{}).
+		Watches(&source.Kind{Type: &infrastructurev1alpha1.Worker{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.workerToAddons),
+		}).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.sourceToAddons),
+		}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.sourceToAddons),
+		}).
+		Complete(r)
+}
+
+func (r *WorkerAddonReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, reterr error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("workeraddon", req.NamespacedName)
+
+	var addon infrastructurev1alpha1.WorkerAddon
+	if err := r.Get(ctx, req.NamespacedName, &addon); err != nil {
+		log.Error(err, "unable to fetch worker addon")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if !addon.ObjectMeta.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	manifest, err := r.getManifest(ctx, &addon)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to get worker addon manifests: %w", err)
+	}
+	revision := fmt.Sprintf("%x", sha256.Sum256(manifest))[:10]
+
+	selector, err := metav1.LabelSelectorAsSelector(&addon.Spec.WorkerSelector)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("invalid worker selector: %w", err)
+	}
+
+	var workers infrastructurev1alpha1.WorkerList
+	if err := r.List(ctx, &workers, client.InNamespace(addon.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to list workers: %w", err)
+	}
+
+	defer func() {
+		if err := r.Status().Update(ctx, &addon); err != nil && reterr == nil {
+			log.Error(err, "failed to update worker addon status")
+			reterr = err
+		}
+	}()
+
+	previous := map[string]infrastructurev1alpha1.WorkerAddonWorkerStatus{}
+	for _, status := range addon.Status.Workers {
+		previous[status.Name] = status
+	}
+
+	var errs []error
+	statuses := make([]infrastructurev1alpha1.WorkerAddonWorkerStatus, 0, len(workers.Items))
+	for i := range workers.Items {
+		worker := &workers.Items[i]
+		status := previous[worker.Name]
+		status.Name = worker.Name
+
+		// the worker's kubeconfig isn't usable until it's running
+		if worker.Status.Phase == infrastructurev1alpha1.WorkerRunning {
+			if err := r.reconcileWorker(ctx, &addon, worker, manifest, revision, &status); err != nil {
+				log.Error(err, "failed to apply worker addon", "worker", worker.Name)
+				errs = append(errs, err)
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	addon.Status.Workers = statuses
+
+	if err := kerrors.NewAggregate(errs); err != nil {
+		return ctrl.Result{}, err
+	}
+	if addon.Spec.Mode == infrastructurev1alpha1.WorkerAddonApplyOnce {
+		return ctrl.Result{}, nil
+	}
+	return ctrl.Result{RequeueAfter: workerAddonResyncPeriod}, nil
+}
+
+func (r *WorkerAddonReconciler) reconcileWorker(
+	ctx context.Context,
+	addon *infrastructurev1alpha1.WorkerAddon,
+	worker *infrastructurev1alpha1.Worker,
+	manifest []byte,
+	revision string,
+	status *infrastructurev1alpha1.WorkerAddonWorkerStatus) (reterr error) {
+	defer func() {
+		status.Error = ""
+		if reterr != nil {
+			status.Healthy = false
+			status.Error = reterr.Error()
+		}
+	}()
+
+	remoteClient, err := r.getRemoteClient(ctx, worker)
+	if err != nil {
+		return err
+	}
+
+	// ApplyOnce addons are never reapplied, even if their manifests change
+	if addon.Spec.Mode != infrastructurev1alpha1.WorkerAddonApplyOnce || status.Revision == "" {
+		if _, stderr, err := remoteClient.ApplyManifest(manifest); err != nil {
+			return fmt.Errorf("failed to apply manifests to worker %s: %w: %s", worker.Name, err, stderr)
+		}
+		status.Revision = revision
+		status.LastAppliedTime = metav1.Now()
+	}
+
+	healthy, err := remoteClient.Ready(ctx, manifest)
+	if err != nil {
+		return fmt.Errorf("failed to check addon health on worker %s: %w", worker.Name, err)
+	}
+	status.Healthy = healthy
+
+	return nil
+}
+
+func (r *WorkerAddonReconciler) getRemoteClient(ctx context.Context, worker *infrastructurev1alpha1.Worker) (addonApplier, error) {
+	if r.remoteClient != nil {
+		return r.remoteClient(ctx, worker)
+	}
+	return getRemoteClient(ctx, r.Client, worker)
+}
+
+// getManifest resolves every manifest source of the addon into a single multi-document manifest
+func (r *WorkerAddonReconciler) getManifest(ctx context.Context, addon *infrastructurev1alpha1.WorkerAddon) ([]byte, error) {
+	var manifest []byte
+	for i, source := range addon.Spec.Manifests {
+		var data string
+		switch {
+		case source.Inline != "":
+			data = source.Inline
+		case source.ConfigMapRef != nil:
+			var cm corev1.ConfigMap
+			key := types.NamespacedName{Namespace: addon.Namespace, Name: source.ConfigMapRef.Name}
+			if err := r.Get(ctx, key, &cm); err != nil {
+				return nil, fmt.Errorf("failed to get configmap %s: %w", key, err)
+			}
+			dataKey := manifestKey(source.ConfigMapRef)
+			var ok bool
+			if data, ok = cm.Data[dataKey]; !ok {
+				return nil, fmt.Errorf("missing key %q in configmap %s", dataKey, key)
+			}
+		case source.SecretRef != nil:
+			var s corev1.Secret
+			key := types.NamespacedName{Namespace: addon.Namespace, Name: source.SecretRef.Name}
+			if err := r.Get(ctx, key, &s); err != nil {
+				return nil, fmt.Errorf("failed to get secret %s: %w", key, err)
+			}
+			dataKey := manifestKey(source.SecretRef)
+			b, ok := s.Data[dataKey]
+			if !ok {
+				return nil, fmt.Errorf("missing key %q in secret %s", dataKey, key)
+			}
+			data = string(b)
+		default:
+			return nil, fmt.Errorf("manifest %d has no source", i)
+		}
+		manifest = append(manifest, "\n---\n"...)
+		manifest = append(manifest, data...)
+	}
+	return manifest, nil
+}
+
+func (r *WorkerAddonReconciler) workerToAddons(o handler.MapObject) []ctrl.Request {
+	var list infrastructurev1alpha1.WorkerAddonList
+	if err := r.List(context.Background(), &list, client.InNamespace(o.Meta.GetNamespace())); err != nil {
+		r.Log.Error(err, "unable to list worker addons")
+		return nil
+	}
+
+	var requests []ctrl.Request
+	for i := range list.Items {
+		selector, err := metav1.LabelSelectorAsSelector(&list.Items[i].Spec.WorkerSelector)
+		if err != nil || !selector.Matches(labels.Set(o.Meta.GetLabels())) {
+			continue
+		}
+		requests = append(requests, ctrl.Request{
+			NamespacedName: types.NamespacedName{Namespace: list.Items[i].Namespace, Name: list.Items[i].Name},
+		})
+	}
+	return requests
+}
+
+// sourceToAddons maps a ConfigMap or Secret to the addons in its namespace
+// whose manifests reference it, so changed manifests are applied without
+// waiting for the resync.
+func (r *WorkerAddonReconciler) sourceToAddons(o handler.MapObject) []ctrl.Request {
+	var list infrastructurev1alpha1.WorkerAddonList
+	if err := r.List(context.Background(), &list, client.InNamespace(o.Meta.GetNamespace())); err != nil {
+		r.Log.Error(err, "unable to list worker addons")
+		return nil
+	}
+
+	_, isSecret := o.Object.(*corev1.Secret)
+	var requests []ctrl.Request
+	for i := range list.Items {
+		for _, source := range list.Items[i].Spec.Manifests {
+			ref := source.ConfigMapRef
+			if isSecret {
+				ref = source.SecretRef
+			}
+			if ref != nil && ref.Name == o.Meta.GetName() {
+				requests = append(requests, ctrl.Request{
+					NamespacedName: types.NamespacedName{Namespace: list.Items[i].Namespace, Name: list.Items[i].Name},
+				})
+				break
+			}
+		}
+	}
+	return requests
+}
+
+func manifestKey(ref *infrastructurev1alpha1.WorkerAddonManifestRef) string {
+	if ref.Key == "" {
+		return addons.ManifestKey
+	}
+	return ref.Key
+}
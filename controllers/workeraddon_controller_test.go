@@ -0,0 +1,248 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+)
+
+// fakeApplier records the manifests applied to a worker.
+type fakeApplier struct {
+	applied  []string
+	ready    bool
+	applyErr error
+}
+
+func (a *fakeApplier) ApplyManifest(manifest []byte) (*bytes.Buffer, *bytes.Buffer, error) {
+	if a.applyErr != nil {
+		return nil, bytes.NewBufferString("rejected"), a.applyErr
+	}
+	a.applied = append(a.applied, string(manifest))
+	return &bytes.Buffer{}, &bytes.Buffer{}, nil
+}
+
+func (a *fakeApplier) Ready(ctx context.Context, manifest []byte) (bool, error) {
+	return a.ready, nil
+}
+
+func workerAddon(mode infrastructurev1alpha1.WorkerAddonMode) *infrastructurev1alpha1.WorkerAddon {
+	return &infrastructurev1alpha1.WorkerAddon{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "monitoring"},
+		Spec: infrastructurev1alpha1.WorkerAddonSpec{
+			WorkerSelector: metav1.LabelSelector{MatchLabels: map[string]string{"tier": "prod"}},
+			Mode:           mode,
+			Manifests: []infrastructurev1alpha1.WorkerAddonManifest{
+				{ConfigMapRef: &infrastructurev1alpha1.WorkerAddonManifestRef{Name: "monitoring"}},
+			},
+		},
+	}
+}
+
+func manifestConfigMap(manifest string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "monitoring"},
+		Data:       map[string]string{"manifest.yaml": manifest},
+	}
+}
+
+// newWorkerAddonReconciler returns a reconciler applying addons to a fake
+// applier per worker.
+func newWorkerAddonReconciler(t *testing.T, appliers map[string]*fakeApplier, objs ...runtime.Object) *WorkerAddonReconciler {
+	t.Helper()
+	return &WorkerAddonReconciler{
+		Client: newFakeClient(t, objs...),
+		Log:    zap.New(zap.UseDevMode(true)),
+		remoteClient: func(ctx context.Context, worker *infrastructurev1alpha1.Worker) (addonApplier, error) {
+			a, ok := appliers[worker.Name]
+			if !ok {
+				t.Fatalf("unexpected worker %s", worker.Name)
+			}
+			return a, nil
+		},
+	}
+}
+
+// reconcileAddon reconciles the monitoring addon and returns its worker statuses by name.
+func reconcileAddon(t *testing.T, r *WorkerAddonReconciler) (ctrl.Result, map[string]infrastructurev1alpha1.WorkerAddonWorkerStatus, error) {
+	t.Helper()
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "monitoring"}}
+	result, err := r.Reconcile(req)
+	var addon infrastructurev1alpha1.WorkerAddon
+	if getErr := r.Get(context.Background(), req.NamespacedName, &addon); getErr != nil {
+		t.Fatalf("failed to get worker addon: %v", getErr)
+	}
+	statuses := map[string]infrastructurev1alpha1.WorkerAddonWorkerStatus{}
+	for _, status := range addon.Status.Workers {
+		statuses[status.Name] = status
+	}
+	return result, statuses, err
+}
+
+func updateManifest(t *testing.T, r *WorkerAddonReconciler, manifest string) {
+	t.Helper()
+	var cm corev1.ConfigMap
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "monitoring"}, &cm); err != nil {
+		t.Fatalf("failed to get configmap: %v", err)
+	}
+	cm.Data["manifest.yaml"] = manifest
+	if err := r.Update(context.Background(), &cm); err != nil {
+		t.Fatalf("failed to update configmap: %v", err)
+	}
+}
+
+func TestWorkerAddonModes(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        infrastructurev1alpha1.WorkerAddonMode
+		wantApplied int
+		wantNewRev  bool
+		wantResync  bool
+	}{
+		{name: "reconcile", mode: infrastructurev1alpha1.WorkerAddonReconcile, wantApplied: 3, wantNewRev: true, wantResync: true},
+		{name: "default is reconcile", wantApplied: 3, wantNewRev: true, wantResync: true},
+		{name: "apply once", mode: infrastructurev1alpha1.WorkerAddonApplyOnce, wantApplied: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applier := &fakeApplier{ready: true}
+			r := newWorkerAddonReconciler(t, map[string]*fakeApplier{"east-prod": applier},
+				workerAddon(tt.mode),
+				manifestConfigMap("kind: Namespace"),
+				runningWorker("east-prod", "eastus", map[string]string{"tier": "prod"}),
+			)
+
+			result, statuses, err := reconcileAddon(t, r)
+			if err != nil {
+				t.Fatalf("reconcile failed: %v", err)
+			}
+			if (result.RequeueAfter == workerAddonResyncPeriod) != tt.wantResync {
+				t.Errorf("expected resync %v, got requeue after %v", tt.wantResync, result.RequeueAfter)
+			}
+			first := statuses["east-prod"].Revision
+			if first == "" || !statuses["east-prod"].Healthy {
+				t.Fatalf("expected the addon to be applied and healthy, got %+v", statuses["east-prod"])
+			}
+
+			// reconciling an unchanged manifest only reapplies in reconcile mode
+			if _, _, err := reconcileAddon(t, r); err != nil {
+				t.Fatalf("reconcile failed: %v", err)
+			}
+			updateManifest(t, r, "kind: Namespace\nmetadata:\n  name: monitoring")
+			_, statuses, err = reconcileAddon(t, r)
+			if err != nil {
+				t.Fatalf("reconcile failed: %v", err)
+			}
+			if len(applier.applied) != tt.wantApplied {
+				t.Errorf("expected %d applies, got %d", tt.wantApplied, len(applier.applied))
+			}
+			if changed := statuses["east-prod"].Revision != first; changed != tt.wantNewRev {
+				t.Errorf("expected revision change %v, got %s then %s", tt.wantNewRev, first, statuses["east-prod"].Revision)
+			}
+		})
+	}
+}
+
+func TestWorkerAddonAppliesToSelectedRunningWorkers(t *testing.T) {
+	pending := runningWorker("west-prod", "westus", map[string]string{"tier": "prod"})
+	pending.Status.Phase = infrastructurev1alpha1.WorkerPending
+	appliers := map[string]*fakeApplier{"east-prod": {ready: true}}
+	r := newWorkerAddonReconciler(t, appliers,
+		workerAddon(infrastructurev1alpha1.WorkerAddonReconcile),
+		manifestConfigMap("kind: Namespace"),
+		runningWorker("east-prod", "eastus", map[string]string{"tier": "prod"}),
+		runningWorker("east-dev", "eastus", map[string]string{"tier": "dev"}),
+		pending,
+	)
+
+	_, statuses, err := reconcileAddon(t, r)
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("expected the prod workers to be selected, got %+v", statuses)
+	}
+	if statuses["east-prod"].Revision == "" || len(appliers["east-prod"].applied) != 1 {
+		t.Errorf("expected the addon to be applied to east-prod, got %+v", statuses["east-prod"])
+	}
+	if statuses["west-prod"].Revision != "" {
+		t.Errorf("expected the addon not to be applied to the pending worker, got %+v", statuses["west-prod"])
+	}
+}
+
+func TestWorkerAddonReportsHealth(t *testing.T) {
+	tests := []struct {
+		name        string
+		applier     *fakeApplier
+		wantHealthy bool
+		wantErr     bool
+	}{
+		{name: "ready", applier: &fakeApplier{ready: true}, wantHealthy: true},
+		{name: "not ready", applier: &fakeApplier{}},
+		{name: "apply fails", applier: &fakeApplier{ready: true, applyErr: errors.New("invalid manifest")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newWorkerAddonReconciler(t, map[string]*fakeApplier{"east-prod": tt.applier},
+				workerAddon(infrastructurev1alpha1.WorkerAddonReconcile),
+				manifestConfigMap("kind: Namespace"),
+				runningWorker("east-prod", "eastus", map[string]string{"tier": "prod"}),
+			)
+
+			_, statuses, err := reconcileAddon(t, r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			status := statuses["east-prod"]
+			if status.Healthy != tt.wantHealthy || (status.Error != "") != tt.wantErr {
+				t.Errorf("expected healthy %v and error %v, got %+v", tt.wantHealthy, tt.wantErr, status)
+			}
+		})
+	}
+}
+
+func TestWorkerAddonWatchMapping(t *testing.T) {
+	addon := workerAddon(infrastructurev1alpha1.WorkerAddonReconcile)
+	addon.Spec.Manifests = append(addon.Spec.Manifests, infrastructurev1alpha1.WorkerAddonManifest{
+		SecretRef: &infrastructurev1alpha1.WorkerAddonManifestRef{Name: "credentials"},
+	})
+	r := newWorkerAddonReconciler(t, nil, addon)
+	mapObject := func(o runtime.Object) handler.MapObject {
+		return handler.MapObject{Meta: o.(metav1.Object), Object: o}
+	}
+
+	tests := []struct {
+		name   string
+		toReqs func(handler.MapObject) []ctrl.Request
+		object runtime.Object
+		want   int
+	}{
+		{name: "selected worker", toReqs: r.workerToAddons, object: runningWorker("east-prod", "eastus", map[string]string{"tier": "prod"}), want: 1},
+		{name: "unselected worker", toReqs: r.workerToAddons, object: runningWorker("east-dev", "eastus", map[string]string{"tier": "dev"})},
+		{name: "referenced configmap", toReqs: r.sourceToAddons, object: manifestConfigMap(""), want: 1},
+		{name: "referenced secret", toReqs: r.sourceToAddons, object: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "credentials"}}, want: 1},
+		{name: "configmap named like a secret", toReqs: r.sourceToAddons, object: &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "credentials"}}},
+		{name: "other namespace", toReqs: r.sourceToAddons, object: &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "monitoring"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := tt.toReqs(mapObject(tt.object))
+			if len(requests) != tt.want {
+				t.Fatalf("expected %d requests, got %v", tt.want, requests)
+			}
+			if tt.want > 0 && requests[0].Name != "monitoring" {
+				t.Errorf("expected the monitoring addon, got %v", requests[0])
+			}
+		})
+	}
+}
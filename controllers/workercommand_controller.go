@@ -0,0 +1,139 @@
+/*
+Copyright 2020 Juan-Lee Pang.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License. You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied. See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+// WorkerCommandReconciler broadcasts WorkerCommands to the workers matching
+// their selector and tracks the acknowledgement of every recipient. The
+// acknowledgements are recorded by the status subscriber.
+type WorkerCommandReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// Publisher broadcasts the commands. Commands are staged in the
+	// command's outbox and published by an OutboxRelay. Commands are not
+	// broadcast when it is nil.
+	Publisher bus.Publisher
+}
+
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=workercommands,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=workercommands/status,verbs=get;update;patch
+
+func (r *WorkerCommandReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Publisher != nil {
+		if err := (&OutboxRelay{
+			Client:    r.Client,
+			Log:       r.Log.WithName("outbox"),
+			Publisher: r.Publisher,
+			For:       &infrastructurev1alpha1.WorkerCommand{},
+		}).SetupWithManager(mgr); err != nil {
+			return fmt.Errorf("failed to set up outbox relay: %w", err)
+		}
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&infrastructurev1alpha1.WorkerCommand{}).
+		Complete(r)
+}
+
+// Reconcile broadcasts a new command once. The recipients are the running
+// workers matching the selector at that time; workers added later don't
+// receive it.
+func (r *WorkerCommandReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("workercommand", req.NamespacedName)
+
+	var wc infrastructurev1alpha1.WorkerCommand
+	if err := r.Get(ctx, req.NamespacedName, &wc); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if wc.Status.CommandID != "" || !wc.DeletionTimestamp.IsZero() || r.Publisher == nil {
+		return ctrl.Result{}, nil
+	}
+
+	recipients, err := r.recipients(ctx, &wc)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	command := messages.Command{
+		Id:            uuid.New(),
+		DestinationId: messages.BroadcastId,
+		Selector:      messages.Selector(wc.Spec.Selector),
+	}
+	var message messages.Message
+	switch wc.Spec.Type {
+	case infrastructurev1alpha1.WorkerCommandReportInventory:
+		message = workers.ReportInventory{Command: command}
+	case infrastructurev1alpha1.WorkerCommandRotateCredentials:
+		message = workers.RotateCredentials{Command: command}
+	default:
+		log.Info("ignoring command of unknown type", "type", wc.Spec.Type)
+		return ctrl.Result{}, nil
+	}
+	if len(recipients) > 0 {
+		if err := stageMessage(&wc, message); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	wc.Status.CommandID = command.Id.String()
+	wc.Status.Recipients = recipients
+	wc.Status.UpdatePhase()
+	if err := r.Status().Update(ctx, &wc); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to update worker command status: %w", err)
+	}
+
+	log.Info("broadcast worker command", "command", command.Id, "type", wc.Spec.Type, "recipients", recipients)
+	return ctrl.Result{}, nil
+}
+
+// recipients returns the names of the running workers whose labels match the
+// command's selector.
+func (r *WorkerCommandReconciler) recipients(ctx context.Context, wc *infrastructurev1alpha1.WorkerCommand) ([]string, error) {
+	var list infrastructurev1alpha1.WorkerList
+	if err := r.List(ctx, &list, client.InNamespace(wc.Namespace)); err != nil {
+		return nil, fmt.Errorf("unable to list workers: %w", err)
+	}
+
+	recipients := []string{}
+	for i := range list.Items {
+		worker := &list.Items[i]
+		if worker.Status.Phase != infrastructurev1alpha1.WorkerRunning {
+			continue
+		}
+		if messages.Selector(wc.Spec.Selector).Matches(worker.RecipientLabels()) {
+			recipients = append(recipients, worker.Name)
+		}
+	}
+	return recipients, nil
+}
@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	infrastructurev1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus/bustest"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+func runningWorker(name, location string, labels map[string]string) *infrastructurev1alpha1.Worker {
+	return &infrastructurev1alpha1.Worker{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: labels},
+		Spec:       infrastructurev1alpha1.WorkerSpec{Location: location},
+		Status:     infrastructurev1alpha1.WorkerStatus{Phase: infrastructurev1alpha1.WorkerRunning},
+	}
+}
+
+func TestWorkerCommandBroadcastsToSelectedWorkers(t *testing.T) {
+	wc := &infrastructurev1alpha1.WorkerCommand{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "inventory"},
+		Spec: infrastructurev1alpha1.WorkerCommandSpec{
+			Type:     infrastructurev1alpha1.WorkerCommandReportInventory,
+			Selector: map[string]string{infrastructurev1alpha1.WorkerRegionLabel: "eastus", "tier": "prod"},
+		},
+	}
+	pending := runningWorker("pending", "eastus", map[string]string{"tier": "prod"})
+	pending.Status.Phase = infrastructurev1alpha1.WorkerPending
+	r := &WorkerCommandReconciler{
+		Client: newFakeClient(t,
+			wc,
+			runningWorker("east-prod", "eastus", map[string]string{"tier": "prod"}),
+			runningWorker("east-dev", "eastus", map[string]string{"tier": "dev"}),
+			runningWorker("west-prod", "westus", map[string]string{"tier": "prod"}),
+			pending,
+		),
+		Log:       zap.New(zap.UseDevMode(true)),
+		Publisher: &bustest.RecordingPublisher{},
+	}
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "inventory"}}
+
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	var got infrastructurev1alpha1.WorkerCommand
+	if err := r.Get(context.Background(), req.NamespacedName, &got); err != nil {
+		t.Fatalf("failed to get worker command: %v", err)
+	}
+	if got.Status.Phase != infrastructurev1alpha1.WorkerCommandPending ||
+		len(got.Status.Recipients) != 1 || got.Status.Recipients[0] != "east-prod" {
+		t.Fatalf("expected east-prod to be the pending recipient, got %+v", got.Status)
+	}
+	if len(got.Status.Outbox) != 1 {
+		t.Fatalf("expected the command to be staged, got %v", got.Status.Outbox)
+	}
+	message, err := decodeOutboxEntry(got.Status.Outbox[0])
+	if err != nil {
+		t.Fatalf("failed to decode staged command: %v", err)
+	}
+	cmd, ok := message.(*workers.ReportInventory)
+	if !ok || cmd.Id.String() != got.Status.CommandID || cmd.DestinationId != messages.BroadcastId ||
+		!cmd.Selector.Matches(map[string]string{infrastructurev1alpha1.WorkerRegionLabel: "eastus", "tier": "prod"}) ||
+		cmd.Selector.Matches(map[string]string{infrastructurev1alpha1.WorkerRegionLabel: "westus", "tier": "prod"}) {
+		t.Fatalf("expected a broadcast selecting eastus prod workers, got %+v", message)
+	}
+
+	// the command is only broadcast once
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	var again infrastructurev1alpha1.WorkerCommand
+	if err := r.Get(context.Background(), req.NamespacedName, &again); err != nil {
+		t.Fatalf("failed to get worker command: %v", err)
+	}
+	if again.Status.CommandID != got.Status.CommandID || len(again.Status.Outbox) != 1 {
+		t.Fatalf("expected the command not to be broadcast again, got %+v", again.Status)
+	}
+}
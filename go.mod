@@ -4,13 +4,18 @@ go 1.14
 
 require (
 	github.com/Azure/azure-service-bus-go v0.10.0
+	github.com/Azure/go-amqp v0.12.6
+	github.com/Azure/go-autorest/autorest v0.10.0
 	github.com/Azure/go-autorest/autorest/azure/auth v0.4.2
 	github.com/Azure/go-autorest/autorest/to v0.3.0
 	github.com/apex/log v1.1.4
 	github.com/go-logr/logr v0.1.0
 	github.com/google/uuid v1.1.1
+	github.com/nats-io/nats-server/v2 v2.2.6
+	github.com/nats-io/nats.go v1.11.0
 	github.com/onsi/ginkgo v1.12.0
 	github.com/onsi/gomega v1.9.0
+	github.com/prometheus/client_golang v1.5.0
 	github.com/spf13/pflag v1.0.5
 	go.uber.org/zap v1.10.0
 	k8s.io/api v0.17.4
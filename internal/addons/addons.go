@@ -0,0 +1,81 @@
+package addons
+
+//go:generate go run gen_manifests.go
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// NameLabel selects ConfigMaps that provide an addon manifest
+	NameLabel = "addons.carp.cluster.x-k8s.io/name"
+
+	// VersionLabel is the addon version provided by a ConfigMap
+	VersionLabel = "addons.carp.cluster.x-k8s.io/version"
+
+	// ManifestKey is the ConfigMap data key holding the addon manifest
+	ManifestKey = "manifest.yaml"
+)
+
+// defaultVersions is the version used when an addon is requested without one
+var defaultVersions = map[string]string{
+	"calico":                     "v3.12.1",
+	"cert-manager":               "v0.14.2",
+	"cluster-api":                "v0.3.3",
+	"cluster-api-provider-azure": "v0.4.2",
+}
+
+// Addon is a versioned set of manifests to install on a remote cluster
+type Addon struct {
+	Name     string
+	Version  string
+	Manifest string
+}
+
+// Get returns the manifest for the named addon. ConfigMaps in namespace
+// labelled with NameLabel and VersionLabel take precedence over the manifests
+// embedded in the binary, which allows shipping new versions without a
+// rebuild. An empty version selects the default embedded version.
+func Get(ctx context.Context, c client.Client, namespace, name, version string) (*Addon, error) {
+	if version == "" {
+		version = defaultVersions[name]
+	}
+	if version == "" {
+		return nil, fmt.Errorf("no version specified for addon %s and no default is available; "+
+			"set a version and provide its manifest in a configmap labelled %s=%s and %s=<version>",
+			name, NameLabel, name, VersionLabel)
+	}
+
+	var configMaps corev1.ConfigMapList
+	if err := c.List(ctx, &configMaps,
+		client.InNamespace(namespace),
+		client.MatchingLabels{NameLabel: name, VersionLabel: version}); err != nil {
+		return nil, fmt.Errorf("failed to list addon configmaps: %w", err)
+	}
+	for i := range configMaps.Items {
+		if manifest, ok := configMaps.Items[i].Data[ManifestKey]; ok {
+			return &Addon{Name: name, Version: version, Manifest: manifest}, nil
+		}
+	}
+
+	manifest, ok := embedded[fmt.Sprintf("%s/%s", name, version)]
+	if !ok {
+		return nil, fmt.Errorf("addon %s version %s not found: no configmap in %s is labelled %s=%s and %s=%s, and none is embedded",
+			name, version, namespace, NameLabel, name, VersionLabel, version)
+	}
+	return &Addon{Name: name, Version: version, Manifest: manifest}, nil
+}
+
+// Render substitutes ${KEY} placeholders in the manifest with vars
+func (a *Addon) Render(vars map[string]string) []byte {
+	oldnew := make([]string, 0, len(vars)*2)
+	for k, v := range vars {
+		oldnew = append(oldnew, fmt.Sprintf("${%s}", k), v)
+	}
+	return []byte(strings.NewReplacer(oldnew...).Replace(a.Manifest))
+}
@@ -0,0 +1,106 @@
+package addons
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func addonConfigMap(namespace, name, version, manifest string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name + "-" + version,
+			Labels:    map[string]string{NameLabel: name, VersionLabel: version},
+		},
+		Data: map[string]string{ManifestKey: manifest},
+	}
+}
+
+func TestGet(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to build scheme: %v", err)
+	}
+	c := fake.NewFakeClientWithScheme(scheme,
+		addonConfigMap("carp-system", "calico", "v3.12.1", "overridden"),
+		addonConfigMap("carp-system", "calico", "v9.9.9", "shipped without a rebuild"),
+		addonConfigMap("other", "cert-manager", "v0.14.2", "other namespace"),
+		addonConfigMap("carp-system", "cilium", "v1.7.2", "cilium from a configmap"),
+	)
+
+	tests := []struct {
+		name, addon, version string
+		wantVersion          string
+		wantManifest         string
+		wantErr              bool
+	}{
+		{name: "configmap overrides embedded", addon: "calico", wantVersion: "v3.12.1", wantManifest: "overridden"},
+		{name: "configmap only version", addon: "calico", version: "v9.9.9", wantVersion: "v9.9.9", wantManifest: "shipped without a rebuild"},
+		{name: "default embedded version", addon: "cert-manager", wantVersion: "v0.14.2"},
+		{name: "explicit embedded version", addon: "cluster-api", version: "v0.3.3", wantVersion: "v0.3.3"},
+		{name: "unknown version", addon: "cert-manager", version: "v0.0.1", wantErr: true},
+		{name: "configmap only addon", addon: "cilium", version: "v1.7.2", wantVersion: "v1.7.2", wantManifest: "cilium from a configmap"},
+		{name: "configmap only addon without version", addon: "cilium", wantErr: true},
+		{name: "configmap only addon missing configmap", addon: "cilium", version: "v1.8.0", wantErr: true},
+		{name: "unknown addon", addon: "flannel", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addon, err := Get(context.Background(), c, "carp-system", tt.addon, tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if addon.Name != tt.addon || addon.Version != tt.wantVersion {
+				t.Errorf("expected %s %s, got %s %s", tt.addon, tt.wantVersion, addon.Name, addon.Version)
+			}
+			if tt.wantManifest != "" && addon.Manifest != tt.wantManifest {
+				t.Errorf("expected manifest %q, got %q", tt.wantManifest, addon.Manifest)
+			}
+			if tt.wantManifest == "" && addon.Manifest != embedded[tt.addon+"/"+tt.wantVersion] {
+				t.Errorf("expected the embedded manifest")
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		vars     map[string]string
+		want     string
+	}{
+		{name: "no vars", manifest: "cidr: ${POD_CIDR}", want: "cidr: ${POD_CIDR}"},
+		{name: "pod cidr", manifest: "cidr: ${POD_CIDR}", vars: map[string]string{"POD_CIDR": "10.0.0.0/16"}, want: "cidr: 10.0.0.0/16"},
+		{name: "repeated", manifest: "${A}-${A}", vars: map[string]string{"A": "x"}, want: "x-x"},
+		{name: "unbraced", manifest: "$POD_CIDR", vars: map[string]string{"POD_CIDR": "10.0.0.0/16"}, want: "$POD_CIDR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := (&Addon{Manifest: tt.manifest}).Render(tt.vars)
+			if string(got) != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRenderEmbeddedCalicoPodCIDR(t *testing.T) {
+	addon := &Addon{Name: "calico", Version: "v3.12.1", Manifest: embedded["calico/v3.12.1"]}
+	if !strings.Contains(addon.Manifest, "${POD_CIDR}") {
+		t.Fatalf("expected the calico manifest to have a POD_CIDR placeholder")
+	}
+	got := string(addon.Render(map[string]string{"POD_CIDR": "10.244.0.0/16"}))
+	if strings.Contains(got, "${POD_CIDR}") || !strings.Contains(got, "10.244.0.0/16") {
+		t.Errorf("expected the pod cidr to be substituted")
+	}
+}
@@ -0,0 +1,77 @@
+// +build ignore
+
+// gen_manifests embeds the manifests directory into zz_generated.manifests.go
+// so addons can be installed without network access.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func main() {
+	paths, err := filepath.Glob(filepath.Join("manifests", "*", "*.yaml"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Strings(paths)
+
+	header, err := ioutil.ReadFile(filepath.Join("..", "..", "hack", "boilerplate.go.txt"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// carp's own CRDs are shipped to workers for the agent
+	crds, err := filepath.Glob(filepath.Join("..", "..", "config", "crd", "bases", "*.yaml"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Strings(crds)
+	var crdManifest []byte
+	for _, path := range crds {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		crdManifest = append(crdManifest, data...)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(header)
+	buf.WriteString("\n\n// Code generated by gen_manifests.go. DO NOT EDIT.\n\n")
+	buf.WriteString("package addons\n\n")
+	buf.WriteString("var embedded = map[string]string{\n")
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rel, err := filepath.Rel("manifests", path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		writeEntry(&buf, strings.TrimSuffix(filepath.ToSlash(rel), ".yaml"), data)
+	}
+	writeEntry(&buf, "carp-crds/v1alpha1", crdManifest)
+	buf.WriteString("}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("zz_generated.manifests.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func writeEntry(buf *bytes.Buffer, key string, data []byte) {
+	// raw strings can't contain backticks, so splice them in as literals
+	literal := "`" + strings.ReplaceAll(string(data), "`", "` + \"`\" + `") + "`"
+	fmt.Fprintf(buf, "%q: %s,\n", key, literal)
+}
@@ -3,9 +3,15 @@ package azure
 import (
 	"fmt"
 
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
+	corev1 "k8s.io/api/core/v1"
 )
 
+// environmentKey is the optional key of a credentials secret naming the azure
+// cloud, such as AzureUSGovernmentCloud.
+const environmentKey = "environment-name"
+
 // GetSettings returns unstructured azure settings for the given environment
 func GetSettings() (map[string]string, error) {
 	file, fileErr := auth.GetSettingsFromFile()
@@ -14,7 +20,40 @@ func GetSettings() (map[string]string, error) {
 		if envErr != nil {
 			return nil, fmt.Errorf("failed to get settings from file: %s\n\n failed to get settings from environment: %s", fileErr.Error(), envErr.Error())
 		}
-		return env.Values, nil
+		return withEnvironment(env.Values), nil
+	}
+	return withEnvironment(file.Values), nil
+}
+
+// GetSettingsFromSecret returns unstructured azure settings from a capz
+// credentials secret, such as the one carp copies to each worker cluster
+func GetSettingsFromSecret(secret *corev1.Secret) (map[string]string, error) {
+	keys := map[string]string{
+		auth.SubscriptionID: "subscription-id",
+		auth.TenantID:       "tenant-id",
+		auth.ClientID:       "client-id",
+		auth.ClientSecret:   "client-secret",
+	}
+
+	settings := map[string]string{}
+	for setting, key := range keys {
+		value, ok := secret.Data[key]
+		if !ok {
+			return nil, fmt.Errorf("missing key %q in secret %s/%s", key, secret.Namespace, secret.Name)
+		}
+		settings[setting] = string(value)
+	}
+	if value, ok := secret.Data[environmentKey]; ok {
+		settings[auth.EnvironmentName] = string(value)
+	}
+	return withEnvironment(settings), nil
+}
+
+// withEnvironment defaults the environment name to the public cloud, which
+// autorest assumes when none is configured.
+func withEnvironment(settings map[string]string) map[string]string {
+	if settings[auth.EnvironmentName] == "" {
+		settings[auth.EnvironmentName] = azure.PublicCloud.Name
 	}
-	return file.Values, nil
+	return settings
 }
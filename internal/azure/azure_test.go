@@ -0,0 +1,53 @@
+package azure
+
+import (
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGetSettingsFromSecret(t *testing.T) {
+	credentials := map[string][]byte{
+		"subscription-id": []byte("subscription"),
+		"tenant-id":       []byte("tenant"),
+		"client-id":       []byte("client"),
+		"client-secret":   []byte("secret"),
+	}
+	withKey := func(key, value string) map[string][]byte {
+		data := map[string][]byte{key: []byte(value)}
+		for k, v := range credentials {
+			data[k] = v
+		}
+		return data
+	}
+
+	tests := []struct {
+		name            string
+		data            map[string][]byte
+		wantEnvironment string
+		wantErr         bool
+	}{
+		{name: "defaults to the public cloud", data: credentials, wantEnvironment: "AzurePublicCloud"},
+		{name: "named cloud", data: withKey("environment-name", "AzureUSGovernmentCloud"), wantEnvironment: "AzureUSGovernmentCloud"},
+		{name: "empty cloud", data: withKey("environment-name", ""), wantEnvironment: "AzurePublicCloud"},
+		{name: "missing key", data: map[string][]byte{"tenant-id": []byte("tenant")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := GetSettingsFromSecret(&corev1.Secret{Data: tt.data})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if settings[auth.EnvironmentName] != tt.wantEnvironment {
+				t.Errorf("expected environment %q, got %q", tt.wantEnvironment, settings[auth.EnvironmentName])
+			}
+			if settings[auth.ClientSecret] != "secret" {
+				t.Errorf("expected the client secret to be read, got %q", settings[auth.ClientSecret])
+			}
+		})
+	}
+}
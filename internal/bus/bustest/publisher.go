@@ -0,0 +1,29 @@
+// Package bustest provides fakes of the bus for tests.
+package bustest
+
+import (
+	"context"
+	"errors"
+
+	"github.com/juan-lee/carp/internal/messages"
+)
+
+// ErrUnavailable is returned by a RecordingPublisher while Fail is set.
+var ErrUnavailable = errors.New("bus unavailable")
+
+// RecordingPublisher is a bus.Publisher recording the messages it publishes.
+type RecordingPublisher struct {
+	// Published are the published messages in order.
+	Published []messages.Message
+	// Fail makes Publish fail with ErrUnavailable without recording the message.
+	Fail bool
+}
+
+// Publish records the message, or fails while Fail is set.
+func (p *RecordingPublisher) Publish(ctx context.Context, message messages.Message) error {
+	if p.Fail {
+		return ErrUnavailable
+	}
+	p.Published = append(p.Published, message)
+	return nil
+}
@@ -0,0 +1,225 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+
+	"github.com/juan-lee/carp/internal/messages"
+)
+
+// Service bus user properties holding why a message was dead-lettered.
+const (
+	deadLetterReasonProperty      = "DeadLetterReason"
+	deadLetterDescriptionProperty = "DeadLetterErrorDescription"
+)
+
+// receiveTimeout is how long dead-letter operations wait for the next message
+// before concluding the queue has been drained.
+const receiveTimeout = 5 * time.Second
+
+// ErrDeadLetterNotFound is returned when a dead-lettered message doesn't exist.
+var ErrDeadLetterNotFound = errors.New("dead-lettered message not found")
+
+// DeadLetteredMessage is a message a listener gave up on.
+type DeadLetteredMessage struct {
+	MessageID     string
+	Type          string
+	Reason        string
+	Description   string
+	DeliveryCount uint32
+	EnqueuedTime  time.Time
+	// Data is the message envelope
+	Data []byte
+}
+
+// DeadLetterQueue manages the dead-lettered messages of a subscription.
+type DeadLetterQueue interface {
+	// List returns the dead-lettered messages, oldest first.
+	List(ctx context.Context) ([]DeadLetteredMessage, error)
+	// Resubmit publishes a dead-lettered message again, with a fresh delivery
+	// count, and removes it from the queue.
+	Resubmit(ctx context.Context, messageID string) error
+	// Purge removes a dead-lettered message, or all of them when messageID is empty.
+	Purge(ctx context.Context, messageID string) error
+}
+
+// envelopeType returns the type of the message in an envelope, if it can be read.
+func envelopeType(data []byte) string {
+	var envelope messages.Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return ""
+	}
+	return envelope.Type
+}
+
+// ServiceBusDeadLetterQueue manages the dead-letter queue of a service bus subscription.
+type ServiceBusDeadLetterQueue struct {
+	Config *ListenerConfig
+}
+
+// NewDeadLetterQueue returns the dead-letter queue of the underlay's subscription.
+func NewDeadLetterQueue(cfg *ListenerConfig) DeadLetterQueue {
+	return &ServiceBusDeadLetterQueue{cfg}
+}
+
+func (q *ServiceBusDeadLetterQueue) topic() (*servicebus.Topic, error) {
+	namespace, err := getNamespace(q.Config.ServiceBusConnectionString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get namespace from provided ServiceBus connection string: %w", err)
+	}
+	name := topicName(q.Config.Environment, q.Config.Region)
+	topic, err := namespace.NewTopic(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new topic %s: %w", name, err)
+	}
+	return topic, nil
+}
+
+// List peeks at the dead-letter queue without locking its messages.
+func (q *ServiceBusDeadLetterQueue) List(ctx context.Context) ([]DeadLetteredMessage, error) {
+	topic, err := q.topic()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = topic.Close(ctx)
+	}()
+
+	// the dead-letter queue is addressed as a sub-entity of the subscription
+	dlq, err := topic.NewSubscription(q.Config.UnderlayID + "/" + servicebus.DeadLetterQueueName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter queue of %s: %w", q.Config.UnderlayID, err)
+	}
+	defer func() {
+		_ = dlq.Close(ctx)
+	}()
+	it, err := dlq.Peek(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to peek dead-letter queue of %s: %w", q.Config.UnderlayID, err)
+	}
+
+	var list []DeadLetteredMessage
+	for {
+		message, err := it.Next(ctx)
+		if errors.As(err, &servicebus.ErrNoMessages{}) {
+			return list, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to peek dead-letter queue of %s: %w", q.Config.UnderlayID, err)
+		}
+		list = append(list, serviceBusDeadLetter(message))
+	}
+}
+
+func serviceBusDeadLetter(message *servicebus.Message) DeadLetteredMessage {
+	md := serviceBusMetadata(message)
+	reason, _ := message.UserProperties[deadLetterReasonProperty].(string)
+	description, _ := message.UserProperties[deadLetterDescriptionProperty].(string)
+	return DeadLetteredMessage{
+		MessageID:     md.MessageID,
+		Type:          envelopeType(message.Data),
+		Reason:        reason,
+		Description:   description,
+		DeliveryCount: md.DeliveryCount,
+		EnqueuedTime:  md.EnqueuedTime,
+		Data:          message.Data,
+	}
+}
+
+// Resubmit sends a copy of the dead-lettered message to the topic and
+// completes the original.
+func (q *ServiceBusDeadLetterQueue) Resubmit(ctx context.Context, messageID string) error {
+	topic, err := q.topic()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = topic.Close(ctx)
+	}()
+
+	return q.receive(ctx, topic, messageID, func(ctx context.Context, message *servicebus.Message) error {
+		resubmitted := servicebus.NewMessage(message.Data)
+		resubmitted.ID = message.ID
+		resubmitted.CorrelationID = message.CorrelationID
+		resubmitted.SessionID = message.SessionID
+		resubmitted.ContentType = message.ContentType
+		resubmitted.UserProperties = map[string]interface{}{}
+		for k, v := range message.UserProperties {
+			switch k {
+			case deadLetterReasonProperty, deadLetterDescriptionProperty:
+			default:
+				resubmitted.UserProperties[k] = v
+			}
+		}
+		if err := topic.Send(ctx, resubmitted); err != nil {
+			return fmt.Errorf("failed to resubmit message %s: %w", message.ID, err)
+		}
+		return message.Complete(ctx)
+	})
+}
+
+// Purge completes the dead-lettered message, or every message in the queue.
+func (q *ServiceBusDeadLetterQueue) Purge(ctx context.Context, messageID string) error {
+	topic, err := q.topic()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = topic.Close(ctx)
+	}()
+
+	return q.receive(ctx, topic, messageID, func(ctx context.Context, message *servicebus.Message) error {
+		return message.Complete(ctx)
+	})
+}
+
+// receive hands the dead-lettered message with the given id, or every
+// message when the id is empty, to the handler. Other messages are left
+// locked rather than abandoned, so they aren't received again until their
+// lock expires.
+func (q *ServiceBusDeadLetterQueue) receive(ctx context.Context, topic *servicebus.Topic, messageID string, h servicebus.HandlerFunc) error {
+	sub, err := topic.NewSubscription(q.Config.UnderlayID)
+	if err != nil {
+		return fmt.Errorf("failed to create new subscription %s: %w", q.Config.UnderlayID, err)
+	}
+	receiver, err := sub.NewDeadLetterReceiver(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter queue of %s: %w", q.Config.UnderlayID, err)
+	}
+	defer func() {
+		_ = receiver.Close(ctx)
+	}()
+
+	found := false
+	for {
+		receiveCtx, cancel := context.WithTimeout(ctx, receiveTimeout)
+		err := receiver.ReceiveOne(receiveCtx, servicebus.HandlerFunc(func(ctx context.Context, message *servicebus.Message) error {
+			if messageID != "" && message.ID != messageID {
+				return nil
+			}
+			found = true
+			return h(ctx, message)
+		}))
+		drained := receiveCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+
+		if messageID != "" && found {
+			return err
+		}
+		if drained {
+			// the queue has been drained
+			if messageID != "" {
+				return fmt.Errorf("%w: %s", ErrDeadLetterNotFound, messageID)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to receive from dead-letter queue of %s: %w", q.Config.UnderlayID, err)
+		}
+	}
+}
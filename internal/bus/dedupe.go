@@ -0,0 +1,179 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// defaultDedupeCapacity is how many message ids a dedupe store remembers.
+const defaultDedupeCapacity = 1000
+
+// DedupeStore remembers the ids of handled messages so that redelivered and
+// replayed messages are not handled twice.
+type DedupeStore interface {
+	// Seen reports whether the message has already been handled.
+	Seen(ctx context.Context, id string) (bool, error)
+	// Mark records that the message has been handled.
+	Mark(ctx context.Context, id string) error
+}
+
+// MemoryDedupeStore remembers the most recently handled message ids in memory.
+type MemoryDedupeStore struct {
+	mu       sync.Mutex
+	capacity int
+	handled  map[string]time.Time
+	order    []string
+}
+
+// NewMemoryDedupeStore returns a store remembering up to capacity ids, or the
+// default capacity when it is not positive.
+func NewMemoryDedupeStore(capacity int) *MemoryDedupeStore {
+	if capacity <= 0 {
+		capacity = defaultDedupeCapacity
+	}
+	return &MemoryDedupeStore{capacity: capacity, handled: map[string]time.Time{}}
+}
+
+// Seen reports whether the message is one of the remembered ids.
+func (s *MemoryDedupeStore) Seen(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.handled[id]
+	return ok, nil
+}
+
+// Mark remembers the message, forgetting the oldest id when the store is full.
+func (s *MemoryDedupeStore) Mark(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mark(id, time.Now().UTC())
+	return nil
+}
+
+func (s *MemoryDedupeStore) mark(id string, at time.Time) {
+	if _, ok := s.handled[id]; ok {
+		return
+	}
+	s.handled[id] = at
+	s.order = append(s.order, id)
+	for len(s.order) > s.capacity {
+		delete(s.handled, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// snapshot returns the remembered ids and when they were handled.
+func (s *MemoryDedupeStore) snapshot() map[string]string {
+	data := make(map[string]string, len(s.handled))
+	for id, at := range s.handled {
+		data[id] = at.Format(time.RFC3339Nano)
+	}
+	return data
+}
+
+// ConfigMapDedupeStore persists the most recently handled message ids in a
+// ConfigMap, so they survive restarts of the listener. The ConfigMap maps each
+// id to when it was handled.
+type ConfigMapDedupeStore struct {
+	Client client.Client
+	Key    types.NamespacedName
+
+	mu     sync.Mutex
+	loaded bool
+	memory *MemoryDedupeStore
+}
+
+// NewConfigMapDedupeStore returns a store remembering up to capacity ids in
+// the named ConfigMap, or the default capacity when it is not positive.
+func NewConfigMapDedupeStore(c client.Client, key types.NamespacedName, capacity int) *ConfigMapDedupeStore {
+	return &ConfigMapDedupeStore{Client: c, Key: key, memory: NewMemoryDedupeStore(capacity)}
+}
+
+// load reads the ConfigMap into memory, oldest id first. A failed load is
+// tried again on the next call.
+func (s *ConfigMapDedupeStore) load(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loaded {
+		return nil
+	}
+
+	var cm corev1.ConfigMap
+	if err := s.Client.Get(ctx, s.Key, &cm); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get dedupe configmap %s: %w", s.Key, err)
+		}
+		s.loaded = true
+		return nil
+	}
+
+	type entry struct {
+		id string
+		at time.Time
+	}
+	entries := make([]entry, 0, len(cm.Data))
+	for id, v := range cm.Data {
+		at, _ := time.Parse(time.RFC3339Nano, v)
+		entries = append(entries, entry{id: id, at: at})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].at.Before(entries[j].at) })
+	s.memory.mu.Lock()
+	defer s.memory.mu.Unlock()
+	for _, e := range entries {
+		s.memory.mark(e.id, e.at)
+	}
+	s.loaded = true
+	return nil
+}
+
+// Seen reports whether the message is one of the persisted ids.
+func (s *ConfigMapDedupeStore) Seen(ctx context.Context, id string) (bool, error) {
+	if err := s.load(ctx); err != nil {
+		return false, err
+	}
+	return s.memory.Seen(ctx, id)
+}
+
+// Mark persists the message, forgetting the oldest id when the store is full.
+func (s *ConfigMapDedupeStore) Mark(ctx context.Context, id string) error {
+	if err := s.load(ctx); err != nil {
+		return err
+	}
+
+	s.memory.mu.Lock()
+	defer s.memory.mu.Unlock()
+	s.memory.mark(id, time.Now().UTC())
+	data := s.memory.snapshot()
+
+	// errors are returned unwrapped so conflicts are recognised and retried
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var cm corev1.ConfigMap
+		err := s.Client.Get(ctx, s.Key, &cm)
+		if apierrors.IsNotFound(err) {
+			cm = corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: s.Key.Namespace, Name: s.Key.Name},
+				Data:       data,
+			}
+			return s.Client.Create(ctx, &cm)
+		}
+		if err != nil {
+			return err
+		}
+		cm.Data = data
+		return s.Client.Update(ctx, &cm)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save dedupe configmap %s: %w", s.Key, err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+func TestMemoryDedupeStoreForgetsOldestIds(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryDedupeStore(2)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := s.Mark(ctx, id); err != nil {
+			t.Fatalf("failed to mark %s: %v", id, err)
+		}
+	}
+
+	for id, expected := range map[string]bool{"a": false, "b": true, "c": true} {
+		if seen, _ := s.Seen(ctx, id); seen != expected {
+			t.Errorf("seen %s = %v, expected %v", id, seen, expected)
+		}
+	}
+}
+
+func TestConfigMapDedupeStoreSurvivesRestarts(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to build scheme: %v", err)
+	}
+	c := fake.NewFakeClientWithScheme(scheme)
+	key := types.NamespacedName{Namespace: "carp-system", Name: "carp-dedupe-worker-a"}
+
+	s := NewConfigMapDedupeStore(c, key, 2)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := s.Mark(ctx, id); err != nil {
+			t.Fatalf("failed to mark %s: %v", id, err)
+		}
+	}
+
+	var cm corev1.ConfigMap
+	if err := c.Get(ctx, key, &cm); err != nil {
+		t.Fatalf("failed to get configmap: %v", err)
+	}
+	if len(cm.Data) != 2 {
+		t.Errorf("configmap has %d ids, expected 2", len(cm.Data))
+	}
+
+	restarted := NewConfigMapDedupeStore(c, key, 2)
+	if seen, err := restarted.Seen(ctx, "c"); err != nil || !seen {
+		t.Errorf("expected c to be seen after a restart, got %v, %v", seen, err)
+	}
+	if seen, _ := restarted.Seen(ctx, "a"); seen {
+		t.Errorf("expected a to be forgotten")
+	}
+
+	// ids handled within the same second are still forgotten oldest first
+	if err := restarted.Mark(ctx, "d"); err != nil {
+		t.Fatalf("failed to mark d: %v", err)
+	}
+	for id, expected := range map[string]bool{"b": false, "c": true, "d": true} {
+		if seen, _ := restarted.Seen(ctx, id); seen != expected {
+			t.Errorf("seen %s = %v after a restart, expected %v", id, seen, expected)
+		}
+	}
+}
+
+// flakyClient fails the first failures Gets.
+type flakyClient struct {
+	client.Client
+	failures int
+}
+
+func (c *flakyClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	if c.failures > 0 {
+		c.failures--
+		return errors.New("connection refused")
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestConfigMapDedupeStoreRetriesFailedLoads(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to build scheme: %v", err)
+	}
+	key := types.NamespacedName{Namespace: "carp-system", Name: "carp-dedupe-worker-a"}
+	c := fake.NewFakeClientWithScheme(scheme, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+		Data:       map[string]string{"a": time.Now().UTC().Format(time.RFC3339Nano)},
+	})
+
+	s := NewConfigMapDedupeStore(&flakyClient{Client: c, failures: 1}, key, 2)
+	if _, err := s.Seen(ctx, "a"); err == nil {
+		t.Fatalf("expected the first load to fail")
+	}
+	if seen, err := s.Seen(ctx, "a"); err != nil || !seen {
+		t.Errorf("expected a to be seen once the configmap loads, got %v, %v", seen, err)
+	}
+	if err := s.Mark(ctx, "b"); err != nil {
+		t.Errorf("failed to mark b after the load was retried: %v", err)
+	}
+}
+
+func TestDispatcherSkipsDuplicates(t *testing.T) {
+	// messages published without an id are given one
+	envelope, err := messages.NewEnvelope(workers.PutCluster{Command: messages.Command{DestinationId: "worker-a"}, Name: "one"})
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	if envelope.Id == uuid.Nil {
+		t.Fatalf("expected the envelope to be given an id")
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("failed to marshal envelope: %v", err)
+	}
+
+	var handled int
+	d := NewDispatcher()
+	d.Deduplicate(NewMemoryDedupeStore(0))
+	d.Handle(workers.PutClusterType, func(ctx context.Context, md Metadata, m messages.Message) error {
+		if m.MessageID() != envelope.Id {
+			t.Errorf("handled message %s, expected %s", m.MessageID(), envelope.Id)
+		}
+		handled++
+		return nil
+	})
+
+	before := testutil.ToFloat64(duplicateMessages.WithLabelValues(workers.PutClusterType))
+	for i := 0; i < 3; i++ {
+		if err := d.Dispatch(context.Background(), Metadata{DeliveryCount: uint32(i + 1)}, data); err != nil {
+			t.Fatalf("dispatch failed: %v", err)
+		}
+	}
+	if handled != 1 {
+		t.Errorf("handled %d times, expected 1", handled)
+	}
+	if got := testutil.ToFloat64(duplicateMessages.WithLabelValues(workers.PutClusterType)) - before; got != 2 {
+		t.Errorf("counted %v duplicates, expected 2", got)
+	}
+}
@@ -0,0 +1,163 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/juan-lee/carp/internal/messages"
+)
+
+// Metadata describes a single delivery of a message.
+type Metadata struct {
+	// MessageID is the id of the message
+	MessageID string
+	// Type is the registered type of the message, if its envelope could be read
+	Type string
+	// CorrelationID is the id of the message that caused this one, if any
+	CorrelationID string
+	// SessionID is the session the message is ordered within
+	SessionID string
+	// DeliveryCount is the number of times the message has been delivered, including this one
+	DeliveryCount uint32
+	// EnqueuedTime is when the bus accepted the message
+	EnqueuedTime time.Time
+}
+
+// HandlerFunc handles a decoded message. The message is a pointer to the type
+// the handler was registered for.
+type HandlerFunc func(ctx context.Context, md Metadata, message messages.Message) error
+
+// FallbackFunc handles a message that has no registered handler.
+type FallbackFunc func(ctx context.Context, md Metadata, data []byte) error
+
+// Dispatcher decodes the messages received by a Listener and routes them to
+// the handler registered for their type.
+type Dispatcher struct {
+	handlers map[string]HandlerFunc
+	fallback FallbackFunc
+	dedupe   DedupeStore
+	labels   map[string]string
+}
+
+// NewDispatcher returns a dispatcher whose fallback reports unhandled
+// messages as malformed.
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		handlers: map[string]HandlerFunc{},
+		fallback: func(ctx context.Context, md Metadata, data []byte) error {
+			return fmt.Errorf("%w: no handler for message type %q", ErrMalformed, md.Type)
+		},
+	}
+}
+
+// Handle registers the handler of a message type, replacing any previous one.
+func (d *Dispatcher) Handle(messageType string, h HandlerFunc) {
+	d.handlers[messageType] = h
+}
+
+// Fallback sets the handler of messages with an unknown or unhandled type.
+func (d *Dispatcher) Fallback(f FallbackFunc) {
+	d.fallback = f
+}
+
+// Deduplicate makes the dispatcher skip messages the store has seen. Skipped
+// messages are reported as handled so the listener acknowledges them.
+func (d *Dispatcher) Deduplicate(store DedupeStore) {
+	d.dedupe = store
+}
+
+// Labels sets the labels of the recipient, which broadcasts are selected by.
+// Broadcasts whose selector doesn't match are reported as handled without
+// calling their handler. A dispatcher without labels only handles broadcasts
+// with an empty selector.
+func (d *Dispatcher) Labels(labels map[string]string) {
+	d.labels = labels
+}
+
+// Types returns the message types with a registered handler.
+func (d *Dispatcher) Types() []string {
+	types := make([]string, 0, len(d.handlers))
+	for t := range d.handlers {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Dispatch decodes a message and calls its handler. The metadata is filled in
+// from the envelope where the listener couldn't provide it. Messages that
+// can't be decoded are reported as malformed. With a dedupe store, messages
+// are only marked as seen once their handler succeeds.
+func (d *Dispatcher) Dispatch(ctx context.Context, md Metadata, data []byte) error {
+	var envelope messages.Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return d.fallback(ctx, md, data)
+	}
+
+	md.Type = envelope.Type
+	if md.MessageID == "" {
+		md.MessageID = envelope.Id.String()
+	}
+	if md.CorrelationID == "" {
+		md.CorrelationID = envelope.CorrelationId
+	}
+	if md.SessionID == "" {
+		md.SessionID = envelope.SessionId
+	}
+
+	h, ok := d.handlers[envelope.Type]
+	if !ok {
+		return d.fallback(ctx, md, data)
+	}
+	if !envelope.Selector.Matches(d.labels) {
+		return nil
+	}
+
+	message, err := envelope.Decode()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	if d.dedupe == nil {
+		return h(ctx, md, message)
+	}
+	seen, err := d.dedupe.Seen(ctx, md.MessageID)
+	if err != nil {
+		return err
+	}
+	if seen {
+		duplicateMessages.WithLabelValues(md.Type).Inc()
+		return nil
+	}
+	if err := h(ctx, md, message); err != nil {
+		return err
+	}
+	return d.dedupe.Mark(ctx, md.MessageID)
+}
+
+// dispatch opens a message with the listener's keyring before dispatching it.
+// Messages that fail authentication, including payloads that aren't an
+// envelope at all, are never handed to the dispatcher.
+func dispatch(ctx context.Context, d *Dispatcher, k *Keyring, md Metadata, data []byte) error {
+	if k == nil {
+		return d.Dispatch(ctx, md, data)
+	}
+	var envelope messages.Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		if k.requiresAuthentication() {
+			return fmt.Errorf("%w: payload isn't an envelope: %v", ErrUnauthenticated, err)
+		}
+		return d.Dispatch(ctx, md, data)
+	}
+	if err := k.Open(&envelope); err != nil {
+		return err
+	}
+	opened, err := json.Marshal(&envelope)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return d.Dispatch(ctx, md, opened)
+}
@@ -0,0 +1,195 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+// tracingDedupeStore records the calls made to it in a shared trace.
+type tracingDedupeStore struct {
+	trace *[]string
+	seen  bool
+}
+
+func (s *tracingDedupeStore) Seen(ctx context.Context, id string) (bool, error) {
+	*s.trace = append(*s.trace, "seen")
+	return s.seen, nil
+}
+
+func (s *tracingDedupeStore) Mark(ctx context.Context, id string) error {
+	*s.trace = append(*s.trace, "mark")
+	return nil
+}
+
+func envelopeData(t *testing.T, message messages.Message, mutate func(e *messages.Envelope)) []byte {
+	t.Helper()
+	envelope, err := messages.NewEnvelope(message)
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	if mutate != nil {
+		mutate(envelope)
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("failed to marshal envelope: %v", err)
+	}
+	return data
+}
+
+func TestDispatch(t *testing.T) {
+	errHandler := errors.New("handler failed")
+	broadcast := putCluster(messages.BroadcastId, "one")
+	broadcast.Selector = messages.Selector{"region": "westus2"}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		labels     map[string]string
+		fallback   bool
+		dedupe     *tracingDedupeStore
+		handlerErr error
+		wantTrace  []string
+		wantErr    error
+	}{
+		{
+			name:      "handled",
+			data:      envelopeData(t, putCluster("worker-a", "one"), nil),
+			wantTrace: []string{"handle"},
+		},
+		{
+			name:      "not an envelope",
+			data:      []byte("not json"),
+			fallback:  true,
+			wantTrace: []string{"fallback"},
+		},
+		{
+			name:      "no handler",
+			data:      envelopeData(t, workers.DeleteCluster{Command: messages.Command{DestinationId: "worker-a"}}, nil),
+			fallback:  true,
+			wantTrace: []string{"fallback"},
+		},
+		{
+			name:    "no handler without a fallback",
+			data:    envelopeData(t, workers.DeleteCluster{Command: messages.Command{DestinationId: "worker-a"}}, nil),
+			wantErr: ErrMalformed,
+		},
+		{
+			name:      "selector matches",
+			data:      envelopeData(t, broadcast, nil),
+			labels:    map[string]string{"region": "westus2", "tier": "gold"},
+			wantTrace: []string{"handle"},
+		},
+		{
+			name:   "selector doesn't match",
+			data:   envelopeData(t, broadcast, nil),
+			labels: map[string]string{"region": "eastus"},
+		},
+		{
+			name:   "selector without labels",
+			data:   envelopeData(t, broadcast, nil),
+			dedupe: &tracingDedupeStore{},
+		},
+		{
+			name:    "schema version mismatch",
+			data:    envelopeData(t, putCluster("worker-a", "one"), func(e *messages.Envelope) { e.SchemaVersion = "v0" }),
+			wantErr: ErrMalformed,
+		},
+		{
+			name:      "dedupe marks after handling",
+			data:      envelopeData(t, putCluster("worker-a", "one"), nil),
+			dedupe:    &tracingDedupeStore{},
+			wantTrace: []string{"seen", "handle", "mark"},
+		},
+		{
+			name:      "dedupe skips seen messages",
+			data:      envelopeData(t, putCluster("worker-a", "one"), nil),
+			dedupe:    &tracingDedupeStore{seen: true},
+			wantTrace: []string{"seen"},
+		},
+		{
+			name:       "dedupe doesn't mark failed messages",
+			data:       envelopeData(t, putCluster("worker-a", "one"), nil),
+			dedupe:     &tracingDedupeStore{},
+			handlerErr: errHandler,
+			wantTrace:  []string{"seen", "handle"},
+			wantErr:    errHandler,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var trace []string
+			d := NewDispatcher()
+			d.Labels(tt.labels)
+			d.Handle(workers.PutClusterType, func(ctx context.Context, md Metadata, message messages.Message) error {
+				trace = append(trace, "handle")
+				if _, ok := message.(*workers.PutCluster); !ok {
+					t.Errorf("expected a *PutCluster, got %T", message)
+				}
+				return tt.handlerErr
+			})
+			if tt.fallback {
+				d.Fallback(func(ctx context.Context, md Metadata, data []byte) error {
+					trace = append(trace, "fallback")
+					return nil
+				})
+			}
+			if tt.dedupe != nil {
+				tt.dedupe.trace = &trace
+				d.Deduplicate(tt.dedupe)
+			}
+
+			err := d.Dispatch(context.Background(), Metadata{}, tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(trace, tt.wantTrace) {
+				t.Errorf("expected calls %v, got %v", tt.wantTrace, trace)
+			}
+		})
+	}
+}
+
+func TestDispatchFillsMetadataFromEnvelope(t *testing.T) {
+	command := putCluster("worker-a", "one")
+	command.CorrelationId = "cause"
+	data := envelopeData(t, command, nil)
+
+	tests := []struct {
+		name string
+		md   Metadata
+		want Metadata
+	}{
+		{
+			name: "from envelope",
+			want: Metadata{Type: workers.PutClusterType, MessageID: command.Id.String(), CorrelationID: "cause", SessionID: "default/one"},
+		},
+		{
+			name: "listener metadata wins",
+			md:   Metadata{Type: "Stale", MessageID: "m", CorrelationID: "c", SessionID: "s", DeliveryCount: 2},
+			want: Metadata{Type: workers.PutClusterType, MessageID: "m", CorrelationID: "c", SessionID: "s", DeliveryCount: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Metadata
+			d := NewDispatcher()
+			d.Handle(workers.PutClusterType, func(ctx context.Context, md Metadata, message messages.Message) error {
+				got = md
+				return nil
+			})
+			if err := d.Dispatch(context.Background(), tt.md, data); err != nil {
+				t.Fatalf("dispatch failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected metadata %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
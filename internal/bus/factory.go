@@ -0,0 +1,163 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Transports that can be selected with Config.Transport.
+const (
+	TransportServiceBus = "servicebus"
+	TransportMemory     = "memory"
+	TransportKubernetes = "kubernetes"
+	TransportNATS       = "nats"
+)
+
+// Config selects and configures the transport of a Factory.
+type Config struct {
+	Transport                  string
+	Region                     string
+	Environment                string
+	ServiceBusConnectionString string
+	// KubernetesClient is the client of the cluster storing the messages of the kubernetes transport
+	KubernetesClient client.Client
+	// KubernetesNamespace is the namespace storing the messages of the kubernetes transport
+	KubernetesNamespace string
+	// NATSURL is the url of the NATS server of the nats transport
+	NATSURL string
+	// RetryPolicy decides which failed messages listeners retry, defaulting to DefaultRetryPolicy
+	RetryPolicy *RetryPolicy
+	// Provisioning is ProvisionManaged or ProvisionPreProvisioned, defaulting
+	// to ProvisionManaged. It only applies to the servicebus transport.
+	Provisioning string
+	// Keyring signs, verifies, encrypts and decrypts messages, if set
+	Keyring *Keyring
+	// Supervisor restarts failed listeners, if set
+	Supervisor *Supervisor
+	// MaxConcurrentHandlers, PrefetchCount and DrainTimeout tune the
+	// receivers of the servicebus transport, see ListenerConfig
+	MaxConcurrentHandlers int
+	PrefetchCount         uint32
+	DrainTimeout          time.Duration
+}
+
+// Factory creates the publishers and listeners of the configured transport.
+// Publishers and listeners created by the same factory share a memory bus.
+type Factory struct {
+	cfg        Config
+	memory     *MemoryBus
+	kubernetes *KubernetesBus
+	nats       *NATSBus
+}
+
+// NewFactory returns a factory for the configured transport.
+func NewFactory(cfg Config) (*Factory, error) {
+	f := &Factory{cfg: cfg}
+	switch cfg.Transport {
+	case TransportServiceBus:
+		if cfg.ServiceBusConnectionString == "" {
+			return nil, fmt.Errorf("no Service Bus connection string provided")
+		}
+		switch cfg.Provisioning {
+		case "", ProvisionManaged, ProvisionPreProvisioned:
+		default:
+			return nil, fmt.Errorf("unknown provisioning mode %q", cfg.Provisioning)
+		}
+	case TransportMemory:
+		f.memory = NewMemoryBus()
+	case TransportKubernetes:
+		if cfg.KubernetesClient == nil || cfg.KubernetesNamespace == "" {
+			return nil, fmt.Errorf("no kubernetes client or namespace provided")
+		}
+		f.kubernetes = NewKubernetesBus(cfg.KubernetesClient, cfg.KubernetesNamespace)
+	case TransportNATS:
+		conn, err := nats.Connect(cfg.NATSURL, nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %w", cfg.NATSURL, err)
+		}
+		if f.nats, err = NewNATSBus(conn); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown bus transport %q", cfg.Transport)
+	}
+	return f, nil
+}
+
+// NewPublisher returns a publisher sending to the region and environment's topic.
+func (f *Factory) NewPublisher(ctx context.Context) (Publisher, error) {
+	cfg := &PublisherConfig{
+		Region:                     f.cfg.Region,
+		Environment:                f.cfg.Environment,
+		ServiceBusConnectionString: f.cfg.ServiceBusConnectionString,
+		Provisioning:               f.cfg.Provisioning,
+		Keyring:                    f.cfg.Keyring,
+	}
+	switch {
+	case f.memory != nil:
+		return f.memory.NewPublisher(cfg), nil
+	case f.kubernetes != nil:
+		return f.kubernetes.NewPublisher(cfg), nil
+	case f.nats != nil:
+		return f.nats.NewPublisher(cfg)
+	}
+	return NewPublisher(ctx, cfg)
+}
+
+// NewListener returns a listener receiving the given message types addressed
+// to the underlay. With a supervisor, the listener is restarted when it fails.
+func (f *Factory) NewListener(underlayID string, messageTypes []string) (Listener, error) {
+	l, err := f.newListener(underlayID, messageTypes)
+	if err != nil || f.cfg.Supervisor == nil {
+		return l, err
+	}
+	return f.cfg.Supervisor.Supervise(underlayID, l), nil
+}
+
+func (f *Factory) newListener(underlayID string, messageTypes []string) (Listener, error) {
+	cfg := &ListenerConfig{
+		Region:                     f.cfg.Region,
+		Environment:                f.cfg.Environment,
+		UnderlayID:                 underlayID,
+		ServiceBusConnectionString: f.cfg.ServiceBusConnectionString,
+		MessageTypes:               messageTypes,
+		RetryPolicy:                f.cfg.RetryPolicy,
+		Provisioning:               f.cfg.Provisioning,
+		Keyring:                    f.cfg.Keyring,
+		MaxConcurrentHandlers:      f.cfg.MaxConcurrentHandlers,
+		PrefetchCount:              f.cfg.PrefetchCount,
+		DrainTimeout:               f.cfg.DrainTimeout,
+	}
+	switch {
+	case f.memory != nil:
+		return f.memory.NewListener(cfg)
+	case f.kubernetes != nil:
+		return f.kubernetes.NewListener(cfg)
+	case f.nats != nil:
+		return f.nats.NewListener(cfg)
+	}
+	return NewListener(cfg), nil
+}
+
+// NewDeadLetterQueue returns the dead-letter queue of the underlay's subscription.
+func (f *Factory) NewDeadLetterQueue(underlayID string) (DeadLetterQueue, error) {
+	cfg := &ListenerConfig{
+		Region:                     f.cfg.Region,
+		Environment:                f.cfg.Environment,
+		UnderlayID:                 underlayID,
+		ServiceBusConnectionString: f.cfg.ServiceBusConnectionString,
+	}
+	switch {
+	case f.memory != nil:
+		return f.memory.NewDeadLetterQueue(cfg)
+	case f.kubernetes != nil:
+		return f.kubernetes.NewDeadLetterQueue(cfg)
+	case f.nats != nil:
+		return nil, fmt.Errorf("the nats transport doesn't keep terminated messages")
+	}
+	return NewDeadLetterQueue(cfg), nil
+}
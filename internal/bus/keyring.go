@@ -0,0 +1,383 @@
+package bus
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/juan-lee/carp/internal/messages"
+)
+
+// Algorithms of the keys of a Keyring, which are also the suffixes of their
+// entries in a keyring Secret.
+const (
+	AlgorithmHMACSHA256 = "hmac-sha256"
+	AlgorithmEd25519    = "ed25519"
+	// AlgorithmEd25519Public is an ed25519 public key, which can only verify
+	AlgorithmEd25519Public = "ed25519-public"
+	AlgorithmAES256GCM     = "aes-256-gcm"
+)
+
+// Entries of a keyring Secret selecting the active keys.
+const (
+	// SigningKeyIDKey is the id of the key publishers sign with
+	SigningKeyIDKey = "signing-key-id"
+	// EncryptionKeyIDKey is the id of the key confidential payloads are encrypted with, if any
+	EncryptionKeyIDKey = "encryption-key-id"
+)
+
+// ErrUnauthenticated is returned for messages that are unsigned, signed with
+// an unknown key or whose signature doesn't match. They are dead-lettered.
+var ErrUnauthenticated = errors.New("message failed authentication")
+
+type key struct {
+	algorithm string
+	secret    []byte
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+}
+
+// Keyring holds the keys envelopes are signed, verified, encrypted and
+// decrypted with, by key id. Keys are rotated by adding a key with a new id,
+// making it the signing or encryption key once every listener has it, and
+// removing the old key once no message signed with it is left on the bus.
+//
+// A keyring with a signing or verification key rejects unsigned messages. A
+// nil keyring neither signs nor verifies.
+type Keyring struct {
+	mu              sync.RWMutex
+	keys            map[string]key
+	signingKeyID    string
+	encryptionKeyID string
+}
+
+// NewKeyringFromSecret returns a keyring with the keys of a Secret.
+func NewKeyringFromSecret(secret *corev1.Secret) (*Keyring, error) {
+	k := &Keyring{}
+	if err := k.Load(secret); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Load replaces the keys of the keyring with the keys of a Secret. Keys are
+// the entries named <key id>.<algorithm>: the raw HMAC or AES-256 key, the
+// ed25519 private key or seed, or the ed25519 public key. The signing-key-id
+// and encryption-key-id entries select the keys messages are signed and
+// encrypted with.
+func (k *Keyring) Load(secret *corev1.Secret) error {
+	keys := map[string]key{}
+	for name, data := range secret.Data {
+		if name == SigningKeyIDKey || name == EncryptionKeyIDKey {
+			continue
+		}
+		i := strings.LastIndex(name, ".")
+		if i <= 0 {
+			return fmt.Errorf("key %s of secret %s/%s isn't named <key id>.<algorithm>", name, secret.Namespace, secret.Name)
+		}
+		id, algorithm := name[:i], name[i+1:]
+		parsed, err := parseKey(algorithm, data)
+		if err != nil {
+			return fmt.Errorf("invalid key %s of secret %s/%s: %w", name, secret.Namespace, secret.Name, err)
+		}
+		if _, ok := keys[id]; ok {
+			return fmt.Errorf("key id %s of secret %s/%s has more than one key", id, secret.Namespace, secret.Name)
+		}
+		keys[id] = parsed
+	}
+
+	signingKeyID := strings.TrimSpace(string(secret.Data[SigningKeyIDKey]))
+	if signingKeyID != "" {
+		signing, ok := keys[signingKeyID]
+		if !ok || (signing.algorithm != AlgorithmHMACSHA256 && signing.private == nil) {
+			return fmt.Errorf("signing key %s isn't an hmac or ed25519 private key of secret %s/%s", signingKeyID, secret.Namespace, secret.Name)
+		}
+	}
+	encryptionKeyID := strings.TrimSpace(string(secret.Data[EncryptionKeyIDKey]))
+	if encryptionKeyID != "" {
+		if encryption, ok := keys[encryptionKeyID]; !ok || encryption.algorithm != AlgorithmAES256GCM {
+			return fmt.Errorf("encryption key %s isn't an aes key of secret %s/%s", encryptionKeyID, secret.Namespace, secret.Name)
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.signingKeyID = signingKeyID
+	k.encryptionKeyID = encryptionKeyID
+	return nil
+}
+
+func parseKey(algorithm string, data []byte) (key, error) {
+	switch algorithm {
+	case AlgorithmHMACSHA256:
+		if len(data) < sha256.Size {
+			return key{}, fmt.Errorf("hmac keys must be at least %d bytes", sha256.Size)
+		}
+		return key{algorithm: algorithm, secret: data}, nil
+	case AlgorithmEd25519:
+		var private ed25519.PrivateKey
+		switch len(data) {
+		case ed25519.SeedSize:
+			private = ed25519.NewKeyFromSeed(data)
+		case ed25519.PrivateKeySize:
+			private = ed25519.PrivateKey(data)
+		default:
+			return key{}, fmt.Errorf("ed25519 private keys must be a %d byte seed or %d bytes", ed25519.SeedSize, ed25519.PrivateKeySize)
+		}
+		return key{algorithm: algorithm, private: private, public: private.Public().(ed25519.PublicKey)}, nil
+	case AlgorithmEd25519Public:
+		if len(data) != ed25519.PublicKeySize {
+			return key{}, fmt.Errorf("ed25519 public keys must be %d bytes", ed25519.PublicKeySize)
+		}
+		return key{algorithm: AlgorithmEd25519, public: ed25519.PublicKey(data)}, nil
+	case AlgorithmAES256GCM:
+		if len(data) != 32 {
+			return key{}, fmt.Errorf("aes-256 keys must be 32 bytes")
+		}
+		return key{algorithm: algorithm, secret: data}, nil
+	}
+	return key{}, fmt.Errorf("unknown algorithm %q", algorithm)
+}
+
+// authenticates reports whether the keyring signs or verifies messages.
+func (k *Keyring) authenticates() bool {
+	if k.signingKeyID != "" {
+		return true
+	}
+	for _, key := range k.keys {
+		if key.algorithm != AlgorithmAES256GCM {
+			return true
+		}
+	}
+	return false
+}
+
+// requiresAuthentication reports whether messages must be authenticated to be
+// opened.
+func (k *Keyring) requiresAuthentication() bool {
+	if k == nil {
+		return false
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.authenticates()
+}
+
+// Seal encrypts the payload of confidential messages when the keyring has an
+// encryption key, and then signs the envelope when it has a signing key.
+func (k *Keyring) Seal(envelope *messages.Envelope, confidential bool) error {
+	if k == nil {
+		return nil
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if confidential && k.encryptionKeyID != "" {
+		payload, err := encrypt(k.keys[k.encryptionKeyID].secret, envelope.Payload, envelope.Id[:])
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", envelope.Type, err)
+		}
+		envelope.Payload = payload
+		envelope.EncryptionKeyId = k.encryptionKeyID
+	}
+
+	if k.signingKeyID == "" {
+		return nil
+	}
+	data, err := signedData(envelope)
+	if err != nil {
+		return err
+	}
+	signing := k.keys[k.signingKeyID]
+	signature := &messages.Signature{KeyId: k.signingKeyID, Algorithm: signing.algorithm}
+	switch signing.algorithm {
+	case AlgorithmHMACSHA256:
+		mac := hmac.New(sha256.New, signing.secret)
+		_, _ = mac.Write(data)
+		signature.Value = mac.Sum(nil)
+	case AlgorithmEd25519:
+		signature.Value = ed25519.Sign(signing.private, data)
+	}
+	envelope.Signature = signature
+	return nil
+}
+
+// encodeMessage wraps a message in an envelope sealed with the keyring and
+// returns the envelope and its JSON encoding.
+func encodeMessage(message messages.Message, k *Keyring) (*messages.Envelope, []byte, error) {
+	envelope, err := messages.NewEnvelope(message)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, confidential := message.(messages.Confidential)
+	if err := k.Seal(envelope, confidential); err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal envelope: %w", err)
+	}
+	return envelope, data, nil
+}
+
+// Open verifies the signature of an envelope and decrypts its payload,
+// leaving an envelope that is neither signed nor encrypted.
+func (k *Keyring) Open(envelope *messages.Envelope) error {
+	if k == nil {
+		return nil
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if err := k.verify(envelope); err != nil {
+		return err
+	}
+	envelope.Signature = nil
+
+	if envelope.EncryptionKeyId == "" {
+		return nil
+	}
+	decryption, ok := k.keys[envelope.EncryptionKeyId]
+	if !ok || decryption.algorithm != AlgorithmAES256GCM {
+		return fmt.Errorf("%w: %s %s is encrypted with unknown key %s", ErrMalformed, envelope.Type, envelope.Id, envelope.EncryptionKeyId)
+	}
+	payload, err := decrypt(decryption.secret, envelope.Payload, envelope.Id[:])
+	if err != nil {
+		return fmt.Errorf("%w: failed to decrypt %s %s: %v", ErrMalformed, envelope.Type, envelope.Id, err)
+	}
+	envelope.Payload = payload
+	envelope.EncryptionKeyId = ""
+	return nil
+}
+
+func (k *Keyring) verify(envelope *messages.Envelope) error {
+	signature := envelope.Signature
+	if signature == nil {
+		if k.authenticates() {
+			return fmt.Errorf("%w: %s %s is unsigned", ErrUnauthenticated, envelope.Type, envelope.Id)
+		}
+		return nil
+	}
+
+	verification, ok := k.keys[signature.KeyId]
+	if !ok || verification.algorithm != signature.Algorithm {
+		return fmt.Errorf("%w: %s %s is signed with unknown %s key %s", ErrUnauthenticated, envelope.Type, envelope.Id, signature.Algorithm, signature.KeyId)
+	}
+	data, err := signedData(envelope)
+	if err != nil {
+		return err
+	}
+	var valid bool
+	switch verification.algorithm {
+	case AlgorithmHMACSHA256:
+		mac := hmac.New(sha256.New, verification.secret)
+		_, _ = mac.Write(data)
+		valid = hmac.Equal(mac.Sum(nil), signature.Value)
+	case AlgorithmEd25519:
+		valid = ed25519.Verify(verification.public, data, signature.Value)
+	}
+	if !valid {
+		return fmt.Errorf("%w: %s %s has an invalid signature by key %s", ErrUnauthenticated, envelope.Type, envelope.Id, signature.KeyId)
+	}
+	return nil
+}
+
+// signedData returns the data an envelope's signature is computed over: the
+// JSON encoding of the envelope without its signature.
+func signedData(envelope *messages.Envelope) ([]byte, error) {
+	unsigned := *envelope
+	unsigned.Signature = nil
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal envelope: %w", err)
+	}
+	return data, nil
+}
+
+// encrypt seals a payload with AES-256-GCM, returning the nonce and
+// ciphertext as a JSON string. The additional data binds it to its envelope.
+func encrypt(secret, payload, additionalData []byte) (json.RawMessage, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(gcm.Seal(nonce, nonce, payload, additionalData))
+}
+
+func decrypt(secret []byte, payload json.RawMessage, additionalData []byte) (json.RawMessage, error) {
+	var sealed []byte
+	if err := json.Unmarshal(payload, &sealed); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+}
+
+// KeyringRefresher reloads a keyring from its Secret every interval, so
+// rotated keys are picked up without a restart. Failed reloads are logged and
+// the previous keys are kept.
+type KeyringRefresher struct {
+	Client   client.Reader
+	Log      logr.Logger
+	Keyring  *Keyring
+	Secret   types.NamespacedName
+	Interval time.Duration
+}
+
+// Start reloads the keyring every interval until stop is closed.
+func (r *KeyringRefresher) Start(stop <-chan struct{}) error {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		var secret corev1.Secret
+		err := r.Client.Get(context.Background(), r.Secret, &secret)
+		if err == nil {
+			err = r.Keyring.Load(&secret)
+		}
+		if err != nil {
+			r.Log.Error(err, "failed to reload bus keys", "secret", r.Secret)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package bus
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+var (
+	testHMACKey = bytes.Repeat([]byte{1}, 32)
+	testAESKey  = bytes.Repeat([]byte{2}, 32)
+	testSeed    = bytes.Repeat([]byte{3}, ed25519.SeedSize)
+)
+
+func newTestKeyring(t *testing.T, data map[string][]byte) *Keyring {
+	t.Helper()
+	k, err := NewKeyringFromSecret(&corev1.Secret{Data: data})
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+	return k
+}
+
+// seal encodes a message like a publisher with the given keyring would.
+func seal(t *testing.T, k *Keyring, message messages.Message) *messages.Envelope {
+	t.Helper()
+	envelope, _, err := encodeMessage(message, k)
+	if err != nil {
+		t.Fatalf("failed to encode message: %v", err)
+	}
+	return envelope
+}
+
+func TestKeyringSealOpen(t *testing.T) {
+	public := ed25519.NewKeyFromSeed(testSeed).Public().(ed25519.PublicKey)
+	tests := []struct {
+		name      string
+		publisher map[string][]byte
+		listener  map[string][]byte
+	}{
+		{
+			name:      "hmac",
+			publisher: map[string][]byte{SigningKeyIDKey: []byte("k1"), "k1.hmac-sha256": testHMACKey},
+			listener:  map[string][]byte{"k1.hmac-sha256": testHMACKey},
+		},
+		{
+			name:      "ed25519",
+			publisher: map[string][]byte{SigningKeyIDKey: []byte("k1"), "k1.ed25519": testSeed},
+			listener:  map[string][]byte{"k1.ed25519-public": public},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope := seal(t, newTestKeyring(t, tt.publisher), putCluster("worker-a", "one"))
+			if envelope.Signature == nil || envelope.Signature.KeyId != "k1" {
+				t.Fatalf("expected the envelope to be signed by k1, got %+v", envelope.Signature)
+			}
+			if err := newTestKeyring(t, tt.listener).Open(envelope); err != nil {
+				t.Fatalf("failed to open envelope: %v", err)
+			}
+			message, err := envelope.Decode()
+			if err != nil {
+				t.Fatalf("failed to decode opened envelope: %v", err)
+			}
+			if got := message.(*workers.PutCluster).Name; got != "one" {
+				t.Errorf("expected cluster one, got %s", got)
+			}
+		})
+	}
+}
+
+func TestKeyringRejectsUnauthenticatedMessages(t *testing.T) {
+	signer := newTestKeyring(t, map[string][]byte{SigningKeyIDKey: []byte("k1"), "k1.hmac-sha256": testHMACKey})
+	verifier := newTestKeyring(t, map[string][]byte{"k1.hmac-sha256": testHMACKey})
+	other := newTestKeyring(t, map[string][]byte{SigningKeyIDKey: []byte("k2"), "k2.hmac-sha256": bytes.Repeat([]byte{9}, 32)})
+
+	forged := seal(t, signer, putCluster("worker-a", "one"))
+	forged.Payload = json.RawMessage(`{"name":"other","namespace":"default"}`)
+	wrongAlgorithm := seal(t, signer, putCluster("worker-a", "one"))
+	wrongAlgorithm.Signature.Algorithm = AlgorithmEd25519
+
+	tests := map[string]*messages.Envelope{
+		"unsigned":        seal(t, nil, putCluster("worker-a", "one")),
+		"forged":          forged,
+		"unknown key":     seal(t, other, putCluster("worker-a", "one")),
+		"wrong algorithm": wrongAlgorithm,
+	}
+	for name, envelope := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := verifier.Open(envelope); !errors.Is(err, ErrUnauthenticated) {
+				t.Errorf("expected ErrUnauthenticated, got %v", err)
+			}
+		})
+	}
+}
+
+func TestKeyringEncryptsConfidentialPayloads(t *testing.T) {
+	k := newTestKeyring(t, map[string][]byte{
+		SigningKeyIDKey:    []byte("k1"),
+		EncryptionKeyIDKey: []byte("e1"),
+		"k1.hmac-sha256":   testHMACKey,
+		"e1.aes-256-gcm":   testAESKey,
+	})
+
+	put := seal(t, k, putCluster("worker-a", "secret-cluster"))
+	if put.EncryptionKeyId != "e1" || bytes.Contains(put.Payload, []byte("secret-cluster")) {
+		t.Fatalf("expected the put payload to be encrypted with e1, got %s", put.Payload)
+	}
+	del := seal(t, k, workers.DeleteCluster{
+		Command:   messages.Command{Id: uuid.New(), DestinationId: "worker-a"},
+		Name:      "plain-cluster",
+		Namespace: "default",
+	})
+	if del.EncryptionKeyId != "" || !bytes.Contains(del.Payload, []byte("plain-cluster")) {
+		t.Errorf("expected the delete payload not to be encrypted, got %s", del.Payload)
+	}
+
+	if err := k.Open(put); err != nil {
+		t.Fatalf("failed to open envelope: %v", err)
+	}
+	if put.EncryptionKeyId != "" || !bytes.Contains(put.Payload, []byte("secret-cluster")) {
+		t.Errorf("expected the payload to be decrypted, got %s", put.Payload)
+	}
+
+	// the ciphertext is bound to its envelope
+	moved := seal(t, k, putCluster("worker-a", "secret-cluster"))
+	moved.Id = uuid.New()
+	if _, err := decrypt(testAESKey, moved.Payload, moved.Id[:]); err == nil {
+		t.Errorf("expected decrypting a payload moved to another envelope to fail")
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	newKey := bytes.Repeat([]byte{4}, 32)
+	old := newTestKeyring(t, map[string][]byte{SigningKeyIDKey: []byte("k1"), "k1.hmac-sha256": testHMACKey})
+	rotated := newTestKeyring(t, map[string][]byte{SigningKeyIDKey: []byte("k2"), "k2.hmac-sha256": newKey})
+	oldMessage := seal(t, old, putCluster("worker-a", "one"))
+	newMessage := seal(t, rotated, putCluster("worker-a", "two"))
+
+	// while rotating, listeners verify with both keys
+	verifier := newTestKeyring(t, map[string][]byte{"k1.hmac-sha256": testHMACKey, "k2.hmac-sha256": newKey})
+	for _, envelope := range []*messages.Envelope{oldMessage, newMessage} {
+		if err := verifier.Open(envelope); err != nil {
+			t.Errorf("failed to open envelope during rotation: %v", err)
+		}
+	}
+
+	// once the old key is removed, messages signed with it are rejected
+	if err := verifier.Load(&corev1.Secret{Data: map[string][]byte{"k2.hmac-sha256": newKey}}); err != nil {
+		t.Fatalf("failed to reload keyring: %v", err)
+	}
+	if err := verifier.Open(seal(t, old, putCluster("worker-a", "three"))); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("expected ErrUnauthenticated after removing the old key, got %v", err)
+	}
+}
+
+func TestKeyringLoadRejectsInvalidSecrets(t *testing.T) {
+	tests := map[string]map[string][]byte{
+		"unnamed key":         {"hmac-sha256": testHMACKey},
+		"unknown algorithm":   {"k1.rsa": testHMACKey},
+		"short hmac key":      {"k1.hmac-sha256": []byte("short")},
+		"missing signing key": {SigningKeyIDKey: []byte("k1")},
+		"public signing key":  {SigningKeyIDKey: []byte("k1"), "k1.ed25519-public": make([]byte, ed25519.PublicKeySize)},
+		"hmac encryption key": {EncryptionKeyIDKey: []byte("k1"), "k1.hmac-sha256": testHMACKey},
+		"duplicate key id":    {"k1.hmac-sha256": testHMACKey, "k1.aes-256-gcm": testAESKey},
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewKeyringFromSecret(&corev1.Secret{Data: data}); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestMemoryBusDeadLettersUnauthenticatedMessages(t *testing.T) {
+	b := NewMemoryBus()
+	l, err := b.NewListener(&ListenerConfig{
+		Region:       "eastus",
+		Environment:  "test",
+		UnderlayID:   "worker-a",
+		MessageTypes: []string{workers.PutClusterType},
+		Keyring:      newTestKeyring(t, map[string][]byte{"k1.hmac-sha256": testHMACKey}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	unsigned := b.NewPublisher(&PublisherConfig{Region: "eastus", Environment: "test"})
+	signed := b.NewPublisher(&PublisherConfig{
+		Region:      "eastus",
+		Environment: "test",
+		Keyring:     newTestKeyring(t, map[string][]byte{SigningKeyIDKey: []byte("k1"), "k1.hmac-sha256": testHMACKey}),
+	})
+	if err := unsigned.Publish(context.Background(), putCluster("worker-a", "forged")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	if err := signed.Publish(context.Background(), putCluster("worker-a", "signed")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	listenUntil(t, l, 1, func(ctx context.Context, md Metadata, m messages.Message) error {
+		if name := m.(*workers.PutCluster).Name; name != "signed" {
+			t.Errorf("handled unauthenticated cluster %s", name)
+		}
+		return nil
+	})
+	if got := len(l.DeadLetters()); got != 1 {
+		t.Errorf("expected 1 dead-lettered message, got %d", got)
+	}
+}
+
+func TestDispatchRejectsUnauthenticatedNonEnvelopePayloads(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		wantErr error
+	}{
+		{name: "no keyring"},
+		{name: "encryption only", keyring: newTestKeyring(t, map[string][]byte{"k2.aes-256-gcm": testAESKey})},
+		{
+			name:    "authenticating",
+			keyring: newTestKeyring(t, map[string][]byte{"k1.hmac-sha256": testHMACKey}),
+			wantErr: ErrUnauthenticated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fallback bool
+			d := NewDispatcher()
+			d.Fallback(func(ctx context.Context, md Metadata, data []byte) error {
+				fallback = true
+				return nil
+			})
+
+			err := dispatch(context.Background(), d, tt.keyring, Metadata{}, []byte("not json"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if fallback != (tt.wantErr == nil) {
+				t.Errorf("expected the fallback to be called %t, got %t", tt.wantErr == nil, fallback)
+			}
+		})
+	}
+}
@@ -0,0 +1,452 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/messages"
+)
+
+const (
+	defaultKubernetesTTL          = 24 * time.Hour
+	defaultKubernetesLockDuration = time.Minute
+	defaultKubernetesPollInterval = 2 * time.Second
+)
+
+// KubernetesBus is a bus backed by Message objects in a namespace of the
+// control plane cluster. Workers reach it with a kubeconfig for that cluster.
+type KubernetesBus struct {
+	Client    client.Client
+	Namespace string
+	// TTL is how long messages are kept, delivered or not
+	TTL time.Duration
+	// LockDuration is how long a listener has to handle a message before it is redelivered
+	LockDuration time.Duration
+	// PollInterval is how often listeners look for new messages
+	PollInterval time.Duration
+}
+
+// NewKubernetesBus returns a bus storing messages in the given namespace.
+func NewKubernetesBus(c client.Client, namespace string) *KubernetesBus {
+	return &KubernetesBus{
+		Client:       c,
+		Namespace:    namespace,
+		TTL:          defaultKubernetesTTL,
+		LockDuration: defaultKubernetesLockDuration,
+		PollInterval: defaultKubernetesPollInterval,
+	}
+}
+
+// NewPublisher returns a publisher creating messages in the region and environment's topic.
+func (b *KubernetesBus) NewPublisher(cfg *PublisherConfig) Publisher {
+	return &KubernetesPublisher{bus: b, topic: topicName(cfg.Environment, cfg.Region), keyring: cfg.Keyring}
+}
+
+// NewListener returns a listener receiving the messages of the region and
+// environment's topic addressed to the underlay.
+func (b *KubernetesBus) NewListener(cfg *ListenerConfig) (*KubernetesListener, error) {
+	selector, err := kubernetesSubscription(cfg, cfg.UnderlayID)
+	if err != nil {
+		return nil, err
+	}
+	broadcasts, err := kubernetesSubscription(cfg, messages.BroadcastId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KubernetesListener{
+		bus:        b,
+		underlayID: cfg.UnderlayID,
+		selector:   selector,
+		broadcasts: broadcasts,
+		copied:     map[string]bool{},
+		policy:     cfg.retryPolicy(),
+		keyring:    cfg.Keyring,
+	}, nil
+}
+
+// kubernetesSubscription returns the label selector of the messages of the
+// region and environment's topic addressed to the destination.
+func kubernetesSubscription(cfg *ListenerConfig, destinationId string) (labels.Selector, error) {
+	selector := labels.NewSelector()
+	for _, r := range []struct {
+		key    string
+		op     selection.Operator
+		values []string
+	}{
+		{v1alpha1.MessageTopicLabel, selection.Equals, []string{topicName(cfg.Environment, cfg.Region)}},
+		{v1alpha1.MessageDestinationLabel, selection.Equals, []string{destinationId}},
+		{v1alpha1.MessageTypeLabel, selection.In, cfg.MessageTypes},
+	} {
+		if len(r.values) == 0 {
+			continue
+		}
+		req, err := labels.NewRequirement(r.key, r.op, r.values)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subscription for %s: %w", cfg.UnderlayID, err)
+		}
+		selector = selector.Add(*req)
+	}
+	return selector, nil
+}
+
+// KubernetesPublisher publishes messages as Message objects.
+type KubernetesPublisher struct {
+	bus     *KubernetesBus
+	topic   string
+	keyring *Keyring
+}
+
+// Publish creates a Message named after the message id. Publishing a message
+// that already exists is a no-op.
+func (p *KubernetesPublisher) Publish(ctx context.Context, message messages.Message) error {
+	envelope, data, err := encodeMessage(message, p.keyring)
+	if err != nil {
+		return err
+	}
+
+	m := &v1alpha1.Message{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      envelope.Id.String(),
+			Namespace: p.bus.Namespace,
+			Labels: map[string]string{
+				v1alpha1.MessageTopicLabel:       p.topic,
+				v1alpha1.MessageDestinationLabel: envelope.DestinationId,
+				v1alpha1.MessageTypeLabel:        envelope.Type,
+			},
+		},
+		Spec: v1alpha1.MessageSpec{
+			Topic:          p.topic,
+			DestinationId:  envelope.DestinationId,
+			Type:           envelope.Type,
+			SchemaVersion:  envelope.SchemaVersion,
+			CorrelationId:  envelope.CorrelationId,
+			SessionId:      envelope.SessionId,
+			Timestamp:      metav1.NewMicroTime(envelope.Timestamp),
+			Data:           string(data),
+			ExpirationTime: metav1.NewTime(envelope.Timestamp.Add(p.bus.TTL)),
+		},
+	}
+	if err := p.bus.Client.Create(ctx, m); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create message %s: %w", m.Name, err)
+	}
+	return nil
+}
+
+// KubernetesListener receives the Messages matching its subscription.
+type KubernetesListener struct {
+	bus        *KubernetesBus
+	underlayID string
+	selector   labels.Selector
+	// broadcasts selects the broadcast Messages the listener copies to its subscription
+	broadcasts labels.Selector
+	// copied are the names of the broadcasts already copied
+	copied  map[string]bool
+	policy  *RetryPolicy
+	keyring *Keyring
+}
+
+// Listen polls for pending messages and hands them to the dispatcher until
+// ctx is done. A message is locked by bumping its delivery count before it is
+// dispatched, and acknowledged by setting its phase. Messages of a session are
+// handled in the order they were published: a message isn't delivered while
+// an earlier message of its session is locked or waiting to be retried.
+// Expired messages are deleted. A Message has a single delivery state, so
+// every listener copies the broadcasts it subscribes to before receiving them.
+func (l *KubernetesListener) Listen(ctx context.Context, d *Dispatcher) error {
+	ticker := time.NewTicker(l.bus.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		err := l.receive(ctx, d)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if err == nil {
+			listenerReady(ctx)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// copyBroadcasts creates the listener's copy of each broadcast it hasn't copied
+// yet. The copies expire with their broadcast, so a broadcast is copied again
+// at most once after a restart. Expired broadcasts are deleted.
+func (l *KubernetesListener) copyBroadcasts(ctx context.Context) error {
+	var list v1alpha1.MessageList
+	if err := l.bus.Client.List(ctx, &list,
+		client.InNamespace(l.bus.Namespace),
+		client.MatchingLabelsSelector{Selector: l.broadcasts}); err != nil {
+		return fmt.Errorf("failed to list broadcasts: %w", err)
+	}
+
+	copied := make(map[string]bool, len(list.Items))
+	for i := range list.Items {
+		b := &list.Items[i]
+		now := metav1.Now()
+		if b.Spec.ExpirationTime.Before(&now) {
+			if err := l.bus.Client.Delete(ctx, b); client.IgnoreNotFound(err) != nil {
+				return fmt.Errorf("failed to delete expired broadcast %s: %w", b.Name, err)
+			}
+			continue
+		}
+		if l.copied[b.Name] {
+			copied[b.Name] = true
+			continue
+		}
+
+		m := &v1alpha1.Message{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      b.Name + "-" + l.underlayID,
+				Namespace: b.Namespace,
+				Labels:    map[string]string{},
+			},
+			Spec: b.Spec,
+		}
+		for k, v := range b.Labels {
+			m.Labels[k] = v
+		}
+		m.Labels[v1alpha1.MessageDestinationLabel] = l.underlayID
+		m.Spec.DestinationId = l.underlayID
+		m.Spec.BroadcastName = b.Name
+		if err := l.bus.Client.Create(ctx, m); err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to copy broadcast %s: %w", b.Name, err)
+		}
+		copied[b.Name] = true
+	}
+	l.copied = copied
+	return nil
+}
+
+func (l *KubernetesListener) receive(ctx context.Context, d *Dispatcher) error {
+	if err := l.copyBroadcasts(ctx); err != nil {
+		return err
+	}
+
+	var list v1alpha1.MessageList
+	if err := l.bus.Client.List(ctx, &list,
+		client.InNamespace(l.bus.Namespace),
+		client.MatchingLabelsSelector{Selector: l.selector}); err != nil {
+		return fmt.Errorf("failed to list messages: %w", err)
+	}
+
+	sort.Slice(list.Items, func(i, j int) bool {
+		a, b := list.Items[i].Spec.Timestamp, list.Items[j].Spec.Timestamp
+		if a.Equal(&b) {
+			return list.Items[i].Name < list.Items[j].Name
+		}
+		return a.Before(&b)
+	})
+
+	blocked := map[string]bool{}
+	for i := range list.Items {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		m := &list.Items[i]
+		now := metav1.Now()
+		if m.Spec.ExpirationTime.Before(&now) {
+			if err := l.bus.Client.Delete(ctx, m); client.IgnoreNotFound(err) != nil {
+				return fmt.Errorf("failed to delete expired message %s: %w", m.Name, err)
+			}
+			continue
+		}
+		if m.Status.Phase != "" && m.Status.Phase != v1alpha1.MessagePending {
+			continue
+		}
+		if blocked[m.Spec.SessionId] {
+			continue
+		}
+		if m.Status.LockedUntil != nil && now.Before(m.Status.LockedUntil) {
+			blocked[m.Spec.SessionId] = true
+			continue
+		}
+
+		done, err := l.handle(ctx, d, m)
+		if err != nil {
+			return err
+		}
+		if !done {
+			blocked[m.Spec.SessionId] = true
+		}
+	}
+	return nil
+}
+
+// handle dispatches a message and reports whether it was completed or dead-lettered.
+func (l *KubernetesListener) handle(ctx context.Context, d *Dispatcher, m *v1alpha1.Message) (bool, error) {
+	lockedUntil := metav1.NewTime(time.Now().Add(l.bus.LockDuration))
+	m.Status.Phase = v1alpha1.MessagePending
+	m.Status.DeliveryCount++
+	m.Status.LockedUntil = &lockedUntil
+	if err := l.bus.Client.Status().Update(ctx, m); err != nil {
+		if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+			// another listener locked or deleted the message first
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to lock message %s: %w", m.Name, err)
+	}
+
+	// copies of a broadcast share its id
+	messageID := m.Name
+	if m.Spec.BroadcastName != "" {
+		messageID = m.Spec.BroadcastName
+	}
+	err := dispatch(ctx, d, l.keyring, Metadata{
+		MessageID:     messageID,
+		CorrelationID: m.Spec.CorrelationId,
+		SessionID:     m.Spec.SessionId,
+		DeliveryCount: uint32(m.Status.DeliveryCount),
+		EnqueuedTime:  m.CreationTimestamp.Time,
+	}, []byte(m.Spec.Data))
+
+	now := metav1.Now()
+	m.Status.LockedUntil = nil
+	o := l.policy.outcome(err, uint32(m.Status.DeliveryCount))
+	switch {
+	case o.deadLetter:
+		m.Status.Phase = v1alpha1.MessageDeadLettered
+		m.Status.CompletionTime = &now
+		m.Status.DeadLetterReason = o.reason
+		m.Status.Error = o.description
+	case o.retry && o.delay > 0:
+		// the lock keeps the message from being redelivered before the delay
+		retryAt := metav1.NewTime(now.Add(o.delay))
+		m.Status.LockedUntil = &retryAt
+		m.Status.Error = err.Error()
+	case o.retry:
+		m.Status.Error = err.Error()
+	default:
+		m.Status.Phase = v1alpha1.MessageCompleted
+		m.Status.CompletionTime = &now
+	}
+	if err := l.bus.Client.Status().Update(ctx, m); client.IgnoreNotFound(err) != nil {
+		return false, fmt.Errorf("failed to acknowledge message %s: %w", m.Name, err)
+	}
+	return m.Status.Phase != v1alpha1.MessagePending, nil
+}
+
+// NewDeadLetterQueue returns the dead-letter queue of the underlay's subscription.
+func (b *KubernetesBus) NewDeadLetterQueue(cfg *ListenerConfig) (*KubernetesDeadLetterQueue, error) {
+	l, err := b.NewListener(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &KubernetesDeadLetterQueue{bus: b, selector: l.selector}, nil
+}
+
+// KubernetesDeadLetterQueue manages the DeadLettered Messages of a subscription.
+type KubernetesDeadLetterQueue struct {
+	bus      *KubernetesBus
+	selector labels.Selector
+}
+
+func (q *KubernetesDeadLetterQueue) list(ctx context.Context) ([]v1alpha1.Message, error) {
+	var list v1alpha1.MessageList
+	if err := q.bus.Client.List(ctx, &list,
+		client.InNamespace(q.bus.Namespace),
+		client.MatchingLabelsSelector{Selector: q.selector}); err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+
+	var deadLetters []v1alpha1.Message
+	for _, m := range list.Items {
+		if m.Status.Phase == v1alpha1.MessageDeadLettered {
+			deadLetters = append(deadLetters, m)
+		}
+	}
+	sort.Slice(deadLetters, func(i, j int) bool {
+		a, b := deadLetters[i].CreationTimestamp, deadLetters[j].CreationTimestamp
+		return a.Before(&b)
+	})
+	return deadLetters, nil
+}
+
+func (q *KubernetesDeadLetterQueue) get(ctx context.Context, messageID string) (*v1alpha1.Message, error) {
+	var m v1alpha1.Message
+	if err := q.bus.Client.Get(ctx, client.ObjectKey{Namespace: q.bus.Namespace, Name: messageID}, &m); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %s", ErrDeadLetterNotFound, messageID)
+		}
+		return nil, fmt.Errorf("failed to get message %s: %w", messageID, err)
+	}
+	if m.Status.Phase != v1alpha1.MessageDeadLettered || !q.selector.Matches(labels.Set(m.Labels)) {
+		return nil, fmt.Errorf("%w: %s", ErrDeadLetterNotFound, messageID)
+	}
+	return &m, nil
+}
+
+// List returns the DeadLettered Messages, oldest first.
+func (q *KubernetesDeadLetterQueue) List(ctx context.Context) ([]DeadLetteredMessage, error) {
+	deadLetters, err := q.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]DeadLetteredMessage, len(deadLetters))
+	for i, m := range deadLetters {
+		list[i] = DeadLetteredMessage{
+			MessageID:     m.Name,
+			Type:          m.Spec.Type,
+			Reason:        m.Status.DeadLetterReason,
+			Description:   m.Status.Error,
+			DeliveryCount: uint32(m.Status.DeliveryCount),
+			EnqueuedTime:  m.CreationTimestamp.Time,
+			Data:          []byte(m.Spec.Data),
+		}
+	}
+	return list, nil
+}
+
+// Resubmit makes the Message pending again with a fresh delivery count. Its
+// expiration time is left alone.
+func (q *KubernetesDeadLetterQueue) Resubmit(ctx context.Context, messageID string) error {
+	m, err := q.get(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	m.Status = v1alpha1.MessageStatus{Phase: v1alpha1.MessagePending}
+	if err := q.bus.Client.Status().Update(ctx, m); err != nil {
+		return fmt.Errorf("failed to resubmit message %s: %w", messageID, err)
+	}
+	return nil
+}
+
+// Purge deletes the DeadLettered Message, or all of them.
+func (q *KubernetesDeadLetterQueue) Purge(ctx context.Context, messageID string) error {
+	var deadLetters []v1alpha1.Message
+	if messageID == "" {
+		var err error
+		if deadLetters, err = q.list(ctx); err != nil {
+			return err
+		}
+	} else {
+		m, err := q.get(ctx, messageID)
+		if err != nil {
+			return err
+		}
+		deadLetters = []v1alpha1.Message{*m}
+	}
+
+	for i := range deadLetters {
+		if err := q.bus.Client.Delete(ctx, &deadLetters[i]); client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("failed to delete message %s: %w", deadLetters[i].Name, err)
+		}
+	}
+	return nil
+}
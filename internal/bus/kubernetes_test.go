@@ -0,0 +1,187 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	"github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+// startTestEnv starts an api server with carp's CRDs, skipping the test when
+// the envtest binaries aren't installed.
+func startTestEnv(t *testing.T) client.Client {
+	t.Helper()
+	testEnv := &envtest.Environment{
+		CRDDirectoryPaths: []string{filepath.Join("..", "..", "config", "crd", "bases")},
+	}
+	cfg, err := testEnv.Start()
+	if err != nil {
+		t.Skipf("envtest unavailable: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = testEnv.Stop()
+	})
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "carp-system"}}
+	if err := c.Create(context.Background(), ns); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newTestKubernetesBus(t *testing.T) *KubernetesBus {
+	b := NewKubernetesBus(startTestEnv(t), "carp-system")
+	b.PollInterval = 100 * time.Millisecond
+	return b
+}
+
+func TestKubernetesBusDeliversToDestination(t *testing.T) {
+	b := newTestKubernetesBus(t)
+	ctx := context.Background()
+	p := b.NewPublisher(&PublisherConfig{Region: "eastus", Environment: "test"})
+	l, err := b.NewListener(&ListenerConfig{
+		Region:       "eastus",
+		Environment:  "test",
+		UnderlayID:   "worker-a",
+		MessageTypes: []string{workers.PutClusterType},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mine := putCluster("worker-a", "one")
+	for _, cmd := range []workers.PutCluster{mine, putCluster("worker-b", "two")} {
+		if err := p.Publish(ctx, cmd); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	// publishing the same message twice is a no-op
+	if err := p.Publish(ctx, mine); err != nil {
+		t.Fatalf("failed to republish: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var handled []Metadata
+	d := NewDispatcher()
+	d.Handle(workers.PutClusterType, func(ctx context.Context, md Metadata, m messages.Message) error {
+		handled = append(handled, md)
+		if len(handled) == 1 {
+			// abandon the first delivery so the message is redelivered
+			return errors.New("transient failure")
+		}
+		cancel()
+		return nil
+	})
+	if err := l.Listen(ctx, d); err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	if len(handled) != 2 || handled[1].MessageID != mine.Id.String() || handled[1].DeliveryCount != 2 {
+		t.Fatalf("expected %s to be delivered twice, got %+v", mine.Id, handled)
+	}
+
+	var m v1alpha1.Message
+	if err := b.Client.Get(context.Background(), client.ObjectKey{Namespace: "carp-system", Name: mine.Id.String()}, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Status.Phase != v1alpha1.MessageCompleted {
+		t.Errorf("expected message to be completed, got %s", m.Status.Phase)
+	}
+}
+
+func TestKubernetesBusDeletesExpiredMessages(t *testing.T) {
+	b := newTestKubernetesBus(t)
+	b.TTL = -time.Minute
+	ctx := context.Background()
+	p := b.NewPublisher(&PublisherConfig{Region: "eastus", Environment: "test"})
+	l, err := b.NewListener(&ListenerConfig{Region: "eastus", Environment: "test", UnderlayID: "worker-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := putCluster("worker-a", "one")
+	if err := p.Publish(ctx, cmd); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	d := NewDispatcher()
+	d.Fallback(func(ctx context.Context, md Metadata, data []byte) error {
+		t.Errorf("expired message %s was delivered", md.MessageID)
+		return nil
+	})
+	if err := l.receive(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+
+	var list v1alpha1.MessageList
+	if err := b.Client.List(ctx, &list, client.InNamespace("carp-system")); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 0 {
+		t.Errorf("expected expired messages to be deleted, found %d", len(list.Items))
+	}
+}
+
+func TestKubernetesBusCopiesBroadcasts(t *testing.T) {
+	b := newTestKubernetesBus(t)
+	ctx := context.Background()
+	p := b.NewPublisher(&PublisherConfig{Region: "eastus", Environment: "test"})
+
+	broadcast := putCluster(messages.BroadcastId, "one")
+	if err := p.Publish(ctx, broadcast); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	for _, worker := range []string{"worker-a", "worker-b"} {
+		l, err := b.NewListener(&ListenerConfig{
+			Region:       "eastus",
+			Environment:  "test",
+			UnderlayID:   worker,
+			MessageTypes: []string{workers.PutClusterType},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var handled []Metadata
+		d := NewDispatcher()
+		d.Handle(workers.PutClusterType, func(ctx context.Context, md Metadata, m messages.Message) error {
+			handled = append(handled, md)
+			return nil
+		})
+		// the broadcast is copied and delivered once however often the listener receives
+		for i := 0; i < 3; i++ {
+			if err := l.receive(ctx, d); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(handled) != 1 || handled[0].MessageID != broadcast.Id.String() {
+			t.Fatalf("expected %s to receive %s once, got %+v", worker, broadcast.Id, handled)
+		}
+	}
+}
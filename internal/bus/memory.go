@@ -0,0 +1,406 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juan-lee/carp/internal/messages"
+)
+
+// MemoryBus is an in-process bus with the same topic, subscription and
+// session semantics as service bus. It is meant for tests and for running the
+// control plane and a worker in the same process.
+type MemoryBus struct {
+	mu     sync.Mutex
+	topics map[string]map[string]*memorySubscription
+}
+
+// NewMemoryBus returns an empty in-process bus.
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{topics: map[string]map[string]*memorySubscription{}}
+}
+
+// NewPublisher returns a publisher sending to the topic of the region and environment.
+func (b *MemoryBus) NewPublisher(cfg *PublisherConfig) Publisher {
+	return &MemoryPublisher{bus: b, topic: topicName(cfg.Environment, cfg.Region), keyring: cfg.Keyring}
+}
+
+// NewListener creates the underlay's subscription, if needed, and returns a
+// listener receiving from it. Messages published after NewListener returns are
+// delivered even if Listen hasn't been called yet.
+func (b *MemoryBus) NewListener(cfg *ListenerConfig) (*MemoryListener, error) {
+	// like service bus, a message is received when any rule matches
+	var rules []func(map[string]interface{}) bool
+	for _, filter := range subscriptionRules(cfg.UnderlayID, cfg.MessageTypes) {
+		rule, err := parseFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	sub := b.subscription(cfg)
+	sub.setMatch(func(properties map[string]interface{}) bool {
+		for _, rule := range rules {
+			if rule(properties) {
+				return true
+			}
+		}
+		return false
+	})
+
+	return &MemoryListener{sub: sub, policy: cfg.retryPolicy(), keyring: cfg.Keyring}, nil
+}
+
+// subscription returns the underlay's subscription, creating it without a
+// rule if needed.
+func (b *MemoryBus) subscription(cfg *ListenerConfig) *memorySubscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topic := topicName(cfg.Environment, cfg.Region)
+	if b.topics[topic] == nil {
+		b.topics[topic] = map[string]*memorySubscription{}
+	}
+	sub := b.topics[topic][cfg.UnderlayID]
+	if sub == nil {
+		sub = &memorySubscription{
+			match: func(map[string]interface{}) bool { return false },
+			ready: make(chan struct{}, 1),
+		}
+		b.topics[topic][cfg.UnderlayID] = sub
+	}
+	return sub
+}
+
+func (b *MemoryBus) send(topic string, m *memoryMessage) {
+	b.mu.Lock()
+	subs := make([]*memorySubscription, 0, len(b.topics[topic]))
+	for _, sub := range b.topics[topic] {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.send(m)
+	}
+}
+
+// MemoryPublisher publishes to a MemoryBus topic.
+type MemoryPublisher struct {
+	bus     *MemoryBus
+	topic   string
+	keyring *Keyring
+}
+
+// Publish wraps the message in an envelope and sends it to every subscription
+// of the topic whose rule matches.
+func (p *MemoryPublisher) Publish(ctx context.Context, message messages.Message) error {
+	envelope, data, err := encodeMessage(message, p.keyring)
+	if err != nil {
+		return err
+	}
+
+	p.bus.send(p.topic, &memoryMessage{
+		id:            envelope.Id.String(),
+		correlationID: envelope.CorrelationId,
+		sessionID:     envelope.SessionId,
+		data:          data,
+		properties: map[string]interface{}{
+			destinationIdProperty: envelope.DestinationId,
+			typeProperty:          envelope.Type,
+			schemaVersionProperty: envelope.SchemaVersion,
+		},
+	})
+	return nil
+}
+
+// MemoryListener receives from a MemoryBus subscription.
+type MemoryListener struct {
+	sub     *memorySubscription
+	policy  *RetryPolicy
+	keyring *Keyring
+}
+
+// Listen hands messages to the dispatcher until ctx is done. Handled messages
+// are completed. Failed messages are redelivered after the retry policy's
+// delay, and are dead-lettered when the policy gives up on them. No other
+// message of a session is delivered until the message before it is completed
+// or dead-lettered.
+func (l *MemoryListener) Listen(ctx context.Context, d *Dispatcher) error {
+	// the subscription was made when the listener was created
+	listenerReady(ctx)
+	for {
+		m, ok := l.sub.receive(ctx)
+		if !ok {
+			return nil
+		}
+
+		err := dispatch(ctx, d, l.keyring, Metadata{
+			MessageID:     m.id,
+			CorrelationID: m.correlationID,
+			SessionID:     m.sessionID,
+			DeliveryCount: m.deliveryCount,
+			EnqueuedTime:  m.enqueuedTime,
+		}, m.data)
+		o := l.policy.outcome(err, m.deliveryCount)
+		switch {
+		case o.deadLetter:
+			m.deadLetterReason, m.deadLetterDescription = o.reason, o.description
+			l.sub.deadLetter(m)
+		case o.retry && o.delay > 0:
+			time.AfterFunc(o.delay, func() { l.sub.abandon(m) })
+		case o.retry:
+			l.sub.abandon(m)
+		default:
+			l.sub.complete(m)
+		}
+	}
+}
+
+// DeadLetters returns the data of the dead-lettered messages of the subscription.
+func (l *MemoryListener) DeadLetters() [][]byte {
+	l.sub.mu.Lock()
+	defer l.sub.mu.Unlock()
+
+	data := make([][]byte, len(l.sub.deadLetters))
+	for i, m := range l.sub.deadLetters {
+		data[i] = m.data
+	}
+	return data
+}
+
+// NewDeadLetterQueue returns the dead-letter queue of the underlay's
+// subscription. Resubmitted messages are requeued on the subscription.
+func (b *MemoryBus) NewDeadLetterQueue(cfg *ListenerConfig) (*MemoryDeadLetterQueue, error) {
+	return &MemoryDeadLetterQueue{sub: b.subscription(cfg)}, nil
+}
+
+// MemoryDeadLetterQueue manages the dead-lettered messages of a MemoryBus subscription.
+type MemoryDeadLetterQueue struct {
+	sub *memorySubscription
+}
+
+// List returns the dead-lettered messages, oldest first.
+func (q *MemoryDeadLetterQueue) List(ctx context.Context) ([]DeadLetteredMessage, error) {
+	q.sub.mu.Lock()
+	defer q.sub.mu.Unlock()
+
+	list := make([]DeadLetteredMessage, len(q.sub.deadLetters))
+	for i, m := range q.sub.deadLetters {
+		list[i] = DeadLetteredMessage{
+			MessageID:     m.id,
+			Type:          envelopeType(m.data),
+			Reason:        m.deadLetterReason,
+			Description:   m.deadLetterDescription,
+			DeliveryCount: m.deliveryCount,
+			EnqueuedTime:  m.enqueuedTime,
+			Data:          m.data,
+		}
+	}
+	return list, nil
+}
+
+// Resubmit requeues the dead-lettered message with a fresh delivery count.
+func (q *MemoryDeadLetterQueue) Resubmit(ctx context.Context, messageID string) error {
+	m, err := q.remove(messageID)
+	if err != nil {
+		return err
+	}
+	m.deliveryCount = 0
+	m.deadLetterReason, m.deadLetterDescription = "", ""
+	q.sub.enqueue(m)
+	return nil
+}
+
+// Purge removes the dead-lettered message, or all of them.
+func (q *MemoryDeadLetterQueue) Purge(ctx context.Context, messageID string) error {
+	if messageID == "" {
+		q.sub.mu.Lock()
+		defer q.sub.mu.Unlock()
+		q.sub.deadLetters = nil
+		return nil
+	}
+	_, err := q.remove(messageID)
+	return err
+}
+
+func (q *MemoryDeadLetterQueue) remove(messageID string) (*memoryMessage, error) {
+	q.sub.mu.Lock()
+	defer q.sub.mu.Unlock()
+
+	for i, m := range q.sub.deadLetters {
+		if m.id == messageID {
+			q.sub.deadLetters = append(q.sub.deadLetters[:i], q.sub.deadLetters[i+1:]...)
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrDeadLetterNotFound, messageID)
+}
+
+type memoryMessage struct {
+	id            string
+	correlationID string
+	sessionID     string
+	data          []byte
+	properties    map[string]interface{}
+	enqueuedTime  time.Time
+	deliveryCount uint32
+	// deadLetterReason and deadLetterDescription are set when the message is dead-lettered
+	deadLetterReason      string
+	deadLetterDescription string
+}
+
+type memorySubscription struct {
+	mu          sync.Mutex
+	match       func(map[string]interface{}) bool
+	queue       []*memoryMessage
+	deadLetters []*memoryMessage
+	// locked holds the sessions with a message being handled or waiting to be retried
+	locked map[string]bool
+	// ready is signalled whenever a message is queued
+	ready chan struct{}
+}
+
+func (s *memorySubscription) setMatch(match func(map[string]interface{}) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.match = match
+}
+
+func (s *memorySubscription) send(m *memoryMessage) {
+	s.mu.Lock()
+	match := s.match(m.properties)
+	s.mu.Unlock()
+	if !match {
+		return
+	}
+
+	copied := *m
+	copied.enqueuedTime = time.Now()
+	s.enqueue(&copied)
+}
+
+// enqueue adds the message to the tail of the queue.
+func (s *memorySubscription) enqueue(m *memoryMessage) {
+	s.mu.Lock()
+	s.queue = append(s.queue, m)
+	s.mu.Unlock()
+
+	s.signal()
+}
+
+// receive returns the first queued message whose session isn't locked, and
+// locks its session.
+func (s *memorySubscription) receive(ctx context.Context) (*memoryMessage, bool) {
+	for {
+		s.mu.Lock()
+		for i, m := range s.queue {
+			if s.locked[m.sessionID] {
+				continue
+			}
+			s.queue = append(s.queue[:i:i], s.queue[i+1:]...)
+			m.deliveryCount++
+			if s.locked == nil {
+				s.locked = map[string]bool{}
+			}
+			s.locked[m.sessionID] = true
+			s.mu.Unlock()
+			return m, true
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.ready:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// complete unlocks the session of a handled message.
+func (s *memorySubscription) complete(m *memoryMessage) {
+	s.mu.Lock()
+	delete(s.locked, m.sessionID)
+	s.mu.Unlock()
+
+	s.signal()
+}
+
+// abandon puts the message back at the head of the queue for redelivery and
+// unlocks its session.
+func (s *memorySubscription) abandon(m *memoryMessage) {
+	s.mu.Lock()
+	s.queue = append([]*memoryMessage{m}, s.queue...)
+	delete(s.locked, m.sessionID)
+	s.mu.Unlock()
+
+	s.signal()
+}
+
+func (s *memorySubscription) deadLetter(m *memoryMessage) {
+	s.mu.Lock()
+	s.deadLetters = append(s.deadLetters, m)
+	delete(s.locked, m.sessionID)
+	s.mu.Unlock()
+
+	s.signal()
+}
+
+func (s *memorySubscription) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+var (
+	equalsClause = regexp.MustCompile(`^(\w+) = '([^']*)'$`)
+	inClause     = regexp.MustCompile(`^(\w+) IN \((.*)\)$`)
+	quotedValue  = regexp.MustCompile(`^'([^']*)'$`)
+)
+
+// parseFilter parses the subset of the service bus sql filter syntax produced
+// by subscriptionFilter: equality and IN clauses on string properties joined
+// by AND.
+func parseFilter(expr string) (func(map[string]interface{}) bool, error) {
+	type clause struct {
+		property string
+		values   map[string]bool
+	}
+
+	var clauses []clause
+	for _, c := range strings.Split(expr, " AND ") {
+		if m := equalsClause.FindStringSubmatch(c); m != nil {
+			clauses = append(clauses, clause{property: m[1], values: map[string]bool{m[2]: true}})
+			continue
+		}
+		if m := inClause.FindStringSubmatch(c); m != nil {
+			values := map[string]bool{}
+			for _, v := range strings.Split(m[2], ", ") {
+				q := quotedValue.FindStringSubmatch(v)
+				if q == nil {
+					return nil, fmt.Errorf("unsupported value %q in filter %q", v, expr)
+				}
+				values[q[1]] = true
+			}
+			clauses = append(clauses, clause{property: m[1], values: values})
+			continue
+		}
+		return nil, fmt.Errorf("unsupported clause %q in filter %q", c, expr)
+	}
+
+	return func(properties map[string]interface{}) bool {
+		for _, c := range clauses {
+			v, ok := properties[c.property].(string)
+			if !ok || !c.values[v] {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
@@ -0,0 +1,287 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+func newMemoryListener(t *testing.T, b *MemoryBus, underlayID string) *MemoryListener {
+	t.Helper()
+	l, err := b.NewListener(&ListenerConfig{
+		Region:       "eastus",
+		Environment:  "test",
+		UnderlayID:   underlayID,
+		MessageTypes: []string{workers.PutClusterType},
+	})
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	return l
+}
+
+func putCluster(destination, name string) workers.PutCluster {
+	return workers.PutCluster{
+		Command:   messages.Command{Id: uuid.New(), DestinationId: destination},
+		Name:      name,
+		Namespace: "default",
+	}
+}
+
+// listenUntil listens until n messages have been handled by h.
+func listenUntil(t *testing.T, l Listener, n int, h HandlerFunc) []Metadata {
+	t.Helper()
+	return listenLabelledUntil(t, l, nil, n, h)
+}
+
+// listenLabelledUntil listens as a recipient with the given labels until n
+// messages have been handled by h.
+func listenLabelledUntil(t *testing.T, l Listener, labels map[string]string, n int, h HandlerFunc) []Metadata {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var handled []Metadata
+	d := NewDispatcher()
+	d.Labels(labels)
+	d.Handle(workers.PutClusterType, func(ctx context.Context, md Metadata, m messages.Message) error {
+		handled = append(handled, md)
+		if len(handled) == n {
+			defer cancel()
+		}
+		return h(ctx, md, m)
+	})
+	if err := l.Listen(ctx, d); err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	if len(handled) != n {
+		t.Fatalf("handled %d messages, expected %d", len(handled), n)
+	}
+	return handled
+}
+
+func TestMemoryBusFiltersByDestination(t *testing.T) {
+	b := NewMemoryBus()
+	a := newMemoryListener(t, b, "worker-a")
+	other := newMemoryListener(t, b, "worker-b")
+	p := b.NewPublisher(&PublisherConfig{Region: "eastus", Environment: "test"})
+
+	for _, cmd := range []workers.PutCluster{putCluster("worker-a", "one"), putCluster("worker-b", "two"), putCluster("worker-a", "three")} {
+		if err := p.Publish(context.Background(), cmd); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	// status events are addressed to the control plane and filtered by type
+	if err := p.Publish(context.Background(), workers.ClusterStatusChanged{}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	var names []string
+	listenUntil(t, a, 2, func(ctx context.Context, md Metadata, m messages.Message) error {
+		names = append(names, m.(*workers.PutCluster).Name)
+		return nil
+	})
+	if len(names) != 2 || names[0] != "one" || names[1] != "three" {
+		t.Errorf("worker-a received %v, expected [one three]", names)
+	}
+	if got := len(other.sub.queue); got != 1 {
+		t.Errorf("worker-b has %d queued messages, expected 1", got)
+	}
+}
+
+func TestMemoryBusBroadcastsToSelectedListeners(t *testing.T) {
+	b := NewMemoryBus()
+	east := newMemoryListener(t, b, "worker-a")
+	west := newMemoryListener(t, b, "worker-b")
+	p := b.NewPublisher(&PublisherConfig{Region: "eastus", Environment: "test"})
+
+	selected := putCluster(messages.BroadcastId, "east-only")
+	selected.Selector = messages.Selector{"topology.kubernetes.io/region": "eastus"}
+	for _, cmd := range []workers.PutCluster{selected, putCluster(messages.BroadcastId, "all"), putCluster("worker-b", "direct")} {
+		if err := p.Publish(context.Background(), cmd); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		listener *MemoryListener
+		region   string
+		expected []string
+	}{
+		{east, "eastus", []string{"east-only", "all"}},
+		{west, "westus", []string{"all", "direct"}},
+	} {
+		var names []string
+		labels := map[string]string{"topology.kubernetes.io/region": tc.region}
+		listenLabelledUntil(t, tc.listener, labels, len(tc.expected), func(ctx context.Context, md Metadata, m messages.Message) error {
+			names = append(names, m.(*workers.PutCluster).Name)
+			return nil
+		})
+		for i := range tc.expected {
+			if names[i] != tc.expected[i] {
+				t.Fatalf("expected %s to handle %v, got %v", tc.region, tc.expected, names)
+			}
+		}
+	}
+}
+
+func TestMemoryBusRedeliversAbandonedMessages(t *testing.T) {
+	b := NewMemoryBus()
+	l := newMemoryListener(t, b, "worker-a")
+	p := b.NewPublisher(&PublisherConfig{Region: "eastus", Environment: "test"})
+	if err := p.Publish(context.Background(), putCluster("worker-a", "one")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	handled := listenUntil(t, l, 2, func(ctx context.Context, md Metadata, m messages.Message) error {
+		if md.DeliveryCount == 1 {
+			return errors.New("transient failure")
+		}
+		return nil
+	})
+	if handled[0].MessageID != handled[1].MessageID || handled[1].DeliveryCount != 2 {
+		t.Errorf("expected the same message to be redelivered, got %+v", handled)
+	}
+	if len(l.sub.queue) != 0 || len(l.DeadLetters()) != 0 {
+		t.Errorf("expected the message to be completed")
+	}
+}
+
+func TestMemoryBusDeadLettersMalformedMessages(t *testing.T) {
+	b := NewMemoryBus()
+	l := newMemoryListener(t, b, "worker-a")
+	p := b.NewPublisher(&PublisherConfig{Region: "eastus", Environment: "test"})
+	if err := p.Publish(context.Background(), putCluster("worker-a", "one")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	listenUntil(t, l, 1, func(ctx context.Context, md Metadata, m messages.Message) error {
+		return ErrMalformed
+	})
+	if got := len(l.DeadLetters()); got != 1 {
+		t.Errorf("expected 1 dead-lettered message, got %d", got)
+	}
+}
+
+func TestMemoryBusDelaysRetries(t *testing.T) {
+	b := NewMemoryBus()
+	l, err := b.NewListener(&ListenerConfig{
+		Region:       "eastus",
+		Environment:  "test",
+		UnderlayID:   "worker-a",
+		MessageTypes: []string{workers.PutClusterType},
+		RetryPolicy:  &RetryPolicy{MaxDeliveries: 3, Backoff: 100 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	p := b.NewPublisher(&PublisherConfig{Region: "eastus", Environment: "test"})
+	if err := p.Publish(context.Background(), putCluster("worker-a", "one")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	var deliveries []time.Time
+	listenUntil(t, l, 2, func(ctx context.Context, md Metadata, m messages.Message) error {
+		deliveries = append(deliveries, time.Now())
+		if md.DeliveryCount == 1 {
+			return errors.New("transient failure")
+		}
+		return nil
+	})
+	if delay := deliveries[1].Sub(deliveries[0]); delay < 100*time.Millisecond {
+		t.Errorf("redelivered after %v, expected at least 100ms", delay)
+	}
+}
+
+func TestMemoryDeadLetterQueue(t *testing.T) {
+	b := NewMemoryBus()
+	l := newMemoryListener(t, b, "worker-a")
+	p := b.NewPublisher(&PublisherConfig{Region: "eastus", Environment: "test"})
+	for _, name := range []string{"one", "two"} {
+		if err := p.Publish(context.Background(), putCluster("worker-a", name)); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	listenUntil(t, l, 2, func(ctx context.Context, md Metadata, m messages.Message) error {
+		return DeadLetter("QuotaExceeded", "no capacity for "+m.(*workers.PutCluster).Name)
+	})
+
+	q, err := b.NewDeadLetterQueue(&ListenerConfig{Region: "eastus", Environment: "test", UnderlayID: "worker-a"})
+	if err != nil {
+		t.Fatalf("failed to open dead-letter queue: %v", err)
+	}
+	deadLetters, err := q.List(context.Background())
+	if err != nil || len(deadLetters) != 2 {
+		t.Fatalf("expected 2 dead-lettered messages, got %v, %v", deadLetters, err)
+	}
+	if m := deadLetters[0]; m.Reason != "QuotaExceeded" || m.Description != "no capacity for one" || m.Type != workers.PutClusterType {
+		t.Errorf("unexpected dead-lettered message %+v", m)
+	}
+
+	if err := q.Resubmit(context.Background(), deadLetters[0].MessageID); err != nil {
+		t.Fatalf("failed to resubmit: %v", err)
+	}
+	handled := listenUntil(t, l, 1, func(ctx context.Context, md Metadata, m messages.Message) error {
+		return nil
+	})
+	if handled[0].MessageID != deadLetters[0].MessageID || handled[0].DeliveryCount != 1 {
+		t.Errorf("expected the resubmitted message with a fresh delivery count, got %+v", handled[0])
+	}
+
+	if err := q.Purge(context.Background(), "unknown"); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("expected purging an unknown message to fail, got %v", err)
+	}
+	if err := q.Purge(context.Background(), ""); err != nil {
+		t.Fatalf("failed to purge: %v", err)
+	}
+	if deadLetters, _ := q.List(context.Background()); len(deadLetters) != 0 {
+		t.Errorf("expected the queue to be empty, got %d messages", len(deadLetters))
+	}
+}
+
+func TestMemoryBusKeepsSessionsInOrder(t *testing.T) {
+	b := NewMemoryBus()
+	l, err := b.NewListener(&ListenerConfig{
+		Region:       "eastus",
+		Environment:  "test",
+		UnderlayID:   "worker-a",
+		MessageTypes: []string{workers.PutClusterType},
+		RetryPolicy:  &RetryPolicy{MaxDeliveries: 3, Backoff: 50 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	p := b.NewPublisher(&PublisherConfig{Region: "eastus", Environment: "test"})
+
+	// one and two are commands about the same cluster, other is about another cluster
+	first, second, other := putCluster("worker-a", "one"), putCluster("worker-a", "one"), putCluster("worker-a", "other")
+	for _, cmd := range []workers.PutCluster{first, second, other} {
+		if err := p.Publish(context.Background(), cmd); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	var handled []uuid.UUID
+	listenUntil(t, l, 4, func(ctx context.Context, md Metadata, m messages.Message) error {
+		handled = append(handled, m.MessageID())
+		if m.MessageID() == first.Id && md.DeliveryCount == 1 {
+			return errors.New("transient failure")
+		}
+		return nil
+	})
+
+	// the other cluster isn't held up by the retry, but the second command waits for the first
+	expected := []uuid.UUID{first.Id, other.Id, first.Id, second.Id}
+	for i := range expected {
+		if handled[i] != expected[i] {
+			t.Fatalf("handled %v, expected %v", handled, expected)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package bus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var duplicateMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "carp_bus_duplicate_messages_total",
+	Help: "Number of received messages that had already been handled, by message type.",
+}, []string{"type"})
+
+var listenerRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "carp_bus_listener_restarts_total",
+	Help: "Number of times a failed listener was restarted, by listener.",
+}, []string{"listener"})
+
+func init() {
+	metrics.Registry.MustRegister(duplicateMessages, listenerRestarts)
+}
@@ -0,0 +1,319 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/juan-lee/carp/internal/messages"
+)
+
+const (
+	defaultNATSMaxAge    = 24 * time.Hour
+	defaultNATSFetchWait = 5 * time.Second
+	// natsFetchBatch is one because a consumer has a single message in
+	// flight, which keeps the messages of every session in order
+	natsFetchBatch = 1
+)
+
+// NATSBus is a bus backed by NATS JetStream. Each topic is a stream whose
+// subjects are <topic>.<destinationId>.<type>, and each subscription is a
+// durable pull consumer named after the underlay and filtered by its
+// destination subject, plus a <underlay>-broadcast consumer of the broadcast
+// subject.
+type NATSBus struct {
+	js nats.JetStreamContext
+	// MaxAge is how long a stream keeps messages
+	MaxAge time.Duration
+	// FetchWait is how long a listener waits for messages before fetching again
+	FetchWait time.Duration
+}
+
+// NewNATSBus returns a bus using the JetStream of the connection.
+func NewNATSBus(conn *nats.Conn) (*NATSBus, error) {
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get jetstream context: %w", err)
+	}
+	return &NATSBus{js: js, MaxAge: defaultNATSMaxAge, FetchWait: defaultNATSFetchWait}, nil
+}
+
+// ensureStream creates the stream of a topic if it doesn't exist.
+func (b *NATSBus) ensureStream(topic string) error {
+	if _, err := b.js.StreamInfo(topic); err == nil {
+		return nil
+	}
+
+	_, err := b.js.AddStream(&nats.StreamConfig{
+		Name:     topic,
+		Subjects: []string{topic + ".>"},
+		Storage:  nats.FileStorage,
+		MaxAge:   b.MaxAge,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create stream %s: %w", topic, err)
+	}
+	return nil
+}
+
+// validateNATSToken rejects names that can't be a single token of a subject,
+// nor a stream or durable consumer name: empty names and names containing
+// dots, wildcards, whitespace or path separators.
+func validateNATSToken(kind, name string) error {
+	if name == "" || strings.ContainsAny(name, ".*>/\\ \t\r\n") {
+		return fmt.Errorf("invalid %s %q: nats names must be non-empty and must not contain '.', '*', '>', '/', '\\' or whitespace", kind, name)
+	}
+	return nil
+}
+
+// NewPublisher returns a publisher sending to the region and environment's stream.
+func (b *NATSBus) NewPublisher(cfg *PublisherConfig) (*NATSPublisher, error) {
+	topic := topicName(cfg.Environment, cfg.Region)
+	if err := validateNATSToken("topic", topic); err != nil {
+		return nil, err
+	}
+	if err := b.ensureStream(topic); err != nil {
+		return nil, err
+	}
+	return &NATSPublisher{bus: b, topic: topic, keyring: cfg.Keyring}, nil
+}
+
+// NewListener returns a listener receiving the messages of the region and
+// environment's stream addressed to the underlay.
+func (b *NATSBus) NewListener(cfg *ListenerConfig) (*NATSListener, error) {
+	topic := topicName(cfg.Environment, cfg.Region)
+	if err := validateNATSToken("topic", topic); err != nil {
+		return nil, err
+	}
+	if err := validateNATSToken("underlay id", cfg.UnderlayID); err != nil {
+		return nil, err
+	}
+	for _, t := range cfg.MessageTypes {
+		if err := validateNATSToken("message type", t); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.ensureStream(topic); err != nil {
+		return nil, err
+	}
+
+	// a consumer has a single filter subject, so several types are filtered by the listener
+	subject := func(destinationId string) string {
+		if len(cfg.MessageTypes) == 1 {
+			return natsSubject(topic, destinationId, cfg.MessageTypes[0])
+		}
+		return fmt.Sprintf("%s.%s.*", topic, destinationId)
+	}
+
+	types := map[string]bool{}
+	for _, t := range cfg.MessageTypes {
+		types[t] = true
+	}
+
+	return &NATSListener{
+		bus: b,
+		consumers: []natsConsumer{
+			{subject: subject(cfg.UnderlayID), durable: cfg.UnderlayID},
+			{subject: subject(messages.BroadcastId), durable: cfg.UnderlayID + "-broadcast"},
+		},
+		types:   types,
+		policy:  cfg.retryPolicy(),
+		keyring: cfg.Keyring,
+	}, nil
+}
+
+func natsSubject(topic, destinationId, messageType string) string {
+	return fmt.Sprintf("%s.%s.%s", topic, destinationId, messageType)
+}
+
+// NATSPublisher publishes to a JetStream stream.
+type NATSPublisher struct {
+	bus     *NATSBus
+	topic   string
+	keyring *Keyring
+}
+
+// Publish sends the message to its destination's subject. The message id is
+// used as the JetStream message id, so republishing within the stream's
+// duplicate window is a no-op.
+func (p *NATSPublisher) Publish(ctx context.Context, message messages.Message) error {
+	envelope, data, err := encodeMessage(message, p.keyring)
+	if err != nil {
+		return err
+	}
+	if err := validateNATSToken("destination id", envelope.DestinationId); err != nil {
+		return err
+	}
+	if err := validateNATSToken("message type", envelope.Type); err != nil {
+		return err
+	}
+
+	msg := nats.NewMsg(natsSubject(p.topic, envelope.DestinationId, envelope.Type))
+	msg.Data = data
+	msg.Header.Set(destinationIdProperty, envelope.DestinationId)
+	msg.Header.Set(typeProperty, envelope.Type)
+	msg.Header.Set(schemaVersionProperty, envelope.SchemaVersion)
+	if envelope.CorrelationId != "" {
+		msg.Header.Set(correlationIdHeader, envelope.CorrelationId)
+	}
+
+	if _, err := p.bus.js.PublishMsg(msg, nats.MsgId(envelope.Id.String()), nats.Context(ctx)); err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", msg.Subject, err)
+	}
+	return nil
+}
+
+const correlationIdHeader = "correlationId"
+
+// natsProgressInterval is how often a message held for a delayed retry is
+// reported in progress, well within the default ack wait of 30s.
+const natsProgressInterval = 10 * time.Second
+
+// holdMessage waits for the delay, or until ctx is done, reporting the
+// message in progress so it isn't redelivered meanwhile. It returns early if
+// the message can't be reported in progress.
+func holdMessage(ctx context.Context, msg *nats.Msg, delay time.Duration) {
+	deadline := time.Now().Add(delay)
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return
+		}
+		if wait > natsProgressInterval {
+			wait = natsProgressInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if time.Now().Before(deadline) {
+			if err := msg.InProgress(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// NATSListener receives from the durable pull consumers of a subscription.
+type NATSListener struct {
+	bus       *NATSBus
+	consumers []natsConsumer
+	types     map[string]bool
+	policy    *RetryPolicy
+	keyring   *Keyring
+}
+
+// natsConsumer is a durable pull consumer of a subject.
+type natsConsumer struct {
+	subject string
+	durable string
+}
+
+// Listen fetches messages from every consumer of the subscription and hands
+// them to the dispatcher until ctx is done or a consumer fails. Handled
+// messages are acked and messages the retry policy gives up on are
+// terminated. This version of JetStream can't delay a nack, so a failed
+// message is held for the retry policy's backoff, up to its MaxHold, before
+// it is nacked for redelivery; as a consumer has a single message in flight,
+// the messages after it wait and stay in order.
+func (l *NATSListener) Listen(ctx context.Context, d *Dispatcher) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the listener is ready once every consumer has subscribed
+	unsubscribed := int32(len(l.consumers))
+	subscribed := func() {
+		if atomic.AddInt32(&unsubscribed, -1) == 0 {
+			listenerReady(ctx)
+		}
+	}
+	errs := make(chan error, len(l.consumers))
+	for _, c := range l.consumers {
+		go func(c natsConsumer) {
+			errs <- l.consume(ctx, d, c, subscribed)
+		}(c)
+	}
+
+	var err error
+	for range l.consumers {
+		if cerr := <-errs; cerr != nil && err == nil {
+			err = cerr
+			cancel()
+		}
+	}
+	return err
+}
+
+func (l *NATSListener) consume(ctx context.Context, d *Dispatcher, c natsConsumer, subscribed func()) error {
+	sub, err := l.bus.js.PullSubscribe(c.subject, c.durable,
+		nats.MaxDeliver(int(l.policy.MaxDeliveries)),
+		// JetStream has no sessions, so ordering is kept per consumer
+		nats.MaxAckPending(1))
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", c.subject, err)
+	}
+	defer func() {
+		// the durable consumer outlives the subscription
+		_ = sub.Unsubscribe()
+	}()
+	subscribed()
+
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, l.bus.FetchWait)
+		msgs, err := sub.Fetch(natsFetchBatch, nats.Context(fetchCtx))
+		cancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+				continue
+			}
+			return fmt.Errorf("failed to fetch from %s: %w", c.subject, err)
+		}
+
+		for _, msg := range msgs {
+			if err := l.handle(ctx, d, msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (l *NATSListener) handle(ctx context.Context, d *Dispatcher, msg *nats.Msg) error {
+	if len(l.types) > 0 && !l.types[msg.Header.Get(typeProperty)] {
+		// not a type this subscription receives
+		return msg.Term()
+	}
+
+	md := Metadata{
+		MessageID:     msg.Header.Get(nats.MsgIdHdr),
+		CorrelationID: msg.Header.Get(correlationIdHeader),
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		md.DeliveryCount = uint32(meta.NumDelivered)
+		md.EnqueuedTime = meta.Timestamp
+	}
+
+	o := l.policy.outcome(dispatch(ctx, d, l.keyring, md, msg.Data), md.DeliveryCount)
+	var err error
+	switch {
+	case o.deadLetter:
+		err = msg.Term()
+	case o.retry:
+		holdMessage(ctx, msg, l.policy.hold(o.delay))
+		err = msg.Nak()
+	default:
+		err = msg.Ack()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to acknowledge message from %s: %w", msg.Subject, err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+// newNATSBus starts an embedded JetStream server and returns a bus connected to it.
+func newNATSBus(t *testing.T) *NATSBus {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "carp-nats")
+	if err != nil {
+		t.Fatalf("failed to create store dir: %v", err)
+	}
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: dir})
+	if err != nil {
+		t.Fatalf("failed to create nats server: %v", err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("nats server not ready")
+	}
+
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		s.Shutdown()
+		os.RemoveAll(dir)
+	})
+
+	b, err := NewNATSBus(conn)
+	if err != nil {
+		t.Fatalf("failed to create bus: %v", err)
+	}
+	b.FetchWait = 100 * time.Millisecond
+	return b
+}
+
+func newNATSListener(t *testing.T, b *NATSBus, underlayID string) *NATSListener {
+	t.Helper()
+	l, err := b.NewListener(&ListenerConfig{
+		Region:       "eastus",
+		Environment:  "test",
+		UnderlayID:   underlayID,
+		MessageTypes: []string{workers.PutClusterType},
+	})
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	return l
+}
+
+func newNATSPublisher(t *testing.T, b *NATSBus) *NATSPublisher {
+	t.Helper()
+	p, err := b.NewPublisher(&PublisherConfig{Region: "eastus", Environment: "test"})
+	if err != nil {
+		t.Fatalf("failed to create publisher: %v", err)
+	}
+	return p
+}
+
+func TestNATSBusFiltersByDestination(t *testing.T) {
+	b := newNATSBus(t)
+	a := newNATSListener(t, b, "worker-a")
+	p := newNATSPublisher(t, b)
+
+	for _, cmd := range []workers.PutCluster{putCluster("worker-a", "one"), putCluster("worker-b", "two"), putCluster("worker-a", "three")} {
+		if err := p.Publish(context.Background(), cmd); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	if err := p.Publish(context.Background(), workers.ClusterStatusChanged{}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	var names []string
+	listenUntil(t, a, 2, func(ctx context.Context, md Metadata, m messages.Message) error {
+		names = append(names, m.(*workers.PutCluster).Name)
+		return nil
+	})
+	if len(names) != 2 || names[0] != "one" || names[1] != "three" {
+		t.Errorf("worker-a received %v, expected [one three]", names)
+	}
+
+	// worker-b's durable consumer starts from the beginning of the stream
+	var other []string
+	listenUntil(t, newNATSListener(t, b, "worker-b"), 1, func(ctx context.Context, md Metadata, m messages.Message) error {
+		other = append(other, m.(*workers.PutCluster).Name)
+		return nil
+	})
+	if len(other) != 1 || other[0] != "two" {
+		t.Errorf("worker-b received %v, expected [two]", other)
+	}
+}
+
+func TestNATSBusRedeliversNakedMessages(t *testing.T) {
+	b := newNATSBus(t)
+	l := newNATSListener(t, b, "worker-a")
+	p := newNATSPublisher(t, b)
+	if err := p.Publish(context.Background(), putCluster("worker-a", "one")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	handled := listenUntil(t, l, 2, func(ctx context.Context, md Metadata, m messages.Message) error {
+		if md.DeliveryCount == 1 {
+			return errors.New("transient failure")
+		}
+		return nil
+	})
+	if handled[0].MessageID != handled[1].MessageID || handled[1].DeliveryCount != 2 {
+		t.Errorf("expected the same message to be redelivered, got %+v", handled)
+	}
+}
+
+func TestNATSBusDeduplicatesPublishes(t *testing.T) {
+	b := newNATSBus(t)
+	l := newNATSListener(t, b, "worker-a")
+	p := newNATSPublisher(t, b)
+	cmd := putCluster("worker-a", "one")
+	for i := 0; i < 2; i++ {
+		if err := p.Publish(context.Background(), cmd); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	if err := p.Publish(context.Background(), putCluster("worker-a", "two")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	var names []string
+	listenUntil(t, l, 2, func(ctx context.Context, md Metadata, m messages.Message) error {
+		names = append(names, m.(*workers.PutCluster).Name)
+		return nil
+	})
+	if len(names) != 2 || names[0] != "one" || names[1] != "two" {
+		t.Errorf("received %v, expected [one two]", names)
+	}
+}
+
+func TestNATSBusRejectsInvalidTokens(t *testing.T) {
+	b := newNATSBus(t)
+	for _, id := range []string{"", "worker.a", "worker-*", "worker->", "worker a", "worker/a"} {
+		t.Run(id, func(t *testing.T) {
+			_, err := b.NewListener(&ListenerConfig{
+				Region:       "eastus",
+				Environment:  "test",
+				UnderlayID:   id,
+				MessageTypes: []string{workers.PutClusterType},
+			})
+			if err == nil {
+				t.Errorf("expected underlay id %q to be rejected", id)
+			}
+			if err := newNATSPublisher(t, b).Publish(context.Background(), putCluster(id, "one")); err == nil {
+				t.Errorf("expected destination id %q to be rejected", id)
+			}
+		})
+	}
+	if _, err := b.NewPublisher(&PublisherConfig{Region: "east.us", Environment: "test"}); err == nil {
+		t.Errorf("expected an invalid topic to be rejected")
+	}
+}
@@ -2,15 +2,15 @@ package bus
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 
 	servicebus "github.com/Azure/azure-service-bus-go"
-	"github.com/juan-lee/carp/internal/messages/workers"
+	"github.com/juan-lee/carp/internal/messages"
 )
 
 type ServiceBusPublisher struct {
 	topicSender *servicebus.Sender
+	keyring     *Keyring
 }
 
 type PublisherConfig struct {
@@ -18,6 +18,10 @@ type PublisherConfig struct {
 	Environment                string
 	UnderlayName               string
 	ServiceBusConnectionString string
+	// Provisioning is ProvisionManaged or ProvisionPreProvisioned, defaulting to ProvisionManaged
+	Provisioning string
+	// Keyring signs and encrypts published messages, if set
+	Keyring *Keyring
 }
 
 func NewPublisher(ctx context.Context, cfg *PublisherConfig) (Publisher, error) {
@@ -26,7 +30,7 @@ func NewPublisher(ctx context.Context, cfg *PublisherConfig) (Publisher, error)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get namespace from provided ServiceBus connection string: %w", err)
 	}
-	topicEntity, err := getTopicEntity(ctx, cfg.Environment, cfg.Region, namespace)
+	topicEntity, err := getTopicEntity(ctx, cfg.Environment, cfg.Region, cfg.Provisioning, namespace)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get topicEntity: %w", err)
 	}
@@ -44,17 +48,28 @@ func NewPublisher(ctx context.Context, cfg *PublisherConfig) (Publisher, error)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new topic sender for topic %s: %w", topicEntity.Name, err)
 	}
-	return &ServiceBusPublisher{topicSender}, nil
+	return &ServiceBusPublisher{topicSender: topicSender, keyring: cfg.Keyring}, nil
 }
 
-// Publish sends a message to a topic based on region and environment
-func (p *ServiceBusPublisher) Publish(ctx context.Context, command workers.PutCluster) error {
-	commandStr, err := json.Marshal(command)
+// Publish sends a message to a topic based on region and environment. The
+// message is wrapped in an envelope and its type, schema version and
+// destination are mirrored into the user properties for subscription rules.
+func (p *ServiceBusPublisher) Publish(ctx context.Context, message messages.Message) error {
+	envelope, envelopeStr, err := encodeMessage(message, p.keyring)
+	if err != nil {
+		return err
+	}
 
 	// Adding in user properties to enable filtering on receiver side
-	msg := servicebus.NewMessageFromString(string(commandStr))
+	msg := servicebus.NewMessageFromString(string(envelopeStr))
+	msg.ID = envelope.Id.String()
+	msg.CorrelationID = envelope.CorrelationId
+	msg.SessionID = &envelope.SessionId
+	msg.ContentType = "application/json"
 	msg.UserProperties = make(map[string]interface{})
-	msg.UserProperties["destinationId"] = command.DestinationId
+	msg.UserProperties[destinationIdProperty] = envelope.DestinationId
+	msg.UserProperties[typeProperty] = envelope.Type
+	msg.UserProperties[schemaVersionProperty] = envelope.SchemaVersion
 	err = p.topicSender.Send(ctx, msg)
 	if err != nil {
 		return fmt.Errorf("failed to send message to topic %s: %w", p.topicSender.Name, err)
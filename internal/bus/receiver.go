@@ -4,8 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	servicebus "github.com/Azure/azure-service-bus-go"
+	"github.com/Azure/go-amqp"
 )
 
 type ServiceBusListener struct {
@@ -18,24 +22,77 @@ type ListenerConfig struct {
 	UnderlayID                 string // ex: region/<region>/underlay/<id>
 	ServiceBusNamespace        string
 	ServiceBusConnectionString string
+	// MessageTypes limits the subscription to the given message types. All
+	// types addressed to the underlay are received when it is empty.
+	MessageTypes []string
+	// RetryPolicy decides which failed messages are retried, defaulting to DefaultRetryPolicy
+	RetryPolicy *RetryPolicy
+	// Provisioning is ProvisionManaged or ProvisionPreProvisioned, defaulting to ProvisionManaged
+	Provisioning string
+	// Keyring verifies and decrypts received messages, if set
+	Keyring *Keyring
+	// MaxConcurrentHandlers is how many sessions are handled at once,
+	// defaulting to 4, so a session held for a retry doesn't stall the others.
+	// It only applies to the servicebus transport.
+	MaxConcurrentHandlers int
+	// PrefetchCount is how many messages the receiver fetches ahead of the
+	// handlers, defaulting to the service bus default. It only applies to the
+	// servicebus transport.
+	PrefetchCount uint32
+	// DrainTimeout is how long the handlers in flight when the listener stops
+	// are waited for before their context is cancelled, defaulting to 30s. It
+	// only applies to the servicebus transport.
+	DrainTimeout time.Duration
+}
+
+// defaultMaxConcurrentHandlers is how many sessions a listener handles at once by default.
+const defaultMaxConcurrentHandlers = 4
+
+// defaultDrainTimeout is how long a stopping listener waits for its handlers by default.
+const defaultDrainTimeout = 30 * time.Second
+
+func (cfg *ListenerConfig) retryPolicy() *RetryPolicy {
+	if cfg.RetryPolicy == nil {
+		return DefaultRetryPolicy()
+	}
+	return cfg.RetryPolicy
+}
+
+func (cfg *ListenerConfig) maxConcurrentHandlers() int {
+	if cfg.MaxConcurrentHandlers <= 0 {
+		return defaultMaxConcurrentHandlers
+	}
+	return cfg.MaxConcurrentHandlers
+}
+
+func (cfg *ListenerConfig) drainTimeout() time.Duration {
+	if cfg.DrainTimeout <= 0 {
+		return defaultDrainTimeout
+	}
+	return cfg.DrainTimeout
 }
 
 func NewListener(cfg *ListenerConfig) Listener {
 	return &ServiceBusListener{cfg}
 }
 
-// Listen waits for a message from the Service Bus Topic subscription
-func (l *ServiceBusListener) Listen(ctx context.Context, handle Handle) error {
+// Listen ensures the topic and subscription, and handles the sessions of the
+// subscription until ctx is done or receiving fails. A failed message is
+// retried after holding its session for the retry policy's backoff, up to its
+// MaxHold, so the later messages of the session wait for it. Once ctx is done no more
+// messages are received, and Listen waits for the handlers in flight before
+// closing the sessions.
+func (l *ServiceBusListener) Listen(ctx context.Context, d *Dispatcher) error {
 	// Setup necessary SB resources
 	namespace, err := getNamespace(l.Config.ServiceBusConnectionString)
 	if err != nil {
 		return fmt.Errorf("failed to get namespace from provided ServiceBus connection string: %w", err)
 	}
-	topicEntity, err := getTopicEntity(ctx, l.Config.Environment, l.Config.Region, namespace)
+	topicEntity, err := getTopicEntity(ctx, l.Config.Environment, l.Config.Region, l.Config.Provisioning, namespace)
 	if err != nil {
 		return fmt.Errorf("failed to get topicEntity: %w", err)
 	}
-	subscriptionEntity, err := getSubscriptionEntity(ctx, l.Config.UnderlayID, namespace, topicEntity)
+	subscriptionEntity, err := getSubscriptionEntity(ctx, l.Config.UnderlayID, l.Config.MessageTypes, l.Config.Provisioning, namespace, topicEntity)
 	if err != nil {
 		return fmt.Errorf("failed to get subscriptionEntity: %w", err)
 	}
@@ -50,31 +107,238 @@ func (l *ServiceBusListener) Listen(ctx context.Context, handle Handle) error {
 	}()
 
 	// Generate new subscription client
-	sub, err := topic.NewSubscription(subscriptionEntity.Name)
+	var opts []servicebus.SubscriptionOption
+	if l.Config.PrefetchCount > 0 {
+		opts = append(opts, servicebus.SubscriptionWithPrefetchCount(l.Config.PrefetchCount))
+	}
+	sub, err := topic.NewSubscription(subscriptionEntity.Name, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to create new subscription %s: %w", subscriptionEntity.Name, err)
 	}
-	subReceiver, err := sub.NewReceiver(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to create new subscription receiver %s: %w", subReceiver.Name, err)
-	}
-	// Create a handle class that has that function
-	listenerHandle := subReceiver.Listen(ctx, servicebus.HandlerFunc(
-		func(ctx context.Context, message *servicebus.Message) error {
-			err := handle(ctx, string(message.Data))
-			if err != nil {
-				err = message.Abandon(ctx)
-				return err
-			}
+	// the subscription has been ensured and verified with the namespace, and
+	// failing to receive from it restarts the listener
+	listenerReady(ctx)
+
+	policy := l.Config.retryPolicy()
+	handler := func(ctx context.Context, session *servicebus.MessageSession, message *servicebus.Message) error {
+		if !routedTo(message.UserProperties, l.Config.UnderlayID, l.Config.MessageTypes) {
 			return message.Complete(ctx)
-		},
-	))
-	<-listenerHandle.Done()
+		}
+		md := serviceBusMetadata(message)
+		o := policy.outcome(dispatch(ctx, d, l.Config.Keyring, md, message.Data), md.DeliveryCount)
+		switch {
+		case o.deadLetter:
+			return message.DeadLetterWithInfo(ctx, errors.New(o.description), servicebus.MessageErrorCondition(o.reason), nil)
+		case o.retry:
+			// the later messages of the session wait for the retry, which
+			// keeps them in order
+			holdSession(ctx, session, policy.hold(o.delay))
+			return message.Abandon(ctx)
+		}
+		return message.Complete(ctx)
+	}
+	pool := newHandlerPool(l.Config.maxConcurrentHandlers(), l.Config.drainTimeout())
+	return listenSessions(ctx, sub, pool, handler)
+}
+
+// sessionHandlerFunc handles a message of a session.
+type sessionHandlerFunc func(ctx context.Context, session *servicebus.MessageSession, message *servicebus.Message) error
+
+// sessionLockRenewInterval is how often the lock of a session held for a
+// delayed retry is renewed, well within the default lock duration of a minute.
+const sessionLockRenewInterval = 10 * time.Second
 
-	if err := subReceiver.Close(ctx); err != nil {
-		return fmt.Errorf("error shutting down service bus subscription. %w", err)
+// holdSession waits for the delay, or until ctx is done, renewing the lock of
+// the session so its messages aren't handed to another receiver meanwhile. It
+// returns early if the lock can't be renewed.
+func holdSession(ctx context.Context, session *servicebus.MessageSession, delay time.Duration) {
+	deadline := time.Now().Add(delay)
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return
+		}
+		if wait > sessionLockRenewInterval {
+			wait = sessionLockRenewInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if time.Now().Before(deadline) {
+			if err := session.RenewLock(ctx); err != nil {
+				return
+			}
+		}
 	}
-	return listenerHandle.Err()
+}
+
+// sessionIdleTimeout is how long a session receiver waits for the next
+// message of its session before moving on to another session.
+const sessionIdleTimeout = 5 * time.Second
+
+// listenSessions handles as many sessions at once as the pool has slots, and
+// the messages of each session one at a time and in order, until ctx is done
+// or receiving a session fails.
+func listenSessions(ctx context.Context, sub *servicebus.Subscription, pool *handlerPool, h sessionHandlerFunc) error {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	errs := make(chan error, pool.size())
+	var wg sync.WaitGroup
+	for i := 0; i < pool.size(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := receiveSessions(ctx, sub, pool, h); err != nil {
+				errs <- err
+				stop()
+			}
+		}()
+	}
+	wg.Wait()
+	pool.drain()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// receiveSessions receives one session at a time until ctx is done. A
+// session isn't closed until the pool has drained, as its handler may still
+// be settling a message after ctx is done.
+func receiveSessions(ctx context.Context, sub *servicebus.Subscription, pool *handlerPool, h sessionHandlerFunc) error {
+	handler := func(ctx context.Context, session *servicebus.MessageSession, message *servicebus.Message) error {
+		if !pool.acquire(ctx) {
+			_ = message.Abandon(pool.ctx)
+			return nil
+		}
+		defer pool.release()
+		return h(pool.ctx, session, message)
+	}
+
+	for ctx.Err() == nil {
+		session := sub.NewSession(nil)
+		err := session.ReceiveOne(ctx, &idleSessionHandler{handler: handler})
+		if ctx.Err() != nil {
+			pool.drain()
+		}
+		closeCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_ = session.Close(closeCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil && !isTimeout(err) {
+			return fmt.Errorf("failed to receive session of %s: %w", sub.Name, err)
+		}
+	}
+	return nil
+}
+
+// handlerPool runs at most size message handlers at once. Handlers run on the
+// pool's context rather than the receiver's, so stopping the receiver doesn't
+// interrupt them; draining the pool waits for them and only cancels their
+// context once the drain timeout has passed.
+type handlerPool struct {
+	slots        chan struct{}
+	drainTimeout time.Duration
+	drained      sync.Once
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newHandlerPool(size int, drainTimeout time.Duration) *handlerPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &handlerPool{
+		slots:        make(chan struct{}, size),
+		drainTimeout: drainTimeout,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+func (p *handlerPool) size() int {
+	return cap(p.slots)
+}
+
+// acquire waits for a free slot, and reports false if ctx is done first.
+func (p *handlerPool) acquire(ctx context.Context) bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *handlerPool) release() {
+	<-p.slots
+}
+
+// drain waits for the handlers in flight by taking every slot, cancelling
+// their context once the drain timeout has passed. Later calls wait for the
+// first one to finish.
+func (p *handlerPool) drain() {
+	p.drained.Do(func() {
+		timeout := time.NewTimer(p.drainTimeout)
+		defer timeout.Stop()
+		for i := 0; i < p.size(); i++ {
+			select {
+			case p.slots <- struct{}{}:
+			case <-timeout.C:
+				p.cancel()
+				p.slots <- struct{}{}
+			}
+		}
+		p.cancel()
+	})
+}
+
+// idleSessionHandler releases its session once no message has been received
+// for sessionIdleTimeout.
+type idleSessionHandler struct {
+	handler sessionHandlerFunc
+	session *servicebus.MessageSession
+	idle    *time.Timer
+}
+
+func (h *idleSessionHandler) Start(session *servicebus.MessageSession) error {
+	h.session = session
+	h.idle = time.AfterFunc(sessionIdleTimeout, session.Close)
+	return nil
+}
+
+func (h *idleSessionHandler) Handle(ctx context.Context, message *servicebus.Message) error {
+	h.idle.Stop()
+	defer h.idle.Reset(sessionIdleTimeout)
+	return h.handler(ctx, h.session, message)
+}
+
+func (h *idleSessionHandler) End() {
+	h.idle.Stop()
+}
+
+// isTimeout reports whether accepting a session timed out because no session
+// had messages.
+func isTimeout(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Condition == "com.microsoft:timeout"
+}
+
+// serviceBusMetadata returns the metadata of a delivery.
+func serviceBusMetadata(message *servicebus.Message) Metadata {
+	md := Metadata{
+		MessageID:     message.ID,
+		CorrelationID: message.CorrelationID,
+		DeliveryCount: message.DeliveryCount,
+	}
+	if message.SystemProperties != nil && message.SystemProperties.EnqueuedTime != nil {
+		md.EnqueuedTime = *message.SystemProperties.EnqueuedTime
+	}
+	return md
 }
 
 func getNamespace(connStr string) (*servicebus.Namespace, error) {
@@ -89,9 +353,18 @@ func getNamespace(connStr string) (*servicebus.Namespace, error) {
 	return namespace, nil
 }
 
-func getTopicEntity(ctx context.Context, environment, region string, namespace *servicebus.Namespace) (*servicebus.TopicEntity, error) {
+func getTopicEntity(ctx context.Context, environment, region, provisioning string, namespace *servicebus.Namespace) (*servicebus.TopicEntity, error) {
 	topicManager := namespace.NewTopicManager()
-	topicEntity, err := ensureTopic(ctx, topicManager, fmt.Sprintf("%s-%s", environment, region))
+	name := topicName(environment, region)
+	if provisioning == ProvisionPreProvisioned {
+		topicEntity, err := topicManager.Get(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to get pre-provisioned topic %s: %v", ErrTopologyMismatch, name, err)
+		}
+		return topicEntity, nil
+	}
+
+	topicEntity, err := ensureTopic(ctx, topicManager, name)
 	if err != nil {
 		return nil, err
 	}
@@ -99,9 +372,21 @@ func getTopicEntity(ctx context.Context, environment, region string, namespace *
 	return topicEntity, nil
 }
 
+// topicName returns the name of the topic shared by the control plane and
+// workers of a region and environment.
+func topicName(environment, region string) string {
+	return fmt.Sprintf("%s-%s", environment, region)
+}
+
+// getSubscriptionEntity returns the subscription of an underlay once its
+// sessions and rules are verified, so the listener handles the messages of a
+// cluster in order and never receives messages meant for others.
+// Managed subscriptions are created and their rules reconciled first.
 func getSubscriptionEntity(
 	ctx context.Context,
 	underlayID string,
+	messageTypes []string,
+	provisioning string,
 	ns *servicebus.Namespace,
 	te *servicebus.TopicEntity) (*servicebus.SubscriptionEntity, error) {
 	subscriptionManager, err := ns.NewSubscriptionManager(te.Name)
@@ -109,11 +394,29 @@ func getSubscriptionEntity(
 		return nil, err
 	}
 
-	subEntity, err := ensureSubscription(ctx, subscriptionManager, underlayID)
-	if err != nil {
-		return nil, err
+	rules := subscriptionRules(underlayID, messageTypes)
+	var subEntity *servicebus.SubscriptionEntity
+	if provisioning == ProvisionPreProvisioned {
+		subEntity, err = subscriptionManager.Get(ctx, underlayID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to get pre-provisioned subscription %s: %v", ErrTopologyMismatch, underlayID, err)
+		}
+	} else {
+		subEntity, err = ensureSubscription(ctx, subscriptionManager, underlayID)
+		if err != nil {
+			return nil, err
+		}
+		if err := reconcileRules(ctx, subscriptionManager, underlayID, rules); err != nil {
+			return nil, err
+		}
 	}
 
+	if err := verifySessions(subEntity); err != nil {
+		return nil, err
+	}
+	if err := verifyRules(ctx, subscriptionManager, underlayID, rules); err != nil {
+		return nil, err
+	}
 	return subEntity, nil
 }
 
@@ -126,20 +429,44 @@ func ensureTopic(ctx context.Context, tm *servicebus.TopicManager, name string)
 	return tm.Put(ctx, name)
 }
 
-func ensureSubscription(ctx context.Context, sm *servicebus.SubscriptionManager, name string) (*servicebus.SubscriptionEntity, error) {
+// ensureSubscription creates the subscription if it doesn't exist. Service
+// Bus creates it with a $Default rule matching every message, which
+// reconcileRules replaces; messages it lets in meanwhile are dropped by the
+// listener as not routed to it.
+func ensureSubscription(
+	ctx context.Context,
+	sm *servicebus.SubscriptionManager,
+	name string) (*servicebus.SubscriptionEntity, error) {
 	subEntity, err := sm.Get(ctx, name)
 	if err == nil {
 		return subEntity, nil
 	}
 
-	subEntity, err = sm.Put(ctx, name)
+	// sessions keep the messages about a cluster in order
+	subEntity, err = sm.Put(ctx, name, servicebus.SubscriptionWithRequiredSessions())
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't create subscription %s", name)
+		return nil, fmt.Errorf("failed to create subscription %s: %w", name, err)
+	}
+	return subEntity, nil
+}
+
+// subscriptionFilter returns the sql filter selecting the messages addressed
+// to the destination, optionally limited to the given message types.
+func subscriptionFilter(destinationId string, messageTypes []string) string {
+	filter := fmt.Sprintf("%s = %s", destinationIdProperty, sqlString(destinationId))
+	if len(messageTypes) == 0 {
+		return filter
 	}
 
-	// TODO(keikumata): figure out how to filter properly
-	// This may result in a concurrency issue where the receiver may get a message before the filter rule is in place
-	sqlFilter := fmt.Sprintf("destinationId = '%s'", name)
-	_, err = sm.PutRule(ctx, name, "destinationIdFilter", servicebus.SQLFilter{Expression: sqlFilter})
-	return subEntity, err
+	quoted := make([]string, len(messageTypes))
+	for i, t := range messageTypes {
+		quoted[i] = sqlString(t)
+	}
+	return fmt.Sprintf("%s AND %s IN (%s)", filter, typeProperty, strings.Join(quoted, ", "))
+}
+
+// sqlString quotes a value as a sql string literal, doubling its quotes so
+// an id can't end the literal and widen the filter.
+func sqlString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
 }
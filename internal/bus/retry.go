@@ -0,0 +1,123 @@
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Reasons listeners give for dead-lettering a message.
+const (
+	// ReasonMalformed means the message could not be decoded or had no handler
+	ReasonMalformed = "MalformedMessage"
+	// ReasonPermanentError means the handler failed with an error retrying can't fix
+	ReasonPermanentError = "PermanentError"
+	// ReasonMaxDeliveryCountExceeded means the handler kept failing until the message ran out of retries
+	ReasonMaxDeliveryCountExceeded = "MaxDeliveryCountExceeded"
+	// ReasonUnauthenticated means the message was unsigned or its signature didn't verify
+	ReasonUnauthenticated = "UnauthenticatedMessage"
+)
+
+// DeadLetterError is returned by a handler to dead-letter a message with a
+// reason and description instead of retrying it.
+type DeadLetterError struct {
+	Reason      string
+	Description string
+}
+
+func (e *DeadLetterError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Description)
+}
+
+// DeadLetter returns an error that makes the listener dead-letter the message
+// with the given reason and description.
+func DeadLetter(reason, description string) error {
+	return &DeadLetterError{Reason: reason, Description: description}
+}
+
+// RetryPolicy decides what a listener does with a message whose handler failed.
+type RetryPolicy struct {
+	// MaxDeliveries is the number of deliveries after which a failing message
+	// is dead-lettered
+	MaxDeliveries uint32
+	// Backoff is the delay before the first retry, doubled on every further
+	// retry up to MaxBackoff. Failed messages are retried immediately when it is zero.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// MaxHold is the longest the servicebus and nats transports hold a failed
+	// message, and with it the later messages of its session or consumer,
+	// before releasing it for redelivery, defaulting to 30s. Longer delays are
+	// cut short so that one failing message can't stall a listener for the
+	// whole backoff.
+	MaxHold time.Duration
+	// Permanent reports whether an error can't be fixed by retrying, in
+	// addition to malformed messages and DeadLetterErrors which are always permanent
+	Permanent func(error) bool
+}
+
+// DefaultRetryPolicy retries failed messages immediately up to the service
+// bus default max delivery count.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{MaxDeliveries: maxDeliveryCount}
+}
+
+// defaultMaxHold is how long a failed message is held at most by default.
+const defaultMaxHold = 30 * time.Second
+
+// hold returns how long a transport that holds failed messages waits before
+// releasing a message to be retried after delay.
+func (p *RetryPolicy) hold(delay time.Duration) time.Duration {
+	max := p.MaxHold
+	if max <= 0 {
+		max = defaultMaxHold
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// outcome is what a listener does with a message after dispatching it.
+type outcome struct {
+	// retry is set when the message should be redelivered after delay
+	retry bool
+	delay time.Duration
+	// deadLetter is set when the message should be dead-lettered
+	deadLetter  bool
+	reason      string
+	description string
+}
+
+// outcome classifies the result of the given delivery of a message.
+func (p *RetryPolicy) outcome(err error, deliveryCount uint32) outcome {
+	if err == nil {
+		return outcome{}
+	}
+
+	var dl *DeadLetterError
+	switch {
+	case errors.As(err, &dl):
+		return outcome{deadLetter: true, reason: dl.Reason, description: dl.Description}
+	case errors.Is(err, ErrUnauthenticated):
+		return outcome{deadLetter: true, reason: ReasonUnauthenticated, description: err.Error()}
+	case errors.Is(err, ErrMalformed):
+		return outcome{deadLetter: true, reason: ReasonMalformed, description: err.Error()}
+	case p.Permanent != nil && p.Permanent(err):
+		return outcome{deadLetter: true, reason: ReasonPermanentError, description: err.Error()}
+	case deliveryCount >= p.MaxDeliveries:
+		return outcome{deadLetter: true, reason: ReasonMaxDeliveryCountExceeded, description: err.Error()}
+	}
+	return outcome{retry: true, delay: p.backoff(deliveryCount)}
+}
+
+// backoff returns the delay before retrying the given delivery.
+func (p *RetryPolicy) backoff(deliveryCount uint32) time.Duration {
+	delay := p.Backoff
+	for i := uint32(1); i < deliveryCount && delay > 0; i++ {
+		delay *= 2
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return delay
+}
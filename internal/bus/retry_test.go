@@ -0,0 +1,70 @@
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var errConflict = errors.New("conflict")
+
+func TestRetryPolicyOutcome(t *testing.T) {
+	p := &RetryPolicy{
+		MaxDeliveries: 3,
+		Backoff:       time.Second,
+		MaxBackoff:    3 * time.Second,
+		Permanent:     func(err error) bool { return errors.Is(err, errConflict) },
+	}
+
+	for _, tc := range []struct {
+		name          string
+		err           error
+		deliveryCount uint32
+		expected      outcome
+	}{
+		{"handled", nil, 1, outcome{}},
+		{"transient", errors.New("timeout"), 1, outcome{retry: true, delay: time.Second}},
+		{"backs off", errors.New("timeout"), 2, outcome{retry: true, delay: 2 * time.Second}},
+		{"out of retries", errors.New("timeout"), 3, outcome{deadLetter: true, reason: ReasonMaxDeliveryCountExceeded, description: "timeout"}},
+		{"malformed", fmt.Errorf("%w: bad json", ErrMalformed), 1, outcome{deadLetter: true, reason: ReasonMalformed, description: "malformed message: bad json"}},
+		{"permanent", fmt.Errorf("put failed: %w", errConflict), 1, outcome{deadLetter: true, reason: ReasonPermanentError, description: "put failed: conflict"}},
+		{"explicit", fmt.Errorf("wrapped: %w", DeadLetter("QuotaExceeded", "no capacity")), 1, outcome{deadLetter: true, reason: "QuotaExceeded", description: "no capacity"}},
+	} {
+		if got := p.outcome(tc.err, tc.deliveryCount); got != tc.expected {
+			t.Errorf("%s: got %+v, expected %+v", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffIsCapped(t *testing.T) {
+	p := &RetryPolicy{MaxDeliveries: 100, Backoff: time.Second, MaxBackoff: time.Minute}
+	if got := p.backoff(50); got != time.Minute {
+		t.Errorf("got %v, expected %v", got, time.Minute)
+	}
+	if got := DefaultRetryPolicy().backoff(5); got != 0 {
+		t.Errorf("expected the default policy to retry immediately, got %v", got)
+	}
+}
+
+func TestRetryPolicyHoldIsCapped(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxHold time.Duration
+		delay   time.Duration
+		want    time.Duration
+	}{
+		{name: "short delay", delay: 5 * time.Second, want: 5 * time.Second},
+		{name: "default cap", delay: 5 * time.Minute, want: defaultMaxHold},
+		{name: "configured cap", maxHold: 10 * time.Second, delay: time.Minute, want: 10 * time.Second},
+		{name: "no delay", delay: 0, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &RetryPolicy{MaxHold: tt.maxHold}
+			if got := p.hold(tt.delay); got != tt.want {
+				t.Errorf("got %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
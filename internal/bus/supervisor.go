@@ -0,0 +1,209 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Default delays between the restarts of a failed listener.
+const (
+	defaultRestartBackoff    = time.Second
+	defaultMaxRestartBackoff = 2 * time.Minute
+)
+
+// listenerState is what a supervised listener is doing.
+type listenerState int
+
+const (
+	// listenerIdle listeners haven't been started, or have stopped
+	listenerIdle listenerState = iota
+	// listenerStarting listeners have been started but haven't subscribed or received yet
+	listenerStarting
+	// listenerReceiving listeners have subscribed or received
+	listenerReceiving
+	// listenerRestarting listeners failed and are waiting to be restarted
+	listenerRestarting
+)
+
+// Supervisor restarts the listeners it supervises when they fail, waiting
+// longer after each consecutive failure, and reports whether they are
+// receiving for the manager's readiness probe.
+type Supervisor struct {
+	Log logr.Logger
+	// Backoff is the delay before the first restart of a failed listener, defaulting to 1s
+	Backoff time.Duration
+	// MaxBackoff caps the delay between restarts, defaulting to 2m. A listener
+	// that ran for longer than it before failing is restarted after Backoff again.
+	MaxBackoff time.Duration
+
+	mu     sync.Mutex
+	states map[string]listenerState
+	errs   map[string]error
+}
+
+// Supervise returns a listener that runs l until its context is done,
+// restarting it whenever it fails. The name identifies the listener in logs
+// and readiness failures.
+func (s *Supervisor) Supervise(name string, l Listener) Listener {
+	s.setState(name, listenerIdle, nil)
+	return &supervisedListener{supervisor: s, name: name, listener: l}
+}
+
+// Ready returns an error naming the listeners that are starting or waiting to
+// be restarted. A listener is only ready once it has subscribed or received.
+// Listeners that haven't been started, such as those of a replica that isn't
+// the leader, don't make the supervisor unready.
+func (s *Supervisor) Ready() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var failing []string
+	for name, state := range s.states {
+		switch state {
+		case listenerStarting:
+			failing = append(failing, fmt.Sprintf("%s: starting", name))
+		case listenerRestarting:
+			failing = append(failing, fmt.Sprintf("%s: %v", name, s.errs[name]))
+		}
+	}
+	if len(failing) == 0 {
+		return nil
+	}
+	sort.Strings(failing)
+	return fmt.Errorf("listeners not receiving: %s", strings.Join(failing, "; "))
+}
+
+// Wait waits up to timeout for the supervised listeners to stop, which they
+// do once the handlers in flight when their context was done have finished.
+// It reports whether they all stopped in time.
+func (s *Supervisor) Wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if s.stopped() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (s *Supervisor) stopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, state := range s.states {
+		if state != listenerIdle {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Supervisor) setState(name string, state listenerState, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.states == nil {
+		s.states = map[string]listenerState{}
+		s.errs = map[string]error{}
+	}
+	s.states[name] = state
+	s.errs[name] = err
+}
+
+func (s *Supervisor) maxBackoff() time.Duration {
+	if s.MaxBackoff <= 0 {
+		return defaultMaxRestartBackoff
+	}
+	return s.MaxBackoff
+}
+
+// backoff returns the delay before the given consecutive restart.
+func (s *Supervisor) backoff(restarts int) time.Duration {
+	delay, max := s.Backoff, s.maxBackoff()
+	if delay <= 0 {
+		delay = defaultRestartBackoff
+	}
+	for i := 1; i < restarts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// readyKey is the context key of the callback a supervised listener calls once
+// it has subscribed or received.
+type readyKey struct{}
+
+// withReady returns a context whose listener calls ready once it has
+// subscribed or received.
+func withReady(ctx context.Context, ready func()) context.Context {
+	return context.WithValue(ctx, readyKey{}, ready)
+}
+
+// listenerReady tells the supervisor of the listener listening on ctx, if
+// any, that the listener has subscribed or received. Transports call it after
+// every successful subscribe or receive.
+func listenerReady(ctx context.Context) {
+	if ready, ok := ctx.Value(readyKey{}).(func()); ok {
+		ready()
+	}
+}
+
+// supervisedListener restarts a listener until its context is done.
+type supervisedListener struct {
+	supervisor *Supervisor
+	name       string
+	listener   Listener
+}
+
+// Listen runs the listener, restarting it with backoff whenever it fails.
+// Each restart connects again and ensures the listener's topology again, and
+// the listener isn't ready until it has subscribed or received again.
+func (l *supervisedListener) Listen(ctx context.Context, d *Dispatcher) error {
+	s := l.supervisor
+	defer s.setState(l.name, listenerIdle, nil)
+
+	restarts := 0
+	for {
+		s.setState(l.name, listenerStarting, nil)
+		var once sync.Once
+		ready := func() {
+			once.Do(func() { s.setState(l.name, listenerReceiving, nil) })
+		}
+		started := time.Now()
+		err := l.listener.Listen(withReady(ctx, ready), d)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("listener stopped unexpectedly")
+		}
+
+		if time.Since(started) > s.maxBackoff() {
+			// the listener was healthy for a while, so this is a new failure
+			restarts = 0
+		}
+		restarts++
+		delay := s.backoff(restarts)
+		listenerRestarts.WithLabelValues(l.name).Inc()
+		s.setState(l.name, listenerRestarting, err)
+		s.Log.Error(err, "listener failed, restarting", "listener", l.name, "delay", delay.String(), "restarts", restarts)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// listenerFunc adapts a function to a Listener.
+type listenerFunc func(ctx context.Context, d *Dispatcher) error
+
+func (f listenerFunc) Listen(ctx context.Context, d *Dispatcher) error {
+	return f(ctx, d)
+}
+
+func TestSupervisorRestartsFailedListeners(t *testing.T) {
+	s := &Supervisor{Log: log.Log, Backoff: 10 * time.Millisecond, MaxBackoff: time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var attempts int32
+	receiving := make(chan struct{})
+	l := s.Supervise("worker-a", listenerFunc(func(ctx context.Context, d *Dispatcher) error {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return errors.New("connection refused")
+		}
+		listenerReady(ctx)
+		close(receiving)
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+
+	done := make(chan error)
+	go func() { done <- l.Listen(ctx, NewDispatcher()) }()
+
+	select {
+	case <-receiving:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("listener wasn't restarted, %d attempts", atomic.LoadInt32(&attempts))
+	}
+	if err := s.Ready(); err != nil {
+		t.Errorf("expected the supervisor to be ready once the listener recovered, got %v", err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected a stopped listener to return nil, got %v", err)
+	}
+	if !s.Wait(time.Second) {
+		t.Errorf("expected the listener to be stopped")
+	}
+}
+
+func TestSupervisorNotReadyWhileRestarting(t *testing.T) {
+	s := &Supervisor{Log: log.Log, Backoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	failed := make(chan struct{})
+	l := s.Supervise("worker-a", listenerFunc(func(ctx context.Context, d *Dispatcher) error {
+		close(failed)
+		return errors.New("connection refused")
+	}))
+	if err := s.Ready(); err != nil {
+		t.Errorf("expected a listener that hasn't started not to make the supervisor unready, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- l.Listen(ctx, NewDispatcher()) }()
+	<-failed
+
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = s.Ready(); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err == nil {
+		t.Errorf("expected the supervisor not to be ready while the listener waits to restart")
+	}
+
+	// stopping interrupts the backoff
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("listener didn't stop while waiting to restart")
+	}
+	if err := s.Ready(); err != nil {
+		t.Errorf("expected a stopped listener not to make the supervisor unready, got %v", err)
+	}
+}
+
+func TestSupervisorNotReadyUntilListenerReceives(t *testing.T) {
+	s := &Supervisor{Log: log.Log, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// one listener never connects and the other fails to connect over and over
+	var attempts int32
+	started := make(chan struct{})
+	connecting := s.Supervise("worker-a", listenerFunc(func(ctx context.Context, d *Dispatcher) error {
+		close(started)
+		<-ctx.Done()
+		return nil
+	}))
+	failing := s.Supervise("worker-b", listenerFunc(func(ctx context.Context, d *Dispatcher) error {
+		atomic.AddInt32(&attempts, 1)
+		return errors.New("connection refused")
+	}))
+	done := make(chan error, 2)
+	go func() { done <- connecting.Listen(ctx, NewDispatcher()) }()
+	go func() { done <- failing.Listen(ctx, NewDispatcher()) }()
+	<-started
+	for atomic.LoadInt32(&attempts) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for deadline := time.Now().Add(200 * time.Millisecond); time.Now().Before(deadline); {
+		err := s.Ready()
+		if err == nil || !strings.Contains(err.Error(), "worker-a") || !strings.Contains(err.Error(), "worker-b") {
+			t.Fatalf("expected neither listener to be ready, got %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&attempts) < 2 {
+		t.Errorf("expected the failing listener to be restarted, got %d attempts", atomic.LoadInt32(&attempts))
+	}
+
+	cancel()
+	<-done
+	<-done
+	if err := s.Ready(); err != nil {
+		t.Errorf("expected stopped listeners not to make the supervisor unready, got %v", err)
+	}
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	s := &Supervisor{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, want := range expected {
+		if got := s.backoff(i + 1); got != want {
+			t.Errorf("restart %d: expected %v, got %v", i+1, want, got)
+		}
+	}
+}
+
+func TestHandlerPoolLimitsConcurrency(t *testing.T) {
+	pool := newHandlerPool(2, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if !pool.acquire(ctx) || !pool.acquire(ctx) {
+		t.Fatalf("expected two free slots")
+	}
+	go cancel()
+	if pool.acquire(ctx) {
+		t.Errorf("expected acquiring a full pool to wait until ctx is done")
+	}
+}
+
+func TestHandlerPoolDrainWaitsForHandlers(t *testing.T) {
+	pool := newHandlerPool(2, time.Minute)
+	if !pool.acquire(context.Background()) {
+		t.Fatalf("expected a free slot")
+	}
+
+	var finished int32
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+		pool.release()
+	}()
+	pool.drain()
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Errorf("expected drain to wait for the handler in flight")
+	}
+	if pool.ctx.Err() == nil {
+		t.Errorf("expected the handler context to be cancelled once drained")
+	}
+}
+
+func TestHandlerPoolDrainCancelsHandlersAfterTimeout(t *testing.T) {
+	pool := newHandlerPool(1, 10*time.Millisecond)
+	if !pool.acquire(context.Background()) {
+		t.Fatalf("expected a free slot")
+	}
+
+	// the handler only returns once its context is cancelled
+	go func() {
+		<-pool.ctx.Done()
+		pool.release()
+	}()
+
+	drained := make(chan struct{})
+	go func() {
+		pool.drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("drain didn't cancel the handler after its timeout")
+	}
+}
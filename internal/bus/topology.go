@@ -0,0 +1,175 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+
+	"github.com/juan-lee/carp/internal/messages"
+)
+
+// Provisioning modes of the Service Bus topology, selected with
+// Config.Provisioning.
+const (
+	// ProvisionManaged creates the topic and subscriptions and reconciles the
+	// subscription rules. It requires Manage rights on the namespace.
+	ProvisionManaged = "managed"
+
+	// ProvisionPreProvisioned expects the topic, subscriptions and rules to
+	// exist and only verifies them, for namespaces carp can't manage.
+	ProvisionPreProvisioned = "preprovisioned"
+)
+
+// Names of the rules of a subscription.
+const (
+	destinationRuleName = "destination"
+	broadcastRuleName   = "broadcast"
+)
+
+// ErrTopologyMismatch is returned when a subscription doesn't have the
+// expected rules, so its listener could receive messages meant for others.
+var ErrTopologyMismatch = errors.New("subscription topology mismatch")
+
+// ruleManager manages the rules of topic subscriptions.
+type ruleManager interface {
+	ListRules(ctx context.Context, subscriptionName string) ([]*servicebus.RuleEntity, error)
+	PutRule(ctx context.Context, subscriptionName, ruleName string, filter servicebus.FilterDescriber) (*servicebus.RuleEntity, error)
+	DeleteRule(ctx context.Context, subscriptionName, ruleName string) error
+}
+
+// subscriptionRules returns the sql filters of the rules a subscription must
+// have, keyed by rule name: one selecting the messages addressed to the
+// destination and one selecting broadcasts.
+func subscriptionRules(destinationId string, messageTypes []string) map[string]string {
+	return map[string]string{
+		destinationRuleName: subscriptionFilter(destinationId, messageTypes),
+		broadcastRuleName:   subscriptionFilter(messages.BroadcastId, messageTypes),
+	}
+}
+
+// reconcileRules makes the rules of a subscription match the expected ones.
+// Missing rules are added before unexpected ones, such as $Default, are
+// removed, so the subscription never stops receiving its own messages.
+func reconcileRules(ctx context.Context, rm ruleManager, subscription string, expected map[string]string) error {
+	rules, err := rm.ListRules(ctx, subscription)
+	if err != nil {
+		return fmt.Errorf("failed to list rules of subscription %s: %w", subscription, err)
+	}
+	actual := ruleFilters(rules)
+
+	for _, name := range sortedKeys(expected) {
+		if filter, ok := actual[name]; ok && filter == expected[name] {
+			continue
+		}
+		if _, ok := actual[name]; ok {
+			// rules can't be updated in place
+			if err := rm.DeleteRule(ctx, subscription, name); err != nil {
+				return fmt.Errorf("failed to delete outdated rule %s of subscription %s: %w", name, subscription, err)
+			}
+		}
+		if _, err := rm.PutRule(ctx, subscription, name, servicebus.SQLFilter{Expression: expected[name]}); err != nil {
+			return fmt.Errorf("failed to put rule %s of subscription %s: %w", name, subscription, err)
+		}
+	}
+	for _, name := range sortedKeys(actual) {
+		if _, ok := expected[name]; ok {
+			continue
+		}
+		if err := rm.DeleteRule(ctx, subscription, name); err != nil {
+			return fmt.Errorf("failed to delete unexpected rule %s of subscription %s: %w", name, subscription, err)
+		}
+	}
+	return nil
+}
+
+// verifyRules returns ErrTopologyMismatch describing the differences when the
+// rules of a subscription aren't exactly the expected ones.
+func verifyRules(ctx context.Context, rm ruleManager, subscription string, expected map[string]string) error {
+	rules, err := rm.ListRules(ctx, subscription)
+	if err != nil {
+		return fmt.Errorf("failed to list rules of subscription %s: %w", subscription, err)
+	}
+	actual := ruleFilters(rules)
+
+	var problems []string
+	for _, name := range sortedKeys(expected) {
+		filter, ok := actual[name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("missing rule %s (%s)", name, expected[name]))
+		case filter != expected[name]:
+			problems = append(problems, fmt.Sprintf("rule %s is %q, expected %q", name, filter, expected[name]))
+		}
+	}
+	for _, name := range sortedKeys(actual) {
+		if _, ok := expected[name]; !ok {
+			problems = append(problems, fmt.Sprintf("unexpected rule %s (%s)", name, actual[name]))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: subscription %s: %s", ErrTopologyMismatch, subscription, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// verifySessions returns ErrTopologyMismatch when a subscription doesn't
+// require sessions. Without sessions the messages about a cluster aren't
+// handled in order, and retries can't be delayed without reordering them.
+// Service Bus can't enable sessions on an existing subscription, so it has to
+// be recreated.
+func verifySessions(subscription *servicebus.SubscriptionEntity) error {
+	if subscription.RequiresSession == nil || !*subscription.RequiresSession {
+		return fmt.Errorf("%w: subscription %s doesn't require sessions, recreate it with sessions enabled",
+			ErrTopologyMismatch, subscription.Name)
+	}
+	return nil
+}
+
+// ruleFilters returns the filter of each rule, as its sql expression.
+func ruleFilters(rules []*servicebus.RuleEntity) map[string]string {
+	filters := make(map[string]string, len(rules))
+	for _, r := range rules {
+		if r == nil || r.Entity == nil || r.RuleDescription == nil {
+			continue
+		}
+		filter := r.Filter.Type
+		if r.Filter.SQLExpression != nil {
+			filter = strings.TrimSpace(*r.Filter.SQLExpression)
+		}
+		filters[r.Name] = filter
+	}
+	return filters
+}
+
+// routedTo reports whether a message's properties match the rules of a
+// subscription. Messages that don't were enqueued before the rules were in
+// place; their intended recipients receive copies of their own.
+func routedTo(properties map[string]interface{}, destinationId string, messageTypes []string) bool {
+	destination, _ := properties[destinationIdProperty].(string)
+	if destination != destinationId && destination != messages.BroadcastId {
+		return false
+	}
+	if len(messageTypes) == 0 {
+		return true
+	}
+	messageType, _ := properties[typeProperty].(string)
+	for _, t := range messageTypes {
+		if t == messageType {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
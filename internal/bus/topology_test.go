@@ -0,0 +1,145 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+// fakeRules is a ruleManager recording the rules of a single subscription.
+type fakeRules struct {
+	rules map[string]string
+	// calls are the rule operations in order, as "put <rule>" or "delete <rule>"
+	calls []string
+}
+
+func (f *fakeRules) ListRules(ctx context.Context, subscriptionName string) ([]*servicebus.RuleEntity, error) {
+	var rules []*servicebus.RuleEntity
+	for name, filter := range f.rules {
+		filter := filter
+		rules = append(rules, &servicebus.RuleEntity{
+			RuleDescription: &servicebus.RuleDescription{
+				Filter: servicebus.FilterDescription{Type: "SqlFilter", SQLExpression: &filter},
+			},
+			Entity: &servicebus.Entity{Name: name},
+		})
+	}
+	return rules, nil
+}
+
+func (f *fakeRules) PutRule(ctx context.Context, subscriptionName, ruleName string, filter servicebus.FilterDescriber) (*servicebus.RuleEntity, error) {
+	f.calls = append(f.calls, "put "+ruleName)
+	f.rules[ruleName] = *filter.ToFilterDescription().SQLExpression
+	return nil, nil
+}
+
+func (f *fakeRules) DeleteRule(ctx context.Context, subscriptionName, ruleName string) error {
+	f.calls = append(f.calls, "delete "+ruleName)
+	delete(f.rules, ruleName)
+	return nil
+}
+
+func TestReconcileRulesReplacesDefaultRule(t *testing.T) {
+	ctx := context.Background()
+	expected := subscriptionRules("worker-a", []string{workers.PutClusterType})
+	rm := &fakeRules{rules: map[string]string{
+		"$Default":    "1=1",
+		"destination": "destinationId = 'worker-b'",
+	}}
+
+	if err := verifyRules(ctx, rm, "worker-a", expected); !errors.Is(err, ErrTopologyMismatch) {
+		t.Fatalf("expected a topology mismatch, got %v", err)
+	}
+	if err := reconcileRules(ctx, rm, "worker-a", expected); err != nil {
+		t.Fatalf("failed to reconcile rules: %v", err)
+	}
+	if err := verifyRules(ctx, rm, "worker-a", expected); err != nil {
+		t.Fatalf("expected the rules to match, got %v", err)
+	}
+
+	// the default rule is only removed once the expected rules are in place
+	calls := []string{"put broadcast", "delete destination", "put destination", "delete $Default"}
+	if len(rm.calls) != len(calls) {
+		t.Fatalf("expected calls %v, got %v", calls, rm.calls)
+	}
+	for i := range calls {
+		if rm.calls[i] != calls[i] {
+			t.Fatalf("expected calls %v, got %v", calls, rm.calls)
+		}
+	}
+
+	// reconciling matching rules changes nothing
+	rm.calls = nil
+	if err := reconcileRules(ctx, rm, "worker-a", expected); err != nil {
+		t.Fatalf("failed to reconcile rules: %v", err)
+	}
+	if len(rm.calls) != 0 {
+		t.Fatalf("expected no calls, got %v", rm.calls)
+	}
+}
+
+func TestRoutedTo(t *testing.T) {
+	types := []string{workers.PutClusterType}
+	for _, tc := range []struct {
+		destination, messageType string
+		routed                   bool
+	}{
+		{"worker-a", workers.PutClusterType, true},
+		{messages.BroadcastId, workers.PutClusterType, true},
+		{"worker-b", workers.PutClusterType, false},
+		{"worker-a", workers.ClusterStatusChangedType, false},
+	} {
+		properties := map[string]interface{}{destinationIdProperty: tc.destination, typeProperty: tc.messageType}
+		if routed := routedTo(properties, "worker-a", types); routed != tc.routed {
+			t.Errorf("expected %s %s routed to be %t", tc.destination, tc.messageType, tc.routed)
+		}
+	}
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+	for _, tc := range []struct {
+		destination  string
+		messageTypes []string
+		filter       string
+	}{
+		{"worker-a", nil, "destinationId = 'worker-a'"},
+		{"worker-a", []string{workers.PutClusterType, workers.DeleteClusterType},
+			"destinationId = 'worker-a' AND type IN ('PutCluster', 'DeleteCluster')"},
+		{"worker-a' OR 1=1 OR 'x", nil, "destinationId = 'worker-a'' OR 1=1 OR ''x'"},
+		{"worker-a", []string{"Put'Cluster"}, "destinationId = 'worker-a' AND type IN ('Put''Cluster')"},
+	} {
+		if filter := subscriptionFilter(tc.destination, tc.messageTypes); filter != tc.filter {
+			t.Errorf("expected filter %q, got %q", tc.filter, filter)
+		}
+	}
+}
+
+func TestVerifySessions(t *testing.T) {
+	enabled, disabled := true, false
+	for _, tc := range []struct {
+		name            string
+		requiresSession *bool
+		wantErr         bool
+	}{
+		{"sessions", &enabled, false},
+		{"no sessions", &disabled, true},
+		{"unset", nil, true},
+	} {
+		subscription := &servicebus.SubscriptionEntity{
+			SubscriptionDescription: &servicebus.SubscriptionDescription{RequiresSession: tc.requiresSession},
+			Entity:                  &servicebus.Entity{Name: "worker-a"},
+		}
+		err := verifySessions(subscription)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: expected error %t, got %v", tc.name, tc.wantErr, err)
+		}
+		if err != nil && !errors.Is(err, ErrTopologyMismatch) {
+			t.Errorf("%s: expected a topology mismatch, got %v", tc.name, err)
+		}
+	}
+}
@@ -2,16 +2,31 @@ package bus
 
 import (
 	"context"
+	"errors"
 
-	"github.com/juan-lee/carp/internal/messages/workers"
+	"github.com/juan-lee/carp/internal/messages"
 )
 
-type Handle func(ctx context.Context, message string) error
+// User properties set on every message so subscription rules can filter on them.
+const (
+	destinationIdProperty = "destinationId"
+	typeProperty          = "type"
+	schemaVersionProperty = "schemaVersion"
+)
+
+// maxDeliveryCount matches the service bus default after which an abandoned
+// message is dead-lettered. It is the default RetryPolicy.MaxDeliveries.
+const maxDeliveryCount = 10
+
+// ErrMalformed marks a message that can never be handled. Listeners dead-letter
+// messages whose handler returns an error wrapping it instead of abandoning them.
+var ErrMalformed = errors.New("malformed message")
 
+// Listener receives the messages addressed to it and hands them to a dispatcher.
 type Listener interface {
-	Listen(ctx context.Context, h Handle) error
+	Listen(ctx context.Context, d *Dispatcher) error
 }
 
 type Publisher interface {
-	Publish(ctx context.Context, command workers.PutCluster) error
+	Publish(ctx context.Context, message messages.Message) error
 }
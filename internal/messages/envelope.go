@@ -0,0 +1,150 @@
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Envelope wraps a message with the metadata needed to route and decode it.
+type Envelope struct {
+	Type          string          `json:"type"`
+	SchemaVersion string          `json:"schemaVersion"`
+	Id            uuid.UUID       `json:"id"`
+	CorrelationId string          `json:"correlationId,omitempty"`
+	DestinationId string          `json:"destinationId"`
+	SessionId     string          `json:"sessionId,omitempty"`
+	Selector      Selector        `json:"selector,omitempty"`
+	Timestamp     time.Time       `json:"timestamp"`
+	Payload       json.RawMessage `json:"payload"`
+	// EncryptionKeyId is the key the payload is encrypted with, if it is encrypted
+	EncryptionKeyId string `json:"encryptionKeyId,omitempty"`
+	// Signature authenticates the rest of the envelope, if it is signed
+	Signature *Signature `json:"signature,omitempty"`
+}
+
+// Signature is the signature of an envelope.
+type Signature struct {
+	// KeyId is the id of the key the envelope was signed with
+	KeyId     string `json:"keyId"`
+	Algorithm string `json:"algorithm"`
+	Value     []byte `json:"value"`
+}
+
+type registration struct {
+	name          string
+	schemaVersion string
+	typ           reflect.Type
+}
+
+var (
+	registryMu sync.RWMutex
+	byName     = map[string]registration{}
+	byType     = map[reflect.Type]registration{}
+)
+
+// Register makes a message type known to the bus under the given name and
+// schema version. It panics if the name or type is already registered.
+func Register(name, schemaVersion string, message Message) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	typ := indirect(reflect.TypeOf(message))
+	if _, ok := byName[name]; ok {
+		panic(fmt.Sprintf("message type %s already registered", name))
+	}
+	if _, ok := byType[typ]; ok {
+		panic(fmt.Sprintf("message type %s already registered", typ))
+	}
+
+	r := registration{name: name, schemaVersion: schemaVersion, typ: typ}
+	byName[name] = r
+	byType[typ] = r
+}
+
+// NewEnvelope wraps a message of a registered type. Messages without an id
+// are given a new one, so every message on the bus can be deduplicated.
+func NewEnvelope(message Message) (*Envelope, error) {
+	registryMu.RLock()
+	r, ok := byType[indirect(reflect.TypeOf(message))]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("message type %T is not registered", message)
+	}
+
+	if message.MessageID() == uuid.Nil {
+		var err error
+		if message, err = withID(message, r.typ, uuid.New()); err != nil {
+			return nil, err
+		}
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s: %w", r.name, err)
+	}
+
+	sessionId := message.Destination()
+	if s, ok := message.(Sessioned); ok {
+		sessionId = s.SessionID()
+	}
+	var selector Selector
+	if m, ok := message.(Multicast); ok {
+		selector = m.RecipientSelector()
+	}
+
+	return &Envelope{
+		Type:          r.name,
+		SchemaVersion: r.schemaVersion,
+		Id:            message.MessageID(),
+		CorrelationId: message.CorrelationID(),
+		DestinationId: message.Destination(),
+		SessionId:     sessionId,
+		Selector:      selector,
+		Timestamp:     time.Now().UTC(),
+		Payload:       payload,
+	}, nil
+}
+
+// Decode returns the message in the envelope as a pointer to its registered type.
+func (e *Envelope) Decode() (Message, error) {
+	registryMu.RLock()
+	r, ok := byName[e.Type]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %q", e.Type)
+	}
+	if e.SchemaVersion != r.schemaVersion {
+		return nil, fmt.Errorf("unsupported schema version %q of %s, expected %q", e.SchemaVersion, e.Type, r.schemaVersion)
+	}
+
+	message := reflect.New(r.typ).Interface().(Message)
+	if err := json.Unmarshal(e.Payload, message); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %w", e.Type, err)
+	}
+	return message, nil
+}
+
+// withID returns a copy of the message with the given id. The caller's message
+// is left untouched.
+func withID(message Message, typ reflect.Type, id uuid.UUID) (Message, error) {
+	v := reflect.New(typ)
+	v.Elem().Set(reflect.Indirect(reflect.ValueOf(message)))
+	setter, ok := v.Interface().(interface{ SetMessageID(uuid.UUID) })
+	if !ok {
+		return nil, fmt.Errorf("message type %T has no id to set", message)
+	}
+	setter.SetMessageID(id)
+	return v.Interface().(Message), nil
+}
+
+func indirect(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
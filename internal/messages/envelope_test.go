@@ -0,0 +1,170 @@
+package messages
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type testCommand struct {
+	Command
+	Name string `json:"name"`
+}
+
+// SessionID orders test commands per name.
+func (c testCommand) SessionID() string {
+	return c.Name
+}
+
+type testEvent struct {
+	Event
+}
+
+type unregisteredEvent struct {
+	Event
+}
+
+func init() {
+	Register("TestCommand", "v2", testCommand{})
+	Register("TestEvent", "v1", &testEvent{})
+}
+
+func TestRegisterPanicsOnDuplicates(t *testing.T) {
+	tests := []struct {
+		name        string
+		messageName string
+		message     Message
+	}{
+		{name: "duplicate name", messageName: "TestCommand", message: unregisteredEvent{}},
+		{name: "duplicate type", messageName: "OtherCommand", message: testCommand{}},
+		{name: "duplicate type by pointer", messageName: "OtherEvent", message: testEvent{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected registering %s to panic", tt.messageName)
+				}
+			}()
+			Register(tt.messageName, "v1", tt.message)
+		})
+	}
+}
+
+func TestNewEnvelope(t *testing.T) {
+	id := uuid.New()
+	tests := []struct {
+		name            string
+		message         Message
+		wantType        string
+		wantID          uuid.UUID
+		wantSession     string
+		wantDestination string
+		wantErr         bool
+	}{
+		{
+			name:            "command keeps its id",
+			message:         testCommand{Command: Command{Id: id, DestinationId: "worker-a"}, Name: "one"},
+			wantType:        "TestCommand",
+			wantID:          id,
+			wantSession:     "one",
+			wantDestination: "worker-a",
+		},
+		{
+			name:            "event is given an id",
+			message:         &testEvent{Event: Event{SourceId: "worker-a"}},
+			wantType:        "TestEvent",
+			wantSession:     ControlPlaneId,
+			wantDestination: ControlPlaneId,
+		},
+		{
+			name:    "unregistered type",
+			message: unregisteredEvent{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := NewEnvelope(tt.message)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if envelope.Type != tt.wantType || envelope.SessionId != tt.wantSession || envelope.DestinationId != tt.wantDestination {
+				t.Errorf("expected a %s to %s in session %s, got %+v", tt.wantType, tt.wantDestination, tt.wantSession, envelope)
+			}
+			if tt.wantID != uuid.Nil && envelope.Id != tt.wantID {
+				t.Errorf("expected id %s, got %s", tt.wantID, envelope.Id)
+			}
+			if envelope.Id == uuid.Nil {
+				t.Errorf("expected the envelope to have an id")
+			}
+			var payload struct {
+				Id uuid.UUID `json:"id"`
+			}
+			if err := json.Unmarshal(envelope.Payload, &payload); err != nil || payload.Id != envelope.Id {
+				t.Errorf("expected the payload to carry id %s, got %s (%v)", envelope.Id, payload.Id, err)
+			}
+		})
+	}
+}
+
+func TestNewEnvelopeLeavesCallerMessageUntouched(t *testing.T) {
+	message := &testEvent{Event: Event{SourceId: "worker-a"}}
+	envelope, err := NewEnvelope(message)
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	if message.Id != uuid.Nil {
+		t.Errorf("expected the caller's message to keep its nil id, got %s", message.Id)
+	}
+	again, err := NewEnvelope(message)
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	if again.Id == envelope.Id {
+		t.Errorf("expected every envelope of an id-less message to get a new id")
+	}
+}
+
+func TestEnvelopeDecode(t *testing.T) {
+	envelope, err := NewEnvelope(testCommand{Command: Command{DestinationId: "worker-a"}, Name: "one"})
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(e *Envelope)
+		wantErr string
+	}{
+		{name: "registered", mutate: func(e *Envelope) {}},
+		{name: "unknown type", mutate: func(e *Envelope) { e.Type = "Unknown" }, wantErr: "unknown message type"},
+		{name: "schema version mismatch", mutate: func(e *Envelope) { e.SchemaVersion = "v1" }, wantErr: "unsupported schema version"},
+		{name: "invalid payload", mutate: func(e *Envelope) { e.Payload = json.RawMessage(`"one"`) }, wantErr: "failed to unmarshal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := *envelope
+			tt.mutate(&e)
+			message, err := e.Decode()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decode failed: %v", err)
+			}
+			command, ok := message.(*testCommand)
+			if !ok || command.Id != envelope.Id || command.Name != "one" {
+				t.Errorf("expected the wrapped command, got %#v", message)
+			}
+		})
+	}
+}
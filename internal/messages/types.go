@@ -2,11 +2,123 @@ package messages
 
 import "github.com/google/uuid"
 
+// ControlPlaneId is the destination of the events workers publish.
+const ControlPlaneId = "controlplane"
+
+// ControlPlaneRepliesId is the destination of the replies to the commands the
+// control plane publishes. Replies have a subscription of their own, so they
+// aren't held up behind status reports.
+const ControlPlaneRepliesId = "controlplane-replies"
+
+// BroadcastId is the destination of messages addressed to every listener
+// whose labels match the message's selector. Unlike a worker name it has
+// upper case letters, and it is a valid label value and NATS subject token.
+const BroadcastId = "Broadcast"
+
+// Selector selects the recipients of a broadcast by their labels. An empty
+// selector selects every recipient.
+type Selector map[string]string
+
+// Matches reports whether a recipient with the given labels is selected.
+func (s Selector) Matches(labels map[string]string) bool {
+	for k, v := range s {
+		if l, ok := labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
+
 type Command struct {
 	Id            uuid.UUID `json:"id"`
 	DestinationId string    `json:"destinationId"`
+	CorrelationId string    `json:"correlationId,omitempty"`
+	// Generation increases with every command about the same object, so
+	// destinations can reject commands older than the last one they applied
+	Generation int64 `json:"generation,omitempty"`
+	// Selector limits a broadcast command to the recipients it matches
+	Selector Selector `json:"selector,omitempty"`
+	// ReplyTo is the destination of the replies to the command. The command
+	// isn't replied to when it is empty.
+	ReplyTo string `json:"replyTo,omitempty"`
+}
+
+// MessageID returns the id of the command.
+func (c Command) MessageID() uuid.UUID {
+	return c.Id
+}
+
+// SetMessageID sets the id of the command.
+func (c *Command) SetMessageID(id uuid.UUID) {
+	c.Id = id
+}
+
+// Destination returns the id of the destination the command is addressed to.
+func (c Command) Destination() string {
+	return c.DestinationId
+}
+
+// CorrelationID returns the id of the message that caused the command, if any.
+func (c Command) CorrelationID() string {
+	return c.CorrelationId
+}
+
+// RecipientSelector returns the selector of a broadcast command.
+func (c Command) RecipientSelector() Selector {
+	return c.Selector
 }
 
 type Event struct {
-	Id uuid.UUID
+	Id            uuid.UUID `json:"id"`
+	SourceId      string    `json:"sourceId"`
+	Sequence      int64     `json:"sequence"`
+	CorrelationId string    `json:"correlationId,omitempty"`
+}
+
+// MessageID returns the id of the event.
+func (e Event) MessageID() uuid.UUID {
+	return e.Id
+}
+
+// SetMessageID sets the id of the event.
+func (e *Event) SetMessageID(id uuid.UUID) {
+	e.Id = id
+}
+
+// Destination returns the id of the control plane, which receives all events.
+func (e Event) Destination() string {
+	return ControlPlaneId
+}
+
+// CorrelationID returns the id of the message that caused the event, if any.
+func (e Event) CorrelationID() string {
+	return e.CorrelationId
+}
+
+// Sessioned is implemented by messages that must be handled in order with the
+// other messages of their session, such as the commands about a cluster.
+// Messages that don't implement it share a session per destination.
+type Sessioned interface {
+	SessionID() string
+}
+
+// Multicast is implemented by messages that can be broadcast to the
+// recipients matching a selector, such as commands.
+type Multicast interface {
+	RecipientSelector() Selector
+}
+
+// Confidential is implemented by messages whose payload carries sensitive
+// cluster configuration, which is encrypted on the bus when an encryption
+// key is configured.
+type Confidential interface {
+	ConfidentialPayload()
+}
+
+// Message is a command or event that can be sent over the bus. Commands and
+// events implement it by embedding Command or Event.
+type Message interface {
+	MessageID() uuid.UUID
+	Destination() string
+	CorrelationID() string
 }
@@ -5,12 +5,52 @@ import (
 	"github.com/juan-lee/carp/internal/messages"
 )
 
+// PutCluster creates or updates a managed cluster on the destination worker.
 type PutCluster struct {
 	messages.Command
-	Spec v1alpha1.ManagedClusterSpec
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// ClusterUID is the uid of the managed cluster on the control plane, which
+	// tells a recreated cluster apart from an earlier one of the same name
+	ClusterUID string                      `json:"clusterUid,omitempty"`
+	Spec       v1alpha1.ManagedClusterSpec `json:"spec"`
 }
 
+// SessionID returns the id of the cluster, so the commands about a cluster are handled in order.
+func (c PutCluster) SessionID() string {
+	return ClusterID(c.Namespace, c.Name)
+}
+
+// ConfidentialPayload marks the spec of the cluster as sensitive.
+func (c PutCluster) ConfidentialPayload() {}
+
+// DeleteCluster deletes a managed cluster from the destination worker.
 type DeleteCluster struct {
 	messages.Command
-	Id string
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace"`
+	ClusterUID string `json:"clusterUid,omitempty"`
+}
+
+// SessionID returns the id of the cluster, so the commands about a cluster are handled in order.
+func (c DeleteCluster) SessionID() string {
+	return ClusterID(c.Namespace, c.Name)
+}
+
+// ClusterID returns the id of a managed cluster on the bus.
+func ClusterID(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// ReportInventory asks the destination workers to publish a ClusterDigest
+// right away. It is usually broadcast.
+type ReportInventory struct {
+	messages.Command
+}
+
+// RotateCredentials asks the destination workers to restart the components
+// using the azure credentials copied to them, so rotated credentials are
+// picked up. It is usually broadcast.
+type RotateCredentials struct {
+	messages.Command
 }
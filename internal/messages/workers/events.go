@@ -5,7 +5,78 @@ import (
 	"github.com/juan-lee/carp/internal/messages"
 )
 
+// ClusterStatusChanged reports the status of a managed cluster hosted by the source worker.
 type ClusterStatusChanged struct {
 	messages.Event
-	Status v1alpha1.ManagedClusterStatus
+	Name      string                        `json:"name"`
+	Namespace string                        `json:"namespace"`
+	Status    v1alpha1.ManagedClusterStatus `json:"status"`
+}
+
+// SessionID returns the id of the cluster, so the reports about a cluster are handled in order.
+func (e ClusterStatusChanged) SessionID() string {
+	return ClusterID(e.Namespace, e.Name)
+}
+
+// ClusterDigest lists the managed clusters hosted by the source worker, so the
+// control plane can resend the commands the worker missed.
+type ClusterDigest struct {
+	messages.Event
+	Clusters []HostedCluster `json:"clusters"`
+}
+
+// HostedCluster is a managed cluster in a ClusterDigest.
+type HostedCluster struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// ClusterUID is the uid of the managed cluster on the control plane
+	ClusterUID string `json:"clusterUid"`
+	// Generation is the generation of the last command applied to the cluster
+	Generation int64 `json:"generation"`
+}
+
+// SessionID returns the id of the source worker, so its digests are handled in order.
+func (e ClusterDigest) SessionID() string {
+	return e.SourceId
+}
+
+// CommandAcknowledged reports that the source worker handled an operational
+// command, such as a broadcast ReportInventory.
+type CommandAcknowledged struct {
+	messages.Event
+	// CommandId is the id of the acknowledged command
+	CommandId string `json:"commandId"`
+	// Error is why the command failed, if it did
+	Error string `json:"error,omitempty"`
+}
+
+// SessionID returns the id of the source worker, so its acknowledgements are handled in order.
+func (e CommandAcknowledged) SessionID() string {
+	return e.SourceId
+}
+
+// CommandReply reports the outcome of a cluster command to its ReplyTo
+// destination. A command can be replied to more than once, e.g. Accepted and
+// then Completed.
+type CommandReply struct {
+	messages.Event
+	// DestinationId is the ReplyTo of the command
+	DestinationId string `json:"destinationId"`
+	// CommandId is the id of the command replied to
+	CommandId string                  `json:"commandId"`
+	Name      string                  `json:"name"`
+	Namespace string                  `json:"namespace"`
+	Outcome   v1alpha1.CommandOutcome `json:"outcome"`
+	// Reason is why the command was rejected
+	Reason string `json:"reason,omitempty"`
+}
+
+// Destination returns the ReplyTo of the command replied to.
+func (e CommandReply) Destination() string {
+	return e.DestinationId
+}
+
+// SessionID returns the id of the cluster, so the replies about a cluster are handled in order.
+func (e CommandReply) SessionID() string {
+	return ClusterID(e.Namespace, e.Name)
 }
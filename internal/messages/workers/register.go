@@ -0,0 +1,26 @@
+package workers
+
+import "github.com/juan-lee/carp/internal/messages"
+
+// Names of the worker message types on the bus.
+const (
+	PutClusterType           = "PutCluster"
+	DeleteClusterType        = "DeleteCluster"
+	ClusterStatusChangedType = "ClusterStatusChanged"
+	ClusterDigestType        = "ClusterDigest"
+	ReportInventoryType      = "ReportInventory"
+	RotateCredentialsType    = "RotateCredentials"
+	CommandAcknowledgedType  = "CommandAcknowledged"
+	CommandReplyType         = "CommandReply"
+)
+
+func init() {
+	messages.Register(PutClusterType, "v1", PutCluster{})
+	messages.Register(DeleteClusterType, "v1", DeleteCluster{})
+	messages.Register(ClusterStatusChangedType, "v1", ClusterStatusChanged{})
+	messages.Register(ClusterDigestType, "v1", ClusterDigest{})
+	messages.Register(ReportInventoryType, "v1", ReportInventory{})
+	messages.Register(RotateCredentialsType, "v1", RotateCredentials{})
+	messages.Register(CommandAcknowledgedType, "v1", CommandAcknowledged{})
+	messages.Register(CommandReplyType, "v1", CommandReply{})
+}
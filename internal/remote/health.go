@@ -0,0 +1,79 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Ready reports whether every Deployment, DaemonSet and StatefulSet in the
+// manifest has rolled out on the remote cluster. Missing workloads aren't
+// ready. Other kinds are considered ready once applied.
+func (c *Client) Ready(ctx context.Context, manifest []byte) (bool, error) {
+	decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(manifest), 4096)
+	for {
+		var obj unstructured.Unstructured
+		if err := decoder.Decode(&obj.Object); err != nil {
+			if errors.Is(err, io.EOF) {
+				return true, nil
+			}
+			return false, fmt.Errorf("failed to decode manifest: %w", err)
+		}
+		if obj.Object == nil {
+			continue
+		}
+
+		ready, err := c.objectReady(ctx, &obj)
+		if err != nil {
+			return false, err
+		}
+		if !ready {
+			return false, nil
+		}
+	}
+}
+
+func (c *Client) objectReady(ctx context.Context, obj *unstructured.Unstructured) (bool, error) {
+	kind := obj.GetKind()
+	if kind != "Deployment" && kind != "StatefulSet" && kind != "DaemonSet" {
+		return true, nil
+	}
+
+	namespace := obj.GetNamespace()
+	if namespace == "" {
+		namespace = "default"
+	}
+	key := types.NamespacedName{Namespace: namespace, Name: obj.GetName()}
+	if err := c.Get(ctx, key, obj); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get %s %s: %w", kind, key, err)
+	}
+
+	observed, _, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+	if obj.GetGeneration() != observed {
+		return false, nil
+	}
+
+	var desired, ready int64
+	if kind == "DaemonSet" {
+		desired, _, _ = unstructured.NestedInt64(obj.Object, "status", "desiredNumberScheduled")
+		ready, _, _ = unstructured.NestedInt64(obj.Object, "status", "numberReady")
+	} else {
+		replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+		if !found {
+			replicas = 1
+		}
+		desired = replicas
+		ready, _, _ = unstructured.NestedInt64(obj.Object, "status", "readyReplicas")
+	}
+	return ready >= desired, nil
+}
@@ -0,0 +1,130 @@
+package remote
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func deployment(name string, generation, observed int64, replicas *int32, ready int32) runtime.Object {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "system", Name: name, Generation: generation},
+		Spec:       appsv1.DeploymentSpec{Replicas: replicas},
+		Status:     appsv1.DeploymentStatus{ObservedGeneration: observed, ReadyReplicas: ready},
+	}
+}
+
+func daemonSet(name string, desired, ready int32) runtime.Object {
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "system", Name: name, Generation: 1},
+		Status:     appsv1.DaemonSetStatus{ObservedGeneration: 1, DesiredNumberScheduled: desired, NumberReady: ready},
+	}
+}
+
+const (
+	controllerManifest = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: controller
+  namespace: system
+`
+	agentManifest = `apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: agent
+  namespace: system
+`
+	namespaceManifest = `apiVersion: v1
+kind: Namespace
+metadata:
+  name: system
+`
+)
+
+func TestReady(t *testing.T) {
+	tests := []struct {
+		name     string
+		objects  []runtime.Object
+		manifest string
+		want     bool
+	}{
+		{
+			name:     "available deployment",
+			objects:  []runtime.Object{deployment("controller", 2, 2, int32Ptr(2), 2)},
+			manifest: controllerManifest,
+			want:     true,
+		},
+		{
+			name:     "deployment defaults to one replica",
+			objects:  []runtime.Object{deployment("controller", 1, 1, nil, 1)},
+			manifest: controllerManifest,
+			want:     true,
+		},
+		{
+			name:     "deployment rolling out",
+			objects:  []runtime.Object{deployment("controller", 1, 1, int32Ptr(2), 1)},
+			manifest: controllerManifest,
+		},
+		{
+			name:     "deployment generation not observed",
+			objects:  []runtime.Object{deployment("controller", 2, 1, int32Ptr(1), 1)},
+			manifest: controllerManifest,
+		},
+		{
+			name:     "missing deployment",
+			manifest: controllerManifest,
+		},
+		{
+			name:     "ready daemonset",
+			objects:  []runtime.Object{daemonSet("agent", 3, 3)},
+			manifest: agentManifest,
+			want:     true,
+		},
+		{
+			name:     "daemonset not ready",
+			objects:  []runtime.Object{daemonSet("agent", 3, 2)},
+			manifest: agentManifest,
+		},
+		{
+			name:     "other kinds are ready once applied",
+			manifest: namespaceManifest,
+			want:     true,
+		},
+		{
+			name:     "every workload must be ready",
+			objects:  []runtime.Object{deployment("controller", 1, 1, int32Ptr(1), 1), daemonSet("agent", 3, 2)},
+			manifest: namespaceManifest + "---\n" + controllerManifest + "---\n" + agentManifest,
+		},
+		{
+			name:     "empty documents are skipped",
+			objects:  []runtime.Object{deployment("controller", 1, 1, int32Ptr(1), 1)},
+			manifest: "---\n---\n" + controllerManifest,
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			if err := appsv1.AddToScheme(scheme); err != nil {
+				t.Fatalf("failed to build scheme: %v", err)
+			}
+			c := &Client{Client: fake.NewFakeClientWithScheme(scheme, tt.objects...)}
+
+			got, err := c.Ready(context.Background(), []byte(tt.manifest))
+			if err != nil {
+				t.Fatalf("ready failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected ready %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
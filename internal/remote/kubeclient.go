@@ -3,6 +3,8 @@ package remote
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/tools/clientcmd"
@@ -46,6 +48,26 @@ func (c *Client) Apply(url string) (stdout *bytes.Buffer, stderr *bytes.Buffer,
 
 }
 
+// ApplyManifest applies the given manifest. kubectl only reads "-" from
+// os.Stdin, so the manifest is staged in a temporary file.
+func (c *Client) ApplyManifest(manifest []byte) (stdout *bytes.Buffer, stderr *bytes.Buffer, err error) {
+	f, err := ioutil.TempFile("", "carp-manifest-*.yaml")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create manifest file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(manifest); err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("failed to write manifest file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, nil, fmt.Errorf("failed to close manifest file: %w", err)
+	}
+
+	return c.Apply(f.Name())
+}
+
 // TODO(ace): switch to krusty or shell to kustomize binary. This is reliable
 // but lacks newer kustomize features
 func (c *Client) Kustomize(url string, mutator ApplyOptionsMutateFn) (stdout *bytes.Buffer, stderr *bytes.Buffer, err error) {
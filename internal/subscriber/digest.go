@@ -0,0 +1,236 @@
+package subscriber
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+// DigestPublisher periodically publishes a digest of the managed clusters a
+// worker hosts, so the control plane can find the commands the worker missed.
+type DigestPublisher struct {
+	Client     client.Client
+	Publisher  bus.Publisher
+	Log        logr.Logger
+	WorkerName string
+	// Interval is the time between digests
+	Interval time.Duration
+
+	// sequence is incremented atomically, as inventory reports publish digests
+	// concurrently with Start
+	sequence int64
+}
+
+// Start publishes a digest every interval until stop is closed. Failed
+// digests are logged and left to the next interval.
+func (p *DigestPublisher) Start(stop <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.publish(ctx, ""); err != nil {
+			p.Log.Error(err, "failed to publish cluster digest")
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// publish publishes a digest, correlated with the command asking for it if
+// there is one.
+func (p *DigestPublisher) publish(ctx context.Context, correlationID string) error {
+	digest, err := p.Digest(ctx)
+	if err != nil {
+		return err
+	}
+	digest.CorrelationId = correlationID
+	if err := p.Publisher.Publish(ctx, digest); err != nil {
+		return fmt.Errorf("failed to publish cluster digest: %w", err)
+	}
+	p.Log.V(1).Info("published cluster digest", "clusters", len(digest.Clusters))
+	return nil
+}
+
+// Digest lists the managed clusters created by commands from the control
+// plane, with the generation of the last command applied to each. Clusters
+// being deleted are left out.
+func (p *DigestPublisher) Digest(ctx context.Context) (workers.ClusterDigest, error) {
+	var list v1alpha1.ManagedClusterList
+	if err := p.Client.List(ctx, &list, client.MatchingLabels{v1alpha1.ManagedClusterHostedByLabel: p.WorkerName}); err != nil {
+		return workers.ClusterDigest{}, fmt.Errorf("failed to list managed clusters: %w", err)
+	}
+
+	digest := workers.ClusterDigest{
+		Event: messages.Event{
+			Id:       uuid.New(),
+			SourceId: p.WorkerName,
+			Sequence: atomic.AddInt64(&p.sequence, 1),
+		},
+		Clusters: []workers.HostedCluster{},
+	}
+	generations := map[string]map[string]commandGeneration{}
+	for i := range list.Items {
+		mc := &list.Items[i]
+		if !mc.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		namespaced, ok := generations[mc.Namespace]
+		if !ok {
+			var err error
+			if namespaced, err = commandGenerations(ctx, p.Client, mc.Namespace); err != nil {
+				return workers.ClusterDigest{}, err
+			}
+			generations[mc.Namespace] = namespaced
+		}
+		applied, ok := namespaced[mc.Name]
+		if !ok {
+			continue
+		}
+
+		digest.Clusters = append(digest.Clusters, workers.HostedCluster{
+			Name:       mc.Name,
+			Namespace:  mc.SourceNamespace(),
+			ClusterUID: applied.clusterUID,
+			Generation: applied.generation,
+		})
+	}
+	return digest, nil
+}
+
+// handleClusterDigest compares a worker's digest with the managed clusters
+// assigned to it. Clusters that are missing from the digest, or behind the
+// generation last published, are published again by resetting their published
+// generation. Clusters the worker hosts but isn't assigned are deleted from
+// it. The outcome is reported as the worker's ClustersInSync condition.
+func (s *StatusSubscriber) handleClusterDigest(ctx context.Context, md bus.Metadata, m messages.Message) error {
+	digest := m.(*workers.ClusterDigest)
+	if digest.SourceId == "" {
+		return fmt.Errorf("%w: digest %s has no source worker", bus.ErrMalformed, digest.Id)
+	}
+
+	log := s.Log.WithValues("digest", digest.Id, "worker", digest.SourceId, "deliveryCount", md.DeliveryCount)
+
+	var workerList v1alpha1.WorkerList
+	if err := s.Client.List(ctx, &workerList); err != nil {
+		return fmt.Errorf("failed to list workers: %w", err)
+	}
+	var worker *v1alpha1.Worker
+	for i := range workerList.Items {
+		if workerList.Items[i].Name == digest.SourceId {
+			worker = &workerList.Items[i]
+		}
+	}
+	if worker == nil {
+		log.Info("dropping digest of unknown worker")
+		return nil
+	}
+
+	var list v1alpha1.ManagedClusterList
+	if err := s.Client.List(ctx, &list); err != nil {
+		return fmt.Errorf("failed to list managed clusters: %w", err)
+	}
+
+	hosted := make(map[string]workers.HostedCluster, len(digest.Clusters))
+	for _, h := range digest.Clusters {
+		hosted[workers.ClusterID(h.Namespace, h.Name)] = h
+	}
+
+	var missing, behind, orphaned []string
+	for i := range list.Items {
+		mc := &list.Items[i]
+		if mc.Status.AssignedWorker == nil || *mc.Status.AssignedWorker != digest.SourceId {
+			continue
+		}
+		id := workers.ClusterID(mc.Namespace, mc.Name)
+		h, ok := hosted[id]
+		delete(hosted, id)
+
+		// commands still in the outbox haven't had a chance to reach the worker
+		if !mc.DeletionTimestamp.IsZero() || len(mc.Status.Outbox) > 0 {
+			continue
+		}
+		switch {
+		case !ok || h.ClusterUID != string(mc.UID):
+			missing = append(missing, id)
+		case h.Generation < mc.Status.PublishedGeneration:
+			behind = append(behind, id)
+		default:
+			continue
+		}
+
+		mc.Status.PublishedGeneration = 0
+		if err := s.Client.Status().Update(ctx, mc); err != nil {
+			return fmt.Errorf("failed to republish managed cluster %s: %w", id, err)
+		}
+	}
+
+	for id, h := range hosted {
+		orphaned = append(orphaned, id)
+		if s.Publisher == nil {
+			continue
+		}
+		command := workers.DeleteCluster{
+			Command: messages.Command{
+				Id:            uuid.New(),
+				DestinationId: digest.SourceId,
+				CorrelationId: digest.Id.String(),
+				Generation:    h.Generation + 1,
+			},
+			Name:       h.Name,
+			Namespace:  h.Namespace,
+			ClusterUID: h.ClusterUID,
+		}
+		if err := s.Publisher.Publish(ctx, command); err != nil {
+			return fmt.Errorf("failed to publish delete of orphaned cluster %s: %w", id, err)
+		}
+	}
+
+	if len(missing)+len(behind)+len(orphaned) == 0 {
+		worker.Status.SetCondition(v1alpha1.WorkerClustersInSync, corev1.ConditionTrue, "InSync", "")
+	} else {
+		log.Info("worker is out of sync", "missing", missing, "behind", behind, "orphaned", orphaned)
+		worker.Status.SetCondition(v1alpha1.WorkerClustersInSync, corev1.ConditionFalse, "OutOfSync",
+			digestDiscrepancies(missing, behind, orphaned))
+	}
+	if err := s.Client.Status().Update(ctx, worker); err != nil {
+		return fmt.Errorf("failed to update worker %s status: %w", worker.Name, err)
+	}
+	return nil
+}
+
+// digestDiscrepancies describes the clusters found out of sync by a digest.
+func digestDiscrepancies(missing, behind, orphaned []string) string {
+	var parts []string
+	for _, d := range []struct {
+		kind     string
+		clusters []string
+	}{{"missing", missing}, {"behind", behind}, {"orphaned", orphaned}} {
+		if len(d.clusters) == 0 {
+			continue
+		}
+		sort.Strings(d.clusters)
+		parts = append(parts, fmt.Sprintf("%s: %s", d.kind, strings.Join(d.clusters, ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,113 @@
+package subscriber
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/bus/bustest"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+func assignedCluster(name, uid, worker string, published int64) *v1alpha1.ManagedCluster {
+	return &v1alpha1.ManagedCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(uid)},
+		Status:     v1alpha1.ManagedClusterStatus{AssignedWorker: &worker, PublishedGeneration: published},
+	}
+}
+
+func TestDigestListsClustersCreatedByCommands(t *testing.T) {
+	ctx := context.Background()
+	s := newSubscriber(t)
+
+	put := workers.PutCluster{Command: command(2), Name: "one", Namespace: "default", ClusterUID: "uid-1"}
+	if err := s.putCluster(ctx, bus.Metadata{}, put); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	// clusters created by hand aren't reported
+	local := &v1alpha1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "local"}}
+	if err := s.Client.Create(ctx, local); err != nil {
+		t.Fatalf("failed to create cluster: %v", err)
+	}
+
+	p := &DigestPublisher{Client: s.Client, Log: s.Log, WorkerName: "worker-a"}
+	digest, err := p.Digest(ctx)
+	if err != nil {
+		t.Fatalf("digest failed: %v", err)
+	}
+	expected := workers.HostedCluster{Name: "one", Namespace: "default", ClusterUID: "uid-1", Generation: 2}
+	if digest.SourceId != "worker-a" || len(digest.Clusters) != 1 || digest.Clusters[0] != expected {
+		t.Fatalf("expected a digest of worker-a with %v, got %+v", expected, digest)
+	}
+}
+
+func TestClusterDigestResyncsWorker(t *testing.T) {
+	ctx := context.Background()
+	sub := newSubscriber(t)
+	c := sub.Client
+	publisher := &bustest.RecordingPublisher{}
+	s := &StatusSubscriber{Client: c, Log: sub.Log, Publisher: publisher}
+
+	worker := &v1alpha1.Worker{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "worker-a"}}
+	objs := []runtime.Object{
+		worker,
+		assignedCluster("synced", "uid-synced", "worker-a", 3),
+		assignedCluster("missing", "uid-missing", "worker-a", 1),
+		assignedCluster("behind", "uid-behind", "worker-a", 4),
+		assignedCluster("elsewhere", "uid-elsewhere", "worker-b", 1),
+	}
+	for _, o := range objs {
+		if err := c.Create(ctx, o); err != nil {
+			t.Fatalf("failed to create %v: %v", o, err)
+		}
+	}
+
+	digest := &workers.ClusterDigest{
+		Event: messages.Event{SourceId: "worker-a"},
+		Clusters: []workers.HostedCluster{
+			{Name: "synced", Namespace: "default", ClusterUID: "uid-synced", Generation: 3},
+			{Name: "behind", Namespace: "default", ClusterUID: "uid-behind", Generation: 2},
+			{Name: "elsewhere", Namespace: "default", ClusterUID: "uid-elsewhere", Generation: 1},
+		},
+	}
+	if err := s.handleClusterDigest(ctx, bus.Metadata{}, digest); err != nil {
+		t.Fatalf("digest failed: %v", err)
+	}
+
+	for name, published := range map[string]int64{"synced": 3, "missing": 0, "behind": 0, "elsewhere": 1} {
+		var mc v1alpha1.ManagedCluster
+		if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, &mc); err != nil {
+			t.Fatalf("failed to get %s: %v", name, err)
+		}
+		if mc.Status.PublishedGeneration != published {
+			t.Errorf("expected %s to have published generation %d, got %d", name, published, mc.Status.PublishedGeneration)
+		}
+	}
+
+	if len(publisher.Published) != 1 {
+		t.Fatalf("expected a delete of the orphaned cluster, got %v", publisher.Published)
+	}
+	del, ok := publisher.Published[0].(workers.DeleteCluster)
+	if !ok || del.Name != "elsewhere" || del.DestinationId != "worker-a" || del.Generation != 2 {
+		t.Fatalf("expected a delete of elsewhere from worker-a, got %+v", publisher.Published[0])
+	}
+
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "worker-a"}, worker); err != nil {
+		t.Fatalf("failed to get worker: %v", err)
+	}
+	cond := worker.Status.GetCondition(v1alpha1.WorkerClustersInSync)
+	if cond == nil || cond.Status != corev1.ConditionFalse {
+		t.Fatalf("expected the worker to be out of sync, got %+v", cond)
+	}
+	if expected := "missing: default/missing; behind: default/behind; orphaned: default/elsewhere"; cond.Message != expected {
+		t.Fatalf("expected message %q, got %q", expected, cond.Message)
+	}
+}
@@ -0,0 +1,114 @@
+package subscriber
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// commandGenerationsName is the ConfigMap in a namespace recording the last
+// command applied to each cluster of the namespace, as <cluster uid>/<generation>.
+// Records outlive their clusters, so a stale PutCluster can't resurrect a
+// deleted cluster.
+const commandGenerationsName = "carp-command-generations"
+
+// commandGeneration identifies the last command applied to a cluster.
+type commandGeneration struct {
+	clusterUID string
+	generation int64
+}
+
+func parseCommandGeneration(s string) (commandGeneration, bool) {
+	i := strings.LastIndex(s, "/")
+	if i < 0 {
+		return commandGeneration{}, false
+	}
+	generation, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil {
+		return commandGeneration{}, false
+	}
+	return commandGeneration{clusterUID: s[:i], generation: generation}, true
+}
+
+func (g commandGeneration) String() string {
+	return fmt.Sprintf("%s/%d", g.clusterUID, g.generation)
+}
+
+// stale reports whether a command is older than the last command applied to
+// the same cluster. Commands without a generation, and commands about a
+// recreated cluster, are never stale.
+func stale(ctx context.Context, c client.Client, namespace, name string, cmd commandGeneration) (bool, error) {
+	if cmd.generation == 0 {
+		return false, nil
+	}
+
+	generations, err := commandGenerations(ctx, c, namespace)
+	if err != nil {
+		return false, err
+	}
+
+	applied, ok := generations[name]
+	if !ok || applied.clusterUID != cmd.clusterUID {
+		return false, nil
+	}
+	return cmd.generation < applied.generation, nil
+}
+
+// commandGenerations returns the last command applied to each cluster of a
+// namespace that has one.
+func commandGenerations(ctx context.Context, c client.Client, namespace string) (map[string]commandGeneration, error) {
+	var cm corev1.ConfigMap
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: commandGenerationsName}, &cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get command generations of %s: %w", namespace, err)
+	}
+
+	generations := make(map[string]commandGeneration, len(cm.Data))
+	for name, s := range cm.Data {
+		if g, ok := parseCommandGeneration(s); ok {
+			generations[name] = g
+		}
+	}
+	return generations, nil
+}
+
+// recordGeneration records the command as the last one applied to the cluster.
+func recordGeneration(ctx context.Context, c client.Client, namespace, name string, cmd commandGeneration) error {
+	if cmd.generation == 0 {
+		return nil
+	}
+
+	// errors are returned unwrapped so conflicts are recognised and retried
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var cm corev1.ConfigMap
+		err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: commandGenerationsName}, &cm)
+		if apierrors.IsNotFound(err) {
+			cm = corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: commandGenerationsName},
+				Data:       map[string]string{name: cmd.String()},
+			}
+			return c.Create(ctx, &cm)
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[name] = cmd.String()
+		return c.Update(ctx, &cm)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record command generation of %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package subscriber
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+// restartedAtAnnotation is set on the pod template of a deployment to restart
+// its pods, like kubectl rollout restart does.
+const restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// credentialsDeployments are restarted by RotateCredentials to pick up the
+// azure credentials copied to the worker.
+var credentialsDeployments = []types.NamespacedName{
+	{Namespace: "capz-system", Name: "capz-controller-manager"},
+}
+
+// operation handles an operational command and acknowledges it to the
+// control plane. A failed operation is acknowledged with its error rather
+// than retried; only failing to acknowledge is retried.
+func (s *Subscriber) operation(op func(context.Context, messages.Command) error) bus.HandlerFunc {
+	return func(ctx context.Context, md bus.Metadata, m messages.Message) error {
+		var cmd messages.Command
+		switch c := m.(type) {
+		case *workers.ReportInventory:
+			cmd = c.Command
+		case *workers.RotateCredentials:
+			cmd = c.Command
+		}
+		log := s.Log.WithValues("command", cmd.Id, "type", md.Type, "deliveryCount", md.DeliveryCount)
+
+		ack := workers.CommandAcknowledged{
+			Event: messages.Event{
+				Id:            uuid.New(),
+				SourceId:      s.WorkerName,
+				CorrelationId: cmd.Id.String(),
+			},
+			CommandId: cmd.Id.String(),
+		}
+		if err := op(ctx, cmd); err != nil {
+			log.Error(err, "operation failed")
+			ack.Error = err.Error()
+		} else {
+			log.Info("applied operation")
+		}
+
+		if s.Publisher == nil {
+			return nil
+		}
+		if err := s.Publisher.Publish(ctx, ack); err != nil {
+			return fmt.Errorf("failed to acknowledge command %s: %w", cmd.Id, err)
+		}
+		return nil
+	}
+}
+
+// reportInventory publishes a digest of the worker's clusters right away.
+func (s *Subscriber) reportInventory(ctx context.Context, cmd messages.Command) error {
+	if s.Digest == nil {
+		return fmt.Errorf("worker doesn't publish digests")
+	}
+	return s.Digest.publish(ctx, cmd.Id.String())
+}
+
+// rotateCredentials restarts the deployments using the azure credentials.
+func (s *Subscriber) rotateCredentials(ctx context.Context, cmd messages.Command) error {
+	restartedAt := time.Now().UTC().Format(time.RFC3339)
+	for _, key := range credentialsDeployments {
+		var deployment appsv1.Deployment
+		if err := s.Client.Get(ctx, key, &deployment); err != nil {
+			return fmt.Errorf("failed to get deployment %s: %w", key, err)
+		}
+		patch := client.MergeFrom(deployment.DeepCopy())
+		if deployment.Spec.Template.Annotations == nil {
+			deployment.Spec.Template.Annotations = map[string]string{}
+		}
+		deployment.Spec.Template.Annotations[restartedAtAnnotation] = restartedAt
+		if err := s.Client.Patch(ctx, &deployment, patch); err != nil {
+			return fmt.Errorf("failed to restart deployment %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// handleCommandAcknowledged records a worker's acknowledgement on the
+// WorkerCommand that broadcast the command. Acknowledgements from workers that
+// weren't selected when the command was broadcast are dropped.
+func (s *StatusSubscriber) handleCommandAcknowledged(ctx context.Context, md bus.Metadata, m messages.Message) error {
+	ack := m.(*workers.CommandAcknowledged)
+	if ack.SourceId == "" || ack.CommandId == "" {
+		return fmt.Errorf("%w: acknowledgement %s has no source worker or command", bus.ErrMalformed, ack.Id)
+	}
+
+	log := s.Log.WithValues("event", ack.Id, "command", ack.CommandId, "worker", ack.SourceId, "deliveryCount", md.DeliveryCount)
+
+	// errors are returned unwrapped so conflicts are recognised and retried
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var list v1alpha1.WorkerCommandList
+		if err := s.Client.List(ctx, &list); err != nil {
+			return err
+		}
+		var wc *v1alpha1.WorkerCommand
+		for i := range list.Items {
+			if list.Items[i].Status.CommandID == ack.CommandId {
+				wc = &list.Items[i]
+			}
+		}
+		if wc == nil {
+			log.Info("dropping acknowledgement of unknown command")
+			return nil
+		}
+		if !containsString(wc.Status.Recipients, ack.SourceId) {
+			log.Info("dropping acknowledgement from worker that isn't a recipient")
+			return nil
+		}
+
+		wc.Status.Acknowledge(ack.SourceId, ack.Error)
+		if err := s.Client.Status().Update(ctx, wc); err != nil {
+			return err
+		}
+		log.Info("applied acknowledgement", "workercommand", wc.Namespace+"/"+wc.Name, "phase", wc.Status.Phase)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record acknowledgement of command %s: %w", ack.CommandId, err)
+	}
+	return nil
+}
+
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package subscriber
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/bus/bustest"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+func broadcast() messages.Command {
+	return messages.Command{Id: uuid.New(), DestinationId: messages.BroadcastId}
+}
+
+func TestOperationsAreAcknowledged(t *testing.T) {
+	ctx := context.Background()
+	s := newSubscriber(t)
+	publisher := &bustest.RecordingPublisher{}
+	s.Publisher = publisher
+	s.WorkerName = "worker-a"
+	s.Digest = &DigestPublisher{Client: s.Client, Publisher: publisher, Log: s.Log, WorkerName: "worker-a"}
+
+	report := &workers.ReportInventory{Command: broadcast()}
+	if err := s.operation(s.reportInventory)(ctx, bus.Metadata{}, report); err != nil {
+		t.Fatalf("report inventory failed: %v", err)
+	}
+	if len(publisher.Published) != 2 {
+		t.Fatalf("expected a digest and an acknowledgement, got %v", publisher.Published)
+	}
+	if digest, ok := publisher.Published[0].(workers.ClusterDigest); !ok || digest.CorrelationId != report.Id.String() {
+		t.Fatalf("expected a digest correlated with %s, got %+v", report.Id, publisher.Published[0])
+	}
+	if ack, ok := publisher.Published[1].(workers.CommandAcknowledged); !ok || ack.CommandId != report.Id.String() || ack.SourceId != "worker-a" || ack.Error != "" {
+		t.Fatalf("expected worker-a to acknowledge %s, got %+v", report.Id, publisher.Published[1])
+	}
+
+	// failed operations are acknowledged with their error
+	publisher.Published = nil
+	rotate := &workers.RotateCredentials{Command: broadcast()}
+	if err := s.operation(s.rotateCredentials)(ctx, bus.Metadata{}, rotate); err != nil {
+		t.Fatalf("rotate credentials failed: %v", err)
+	}
+	if ack := publisher.Published[0].(workers.CommandAcknowledged); ack.Error == "" {
+		t.Fatalf("expected the missing capz deployment to be reported, got %+v", ack)
+	}
+
+	publisher.Published = nil
+	capz := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "capz-system", Name: "capz-controller-manager"}}
+	if err := s.Client.Create(ctx, capz); err != nil {
+		t.Fatalf("failed to create deployment: %v", err)
+	}
+	if err := s.operation(s.rotateCredentials)(ctx, bus.Metadata{}, rotate); err != nil {
+		t.Fatalf("rotate credentials failed: %v", err)
+	}
+	if ack := publisher.Published[0].(workers.CommandAcknowledged); ack.Error != "" {
+		t.Fatalf("expected credentials to be rotated, got %+v", ack)
+	}
+	var restarted appsv1.Deployment
+	if err := s.Client.Get(ctx, client.ObjectKey{Namespace: "capz-system", Name: "capz-controller-manager"}, &restarted); err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if restarted.Spec.Template.Annotations[restartedAtAnnotation] == "" {
+		t.Fatalf("expected capz to be restarted, got annotations %v", restarted.Spec.Template.Annotations)
+	}
+}
+
+func TestCommandAcknowledgementsTrackRecipients(t *testing.T) {
+	ctx := context.Background()
+	sub := newSubscriber(t)
+	s := &StatusSubscriber{Client: sub.Client, Log: sub.Log}
+
+	commandID := uuid.New().String()
+	wc := &v1alpha1.WorkerCommand{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "rotate"},
+		Spec:       v1alpha1.WorkerCommandSpec{Type: v1alpha1.WorkerCommandRotateCredentials},
+		Status: v1alpha1.WorkerCommandStatus{
+			Phase:      v1alpha1.WorkerCommandPending,
+			CommandID:  commandID,
+			Recipients: []string{"worker-a", "worker-b"},
+		},
+	}
+	if err := s.Client.Create(ctx, wc); err != nil {
+		t.Fatalf("failed to create worker command: %v", err)
+	}
+
+	for _, tc := range []struct {
+		worker, err string
+		phase       v1alpha1.WorkerCommandPhase
+	}{
+		{"worker-a", "", v1alpha1.WorkerCommandPending},
+		// acknowledgements from workers that weren't selected are dropped
+		{"worker-c", "", v1alpha1.WorkerCommandPending},
+		{"worker-b", "capz not found", v1alpha1.WorkerCommandFailed},
+		// a later acknowledgement replaces the earlier one
+		{"worker-b", "", v1alpha1.WorkerCommandSucceeded},
+	} {
+		ack := &workers.CommandAcknowledged{
+			Event:     messages.Event{Id: uuid.New(), SourceId: tc.worker},
+			CommandId: commandID,
+			Error:     tc.err,
+		}
+		if err := s.handleCommandAcknowledged(ctx, bus.Metadata{}, ack); err != nil {
+			t.Fatalf("acknowledgement failed: %v", err)
+		}
+
+		var got v1alpha1.WorkerCommand
+		if err := s.Client.Get(ctx, client.ObjectKey{Namespace: "default", Name: "rotate"}, &got); err != nil {
+			t.Fatalf("failed to get worker command: %v", err)
+		}
+		if got.Status.Phase != tc.phase {
+			t.Fatalf("expected phase %s after %s acknowledged, got %s", tc.phase, tc.worker, got.Status.Phase)
+		}
+		if got.Status.GetAcknowledgement("worker-c") != nil {
+			t.Fatalf("expected worker-c's acknowledgement to be dropped")
+		}
+	}
+}
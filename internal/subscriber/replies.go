@@ -0,0 +1,111 @@
+package subscriber
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+// ReplySubscriber records the replies of workers to cluster commands on the
+// ManagedClusters of the control plane. It listens on the reply subscription,
+// messages.ControlPlaneRepliesId.
+type ReplySubscriber struct {
+	Client   client.Client
+	Listener bus.Listener
+	Log      logr.Logger
+	// Dedupe remembers handled messages so redeliveries are not applied twice, if set
+	Dedupe bus.DedupeStore
+}
+
+// Start listens for replies until stop is closed.
+func (s *ReplySubscriber) Start(stop <-chan struct{}) error {
+	s.Log.Info("listening for command replies")
+	if err := listen(stop, s.Listener, s.Dispatcher()); err != nil {
+		return fmt.Errorf("failed to listen for command replies: %w", err)
+	}
+	return nil
+}
+
+// Dispatcher returns a dispatcher that records command replies.
+func (s *ReplySubscriber) Dispatcher() *bus.Dispatcher {
+	d := bus.NewDispatcher()
+	d.Handle(workers.CommandReplyType, s.handleCommandReply)
+	if s.Dedupe != nil {
+		d.Deduplicate(s.Dedupe)
+	}
+	return d
+}
+
+// replyRank orders the outcomes of a command, so a late Accepted doesn't
+// replace the Completed or Rejected that followed it.
+var replyRank = map[v1alpha1.CommandOutcome]int{
+	v1alpha1.CommandAccepted:  1,
+	v1alpha1.CommandCompleted: 2,
+	v1alpha1.CommandRejected:  2,
+}
+
+// handleCommandReply records a reply as the outcome of the last command of
+// the managed cluster. Replies from a worker the cluster isn't assigned to,
+// and replies to commands superseded by a later one, are dropped.
+func (s *ReplySubscriber) handleCommandReply(ctx context.Context, md bus.Metadata, m messages.Message) error {
+	reply := m.(*workers.CommandReply)
+	if reply.Name == "" || reply.Namespace == "" || reply.CommandId == "" {
+		return fmt.Errorf("%w: reply %s has no cluster or command", bus.ErrMalformed, reply.Id)
+	}
+	if _, ok := replyRank[reply.Outcome]; !ok {
+		return fmt.Errorf("%w: reply %s has unknown outcome %q", bus.ErrMalformed, reply.Id, reply.Outcome)
+	}
+
+	log := s.Log.WithValues("event", reply.Id, "command", reply.CommandId, "managedcluster", reply.Namespace+"/"+reply.Name,
+		"outcome", reply.Outcome, "deliveryCount", md.DeliveryCount)
+
+	// errors are returned unwrapped so conflicts are recognised and retried
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var mc v1alpha1.ManagedCluster
+		if err := s.Client.Get(ctx, types.NamespacedName{Namespace: reply.Namespace, Name: reply.Name}, &mc); err != nil {
+			if client.IgnoreNotFound(err) == nil {
+				log.Info("dropping reply about unknown managed cluster")
+				return nil
+			}
+			return err
+		}
+
+		switch {
+		case mc.Status.AssignedWorker == nil || *mc.Status.AssignedWorker != reply.SourceId:
+			log.Info("dropping reply from unassigned worker", "worker", reply.SourceId)
+			return nil
+		case mc.Status.LastCommandID != reply.CommandId:
+			log.Info("dropping reply to superseded command", "last", mc.Status.LastCommandID)
+			return nil
+		case replyRank[reply.Outcome] < replyRank[mc.Status.LastCommandOutcome]:
+			log.Info("dropping out of order reply", "recorded", mc.Status.LastCommandOutcome)
+			return nil
+		}
+
+		mc.Status.LastCommandOutcome = reply.Outcome
+		status, message := corev1.ConditionTrue, ""
+		if reply.Outcome == v1alpha1.CommandRejected {
+			status, message = corev1.ConditionFalse, reply.Reason
+		}
+		mc.Status.SetCondition(v1alpha1.ManagedClusterCommandAcknowledged, status, string(reply.Outcome), message)
+		if err := s.Client.Status().Update(ctx, &mc); err != nil {
+			return err
+		}
+		log.Info("applied command reply")
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record reply to command %s: %w", reply.CommandId, err)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package subscriber
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/bus/bustest"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+func TestSubscriberRepliesToCommands(t *testing.T) {
+	ctx := context.Background()
+	s := newSubscriber(t)
+	publisher := &bustest.RecordingPublisher{}
+	s.Publisher = publisher
+	s.WorkerName = "worker-a"
+
+	withReply := func(c messages.Command) messages.Command {
+		c.ReplyTo = messages.ControlPlaneRepliesId
+		return c
+	}
+	put := workers.PutCluster{Command: withReply(command(2)), Name: "one", Namespace: "default", ClusterUID: "uid-1"}
+	stalePut := workers.PutCluster{Command: withReply(command(1)), Name: "one", Namespace: "default", ClusterUID: "uid-1"}
+	del := workers.DeleteCluster{Command: withReply(command(3)), Name: "one", Namespace: "default", ClusterUID: "uid-1"}
+	if err := s.putCluster(ctx, bus.Metadata{}, put); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	// the hosted cluster reconciler replies Completed to the command in the annotations
+	var mc v1alpha1.ManagedCluster
+	if err := s.Client.Get(ctx, client.ObjectKey{Namespace: "default", Name: "one"}, &mc); err != nil {
+		t.Fatalf("failed to get managed cluster: %v", err)
+	}
+	if mc.Annotations[v1alpha1.ManagedClusterCommandAnnotation] != put.Id.String() ||
+		mc.Annotations[v1alpha1.ManagedClusterReplyToAnnotation] != messages.ControlPlaneRepliesId {
+		t.Fatalf("expected the command to be annotated, got %v", mc.Annotations)
+	}
+
+	if err := s.putCluster(ctx, bus.Metadata{}, stalePut); err != nil {
+		t.Fatalf("stale put failed: %v", err)
+	}
+	if err := s.deleteCluster(ctx, bus.Metadata{}, del); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	// commands without a ReplyTo aren't replied to
+	if err := s.putCluster(ctx, bus.Metadata{}, workers.PutCluster{Command: command(4), Name: "two", Namespace: "default"}); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	expected := []struct {
+		command uuid.UUID
+		outcome v1alpha1.CommandOutcome
+	}{
+		{put.Id, v1alpha1.CommandAccepted},
+		{stalePut.Id, v1alpha1.CommandRejected},
+		{del.Id, v1alpha1.CommandCompleted},
+	}
+	if len(publisher.Published) != len(expected) {
+		t.Fatalf("expected %d replies, got %v", len(expected), publisher.Published)
+	}
+	for i, e := range expected {
+		reply := publisher.Published[i].(workers.CommandReply)
+		if reply.CommandId != e.command.String() || reply.Outcome != e.outcome ||
+			reply.Destination() != messages.ControlPlaneRepliesId || reply.SourceId != "worker-a" {
+			t.Errorf("expected %s to be replied %s, got %+v", e.command, e.outcome, reply)
+		}
+	}
+	if reason := publisher.Published[1].(workers.CommandReply).Reason; reason == "" {
+		t.Errorf("expected the rejection to have a reason")
+	}
+}
+
+func TestReplySubscriberRecordsOutcomeOfLastCommand(t *testing.T) {
+	ctx := context.Background()
+	sub := newSubscriber(t)
+	s := &ReplySubscriber{Client: sub.Client, Log: sub.Log}
+
+	last, superseded := uuid.New().String(), uuid.New().String()
+	mc := assignedCluster("one", "uid-1", "worker-a", 2)
+	mc.Status.LastCommandID = last
+	if err := s.Client.Create(ctx, mc); err != nil {
+		t.Fatalf("failed to create managed cluster: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		worker    string
+		command   string
+		outcome   v1alpha1.CommandOutcome
+		recorded  v1alpha1.CommandOutcome
+		condition corev1.ConditionStatus
+	}{
+		{"superseded command", "worker-a", superseded, v1alpha1.CommandRejected, "", ""},
+		{"unassigned worker", "worker-b", last, v1alpha1.CommandAccepted, "", ""},
+		{"accepted", "worker-a", last, v1alpha1.CommandAccepted, v1alpha1.CommandAccepted, corev1.ConditionTrue},
+		{"completed", "worker-a", last, v1alpha1.CommandCompleted, v1alpha1.CommandCompleted, corev1.ConditionTrue},
+		{"late accepted", "worker-a", last, v1alpha1.CommandAccepted, v1alpha1.CommandCompleted, corev1.ConditionTrue},
+	} {
+		reply := &workers.CommandReply{
+			Event:         messages.Event{Id: uuid.New(), SourceId: tc.worker},
+			DestinationId: messages.ControlPlaneRepliesId,
+			CommandId:     tc.command,
+			Name:          "one",
+			Namespace:     "default",
+			Outcome:       tc.outcome,
+		}
+		if err := s.handleCommandReply(ctx, bus.Metadata{}, reply); err != nil {
+			t.Fatalf("%s: reply failed: %v", tc.name, err)
+		}
+
+		var got v1alpha1.ManagedCluster
+		if err := s.Client.Get(ctx, client.ObjectKey{Namespace: "default", Name: "one"}, &got); err != nil {
+			t.Fatalf("failed to get managed cluster: %v", err)
+		}
+		if got.Status.LastCommandOutcome != tc.recorded {
+			t.Fatalf("%s: expected outcome %q, got %q", tc.name, tc.recorded, got.Status.LastCommandOutcome)
+		}
+		cond := got.Status.GetCondition(v1alpha1.ManagedClusterCommandAcknowledged)
+		if tc.condition == "" && cond != nil || tc.condition != "" && (cond == nil || cond.Status != tc.condition) {
+			t.Fatalf("%s: expected condition %q, got %+v", tc.name, tc.condition, cond)
+		}
+	}
+}
+
+func TestReplySubscriberDropsRepliesAboutUnknownClusters(t *testing.T) {
+	sub := newSubscriber(t)
+	s := &ReplySubscriber{Client: sub.Client, Log: sub.Log}
+	reply := &workers.CommandReply{
+		Event:     messages.Event{Id: uuid.New(), SourceId: "worker-a"},
+		CommandId: uuid.New().String(),
+		Name:      "gone",
+		Namespace: "default",
+		Outcome:   v1alpha1.CommandCompleted,
+	}
+	if err := s.handleCommandReply(context.Background(), bus.Metadata{}, reply); err != nil {
+		t.Fatalf("expected the reply to be dropped, got %v", err)
+	}
+}
+
+func TestSubscriberReplyOutcomes(t *testing.T) {
+	withReply := func(generation int64) messages.Command {
+		c := command(generation)
+		c.ReplyTo = messages.ControlPlaneRepliesId
+		return c
+	}
+	tests := []struct {
+		name    string
+		command messages.Message
+		outcome v1alpha1.CommandOutcome
+	}{
+		{
+			name:    "put",
+			command: workers.PutCluster{Command: withReply(6), Name: "one", Namespace: "default", ClusterUID: "uid-1"},
+			outcome: v1alpha1.CommandAccepted,
+		},
+		{
+			name:    "stale put",
+			command: workers.PutCluster{Command: withReply(4), Name: "one", Namespace: "default", ClusterUID: "uid-1"},
+			outcome: v1alpha1.CommandRejected,
+		},
+		{
+			name:    "delete",
+			command: workers.DeleteCluster{Command: withReply(6), Name: "one", Namespace: "default", ClusterUID: "uid-1"},
+			outcome: v1alpha1.CommandCompleted,
+		},
+		{
+			name:    "stale delete",
+			command: workers.DeleteCluster{Command: withReply(4), Name: "one", Namespace: "default", ClusterUID: "uid-1"},
+			outcome: v1alpha1.CommandRejected,
+		},
+		{
+			name:    "delete of an unknown cluster",
+			command: workers.DeleteCluster{Command: withReply(1), Name: "two", Namespace: "default", ClusterUID: "uid-2"},
+			outcome: v1alpha1.CommandCompleted,
+		},
+		{
+			name:    "no reply to",
+			command: workers.PutCluster{Command: command(6), Name: "one", Namespace: "default", ClusterUID: "uid-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newSubscriber(t)
+			s.WorkerName = "worker-a"
+			// generation 5 was already applied, without a reply
+			applied := workers.PutCluster{Command: command(5), Name: "one", Namespace: "default", ClusterUID: "uid-1"}
+			if err := s.putCluster(ctx, bus.Metadata{}, applied); err != nil {
+				t.Fatalf("put failed: %v", err)
+			}
+			publisher := &bustest.RecordingPublisher{}
+			s.Publisher = publisher
+
+			var err error
+			var id uuid.UUID
+			switch cmd := tt.command.(type) {
+			case workers.PutCluster:
+				id, err = cmd.Id, s.putCluster(ctx, bus.Metadata{}, cmd)
+			case workers.DeleteCluster:
+				id, err = cmd.Id, s.deleteCluster(ctx, bus.Metadata{}, cmd)
+			}
+			if err != nil {
+				t.Fatalf("command failed: %v", err)
+			}
+
+			if tt.outcome == "" {
+				if len(publisher.Published) != 0 {
+					t.Fatalf("expected no reply, got %v", publisher.Published)
+				}
+				return
+			}
+			if len(publisher.Published) != 1 {
+				t.Fatalf("expected a single reply, got %v", publisher.Published)
+			}
+			reply := publisher.Published[0].(workers.CommandReply)
+			if reply.CommandId != id.String() || reply.Outcome != tt.outcome ||
+				reply.Destination() != messages.ControlPlaneRepliesId || reply.SourceId != "worker-a" {
+				t.Errorf("expected %s to be replied %s, got %+v", id, tt.outcome, reply)
+			}
+			if (tt.outcome == v1alpha1.CommandRejected) != (reply.Reason != "") {
+				t.Errorf("expected only rejections to have a reason, got %q", reply.Reason)
+			}
+		})
+	}
+}
+
+func TestReplySubscriberRecordsRejections(t *testing.T) {
+	ctx := context.Background()
+	sub := newSubscriber(t)
+	s := &ReplySubscriber{Client: sub.Client, Log: sub.Log}
+
+	mc := assignedCluster("one", "uid-1", "worker-a", 2)
+	mc.Status.LastCommandID = uuid.New().String()
+	if err := s.Client.Create(ctx, mc); err != nil {
+		t.Fatalf("failed to create managed cluster: %v", err)
+	}
+	reply := &workers.CommandReply{
+		Event:         messages.Event{Id: uuid.New(), SourceId: "worker-a"},
+		DestinationId: messages.ControlPlaneRepliesId,
+		CommandId:     mc.Status.LastCommandID,
+		Name:          "one",
+		Namespace:     "default",
+		Outcome:       v1alpha1.CommandRejected,
+		Reason:        "stale",
+	}
+	if err := s.handleCommandReply(ctx, bus.Metadata{}, reply); err != nil {
+		t.Fatalf("reply failed: %v", err)
+	}
+
+	var got v1alpha1.ManagedCluster
+	if err := s.Client.Get(ctx, client.ObjectKey{Namespace: "default", Name: "one"}, &got); err != nil {
+		t.Fatalf("failed to get managed cluster: %v", err)
+	}
+	cond := got.Status.GetCondition(v1alpha1.ManagedClusterCommandAcknowledged)
+	if got.Status.LastCommandOutcome != v1alpha1.CommandRejected || cond == nil ||
+		cond.Status != corev1.ConditionFalse || cond.Reason != string(v1alpha1.CommandRejected) || cond.Message != "stale" {
+		t.Errorf("expected the rejection to be recorded, got %q %+v", got.Status.LastCommandOutcome, cond)
+	}
+}
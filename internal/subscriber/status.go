@@ -0,0 +1,93 @@
+package subscriber
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+// StatusSubscriber applies the status, cluster digests and acknowledgements
+// reported by workers to the ManagedClusters, Workers and WorkerCommands of the
+// control plane.
+type StatusSubscriber struct {
+	Client   client.Client
+	Listener bus.Listener
+	Log      logr.Logger
+	// Dedupe remembers handled messages so redeliveries are not applied twice, if set
+	Dedupe bus.DedupeStore
+	// Publisher deletes the orphaned clusters found by digests from their
+	// worker. Orphans are only reported when it is nil.
+	Publisher bus.Publisher
+}
+
+// Start listens for status reports until stop is closed.
+func (s *StatusSubscriber) Start(stop <-chan struct{}) error {
+	s.Log.Info("listening for cluster status")
+	if err := listen(stop, s.Listener, s.Dispatcher()); err != nil {
+		return fmt.Errorf("failed to listen for cluster status: %w", err)
+	}
+	return nil
+}
+
+// Dispatcher returns a dispatcher that applies status reports, digests and
+// command acknowledgements.
+func (s *StatusSubscriber) Dispatcher() *bus.Dispatcher {
+	d := bus.NewDispatcher()
+	d.Handle(workers.ClusterStatusChangedType, s.handleClusterStatusChanged)
+	d.Handle(workers.ClusterDigestType, s.handleClusterDigest)
+	d.Handle(workers.CommandAcknowledgedType, s.handleCommandAcknowledged)
+	if s.Dedupe != nil {
+		d.Deduplicate(s.Dedupe)
+	}
+	return d
+}
+
+// handleClusterStatusChanged applies a status report. Reports from a worker
+// the cluster isn't assigned to, or older than the last applied report, are
+// dropped.
+func (s *StatusSubscriber) handleClusterStatusChanged(ctx context.Context, md bus.Metadata, m messages.Message) error {
+	event := m.(*workers.ClusterStatusChanged)
+	if event.Name == "" || event.Namespace == "" {
+		return fmt.Errorf("%w: event %s has no cluster name or namespace", bus.ErrMalformed, event.Id)
+	}
+
+	log := s.Log.WithValues("event", event.Id, "managedcluster", event.Namespace+"/"+event.Name, "sequence", event.Sequence, "deliveryCount", md.DeliveryCount)
+
+	var mc v1alpha1.ManagedCluster
+	if err := s.Client.Get(ctx, types.NamespacedName{Namespace: event.Namespace, Name: event.Name}, &mc); err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			log.Info("dropping status of unknown managed cluster")
+			return nil
+		}
+		return fmt.Errorf("failed to get managed cluster %s/%s: %w", event.Namespace, event.Name, err)
+	}
+
+	if mc.Status.AssignedWorker == nil || *mc.Status.AssignedWorker != event.SourceId {
+		log.Info("dropping status from unassigned worker", "worker", event.SourceId)
+		return nil
+	}
+	if event.Sequence <= mc.Status.Sequence {
+		log.Info("dropping stale status", "applied", mc.Status.Sequence)
+		return nil
+	}
+
+	mc.Status.Phase = event.Status.Phase
+	mc.Status.Conditions = event.Status.Conditions
+	mc.Status.ControlPlaneEndpoint = event.Status.ControlPlaneEndpoint
+	mc.Status.Errors = event.Status.Errors
+	mc.Status.Sequence = event.Sequence
+	if err := s.Client.Status().Update(ctx, &mc); err != nil {
+		return fmt.Errorf("failed to update managed cluster %s/%s status: %w", event.Namespace, event.Name, err)
+	}
+
+	log.Info("applied cluster status", "phase", mc.Status.Phase)
+	return nil
+}
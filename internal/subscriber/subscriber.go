@@ -0,0 +1,269 @@
+package subscriber
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+// Subscriber applies the cluster commands published to a worker to the
+// ManagedClusters of the cluster it runs on.
+type Subscriber struct {
+	Client   client.Client
+	Listener bus.Listener
+	Log      logr.Logger
+	// Dedupe remembers handled messages so redeliveries are not applied twice, if set
+	Dedupe bus.DedupeStore
+	// Publisher replies to cluster commands and acknowledges operational
+	// commands to the control plane, if set
+	Publisher bus.Publisher
+	// WorkerName is the name of the worker, which replies and acknowledgements are sent from
+	WorkerName string
+	// Labels are the labels of the worker, which broadcasts are selected by
+	Labels map[string]string
+	// Digest publishes the digests asked for by ReportInventory, if set
+	Digest *DigestPublisher
+	// NamespacePrefix is prepended to the namespaces clusters are hosted in,
+	// so a worker sharing its cluster with the control plane doesn't overwrite
+	// the control plane's managed clusters.
+	NamespacePrefix string
+}
+
+// Start listens for commands until stop is closed.
+func (s *Subscriber) Start(stop <-chan struct{}) error {
+	s.Log.Info("listening for cluster commands")
+	if err := listen(stop, s.Listener, s.Dispatcher()); err != nil {
+		return fmt.Errorf("failed to listen for cluster commands: %w", err)
+	}
+	return nil
+}
+
+// listen runs the listener until stop is closed. Errors caused by stopping
+// are not reported.
+func listen(stop <-chan struct{}, l bus.Listener, d *bus.Dispatcher) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	if err := l.Listen(ctx, d); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// Dispatcher returns a dispatcher that applies cluster commands and the
+// operational commands broadcast to the worker.
+func (s *Subscriber) Dispatcher() *bus.Dispatcher {
+	d := bus.NewDispatcher()
+	d.Handle(workers.PutClusterType, func(ctx context.Context, md bus.Metadata, m messages.Message) error {
+		cmd := m.(*workers.PutCluster)
+		if err := validateCluster(cmd.Name, cmd.Namespace); err != nil {
+			return err
+		}
+		return s.putCluster(ctx, md, *cmd)
+	})
+	d.Handle(workers.DeleteClusterType, func(ctx context.Context, md bus.Metadata, m messages.Message) error {
+		cmd := m.(*workers.DeleteCluster)
+		if err := validateCluster(cmd.Name, cmd.Namespace); err != nil {
+			return err
+		}
+		return s.deleteCluster(ctx, md, *cmd)
+	})
+	d.Handle(workers.ReportInventoryType, s.operation(s.reportInventory))
+	d.Handle(workers.RotateCredentialsType, s.operation(s.rotateCredentials))
+	d.Labels(s.Labels)
+	if s.Dedupe != nil {
+		d.Deduplicate(s.Dedupe)
+	}
+	return d
+}
+
+func validateCluster(name, namespace string) error {
+	if name == "" || namespace == "" {
+		return fmt.Errorf("%w: command has no cluster name or namespace", bus.ErrMalformed)
+	}
+	return nil
+}
+
+// ensureNamespace creates the namespace of a cluster, which also holds the
+// cluster's command generation.
+func (s *Subscriber) ensureNamespace(ctx context.Context, namespace string) error {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+	if err := s.Client.Create(ctx, ns); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create namespace %s: %w", namespace, err)
+	}
+	return nil
+}
+
+func (s *Subscriber) putCluster(ctx context.Context, md bus.Metadata, cmd workers.PutCluster) error {
+	log := s.Log.WithValues("command", cmd.Id, "managedcluster", cmd.Namespace+"/"+cmd.Name, "generation", cmd.Generation, "deliveryCount", md.DeliveryCount)
+
+	namespace := s.NamespacePrefix + cmd.Namespace
+	if err := s.ensureNamespace(ctx, namespace); err != nil {
+		return err
+	}
+
+	gen := commandGeneration{clusterUID: cmd.ClusterUID, generation: cmd.Generation}
+	isStale, err := stale(ctx, s.Client, namespace, cmd.Name, gen)
+	if err != nil {
+		return err
+	}
+	if isStale {
+		log.Info("rejected stale put cluster")
+		return s.reply(ctx, cmd.Command, cmd.Name, cmd.Namespace, v1alpha1.CommandRejected, staleReason)
+	}
+	hosted, err := s.hosted(ctx, namespace, cmd.Name)
+	if err != nil {
+		return err
+	}
+	if !hosted {
+		log.Info("rejected put of a cluster not hosted by the worker")
+		return s.reply(ctx, cmd.Command, cmd.Name, cmd.Namespace, v1alpha1.CommandRejected, notHostedReason)
+	}
+
+	mc := &v1alpha1.ManagedCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cmd.Name,
+			Namespace: namespace,
+		},
+	}
+	result, err := controllerutil.CreateOrUpdate(ctx, s.Client, mc, func() error {
+		mc.Spec = cmd.Spec
+		if mc.Labels == nil {
+			mc.Labels = map[string]string{}
+		}
+		mc.Labels[v1alpha1.ManagedClusterHostedByLabel] = s.WorkerName
+		if namespace != cmd.Namespace {
+			if mc.Annotations == nil {
+				mc.Annotations = map[string]string{}
+			}
+			mc.Annotations[v1alpha1.ManagedClusterSourceNamespaceAnnotation] = cmd.Namespace
+		}
+		// the hosted cluster reconciler replies Completed once the cluster is running
+		if cmd.ReplyTo != "" {
+			if mc.Annotations == nil {
+				mc.Annotations = map[string]string{}
+			}
+			mc.Annotations[v1alpha1.ManagedClusterCommandAnnotation] = cmd.Id.String()
+			mc.Annotations[v1alpha1.ManagedClusterReplyToAnnotation] = cmd.ReplyTo
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put managed cluster %s/%s: %w", namespace, cmd.Name, err)
+	}
+	if err := recordGeneration(ctx, s.Client, namespace, cmd.Name, gen); err != nil {
+		return err
+	}
+
+	log.Info("applied put cluster", "result", result)
+	return s.reply(ctx, cmd.Command, cmd.Name, cmd.Namespace, v1alpha1.CommandAccepted, "")
+}
+
+// deleteCluster deletes the cluster and records the delete, so that puts
+// published before it are rejected even if they arrive later.
+func (s *Subscriber) deleteCluster(ctx context.Context, md bus.Metadata, cmd workers.DeleteCluster) error {
+	log := s.Log.WithValues("command", cmd.Id, "managedcluster", cmd.Namespace+"/"+cmd.Name, "generation", cmd.Generation, "deliveryCount", md.DeliveryCount)
+
+	namespace := s.NamespacePrefix + cmd.Namespace
+	if err := s.ensureNamespace(ctx, namespace); err != nil {
+		return err
+	}
+
+	gen := commandGeneration{clusterUID: cmd.ClusterUID, generation: cmd.Generation}
+	isStale, err := stale(ctx, s.Client, namespace, cmd.Name, gen)
+	if err != nil {
+		return err
+	}
+	if isStale {
+		log.Info("rejected stale delete cluster")
+		return s.reply(ctx, cmd.Command, cmd.Name, cmd.Namespace, v1alpha1.CommandRejected, staleReason)
+	}
+	hosted, err := s.hosted(ctx, namespace, cmd.Name)
+	if err != nil {
+		return err
+	}
+	if !hosted {
+		log.Info("rejected delete of a cluster not hosted by the worker")
+		return s.reply(ctx, cmd.Command, cmd.Name, cmd.Namespace, v1alpha1.CommandRejected, notHostedReason)
+	}
+
+	mc := &v1alpha1.ManagedCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cmd.Name,
+			Namespace: namespace,
+		},
+	}
+	if err := s.Client.Delete(ctx, mc); client.IgnoreNotFound(err) != nil {
+		return fmt.Errorf("failed to delete managed cluster %s/%s: %w", namespace, cmd.Name, err)
+	}
+	if err := recordGeneration(ctx, s.Client, namespace, cmd.Name, gen); err != nil {
+		return err
+	}
+
+	log.Info("applied delete cluster")
+	// the capz objects are garbage collected with the managed cluster
+	return s.reply(ctx, cmd.Command, cmd.Name, cmd.Namespace, v1alpha1.CommandCompleted, "")
+}
+
+// staleReason is the reason commands older than the last applied one are rejected.
+const staleReason = "a later command about the cluster was already applied"
+
+// notHostedReason is the reason commands about managed clusters the worker
+// didn't create are rejected.
+const notHostedReason = "the managed cluster exists and is not hosted by the worker"
+
+// hosted reports whether the managed cluster was created by the worker, or
+// doesn't exist yet.
+func (s *Subscriber) hosted(ctx context.Context, namespace, name string) (bool, error) {
+	var mc v1alpha1.ManagedCluster
+	if err := s.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, &mc); err != nil {
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to get managed cluster %s/%s: %w", namespace, name, err)
+	}
+	return mc.Labels[v1alpha1.ManagedClusterHostedByLabel] == s.WorkerName, nil
+}
+
+// reply reports the outcome of a command to its ReplyTo. Commands without a
+// ReplyTo aren't replied to. A reply that fails to publish fails the command,
+// which is applied again when it is redelivered.
+func (s *Subscriber) reply(ctx context.Context, cmd messages.Command, name, namespace string, outcome v1alpha1.CommandOutcome, reason string) error {
+	if s.Publisher == nil || cmd.ReplyTo == "" {
+		return nil
+	}
+	reply := workers.CommandReply{
+		Event: messages.Event{
+			Id:            uuid.New(),
+			SourceId:      s.WorkerName,
+			CorrelationId: cmd.Id.String(),
+		},
+		DestinationId: cmd.ReplyTo,
+		CommandId:     cmd.Id.String(),
+		Name:          name,
+		Namespace:     namespace,
+		Outcome:       outcome,
+		Reason:        reason,
+	}
+	if err := s.Publisher.Publish(ctx, reply); err != nil {
+		return fmt.Errorf("failed to reply %s to command %s: %w", outcome, cmd.Id, err)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package subscriber
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/juan-lee/carp/api/v1alpha1"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/bus/bustest"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+)
+
+func newSubscriber(t *testing.T) *Subscriber {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	for _, add := range []func(*runtime.Scheme) error{corev1.AddToScheme, appsv1.AddToScheme, v1alpha1.AddToScheme} {
+		if err := add(scheme); err != nil {
+			t.Fatalf("failed to build scheme: %v", err)
+		}
+	}
+	return &Subscriber{Client: fake.NewFakeClientWithScheme(scheme), Log: zap.New(zap.UseDevMode(true)), WorkerName: "worker-a"}
+}
+
+func command(generation int64) messages.Command {
+	return messages.Command{Id: uuid.New(), DestinationId: "worker-a", Generation: generation}
+}
+
+func TestSubscriberRejectsPutsOlderThanDelete(t *testing.T) {
+	ctx := context.Background()
+	s := newSubscriber(t)
+	key := client.ObjectKey{Namespace: "default", Name: "one"}
+
+	put := workers.PutCluster{Command: command(1), Name: "one", Namespace: "default", ClusterUID: "uid-1"}
+	if err := s.putCluster(ctx, bus.Metadata{}, put); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	del := workers.DeleteCluster{Command: command(3), Name: "one", Namespace: "default", ClusterUID: "uid-1"}
+	if err := s.deleteCluster(ctx, bus.Metadata{}, del); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	// a put published before the delete arrives late
+	late := workers.PutCluster{Command: command(2), Name: "one", Namespace: "default", ClusterUID: "uid-1"}
+	if err := s.putCluster(ctx, bus.Metadata{}, late); err != nil {
+		t.Fatalf("late put failed: %v", err)
+	}
+	var mc v1alpha1.ManagedCluster
+	if err := s.Client.Get(ctx, key, &mc); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the stale put to be rejected, got %v", err)
+	}
+
+	// a cluster recreated with the same name has a new uid and starts over
+	recreated := workers.PutCluster{Command: command(1), Name: "one", Namespace: "default", ClusterUID: "uid-2"}
+	if err := s.putCluster(ctx, bus.Metadata{}, recreated); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if err := s.Client.Get(ctx, key, &mc); err != nil {
+		t.Fatalf("expected the recreated cluster to be applied, got %v", err)
+	}
+}
+
+func TestSubscriberRejectsStaleGenerations(t *testing.T) {
+	// the cluster was last put by generation 5 of uid-1 in eastus
+	applied := workers.PutCluster{Command: command(5), Name: "one", Namespace: "default", ClusterUID: "uid-1"}
+	applied.Spec.Location = "eastus"
+	put := func(uid string, generation int64) workers.PutCluster {
+		cmd := workers.PutCluster{Command: command(generation), Name: "one", Namespace: "default", ClusterUID: uid}
+		cmd.Spec.Location = "westus"
+		return cmd
+	}
+	del := func(uid string, generation int64) workers.DeleteCluster {
+		return workers.DeleteCluster{Command: command(generation), Name: "one", Namespace: "default", ClusterUID: uid}
+	}
+
+	tests := []struct {
+		name    string
+		command messages.Message
+		// location is the location of the cluster afterwards, empty if it was deleted
+		location   string
+		generation string
+	}{
+		{name: "older put", command: put("uid-1", 4), location: "eastus", generation: "uid-1/5"},
+		{name: "same generation put", command: put("uid-1", 5), location: "westus", generation: "uid-1/5"},
+		{name: "newer put", command: put("uid-1", 6), location: "westus", generation: "uid-1/6"},
+		{name: "put without generation", command: put("uid-1", 0), location: "westus", generation: "uid-1/5"},
+		{name: "older put of a recreated cluster", command: put("uid-2", 1), location: "westus", generation: "uid-2/1"},
+		{name: "older delete", command: del("uid-1", 4), location: "eastus", generation: "uid-1/5"},
+		{name: "newer delete", command: del("uid-1", 6), generation: "uid-1/6"},
+		{name: "older delete of a recreated cluster", command: del("uid-2", 1), generation: "uid-2/1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newSubscriber(t)
+			if err := s.putCluster(ctx, bus.Metadata{}, applied); err != nil {
+				t.Fatalf("put failed: %v", err)
+			}
+
+			var err error
+			switch cmd := tt.command.(type) {
+			case workers.PutCluster:
+				err = s.putCluster(ctx, bus.Metadata{}, cmd)
+			case workers.DeleteCluster:
+				err = s.deleteCluster(ctx, bus.Metadata{}, cmd)
+			}
+			if err != nil {
+				t.Fatalf("command failed: %v", err)
+			}
+
+			var mc v1alpha1.ManagedCluster
+			err = s.Client.Get(ctx, client.ObjectKey{Namespace: "default", Name: "one"}, &mc)
+			switch {
+			case tt.location == "" && !apierrors.IsNotFound(err):
+				t.Errorf("expected the cluster to be deleted, got %v", err)
+			case tt.location != "" && err != nil:
+				t.Errorf("expected the cluster to exist, got %v", err)
+			case tt.location != "" && mc.Spec.Location != tt.location:
+				t.Errorf("expected the cluster in %s, got %s", tt.location, mc.Spec.Location)
+			}
+
+			generations, err := commandGenerations(ctx, s.Client, "default")
+			if err != nil {
+				t.Fatalf("failed to get command generations: %v", err)
+			}
+			if got := generations["one"].String(); got != tt.generation {
+				t.Errorf("expected generation %s to be recorded, got %s", tt.generation, got)
+			}
+		})
+	}
+}
+
+func TestSubscriberOnlyChangesClustersItHosts(t *testing.T) {
+	ctx := context.Background()
+	s := newSubscriber(t)
+	publisher := &bustest.RecordingPublisher{}
+	s.Publisher = publisher
+
+	// a managed cluster of a control plane sharing the worker's cluster
+	controlPlane := &v1alpha1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "one"}}
+	controlPlane.Spec.Location = "eastus"
+	if err := s.Client.Create(ctx, controlPlane); err != nil {
+		t.Fatalf("failed to create managed cluster: %v", err)
+	}
+
+	withReply := func(generation int64) messages.Command {
+		c := command(generation)
+		c.ReplyTo = messages.ControlPlaneRepliesId
+		return c
+	}
+	put := workers.PutCluster{Command: withReply(1), Name: "one", Namespace: "default", ClusterUID: "uid-1"}
+	put.Spec.Location = "westus"
+	if err := s.putCluster(ctx, bus.Metadata{}, put); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	del := workers.DeleteCluster{Command: withReply(2), Name: "one", Namespace: "default", ClusterUID: "uid-1"}
+	if err := s.deleteCluster(ctx, bus.Metadata{}, del); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	var mc v1alpha1.ManagedCluster
+	if err := s.Client.Get(ctx, client.ObjectKey{Namespace: "default", Name: "one"}, &mc); err != nil {
+		t.Fatalf("expected the control plane's cluster to be left alone, got %v", err)
+	}
+	if mc.Spec.Location != "eastus" || mc.Labels[v1alpha1.ManagedClusterHostedByLabel] != "" {
+		t.Errorf("expected the control plane's cluster to be unchanged, got %+v", mc.ObjectMeta)
+	}
+	if len(publisher.Published) != 2 {
+		t.Fatalf("expected 2 replies, got %v", publisher.Published)
+	}
+	for _, m := range publisher.Published {
+		if reply := m.(workers.CommandReply); reply.Outcome != v1alpha1.CommandRejected {
+			t.Errorf("expected the commands to be rejected, got %+v", reply)
+		}
+	}
+}
+
+func TestSubscriberHostsClustersInPrefixedNamespaces(t *testing.T) {
+	ctx := context.Background()
+	s := newSubscriber(t)
+	s.NamespacePrefix = "hosted-"
+	publisher := &bustest.RecordingPublisher{}
+	s.Publisher = publisher
+
+	controlPlane := &v1alpha1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "one"}}
+	if err := s.Client.Create(ctx, controlPlane); err != nil {
+		t.Fatalf("failed to create managed cluster: %v", err)
+	}
+
+	put := workers.PutCluster{Command: command(1), Name: "one", Namespace: "default", ClusterUID: "uid-1"}
+	put.ReplyTo = messages.ControlPlaneRepliesId
+	if err := s.putCluster(ctx, bus.Metadata{}, put); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	var hosted v1alpha1.ManagedCluster
+	if err := s.Client.Get(ctx, client.ObjectKey{Namespace: "hosted-default", Name: "one"}, &hosted); err != nil {
+		t.Fatalf("expected the cluster to be hosted in hosted-default, got %v", err)
+	}
+	if hosted.Labels[v1alpha1.ManagedClusterHostedByLabel] != "worker-a" || hosted.SourceNamespace() != "default" {
+		t.Errorf("expected the hosted cluster to be labelled and annotated, got %+v", hosted.ObjectMeta)
+	}
+	if reply := publisher.Published[0].(workers.CommandReply); reply.Namespace != "default" ||
+		reply.Outcome != v1alpha1.CommandAccepted {
+		t.Errorf("expected the reply to be about default/one, got %+v", reply)
+	}
+
+	digest, err := (&DigestPublisher{Client: s.Client, WorkerName: "worker-a"}).Digest(ctx)
+	if err != nil {
+		t.Fatalf("digest failed: %v", err)
+	}
+	if len(digest.Clusters) != 1 || digest.Clusters[0].Namespace != "default" {
+		t.Errorf("expected the digest to report default/one, got %+v", digest.Clusters)
+	}
+
+	del := workers.DeleteCluster{Command: command(2), Name: "one", Namespace: "default", ClusterUID: "uid-1"}
+	if err := s.deleteCluster(ctx, bus.Metadata{}, del); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err := s.Client.Get(ctx, client.ObjectKey{Namespace: "hosted-default", Name: "one"}, &hosted); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the hosted cluster to be deleted, got %v", err)
+	}
+	if err := s.Client.Get(ctx, client.ObjectKey{Namespace: "default", Name: "one"}, controlPlane); err != nil {
+		t.Errorf("expected the control plane's cluster to be left alone, got %v", err)
+	}
+}
@@ -17,46 +17,171 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/nats-io/nats.go"
 	realzap "go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
 	kubeadmv1beta1 "k8s.io/kubernetes/cmd/kubeadm/app/apis/kubeadm/v1beta1"
 	capzv1alpha3 "sigs.k8s.io/cluster-api-provider-azure/api/v1alpha3"
 	capiv1alpha3 "sigs.k8s.io/cluster-api/api/v1alpha3"
 	capbkv1alpha3 "sigs.k8s.io/cluster-api/bootstrap/kubeadm/api/v1alpha3"
 	kcpv1alpha3 "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1alpha3"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	carpv1alpha1 "github.com/juan-lee/carp/api/v1alpha1"
 	"github.com/juan-lee/carp/controllers"
 	"github.com/juan-lee/carp/internal/azure"
+	"github.com/juan-lee/carp/internal/bus"
+	"github.com/juan-lee/carp/internal/messages"
+	"github.com/juan-lee/carp/internal/messages/workers"
+	"github.com/juan-lee/carp/internal/subscriber"
 	// +kubebuilder:scaffold:imports
 )
 
+const (
+	// modeControlPlane schedules managed clusters and provisions workers
+	modeControlPlane = "controlplane"
+
+	// modeWorker provisions the managed clusters assigned to the worker it runs on
+	modeWorker = "worker"
+
+	// modeStandalone runs the control plane and a worker in the same process,
+	// hosting the managed clusters on the control plane cluster itself
+	modeStandalone = "standalone"
+)
+
+// standaloneNamespacePrefix is prepended to the namespaces a standalone
+// manager's worker hosts clusters in, keeping them apart from the managed
+// clusters of its control plane.
+const standaloneNamespacePrefix = "hosted-"
+
+// Stores that can be selected with --bus-dedupe.
+const (
+	dedupeMemory    = "memory"
+	dedupeConfigMap = "configmap"
+)
+
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
 )
 
-func init() { // nolint: gochecknoinits
-	_ = setupScheme(scheme)
-	// +kubebuilder:scaffold:scheme
+// options are the mode specific settings of the manager.
+type options struct {
+	agentImage          string
+	busSecret           string
+	workerName          string
+	workerLabels        string
+	hostedNamespaces    string
+	busTransport        string
+	busRegion           string
+	busEnvironment      string
+	busConnectionString string
+	busKubeconfig       string
+	busNamespace        string
+	busNATSURL          string
+	busDedupe           string
+	busProvisioning     string
+	busRetryPolicy      bus.RetryPolicy
+	busKeys             string
+	busAgentKeys        string
+	busKeysInterval     time.Duration
+	busConcurrency      int
+	busPrefetch         uint
+	busDrainTimeout     time.Duration
+	busRestartBackoff   time.Duration
+	busRestartMax       time.Duration
+	digestInterval      time.Duration
+	replyTimeout        time.Duration
 }
 
 func main() {
 	var metricsAddr string
+	var healthAddr string
 	var enableLeaderElection bool
+	var mode string
+	var opts options
+	var maxDeliveries uint
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
+	flag.StringVar(&healthAddr, "health-addr", ":9440", "The address the health and readiness probes bind to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&mode, "mode", modeControlPlane, "The operating mode of the manager, one of controlplane, worker or standalone.")
+	flag.StringVar(&opts.agentImage, "agent-image", "juanlee/carp-controller:latest", "The carp image deployed to workers as the agent.")
+	flag.StringVar(&opts.busSecret, "bus-secret", "",
+		"The namespace/name of the secret holding the bus credentials given to agents. "+
+			"The secret's connection-string key is the service bus connection string.")
+	flag.StringVar(&opts.workerName, "worker-name", "", "The name of the worker the manager runs on. Required in worker and standalone mode.")
+	flag.StringVar(&opts.workerLabels, "worker-labels", "",
+		"The labels of the worker the manager runs on as k=v pairs separated by commas, which broadcast commands are selected by.")
+	flag.StringVar(&opts.busTransport, "bus", bus.TransportServiceBus,
+		"The bus transport, one of servicebus, kubernetes, nats or memory. The memory bus only connects the "+
+			"control plane and worker of a standalone manager.")
+	flag.StringVar(&opts.busKubeconfig, "bus-kubeconfig", "",
+		"The kubeconfig of the control plane cluster storing the messages of the kubernetes bus. "+
+			"Defaults to the cluster the manager runs in.")
+	flag.StringVar(&opts.busNamespace, "bus-namespace", "carp-system",
+		"The namespace storing the messages of the kubernetes bus and the configmap dedupe store.")
+	flag.StringVar(&opts.busDedupe, "bus-dedupe", dedupeMemory,
+		"Where listeners remember handled message ids, one of memory or configmap. The configmap store "+
+			"survives restarts.")
+	flag.StringVar(&opts.busProvisioning, "bus-provisioning", bus.ProvisionManaged,
+		"How the service bus topic and subscriptions are provisioned, one of managed or preprovisioned. "+
+			"Pre-provisioned subscriptions are verified but never created or changed, for namespaces carp can't manage.")
+	flag.StringVar(&opts.busNATSURL, "bus-nats-url", nats.DefaultURL, "The url of the NATS server of the nats bus.")
+	flag.UintVar(&maxDeliveries, "bus-max-deliveries", 10, "The number of deliveries after which a failing message is dead-lettered.")
+	flag.DurationVar(&opts.busRetryPolicy.Backoff, "bus-retry-backoff", 5*time.Second,
+		"The delay before retrying a failed message, doubled on every further retry. Zero retries immediately. "+
+			"The message is held meanwhile, blocking its session or consumer for up to --bus-retry-max-hold.")
+	flag.DurationVar(&opts.busRetryPolicy.MaxBackoff, "bus-retry-max-backoff", 5*time.Minute, "The longest delay before retrying a failed message.")
+	flag.DurationVar(&opts.busRetryPolicy.MaxHold, "bus-retry-max-hold", 30*time.Second,
+		"The longest a service bus or nats listener holds a failed message, and the session or consumer it blocks, before releasing it for redelivery.")
+	flag.DurationVar(&opts.digestInterval, "digest-interval", 5*time.Minute,
+		"How often a worker publishes a digest of its managed clusters for the control plane to resync them.")
+	flag.DurationVar(&opts.replyTimeout, "command-reply-timeout", 5*time.Minute,
+		"How long the control plane waits for a worker to reply to a cluster command before marking it unacknowledged. "+
+			"Zero waits forever.")
+	flag.StringVar(&opts.busKeys, "bus-keys", "",
+		"The namespace/name of the secret holding the keys messages are signed, verified, encrypted and "+
+			"decrypted with. Messages are neither signed nor verified when it is empty.")
+	flag.StringVar(&opts.busAgentKeys, "bus-agent-keys", "",
+		"The namespace/name of the secret holding the bus keys given to agents, if any.")
+	flag.DurationVar(&opts.busKeysInterval, "bus-keys-interval", time.Minute,
+		"How often the bus keys are reloaded to pick up rotated keys.")
+	flag.IntVar(&opts.busConcurrency, "bus-max-concurrent-handlers", 4,
+		"How many sessions each service bus listener handles at once, so a session held for a retry doesn't stall the others.")
+	flag.UintVar(&opts.busPrefetch, "bus-prefetch", 0,
+		"How many messages service bus receivers fetch ahead of the handlers. Zero keeps the service bus default.")
+	flag.DurationVar(&opts.busDrainTimeout, "bus-drain-timeout", 30*time.Second,
+		"How long the handlers in flight at shutdown are waited for before they are cancelled.")
+	flag.DurationVar(&opts.busRestartBackoff, "bus-restart-backoff", time.Second,
+		"The delay before restarting a failed bus listener, doubled after each consecutive failure.")
+	flag.DurationVar(&opts.busRestartMax, "bus-restart-max-backoff", 2*time.Minute, "The longest delay before restarting a failed bus listener.")
+	flag.StringVar(&opts.busRegion, "bus-region", "eastus", "The region of the bus topic.")
+	flag.StringVar(&opts.busEnvironment, "bus-environment", "prod", "The environment of the bus topic (intv2, staging, prod).")
 	flag.Parse()
+	opts.busRetryPolicy.MaxDeliveries = uint32(maxDeliveries)
+
+	opts.busConnectionString = os.Getenv("SERVICE_BUS_CONNECTION_STRING")
 
 	ctrl.SetLogger(
 		zap.New(
@@ -66,12 +191,100 @@ func main() {
 			},
 		),
 	)
-	settings, err := azure.GetSettings()
+
+	if mode != modeControlPlane && mode != modeWorker && mode != modeStandalone {
+		setupLog.Error(fmt.Errorf("unknown mode %q", mode), "invalid mode")
+		os.Exit(1)
+	}
+	if opts.busTransport == bus.TransportMemory && mode != modeStandalone {
+		setupLog.Error(fmt.Errorf("--bus=%s requires --mode=%s", bus.TransportMemory, modeStandalone), "invalid bus")
+		os.Exit(1)
+	}
+	if mode == modeStandalone {
+		opts.hostedNamespaces = standaloneNamespacePrefix
+	}
+
+	if err := setupScheme(scheme, mode); err != nil {
+		setupLog.Error(err, "unable to set up scheme")
+		os.Exit(1)
+	}
+
+	restConfig := ctrl.GetConfigOrDie()
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
+		Scheme:                 scheme,
+		MetricsBindAddress:     metricsAddr,
+		HealthProbeBindAddress: healthAddr,
+		Port:                   9443,
+		LeaderElection:         enableLeaderElection,
+		LeaderElectionID:       "4e0d400a.cluster.x-k8s.io",
+	})
+	if err != nil {
+		setupLog.Error(err, "unable to start manager")
+		os.Exit(1)
+	}
+
+	keyring, err := newKeyring(mgr, opts)
+	if err != nil {
+		setupLog.Error(err, "unable to load bus keys")
+		os.Exit(1)
+	}
+
+	supervisor := &bus.Supervisor{
+		Log:        ctrl.Log.WithName("supervisor"),
+		Backoff:    opts.busRestartBackoff,
+		MaxBackoff: opts.busRestartMax,
+	}
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		setupLog.Error(err, "unable to add health check")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("bus", func(*http.Request) error { return supervisor.Ready() }); err != nil {
+		setupLog.Error(err, "unable to add readiness check")
+		os.Exit(1)
+	}
+
+	factory, err := newBusFactory(restConfig, opts, keyring, supervisor)
+	if err != nil {
+		setupLog.Error(err, "unable to set up bus")
+		os.Exit(1)
+	}
+
+	switch mode {
+	case modeControlPlane:
+		err = setupControlPlane(mgr, factory, opts)
+	case modeWorker:
+		err = setupWorker(mgr, factory, opts)
+	case modeStandalone:
+		if err = setupControlPlane(mgr, factory, opts); err == nil {
+			err = setupWorker(mgr, factory, opts)
+		}
+	}
 	if err != nil {
-		setupLog.Error(err, "failed to get azure settings")
+		setupLog.Error(err, "unable to set up manager", "mode", mode)
+		os.Exit(1)
+	}
+
+	setupLog.Info("starting manager", "mode", mode)
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 
+	// the manager doesn't wait for its runnables, so the listeners are given
+	// the time to finish the messages they are handling
+	if !supervisor.Wait(opts.busDrainTimeout + 5*time.Second) {
+		setupLog.Info("bus listeners did not stop in time")
+	}
+}
+
+// setupControlPlane registers the controllers that schedule managed clusters
+// and provision workers. Only the control plane needs azure credentials.
+func setupControlPlane(mgr ctrl.Manager, factory *bus.Factory, opts options) error {
+	settings, err := azure.GetSettings()
+	if err != nil {
+		return fmt.Errorf("failed to get azure settings: %w", err)
+	}
+
 	if settings[auth.ClientID] == "" ||
 		settings[auth.ClientSecret] == "" ||
 		settings[auth.TenantID] == "" ||
@@ -82,58 +295,292 @@ func main() {
 			"tenant", settings[auth.ClientID],
 			"subscription", settings[auth.ClientID],
 			"length of secret", secretLen,
-		).Error(err, "azure credentials not fully populated")
-		os.Exit(1)
+		).Info("azure credentials not fully populated")
+		return fmt.Errorf("azure credentials not fully populated")
 	}
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:             scheme,
-		MetricsBindAddress: metricsAddr,
-		Port:               9443,
-		LeaderElection:     enableLeaderElection,
-		LeaderElectionID:   "4e0d400a.cluster.x-k8s.io",
-	})
+	busSecretNamespace, busSecretName, err := cache.SplitMetaNamespaceKey(opts.busSecret)
 	if err != nil {
-		setupLog.Error(err, "unable to start manager")
-		os.Exit(1)
+		return fmt.Errorf("invalid bus secret: %w", err)
+	}
+	busKeysNamespace, busKeysName, err := cache.SplitMetaNamespaceKey(opts.busAgentKeys)
+	if err != nil {
+		return fmt.Errorf("invalid --bus-agent-keys: %w", err)
+	}
+
+	var publisher bus.Publisher
+	if factory != nil {
+		publisher, err = factory.NewPublisher(context.Background())
+		if err != nil {
+			return fmt.Errorf("unable to create bus publisher: %w", err)
+		}
+
+		listener, err := factory.NewListener(messages.ControlPlaneId, []string{
+			workers.ClusterStatusChangedType,
+			workers.ClusterDigestType,
+			workers.CommandAcknowledgedType,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create bus listener: %w", err)
+		}
+		dedupe, err := newDedupeStore(mgr, opts, messages.ControlPlaneId)
+		if err != nil {
+			return err
+		}
+		if err := mgr.Add(&subscriber.StatusSubscriber{
+			Client:    mgr.GetClient(),
+			Listener:  listener,
+			Log:       ctrl.Log.WithName("statussubscriber"),
+			Dedupe:    dedupe,
+			Publisher: publisher,
+		}); err != nil {
+			return fmt.Errorf("unable to add status subscriber: %w", err)
+		}
+
+		replyListener, err := factory.NewListener(messages.ControlPlaneRepliesId, []string{workers.CommandReplyType})
+		if err != nil {
+			return fmt.Errorf("unable to create bus reply listener: %w", err)
+		}
+		replyDedupe, err := newDedupeStore(mgr, opts, messages.ControlPlaneRepliesId)
+		if err != nil {
+			return err
+		}
+		if err := mgr.Add(&subscriber.ReplySubscriber{
+			Client:   mgr.GetClient(),
+			Listener: replyListener,
+			Log:      ctrl.Log.WithName("replysubscriber"),
+			Dedupe:   replyDedupe,
+		}); err != nil {
+			return fmt.Errorf("unable to add reply subscriber: %w", err)
+		}
+	} else {
+		setupLog.Info("SERVICE_BUS_CONNECTION_STRING not set, managed clusters will not be published to workers")
 	}
 
-	if err = (&controllers.ManagedClusterReconciler{
+	if err := (&controllers.ManagedClusterReconciler{
+		Client:       mgr.GetClient(),
+		Log:          ctrl.Log.WithName("controllers").WithName("ManagedCluster"),
+		Scheme:       mgr.GetScheme(),
+		Publisher:    publisher,
+		ReplyTimeout: opts.replyTimeout,
+	}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create ManagedCluster controller: %w", err)
+	}
+	if err := (&controllers.WorkerReconciler{
+		Client:          mgr.GetClient(),
+		Log:             ctrl.Log.WithName("controllers").WithName("Worker"),
+		Scheme:          mgr.GetScheme(),
+		AzureSettings:   settings,
+		AgentImage:      opts.agentImage,
+		BusSecret:       types.NamespacedName{Namespace: busSecretNamespace, Name: busSecretName},
+		BusTransport:    opts.busTransport,
+		BusRegion:       opts.busRegion,
+		BusEnvironment:  opts.busEnvironment,
+		BusNATSURL:      opts.busNATSURL,
+		BusProvisioning: opts.busProvisioning,
+		BusKeysSecret:   types.NamespacedName{Namespace: busKeysNamespace, Name: busKeysName},
+	}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create Worker controller: %w", err)
+	}
+	if err := (&controllers.WorkerAddonReconciler{
 		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("ManagedCluster"),
+		Log:    ctrl.Log.WithName("controllers").WithName("WorkerAddon"),
 		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "ManagedCluster")
-		os.Exit(1)
+		return fmt.Errorf("unable to create WorkerAddon controller: %w", err)
 	}
-	if err = (&controllers.WorkerReconciler{
-		Client:        mgr.GetClient(),
-		Log:           ctrl.Log.WithName("controllers").WithName("Worker"),
-		Scheme:        mgr.GetScheme(),
-		AzureSettings: settings,
+	if err := (&controllers.WorkerCommandReconciler{
+		Client:    mgr.GetClient(),
+		Log:       ctrl.Log.WithName("controllers").WithName("WorkerCommand"),
+		Scheme:    mgr.GetScheme(),
+		Publisher: publisher,
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Worker")
-		os.Exit(1)
+		return fmt.Errorf("unable to create WorkerCommand controller: %w", err)
 	}
 	// +kubebuilder:scaffold:builder
 
-	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
-		setupLog.Error(err, "problem running manager")
-		os.Exit(1)
+	return nil
+}
+
+// setupWorker registers the controllers that run on a worker cluster. The
+// hosted clusters use the capz credentials the control plane copies to the
+// worker rather than credentials of their own.
+func setupWorker(mgr ctrl.Manager, factory *bus.Factory, opts options) error {
+	if opts.workerName == "" {
+		return fmt.Errorf("--worker-name is required in worker and standalone mode")
+	}
+	workerLabels, err := labels.ConvertSelectorToLabelsMap(opts.workerLabels)
+	if err != nil {
+		return fmt.Errorf("invalid --worker-labels: %w", err)
+	}
+
+	var publisher bus.Publisher
+	if factory != nil {
+		publisher, err = factory.NewPublisher(context.Background())
+		if err != nil {
+			return fmt.Errorf("unable to create bus publisher: %w", err)
+		}
+
+		listener, err := factory.NewListener(opts.workerName, []string{
+			workers.PutClusterType,
+			workers.DeleteClusterType,
+			workers.ReportInventoryType,
+			workers.RotateCredentialsType,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create bus listener: %w", err)
+		}
+		dedupe, err := newDedupeStore(mgr, opts, opts.workerName)
+		if err != nil {
+			return err
+		}
+		digest := &subscriber.DigestPublisher{
+			Client:     mgr.GetClient(),
+			Publisher:  publisher,
+			Log:        ctrl.Log.WithName("digest"),
+			WorkerName: opts.workerName,
+			Interval:   opts.digestInterval,
+		}
+		if err := mgr.Add(&subscriber.Subscriber{
+			Client:          mgr.GetClient(),
+			Listener:        listener,
+			Log:             ctrl.Log.WithName("subscriber"),
+			Dedupe:          dedupe,
+			Publisher:       publisher,
+			WorkerName:      opts.workerName,
+			Labels:          workerLabels,
+			Digest:          digest,
+			NamespacePrefix: opts.hostedNamespaces,
+		}); err != nil {
+			return fmt.Errorf("unable to add subscriber: %w", err)
+		}
+		if err := mgr.Add(digest); err != nil {
+			return fmt.Errorf("unable to add digest publisher: %w", err)
+		}
+	} else {
+		setupLog.Info("SERVICE_BUS_CONNECTION_STRING not set, managed clusters will not be received from the control plane")
+	}
+
+	if err := (&controllers.HostedClusterReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("HostedCluster"),
+		Scheme: mgr.GetScheme(),
+		CredentialsSecret: types.NamespacedName{
+			Namespace: "capz-system",
+			Name:      "capz-manager-bootstrap-credentials",
+		},
+		WorkerName: opts.workerName,
+		Publisher:  publisher,
+	}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create HostedCluster controller: %w", err)
+	}
+
+	return nil
+}
+
+// newBusFactory returns the factory of the selected bus transport, or nil when
+// the service bus is selected but no connection string is set.
+func newBusFactory(restConfig *rest.Config, opts options, keyring *bus.Keyring, supervisor *bus.Supervisor) (*bus.Factory, error) {
+	if opts.busTransport == bus.TransportServiceBus && opts.busConnectionString == "" {
+		return nil, nil
+	}
+
+	cfg := bus.Config{
+		Transport:                  opts.busTransport,
+		Region:                     opts.busRegion,
+		Environment:                opts.busEnvironment,
+		ServiceBusConnectionString: opts.busConnectionString,
+		KubernetesNamespace:        opts.busNamespace,
+		NATSURL:                    opts.busNATSURL,
+		RetryPolicy:                &opts.busRetryPolicy,
+		Provisioning:               opts.busProvisioning,
+		Keyring:                    keyring,
+		Supervisor:                 supervisor,
+		MaxConcurrentHandlers:      opts.busConcurrency,
+		PrefetchCount:              uint32(opts.busPrefetch),
+		DrainTimeout:               opts.busDrainTimeout,
+	}
+	if opts.busTransport == bus.TransportKubernetes {
+		if opts.busKubeconfig != "" {
+			var err error
+			restConfig, err = clientcmd.BuildConfigFromFlags("", opts.busKubeconfig)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load bus kubeconfig: %w", err)
+			}
+		}
+		c, err := client.New(restConfig, client.Options{Scheme: scheme})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create bus client: %w", err)
+		}
+		cfg.KubernetesClient = c
 	}
+	return bus.NewFactory(cfg)
 }
 
-func setupScheme(scheme *runtime.Scheme) error {
+// newKeyring loads the bus keys and keeps reloading them, or returns nil when
+// no keys are configured. Secrets are read directly so the manager doesn't
+// cache every Secret of the cluster.
+func newKeyring(mgr ctrl.Manager, opts options) (*bus.Keyring, error) {
+	if opts.busKeys == "" {
+		return nil, nil
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(opts.busKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --bus-keys: %w", err)
+	}
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+
+	var secret corev1.Secret
+	if err := mgr.GetAPIReader().Get(context.Background(), key, &secret); err != nil {
+		return nil, fmt.Errorf("failed to get bus keys %s: %w", key, err)
+	}
+	keyring, err := bus.NewKeyringFromSecret(&secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := mgr.Add(&bus.KeyringRefresher{
+		Client:   mgr.GetAPIReader(),
+		Log:      ctrl.Log.WithName("keyring"),
+		Keyring:  keyring,
+		Secret:   key,
+		Interval: opts.busKeysInterval,
+	}); err != nil {
+		return nil, fmt.Errorf("unable to add keyring refresher: %w", err)
+	}
+	return keyring, nil
+}
+
+// newDedupeStore returns the store remembering the messages handled by the
+// listener of an underlay. The configmap store uses a direct client so the
+// manager doesn't cache every ConfigMap of the cluster.
+func newDedupeStore(mgr ctrl.Manager, opts options, underlayID string) (bus.DedupeStore, error) {
+	switch opts.busDedupe {
+	case dedupeMemory:
+		return bus.NewMemoryDedupeStore(0), nil
+	case dedupeConfigMap:
+		c, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme()})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create dedupe client: %w", err)
+		}
+		key := types.NamespacedName{Namespace: opts.busNamespace, Name: "carp-dedupe-" + underlayID}
+		return bus.NewConfigMapDedupeStore(c, key, 0), nil
+	}
+	return nil, fmt.Errorf("unknown dedupe store %q", opts.busDedupe)
+}
+
+func setupScheme(scheme *runtime.Scheme, mode string) error {
 	schemeFn := []func(*runtime.Scheme) error{
 		clientgoscheme.AddToScheme,
 		capzv1alpha3.AddToScheme,
 		capiv1alpha3.AddToScheme,
 		capbkv1alpha3.AddToScheme,
-		kubeadmv1beta1.AddToScheme,
 		kcpv1alpha3.AddToScheme,
 		carpv1alpha1.AddToScheme,
 	}
+	// +kubebuilder:scaffold:scheme
+	if mode != modeWorker {
+		schemeFn = append(schemeFn, kubeadmv1beta1.AddToScheme)
+	}
 	for _, fn := range schemeFn {
 		fn := fn
 		if err := fn(scheme); err != nil {